@@ -0,0 +1,120 @@
+package leaky
+
+import (
+	"context"
+	"time"
+)
+
+// Access is whether a client is on a bucket's allowlist or denylist
+type Access string
+
+const (
+	// Unlisted clients are limited by the bucket as usual
+	Unlisted Access = ""
+	// Allowlisted clients are always admitted, without taking drops from their bucket
+	Allowlisted Access = "allow"
+	// Denylisted clients are always rejected
+	Denylisted Access = "deny"
+)
+
+// WithAccessLists has the bucket apply the allowlist and denylist kept in the store by AllowKey and DenyKey,
+// remembering what it read for each client for cacheTTL so most requests don't make another round trip.
+// Clients are unlisted while the store is down.
+func WithAccessLists(cacheTTL time.Duration) Option {
+	return func(b *Bucket) {
+		b.access = newExpiringMap[Access](knownMaxEntries)
+		b.accessTTL = cacheTTL
+	}
+}
+
+// AllowKey puts the client on the bucket's allowlist until ttl has passed or they are unlisted, so every
+// instance using WithAccessLists admits their requests without counting them
+func (b *Bucket) AllowKey(ctx context.Context, keyID string, ttl time.Duration) error {
+	return b.writeAccess(ctx, keyID, Allowlisted, ttl)
+}
+
+// DenyKey puts the client on the bucket's denylist until ttl has passed or they are unlisted, so every
+// instance using WithAccessLists rejects their requests
+func (b *Bucket) DenyKey(ctx context.Context, keyID string, ttl time.Duration) error {
+	return b.writeAccess(ctx, keyID, Denylisted, ttl)
+}
+
+// UnlistKey takes the client off the bucket's allowlist or denylist
+func (b *Bucket) UnlistKey(ctx context.Context, keyID string) error {
+	// Stores can't delete, so an unlisted record replaces the listing until it expires
+	return b.writeAccess(ctx, keyID, Unlisted, stateTTL)
+}
+
+// KeyAccess returns whether the client is on the bucket's allowlist or denylist, as stored
+func (b *Bucket) KeyAccess(ctx context.Context, keyID string) (Access, error) {
+	return b.readAccess(ctx, keyID)
+}
+
+func (b *Bucket) writeAccess(ctx context.Context, keyID string, access Access, ttl time.Duration) error {
+	if err := b.writeRecord(ctx, "access", keyID, State{Access: access}, ttl); err != nil {
+		return err
+	}
+
+	b.cacheAccess(keyID, access)
+	return nil
+}
+
+func (b *Bucket) readAccess(ctx context.Context, keyID string) (Access, error) {
+	record, err := b.readRecord(ctx, "access", keyID)
+	if err != nil {
+		return Unlisted, err
+	}
+
+	b.cacheAccess(keyID, record.Access)
+	return record.Access, nil
+}
+
+// cacheAccess remembers whether the client is listed, if the bucket applies its lists
+func (b *Bucket) cacheAccess(keyID string, access Access) {
+	if b.access == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.clock.Now()
+	b.access.set(keyID, access, now.Add(b.accessTTL), now)
+}
+
+// listed returns whether the client is on the bucket's allowlist or denylist, if it applies them,
+// from its cache if read recently
+func (b *Bucket) listed(ctx context.Context, keyID string) Access {
+	if b.access == nil {
+		return Unlisted
+	}
+
+	b.mu.Lock()
+	access, ok := b.access.get(keyID, b.clock.Now())
+	b.mu.Unlock()
+
+	if ok {
+		return access
+	}
+
+	access, err := b.readAccess(ctx, keyID)
+	if err != nil {
+		b.storeFailed(ctx, b.logger.Warn, "Retrieving access lists failed, limiting as unlisted", keyID, err)
+		return Unlisted
+	}
+
+	return access
+}
+
+// listedDecision is the decision for a client on the bucket's allowlist or denylist, or from an exempt network,
+// which takes no drops
+func (b *Bucket) listedDecision(lim limits, keyID string, access Access) (Decision, bool) {
+	d := Decision{Bucket: b.bucketName, KeyID: keyID, Limit: lim.size}
+	if access == Allowlisted {
+		d.Remaining = lim.size
+		return d, true
+	}
+
+	d.RetryAfter, d.ResetAfter = InfDuration, InfDuration
+	return d, false
+}
@@ -0,0 +1,73 @@
+package leaky
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAccessLists(t *testing.T) {
+	tj := prepareTestJig()
+	defer tj.Close()
+
+	ctx := context.Background()
+	bucket := tj.ThrottleManager.ThrottlingHandler(handleFuncSuccessResponse, 1, 0, keyFunc, "test", WithAccessLists(0))
+
+	if err := bucket.AllowKey(ctx, "health-checker", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := bucket.DenyKey(ctx, "abuser", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	if access, err := bucket.KeyAccess(ctx, "abuser"); err != nil || access != Denylisted {
+		t.Errorf("Read access %q, %v", access, err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, ok := bucket.AdmitKey(ctx, http.Header{}, "health-checker"); !ok {
+			t.Errorf("Allowlisted request %d rejected", i)
+		}
+	}
+	if remaining, _ := bucket.Remaining(ctx, "health-checker"); remaining != 1 {
+		t.Errorf("Allowlisted requests counted, %d remaining", remaining)
+	}
+
+	if d, ok := bucket.AdmitKey(ctx, http.Header{}, "abuser"); ok || d.RetryAfter != InfDuration {
+		t.Errorf("Denylisted request admitted: %+v", d)
+	}
+	if _, ok := bucket.AdmitKey(ctx, http.Header{}, "other"); !ok {
+		t.Error("Unlisted request rejected")
+	}
+
+	if err := bucket.UnlistKey(ctx, "abuser"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := bucket.AdmitKey(ctx, http.Header{}, "abuser"); !ok {
+		t.Error("Request rejected once unlisted")
+	}
+}
+
+func TestDenylistMiddleware(t *testing.T) {
+	tj := prepareTestJig()
+	defer tj.Close()
+
+	bucket := tj.ThrottleManager.ThrottlingHandler(handleFuncSuccessResponse, 10, 0, keyFunc, "test",
+		WithAccessLists(time.Minute))
+
+	req, _ := http.NewRequest("GET", "", nil)
+	if err := bucket.DenyKey(context.Background(), keyFunc(*req), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	bucket.ServeHTTP(w, req)
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("Status not TooManyRequests for a denylisted client: %v", w.Code)
+	}
+	if retryAfter := w.Header().Get("Retry-After"); retryAfter != "" {
+		t.Errorf("Retry-After %q sent to a denylisted client", retryAfter)
+	}
+}
@@ -0,0 +1,187 @@
+package leaky
+
+import (
+	"bufio"
+	"math"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// AdaptiveConfig sets when an adaptive bucket considers its handler unhealthy, and how it adapts.
+// Zero values take the defaults.
+type AdaptiveConfig struct {
+	// MaxLatency is the mean latency above which the handler is unhealthy, unset to ignore latency
+	MaxLatency time.Duration
+	// MaxErrorRate is the share of failed responses above which the handler is unhealthy, unset to ignore errors.
+	// Responses with a 5xx status are failures.
+	MaxErrorRate float64
+	// Interval is how often the handler's health is judged, from the requests completed since, the default is 10s
+	Interval time.Duration
+	// Decrease multiplies the share of the leak rate applied after an unhealthy interval, the default is 0.5
+	Decrease float64
+	// Increase is added to the share of the leak rate applied after a healthy interval, the default is 0.1
+	Increase float64
+	// MinShare is the smallest share of the leak rate applied, the default is 0.1
+	MinShare float64
+}
+
+// WithAdaptive shrinks the bucket's leak rate while the handler it wraps is unhealthy, multiplying it down
+// after each unhealthy interval and adding it back gradually after healthy ones, to protect a struggling
+// backend. Each instance adapts by the requests it serves itself, the bucket's size is unchanged.
+// Requests not made through ServeHTTP can be reported with Bucket.Observe.
+func WithAdaptive(cfg AdaptiveConfig) Option {
+	if cfg.Interval <= 0 {
+		cfg.Interval = 10 * time.Second
+	}
+	if cfg.Decrease <= 0 {
+		cfg.Decrease = 0.5
+	}
+	if cfg.Increase <= 0 {
+		cfg.Increase = 0.1
+	}
+	if cfg.MinShare <= 0 {
+		cfg.MinShare = 0.1
+	}
+
+	return func(b *Bucket) {
+		b.adaptive = &adaptive{cfg: cfg, share: 1}
+	}
+}
+
+// adaptive tracks the health of a bucket's handler, and the share of the leak rate it allows
+type adaptive struct {
+	cfg AdaptiveConfig
+
+	mu    sync.Mutex
+	share float64
+	// The requests completed since intervalStart, and how many failed and how long they took
+	requests      int
+	failures      int
+	latency       time.Duration
+	intervalStart time.Time
+}
+
+// Observe reports a request completed by the handler a bucket with WithAdaptive protects,
+// it has no effect on other buckets
+func (b *Bucket) Observe(latency time.Duration, failed bool) {
+	a := b.adaptive
+	if a == nil {
+		return
+	}
+
+	now := b.clock.Now()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.judge(now)
+
+	a.requests++
+	a.latency += latency
+	if failed {
+		a.failures++
+	}
+}
+
+// judge adapts the share once an interval has passed, intervals without any requests are healthy
+func (a *adaptive) judge(now time.Time) {
+	if a.intervalStart.IsZero() {
+		a.intervalStart = now
+	}
+
+	elapsed := now.Sub(a.intervalStart)
+	if elapsed < a.cfg.Interval {
+		return
+	}
+
+	intervals := int(elapsed / a.cfg.Interval)
+	if a.unhealthy() {
+		a.share = math.Max(a.cfg.MinShare, a.share*a.cfg.Decrease)
+		intervals--
+	}
+	a.share = math.Min(1, a.share+float64(intervals)*a.cfg.Increase)
+
+	a.requests, a.failures, a.latency = 0, 0, 0
+	a.intervalStart = a.intervalStart.Add(elapsed.Truncate(a.cfg.Interval))
+}
+
+// unhealthy reports whether the requests of the interval crossed either threshold
+func (a *adaptive) unhealthy() bool {
+	if a.requests == 0 {
+		return false
+	}
+
+	if a.cfg.MaxErrorRate > 0 && float64(a.failures)/float64(a.requests) > a.cfg.MaxErrorRate {
+		return true
+	}
+
+	return a.cfg.MaxLatency > 0 && a.latency/time.Duration(a.requests) > a.cfg.MaxLatency
+}
+
+// adapt returns the limits with the leak rate shrunk to the share the handler's health allows,
+// keeping the fingerprint so adapting doesn't migrate the stored state
+func (b *Bucket) adapt(lim limits) limits {
+	a := b.adaptive
+	if a == nil {
+		return lim
+	}
+
+	now := b.clock.Now()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.judge(now)
+	lim.leakRate *= a.share
+
+	return lim
+}
+
+// statusWriter records the status of the response written through it
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+// sent returns the status of the response, 200 OK if nothing was written as net/http sends then
+func (w *statusWriter) sent() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+
+	return hj.Hijack()
+}
+
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,90 @@
+package leaky
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAdaptiveErrors(t *testing.T) {
+	clock := &testClock{now: time.Date(2023, 3, 1, 12, 0, 0, 0, time.UTC)}
+	store := NewMemoryStore(WithMemoryClock(clock))
+	defer store.Close()
+
+	tm := NewThrottleManagerWithStore(store, WithClock(clock))
+	status := http.StatusInternalServerError
+	bucket := tm.ThrottlingHandler(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}, 1, 60, keyFunc, "test", WithAdaptive(AdaptiveConfig{MaxErrorRate: 0.5}))
+
+	req, _ := http.NewRequest("GET", "", nil)
+	bucket.ServeHTTP(httptest.NewRecorder(), req)
+
+	// Once the interval is judged unhealthy a drop takes twice as long to leak
+	clock.now = clock.now.Add(10 * time.Second)
+	if !bucket.Add(1, "test-key") {
+		t.Fatal("Drop rejected")
+	}
+
+	// The stored state keeps the bucket's fingerprint however the rate has adapted
+	if state, _, _ := store.Get(ctx, testKey); state.Fingerprint != bucket.limits.fingerprint {
+		t.Error("Adapting changed the fingerprint of the stored state")
+	}
+
+	clock.now = clock.now.Add(time.Second)
+	if bucket.Add(1, "test-key") {
+		t.Error("Drop admitted at the full leak rate")
+	}
+
+	clock.now = clock.now.Add(time.Second)
+	if !bucket.Add(1, "test-key") {
+		t.Error("Drop rejected at half the leak rate")
+	}
+
+	// Healthy intervals add the rate back gradually, three of them since the last was judged
+	status = http.StatusOK
+	clock.now = clock.now.Add(28 * time.Second)
+	bucket.ServeHTTP(httptest.NewRecorder(), req)
+	if share := bucket.adaptive.share; math.Abs(share-0.8) > 1e-9 {
+		t.Errorf("Share of the leak rate %f after recovering, expected 0.8", share)
+	}
+
+	clock.now = clock.now.Add(time.Minute)
+	bucket.Add(0, "test-key")
+	if share := bucket.adaptive.share; share != 1 {
+		t.Errorf("Share of the leak rate %f, expected it recovered in full", share)
+	}
+}
+
+func TestAdaptiveLatency(t *testing.T) {
+	clock := &testClock{now: time.Now()}
+	tj := prepareTestJig()
+	defer tj.Close()
+
+	bucket := tj.ThrottleManager.ThrottlingHandler(handleFuncSuccessResponse, 10, 60, keyFunc, "test", WithBucketClock(clock),
+		WithAdaptive(AdaptiveConfig{MaxLatency: time.Second, Interval: time.Minute, Decrease: 0.25, MinShare: 0.05}))
+
+	for i := 0; i < 4; i++ {
+		bucket.Observe(500*time.Millisecond, false)
+		bucket.Observe(2*time.Second, false)
+		clock.now = clock.now.Add(time.Minute)
+	}
+	bucket.Add(1, "test-key")
+
+	// A quarter each time, until the floor
+	if share := bucket.adaptive.share; share != 0.05 {
+		t.Errorf("Share of the leak rate %f, expected the minimum", share)
+	}
+
+	// Requests not slow enough on average are healthy
+	bucket.Observe(1500*time.Millisecond, false)
+	bucket.Observe(100*time.Millisecond, false)
+	clock.now = clock.now.Add(time.Minute)
+	bucket.Add(1, "test-key")
+
+	if share := bucket.adaptive.share; math.Abs(share-0.15) > 1e-9 {
+		t.Errorf("Share of the leak rate %f, expected 0.15", share)
+	}
+}
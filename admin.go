@@ -0,0 +1,215 @@
+package leaky
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// AdminAuth reports whether a request to the admin handler may be served, such as by checking its token
+type AdminAuth func(r *http.Request) bool
+
+// AdminOption configures the handler returned by AdminHandler
+type AdminOption func(*adminHandler)
+
+// WithAdminAuth serves only the admin requests auth allows, refusing the rest with 403 Forbidden
+func WithAdminAuth(auth AdminAuth) AdminOption {
+	return func(h *adminHandler) {
+		h.auth = auth
+	}
+}
+
+// AdminHandler returns a handler for inspecting and managing the manager's buckets, to be mounted
+// under a prefix with http.StripPrefix. It serves JSON, with rates per minute and waits in milliseconds,
+// -1 if the bucket never leaks:
+//
+//	GET  /buckets                            lists the buckets and their limits
+//	GET  /buckets/{bucket}                   returns a bucket's limits
+//	PUT  /buckets/{bucket}/limits            sets a bucket's limits from {"size": 10, "rate": 60}, as SetLimit
+//	GET  /buckets/{bucket}/keys/{key}        returns the space remaining in a client's bucket
+//	POST /buckets/{bucket}/keys/{key}/reset  empties a client's bucket, as Reset
+//
+// Keys are path escaped, so they can hold slashes. Every request is refused unless WithAdminAuth allows it,
+// so the handler can't be mounted unprotected by mistake.
+func (m *ThrottleManager) AdminHandler(opts ...AdminOption) http.Handler {
+	h := &adminHandler{manager: m}
+	for _, opt := range opts {
+		opt(h)
+	}
+
+	return h
+}
+
+type adminHandler struct {
+	manager *ThrottleManager
+	auth    AdminAuth
+}
+
+// adminBucket describes a bucket's limits
+type adminBucket struct {
+	Name string  `json:"name"`
+	Size int     `json:"size"`
+	Rate float64 `json:"rate"`
+}
+
+// adminKey describes a client's bucket
+type adminKey struct {
+	Bucket       string `json:"bucket"`
+	Key          string `json:"key"`
+	Remaining    int    `json:"remaining"`
+	Limit        int    `json:"limit"`
+	ResetAfterMs int64  `json:"reset_after_ms"`
+}
+
+// adminLimits are the limits set by PUT /buckets/{bucket}/limits
+type adminLimits struct {
+	Size int     `json:"size"`
+	Rate float64 `json:"rate"`
+}
+
+func (h *adminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.auth == nil || !h.auth(r) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	path, err := adminPath(r.URL)
+	if err != nil || len(path) == 0 || path[0] != "buckets" {
+		http.NotFound(w, r)
+		return
+	}
+
+	if len(path) == 1 {
+		if allowMethod(w, r, http.MethodGet) {
+			writeJSON(w, h.buckets())
+		}
+		return
+	}
+
+	b, ok := h.manager.Bucket(path[1])
+	if !ok {
+		http.Error(w, ErrUnknownBucket.Error(), http.StatusNotFound)
+		return
+	}
+
+	switch {
+	case len(path) == 2:
+		if allowMethod(w, r, http.MethodGet) {
+			writeJSON(w, describeBucket(b))
+		}
+	case len(path) == 3 && path[2] == "limits":
+		if allowMethod(w, r, http.MethodPut) {
+			h.setLimits(w, r, b)
+		}
+	case len(path) == 4 && path[2] == "keys":
+		if allowMethod(w, r, http.MethodGet) {
+			h.key(w, r, b, path[3])
+		}
+	case len(path) == 5 && path[2] == "keys" && path[4] == "reset":
+		if allowMethod(w, r, http.MethodPost) {
+			h.reset(w, r, b, path[3])
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// buckets describes every bucket the manager has created, by name
+func (h *adminHandler) buckets() []adminBucket {
+	h.manager.mu.Lock()
+	buckets := make([]adminBucket, 0, len(h.manager.buckets))
+	for _, b := range h.manager.buckets {
+		buckets = append(buckets, describeBucket(b))
+	}
+	h.manager.mu.Unlock()
+
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].Name < buckets[j].Name })
+	return buckets
+}
+
+func (h *adminHandler) setLimits(w http.ResponseWriter, r *http.Request, b *Bucket) {
+	var lim adminLimits
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&lim); err != nil {
+		http.Error(w, "invalid limits: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if lim.Size <= 0 || lim.Rate < 0 {
+		http.Error(w, "invalid limits: size must be positive and rate not negative", http.StatusBadRequest)
+		return
+	}
+
+	b.SetLimit(Limit{Rate: lim.Rate, Per: time.Minute, Burst: lim.Size})
+	writeJSON(w, describeBucket(b))
+}
+
+func (h *adminHandler) key(w http.ResponseWriter, r *http.Request, b *Bucket, keyID string) {
+	lim := b.adapt(b.limitsFor(r.Context(), keyID))
+	remaining, resetAfter := b.Remaining(r.Context(), keyID)
+
+	writeJSON(w, adminKey{
+		Bucket:       b.bucketName,
+		Key:          keyID,
+		Remaining:    remaining,
+		Limit:        lim.size,
+		ResetAfterMs: adminMillis(resetAfter),
+	})
+}
+
+func (h *adminHandler) reset(w http.ResponseWriter, r *http.Request, b *Bucket, keyID string) {
+	if err := b.Reset(r.Context(), keyID); err != nil {
+		http.Error(w, "resetting failed: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func describeBucket(b *Bucket) adminBucket {
+	l := b.Limit()
+	return adminBucket{Name: b.bucketName, Size: l.Burst, Rate: l.Rate}
+}
+
+// adminPath splits the request's path into its unescaped segments
+func adminPath(u *url.URL) ([]string, error) {
+	var path []string
+	for _, segment := range strings.Split(strings.Trim(u.EscapedPath(), "/"), "/") {
+		if segment == "" {
+			continue
+		}
+
+		unescaped, err := url.PathUnescape(segment)
+		if err != nil {
+			return nil, err
+		}
+		path = append(path, unescaped)
+	}
+
+	return path, nil
+}
+
+// allowMethod reports whether the request uses the method, refusing it if not
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method == method {
+		return true
+	}
+
+	w.Header().Set("Allow", method)
+	http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func adminMillis(d time.Duration) int64 {
+	if d == InfDuration {
+		return -1
+	}
+
+	return d.Milliseconds()
+}
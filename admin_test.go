@@ -0,0 +1,81 @@
+package leaky_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/2bytes/leaky"
+	"github.com/2bytes/leaky/leakytest"
+)
+
+func TestAdminHandler(t *testing.T) {
+	tm := leakytest.NewTestManager(t)
+	api := tm.ThrottlingHandler(handleFuncSuccessResponse, 3, 60, nil, "api")
+	tm.ThrottlingHandler(handleFuncSuccessResponse, 1, 0, nil, "login")
+
+	handler := http.StripPrefix("/admin", tm.AdminHandler(leaky.WithAdminAuth(func(r *http.Request) bool {
+		return r.Header.Get("Authorization") == "Bearer secret"
+	})))
+
+	do := func(method string, path string, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer secret")
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+	expect := func(w *httptest.ResponseRecorder, code int, want string) {
+		t.Helper()
+		if body := strings.TrimSpace(w.Body.String()); w.Code != code || body != want {
+			t.Errorf("Responded %v %s, expected %v %s", w.Code, body, code, want)
+		}
+	}
+
+	expect(do("GET", "/admin/buckets", ""), http.StatusOK,
+		`[{"name":"api","size":3,"rate":60},{"name":"login","size":1,"rate":0}]`)
+
+	api.Add(2, "users/alice")
+	expect(do("GET", "/admin/buckets/api/keys/users%2Falice", ""), http.StatusOK,
+		`{"bucket":"api","key":"users/alice","remaining":1,"limit":3,"reset_after_ms":2000}`)
+
+	expect(do("POST", "/admin/buckets/api/keys/users%2Falice/reset", ""), http.StatusNoContent, "")
+	if remaining, _ := api.Remaining(context.Background(), "users/alice"); remaining != 3 {
+		t.Errorf("%d remaining once reset", remaining)
+	}
+
+	expect(do("PUT", "/admin/buckets/api/limits", `{"size":10,"rate":120}`), http.StatusOK,
+		`{"name":"api","size":10,"rate":120}`)
+	if l := api.Limit(); l.Burst != 10 || l.Rate != 120 {
+		t.Errorf("Limits not set: %+v", l)
+	}
+
+	if w := do("PUT", "/admin/buckets/api/limits", `{"size":0}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Status not BadRequest for invalid limits: %v", w.Code)
+	}
+	if w := do("GET", "/admin/buckets/missing", ""); w.Code != http.StatusNotFound {
+		t.Errorf("Status not NotFound for an unknown bucket: %v", w.Code)
+	}
+	if w := do("DELETE", "/admin/buckets/api", ""); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Status not MethodNotAllowed: %v", w.Code)
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/admin/buckets", nil))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Status not Forbidden without authorization: %v", w.Code)
+	}
+}
+
+func TestAdminHandlerWithoutAuth(t *testing.T) {
+	tm := leakytest.NewTestManager(t)
+
+	w := httptest.NewRecorder()
+	tm.AdminHandler().ServeHTTP(w, httptest.NewRequest("GET", "/buckets", nil))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Status not Forbidden without an auth hook: %v", w.Code)
+	}
+}
@@ -0,0 +1,76 @@
+package leaky
+
+import "context"
+
+// AddMulti adds drops to each client's bucket if there is space, for batches fanning out work across many
+// clients at once, returning whether each client's drops were added. Clients are decided on their own, not all
+// or none, and if the store is a BatchTaker all of them are decided in a single round trip.
+func (b *Bucket) AddMulti(counts map[string]int) map[string]bool {
+	return b.AddMultiContext(context.Background(), counts)
+}
+
+// AddMultiContext is AddMulti, making its calls to the store with ctx so they respect its deadline and cancellation
+func (b *Bucket) AddMultiContext(ctx context.Context, counts map[string]int) map[string]bool {
+	added := make(map[string]bool, len(counts))
+
+	// Coalesced requests and new keys over the key cap are decided by the usual path, one client at a time
+	batcher, ok := b.taker.(BatchTaker)
+	if !ok || b.flights != nil || b.keysFull() {
+		for keyID, count := range counts {
+			added[keyID] = b.fill(ctx, count, keyID)
+		}
+		return added
+	}
+
+	keyIDs := make([]string, 0, len(counts))
+	lims := make([]limits, 0, len(counts))
+	reqs := make([]TakeRequest, 0, len(counts))
+	for keyID, count := range counts {
+		lim := b.adapt(b.limitsFor(ctx, keyID))
+		keyIDs = append(keyIDs, keyID)
+		lims = append(lims, lim)
+		reqs = append(reqs, b.takeRequest(lim, b.getKey(keyID), []Demand{exactly(count)}))
+	}
+
+	// Each client's decision is traced on its own, as take does
+	ctxs := make([]context.Context, len(keyIDs))
+	decided := make([]func(bool), len(keyIDs))
+	for i, keyID := range keyIDs {
+		ctxs[i] = ctx
+		if reqs[i].Demands[0].Count > 0 {
+			ctxs[i], decided[i] = b.observe(ctx, keyID)
+		}
+	}
+
+	var results []TakeResult
+	err := b.roundTrip(ctx, func() error {
+		var err error
+		results, err = batcher.TakeBatch(ctx, reqs)
+		return err
+	})
+
+	for i, keyID := range keyIDs {
+		lim, key, demand := lims[i], reqs[i].Key, reqs[i].Demands[0]
+
+		var taken int
+		var after State
+		if err != nil {
+			b.storeFailed(ctxs[i], b.logger.Error, "Taking from buckets in a batch failed, resetting counters", keyID, err)
+			b.failOpens.Add(1)
+			takenAll, afterAll := b.failTake(lim, key, reqs[i].Demands)
+			b.forget(key)
+			taken, after = takenAll[0], afterAll[0]
+		} else {
+			taken, after = results[i].Taken[0], results[i].State
+			b.rememberTaken(lim, key, results[i], taken)
+		}
+
+		added[keyID] = taken == demand.Count
+		if decided[i] != nil {
+			decided[i](taken > 0)
+			b.hookDecision(ctxs[i], lim, keyID, demand, taken > 0, after)
+		}
+	}
+
+	return added
+}
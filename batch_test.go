@@ -0,0 +1,43 @@
+package leaky
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAddMulti(t *testing.T) {
+	tj := prepareTestJig()
+	defer tj.Close()
+
+	memory := NewMemoryStore()
+	defer memory.Close()
+
+	managers := map[string]*ThrottleManager{
+		"redis":  tj.ThrottleManager,
+		"memory": NewThrottleManagerWithStore(memory),
+	}
+
+	for name, tm := range managers {
+		t.Run(name, func(t *testing.T) {
+			bucket := tm.ThrottlingHandler(nil, 2, 0, keyFunc, "test")
+
+			before := bucket.Stats().RoundTrips
+			added := bucket.AddMulti(map[string]int{"a": 2, "b": 1, "c": 3})
+			if want := map[string]bool{"a": true, "b": true, "c": false}; !reflect.DeepEqual(added, want) {
+				t.Errorf("First batch added %v, expected %v", added, want)
+			}
+			if trips := bucket.Stats().RoundTrips - before; name == "redis" && trips != 1 {
+				t.Errorf("Batch made %d round trips, expected 1", trips)
+			}
+
+			added = bucket.AddMulti(map[string]int{"a": 1, "b": 1})
+			if want := map[string]bool{"a": false, "b": true}; !reflect.DeepEqual(added, want) {
+				t.Errorf("Second batch added %v, expected %v", added, want)
+			}
+
+			if remaining, _ := bucket.Remaining(ctx, "c"); remaining != 2 {
+				t.Errorf("Rejected client has %d drops of space, expected 2", remaining)
+			}
+		})
+	}
+}
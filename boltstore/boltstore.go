@@ -0,0 +1,218 @@
+// Package boltstore provides a leaky.Store keeping bucket state in a bbolt database file,
+// for single instance deployments such as edge devices where state has to survive restarts
+//
+//	db, _ := bolt.Open("/var/lib/gateway/throttling.db", 0600, nil)
+//	store, _ := boltstore.New(db)
+//	defer store.Close()
+//	tm := leaky.NewThrottleManagerWithStore(store)
+package boltstore
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/2bytes/leaky"
+	bolt "go.etcd.io/bbolt"
+)
+
+const defaultSweepInterval = time.Minute
+
+// bucketName is the bbolt bucket state is kept in
+var bucketName = []byte("leaky")
+
+// Store keeps bucket state in a bbolt database as JSON. Entries expire with the TTL they were stored with,
+// a background goroutine deletes expired entries until the store is closed. Every write is a bbolt
+// transaction synced to disk, so the store suits the request rates of a single device.
+type Store struct {
+	db       *bolt.DB
+	clock    leaky.Clock
+	interval time.Duration
+	logger   leaky.Logger
+
+	stop chan struct{}
+	done chan struct{}
+	once sync.Once
+}
+
+// Option configures a Store
+type Option func(*Store)
+
+// WithSweepInterval sets how often expired entries are deleted, the default is a minute
+func WithSweepInterval(interval time.Duration) Option {
+	return func(s *Store) {
+		s.interval = interval
+	}
+}
+
+// WithClock sets the clock entries expire by, it should be the clock used by the manager
+func WithClock(clock leaky.Clock) Option {
+	return func(s *Store) {
+		s.clock = clock
+	}
+}
+
+// WithLogger logs failed sweeps to logger in place of leaky.StdLogger, it should be the logger given to the
+// manager. A nil Logger silences the store.
+func WithLogger(logger leaky.Logger) Option {
+	return func(s *Store) {
+		s.logger = logger
+	}
+}
+
+// entry is the value stored for a key
+type entry struct {
+	State   leaky.State `json:"state"`
+	Expires time.Time   `json:"expires"`
+}
+
+type wallClock struct{}
+
+func (wallClock) Now() time.Time {
+	return time.Now()
+}
+
+func (wallClock) Since(t time.Time) time.Duration {
+	return time.Since(t)
+}
+
+// New creates a store in db and starts its sweeper, Close must be called to stop it.
+// The store doesn't close db.
+func New(db *bolt.DB, opts ...Option) (*Store, error) {
+	s := &Store{
+		db:       db,
+		clock:    wallClock{},
+		interval: defaultSweepInterval,
+		logger:   leaky.StdLogger(),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bucketName)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	go s.sweeper()
+
+	return s, nil
+}
+
+// Get implements leaky.Store
+func (s *Store) Get(ctx context.Context, key string) (leaky.State, bool, error) {
+	var state leaky.State
+	var ok bool
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		state, ok, err = s.get(tx, key)
+		return err
+	})
+
+	return state, ok, err
+}
+
+// Set implements leaky.Store
+func (s *Store) Set(ctx context.Context, key string, state leaky.State, ttl time.Duration) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return s.put(tx, key, state, ttl)
+	})
+}
+
+// GetSet implements leaky.GetSetter, in a single transaction
+func (s *Store) GetSet(ctx context.Context, key string, state leaky.State, ttl time.Duration) (leaky.State, bool, error) {
+	var prev leaky.State
+	var ok bool
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		if prev, ok, err = s.get(tx, key); err != nil {
+			return err
+		}
+
+		return s.put(tx, key, state, ttl)
+	})
+
+	return prev, ok, err
+}
+
+// Sweep deletes expired entries now rather than waiting for the sweeper
+func (s *Store) Sweep() error {
+	now := s.clock.Now()
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		c := tx.Bucket(bucketName).Cursor()
+
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			e := entry{}
+			if err := json.Unmarshal(v, &e); err != nil || !now.Before(e.Expires) {
+				if err := c.Delete(); err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	})
+}
+
+// Close stops the sweeper and waits for it to exit
+func (s *Store) Close() {
+	s.once.Do(func() {
+		close(s.stop)
+	})
+	<-s.done
+}
+
+func (s *Store) get(tx *bolt.Tx, key string) (leaky.State, bool, error) {
+	v := tx.Bucket(bucketName).Get([]byte(key))
+	if v == nil {
+		return leaky.State{}, false, nil
+	}
+
+	e := entry{}
+	if err := json.Unmarshal(v, &e); err != nil {
+		return leaky.State{}, false, err
+	}
+
+	if !s.clock.Now().Before(e.Expires) {
+		return leaky.State{}, false, nil
+	}
+
+	return e.State, true, nil
+}
+
+func (s *Store) put(tx *bolt.Tx, key string, state leaky.State, ttl time.Duration) error {
+	v, err := json.Marshal(entry{State: state, Expires: s.clock.Now().Add(ttl)})
+	if err != nil {
+		return err
+	}
+
+	return tx.Bucket(bucketName).Put([]byte(key), v)
+}
+
+func (s *Store) sweeper() {
+	defer close(s.done)
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.Sweep(); err != nil && s.logger != nil {
+				s.logger.Error("Sweeping expired state failed", "error", err)
+			}
+		case <-s.stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package boltstore
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/2bytes/leaky"
+	"github.com/2bytes/leaky/leakytest"
+	bolt "go.etcd.io/bbolt"
+)
+
+func openTestStore(t *testing.T, path string, clock leaky.Clock) (*Store, *bolt.DB) {
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := New(db, WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return store, db
+}
+
+func TestStateSurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.db")
+	clock := leakytest.NewFakeClock(leakytest.Epoch)
+	ctx := context.Background()
+
+	store, db := openTestStore(t, path, clock)
+	if err := store.Set(ctx, "key", leaky.State{SpaceRemaining: 3}, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+	db.Close()
+
+	store, db = openTestStore(t, path, clock)
+	defer db.Close()
+	defer store.Close()
+
+	if state, ok, err := store.Get(ctx, "key"); err != nil || !ok || state.SpaceRemaining != 3 {
+		t.Errorf("Get after reopening returned %+v, %v, %v", state, ok, err)
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	clock := leakytest.NewFakeClock(leakytest.Epoch)
+	store, db := openTestStore(t, filepath.Join(t.TempDir(), "state.db"), clock)
+	defer db.Close()
+	defer store.Close()
+	ctx := context.Background()
+
+	store.Set(ctx, "short", leaky.State{SpaceRemaining: 1}, time.Second)
+	store.Set(ctx, "long", leaky.State{SpaceRemaining: 2}, time.Hour)
+
+	clock.Advance(time.Second)
+
+	if _, ok, _ := store.Get(ctx, "short"); ok {
+		t.Error("Expired state returned by Get")
+	}
+
+	prev, ok, err := store.GetSet(ctx, "long", leaky.State{SpaceRemaining: 1}, time.Hour)
+	if err != nil || !ok || prev.SpaceRemaining != 2 {
+		t.Errorf("GetSet returned %+v, %v, %v", prev, ok, err)
+	}
+
+	if err := store.Sweep(); err != nil {
+		t.Fatal(err)
+	}
+
+	keys := 0
+	db.View(func(tx *bolt.Tx) error {
+		keys = tx.Bucket(bucketName).Stats().KeyN
+		return nil
+	})
+	if keys != 1 {
+		t.Errorf("%d keys after sweeping, expected 1", keys)
+	}
+}
@@ -0,0 +1,17 @@
+module github.com/2bytes/leaky/boltstore
+
+go 1.20
+
+require (
+	github.com/2bytes/leaky v0.1.1
+	go.etcd.io/bbolt v1.3.8
+)
+
+require (
+	github.com/cespare/xxhash/v2 v2.2.0 // indirect
+	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
+	github.com/redis/go-redis/v9 v9.0.2 // indirect
+	golang.org/x/sys v0.4.0 // indirect
+)
+
+replace github.com/2bytes/leaky => ../
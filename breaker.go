@@ -0,0 +1,176 @@
+package leaky
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// errBreakerOpen is returned in place of a Redis call while the circuit breaker is open
+var errBreakerOpen = errors.New("leaky: circuit breaker open")
+
+// BreakerState is the state of the circuit breaker in front of Redis
+type BreakerState int
+
+const (
+	// BreakerClosed lets every call through to Redis
+	BreakerClosed BreakerState = iota
+	// BreakerOpen fails every call without touching Redis
+	BreakerOpen
+	// BreakerHalfOpen lets a single probe call through to test whether Redis has recovered
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+
+	return "unknown"
+}
+
+// BreakerHook is called whenever the circuit breaker changes state
+type BreakerHook func(from, to BreakerState)
+
+// WithBreaker enables a circuit breaker in front of Redis, shared by every bucket of the manager.
+// After threshold consecutive errors the breaker opens and requests are decided by each bucket's
+// failure policy without calling Redis, after cooldown a single probe call is let through and the breaker closes
+// again if it succeeds.
+func WithBreaker(threshold int, cooldown time.Duration) ManagerOption {
+	return func(m *ThrottleManager) {
+		m.breaker.threshold = threshold
+		m.breaker.cooldown = cooldown
+	}
+}
+
+// WithBreakerHook registers a hook called on every circuit breaker state change
+func WithBreakerHook(hook BreakerHook) ManagerOption {
+	return func(m *ThrottleManager) {
+		m.breaker.hook = hook
+	}
+}
+
+type breaker struct {
+	threshold int
+	cooldown  time.Duration
+	hook      BreakerHook
+	clock     Clock
+	logger    Logger
+
+	mu       sync.Mutex
+	state    BreakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+	// trips counts the times the breaker has opened
+	trips atomic.Uint64
+}
+
+// allow reports whether a call may be made to Redis
+func (cb *breaker) allow() bool {
+	if cb.threshold <= 0 {
+		return true
+	}
+
+	cb.mu.Lock()
+	from := cb.state
+
+	switch cb.state {
+	case BreakerOpen:
+		if cb.clock.Since(cb.openedAt) < cb.cooldown {
+			cb.mu.Unlock()
+			return false
+		}
+		cb.state = BreakerHalfOpen
+		cb.probing = true
+	case BreakerHalfOpen:
+		if cb.probing {
+			cb.mu.Unlock()
+			return false
+		}
+		cb.probing = true
+	}
+
+	to := cb.state
+	cb.mu.Unlock()
+
+	cb.changed(from, to)
+	return true
+}
+
+// cancel records that a call allowed through was abandoned by its caller, which says nothing about
+// the health of Redis, so another probe can be made
+func (cb *breaker) cancel() {
+	if cb.threshold <= 0 {
+		return
+	}
+
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.probing = false
+}
+
+// record records the outcome of a call allowed through to Redis
+func (cb *breaker) record(err error) {
+	if cb.threshold <= 0 {
+		return
+	}
+
+	cb.mu.Lock()
+	from := cb.state
+
+	if err == nil || err == redis.Nil {
+		cb.failures = 0
+		cb.probing = false
+		cb.state = BreakerClosed
+	} else {
+		cb.failures++
+		if cb.state == BreakerHalfOpen || cb.failures >= cb.threshold {
+			if cb.state != BreakerOpen {
+				cb.trips.Add(1)
+			}
+			cb.state = BreakerOpen
+			cb.openedAt = cb.clock.Now()
+			cb.probing = false
+		}
+	}
+
+	to := cb.state
+	cb.mu.Unlock()
+
+	cb.changed(from, to)
+}
+
+func (cb *breaker) current() BreakerState {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	return cb.state
+}
+
+func (cb *breaker) changed(from, to BreakerState) {
+	if from == to {
+		return
+	}
+
+	if cb.logger != nil {
+		logf := cb.logger.Info
+		if to == BreakerOpen {
+			logf = cb.logger.Warn
+		}
+		logf("Store circuit breaker "+to.String(), "from", from.String())
+	}
+
+	if cb.hook != nil {
+		cb.hook(from, to)
+	}
+}
@@ -0,0 +1,178 @@
+package leaky
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestBreakerOpensAndRecovers(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mr.Close()
+
+	var transitions []BreakerState
+	rc := redis.NewClient(&redis.Options{Addr: mr.Addr(), MaxRetries: -1})
+	tm := NewThrottleManager(rc, WithBreaker(3, 50*time.Millisecond), WithBreakerHook(func(from, to BreakerState) {
+		transitions = append(transitions, to)
+	}))
+
+	handler := tm.ThrottlingHandler(handleFuncSuccessResponse, 10, 0, keyFunc, "test")
+	req, _ := http.NewRequest("GET", "", nil)
+
+	mr.Close()
+
+	for i := 0; i < 3; i++ {
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	if state := handler.Stats().Breaker; state != BreakerOpen {
+		t.Fatalf("Breaker not open after threshold: %s", state)
+	}
+
+	// While open, requests fail open without touching Redis
+	trips := handler.Stats().RoundTrips
+	for i := 0; i < 10; i++ {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Errorf("Status not OK while breaker open: %v\n", w.Code)
+		}
+	}
+
+	if rt := handler.Stats().RoundTrips; rt != trips {
+		t.Errorf("Open breaker made %d round trips", rt-trips)
+	}
+
+	if err := mr.Restart(); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+
+	// The first request after the cool-down probes Redis and closes the breaker
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if state := handler.Stats().Breaker; state != BreakerClosed {
+		t.Errorf("Breaker not closed after recovery: %s", state)
+	}
+
+	if rt := handler.Stats().RoundTrips; rt == trips {
+		t.Error("Probe request didn't reach Redis")
+	}
+
+	want := []BreakerState{BreakerOpen, BreakerHalfOpen, BreakerClosed}
+	if len(transitions) != len(want) {
+		t.Fatalf("Unexpected breaker transitions: %v", transitions)
+	}
+	for i := range want {
+		if transitions[i] != want[i] {
+			t.Errorf("Unexpected breaker transitions: %v", transitions)
+		}
+	}
+}
+
+func TestBreakerHalfOpenSingleProbe(t *testing.T) {
+	cb := &breaker{threshold: 1, cooldown: time.Millisecond, clock: wallClock{}}
+
+	cb.record(errors.New("down"))
+	if cb.allow() {
+		t.Error("Open breaker allowed a call before the cool-down")
+	}
+
+	time.Sleep(2 * time.Millisecond)
+
+	if !cb.allow() {
+		t.Fatal("Breaker didn't allow a probe after the cool-down")
+	}
+
+	if cb.allow() {
+		t.Error("Half-open breaker allowed a second call during the probe")
+	}
+
+	cb.record(errors.New("still down"))
+	if state := cb.current(); state != BreakerOpen {
+		t.Errorf("Failed probe didn't reopen the breaker: %s", state)
+	}
+}
+
+func TestBreakerDisabled(t *testing.T) {
+	cb := &breaker{}
+
+	for i := 0; i < 10; i++ {
+		cb.record(errors.New("down"))
+	}
+
+	if !cb.allow() {
+		t.Error("Disabled breaker rejected a call")
+	}
+}
+
+// cancelledStore fails every call with the error of its context, as a store would for a cancelled request
+type cancelledStore struct{}
+
+func (cancelledStore) Get(ctx context.Context, key string) (State, bool, error) {
+	<-ctx.Done()
+	return State{}, false, ctx.Err()
+}
+
+func (cancelledStore) Set(ctx context.Context, key string, state State, ttl time.Duration) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestBreakerIgnoresCancellation(t *testing.T) {
+	tm := NewThrottleManagerWithStore(cancelledStore{}, WithBreaker(1, time.Hour))
+	bucket := tm.ThrottlingHandler(handleFuncSuccessResponse, 1, 0, keyFunc, "test")
+
+	for i := 0; i < 3; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		if !bucket.AddContext(ctx, 1, "test-key") {
+			t.Error("Cancelled request not failed open")
+		}
+	}
+
+	if state := bucket.Stats().Breaker; state != BreakerClosed {
+		t.Errorf("Breaker %v after cancelled requests, expected it closed", state)
+	}
+}
+
+func TestBreakerOpenUsesFailurePolicy(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mr.Close()
+
+	rc := redis.NewClient(&redis.Options{Addr: mr.Addr(), MaxRetries: -1})
+	tm := NewThrottleManager(rc, WithBreaker(2, time.Minute))
+
+	bucket := tm.ThrottlingHandler(handleFuncSuccessResponse, 10, 0, keyFunc, "login", WithFailurePolicy(FailClosed))
+
+	mr.Close()
+
+	for i := 0; i < 5; i++ {
+		if bucket.Add(1, "test-key") {
+			t.Errorf("Drop %d admitted failing closed", i)
+		}
+	}
+
+	stats := bucket.Stats()
+	if stats.RoundTrips != 2 || stats.ShortCircuits != 3 {
+		t.Errorf("%d round trips and %d short circuits, expected 2 and 3", stats.RoundTrips, stats.ShortCircuits)
+	}
+	if stats.BreakerTrips != 1 {
+		t.Errorf("Breaker opened %d times", stats.BreakerTrips)
+	}
+}
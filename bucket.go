@@ -5,24 +5,37 @@
 // this should be cleaned up to allow usage in scenarios where the handler middleware
 // is not required, or not desired.
 //
-// At the moment, the middleware and the leaky-bucket are tightly coupled to Redis as a cache,
-// although a Redis failure is non-fatal (fail-open), the dependency might not be required
-// or desired, and should be decoupled appropriately.
+// State is kept in a Store shared between instances of a service, Redis by default,
+// a store failure is non-fatal (fail-open).
 package leaky
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
 	"math"
 	"net/http"
+	"net/netip"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/redis/go-redis/v9"
 )
 
-var ctx = context.Background()
+// InfDuration is the wait returned when drops will never fit in a bucket
+const InfDuration = time.Duration(math.MaxInt64)
+
+const (
+	// stateTTL is the longest bucket state is kept in the store after its last update by default,
+	// except by a tier which takes longer to refill
+	stateTTL = time.Hour
+	// knownMaxEntries caps how many keys a bucket remembers the stored state of
+	knownMaxEntries = 10000
+	// leakEpsilon absorbs the rounding error of leak rates which aren't exact in binary,
+	// so a drop due to have leaked by a millisecond counts as space
+	leakEpsilon = 1e-9
+)
 
 // Handler creates a new rate limiting leaky bucket handler
 type Handler func(w http.ResponseWriter, r *http.Request)
@@ -32,127 +45,952 @@ type KeyFunc func(r http.Request) string
 
 // ThrottleManager manages leaky buckets
 type ThrottleManager struct {
-	redis *redis.Client
+	store    Store
+	clock    Clock
+	breaker  *breaker
+	hashTags bool
+	retry    retryPolicy
+	replicas int
+	// hashKeys replaces key IDs by their hash, an HMAC if keySecret is set, in the store
+	hashKeys  bool
+	keySecret []byte
+	metrics   Metrics
+	tracer    Tracer
+	logger    Logger
+
+	mu      sync.Mutex
+	buckets map[string]*Bucket
 }
 
-type bucketState struct {
-	LastUpdate     time.Time `json:"last_update"`
-	SpaceRemaining float64   `json:"space_remaining"`
+// ManagerOption configures a ThrottleManager
+type ManagerOption func(*ThrottleManager)
+
+// Option configures a Bucket
+type Option func(*Bucket)
+
+// knownState is the last state this process observed in the store for a key,
+// used as the optimistic assumption when pipelining a fill
+type knownState struct {
+	state  State
+	exists bool
 }
 
-func (s bucketState) MarshalBinary() ([]byte, error) {
-	return json.Marshal(s)
+// matches reports whether two observations describe the same stored state
+func (k knownState) matches(other knownState) bool {
+	if k.exists != other.exists {
+		return false
+	}
+
+	if !k.exists {
+		return true
+	}
+
+	return k.state.LastUpdate.Equal(other.state.LastUpdate) && k.state.SpaceRemaining == other.state.SpaceRemaining &&
+		k.state.Fingerprint == other.state.Fingerprint && k.state.Size == other.state.Size && k.state.TAT.Equal(other.state.TAT)
 }
 
-func (s *bucketState) UnmarshalBinary(data []byte) error {
-	return json.Unmarshal(data, s)
+// Stats holds counters describing a bucket's use of its store
+type Stats struct {
+	// RoundTrips is the number of round trips made to the store, a pipeline counts as one
+	RoundTrips uint64
+	// FailOpens is the number of decisions made without the stored state, because the store
+	// failed or the breaker was open, which were made by the failure policy and so may have
+	// let requests through over their limit
+	FailOpens uint64
+	// ShortCircuits is the number of calls to the store not made because the breaker was open
+	ShortCircuits uint64
+	// Breaker is the current state of the manager's circuit breaker
+	Breaker BreakerState
+	// BreakerTrips is the number of times the manager's circuit breaker has opened
+	BreakerTrips uint64
 }
 
 // Bucket is the instance of a leaky bucket
 type Bucket struct {
-	size       int
-	state      bucketState
-	leakRate   float64
+	// limits are set by options as the bucket is created, and only read through currentLimits after
+	limits     limits
+	limitsMu   sync.RWMutex
 	bucketName string
 	handler    Handler
 	keyFunc    KeyFunc
-	redis      *redis.Client
+	keyFuncE   KeyFuncE
+	limitFunc  LimitFunc
+	costFunc   CostFunc
+	refundOn   StatusFunc
+	chargeOn   StatusFunc
+	migration  MigrationPolicy
+
+	storeClient
+
+	mu        sync.Mutex
+	known     *expiringMap[State]
+	lastSweep time.Time
+
+	flights     *flights
+	keyGuard    *keyGuard
+	concurrency *ConcurrencyBucket
+	adaptive    *adaptive
+
+	headers   HeaderScheme
+	rejection Rejection
+
+	onAllow      DecisionHook
+	onDeny       DecisionHook
+	onStoreError StoreErrorHook
+
+	// keyLimits caches the limits stored for clients, when the bucket applies them
+	keyLimits    *expiringMap[*KeyLimits]
+	keyLimitsTTL time.Duration
+	// access caches whether clients are on the bucket's allowlist or denylist, when it applies them
+	access    *expiringMap[Access]
+	accessTTL time.Duration
+	exempt    []netip.Prefix
+	// shadow lets every request through, only accounting for those the bucket would reject
+	shadow bool
+	// delay is how long a request may be held until it fits, rather than rejected
+	delay time.Duration
+	// priority tags requests, those below High must leave reserved drops of space
+	priority PriorityFunc
+	reserved int
+	// methods are the buckets limiting requests by their method, created from methodLimits
+	methodLimits map[string]limits
+	methods      map[string]*Bucket
+	// penalty is the bucket's penalty box, and blocked caches when clients' blocks end
+	penalty *PenaltyBox
+	blocked *expiringMap[time.Time]
+
+	failure FailurePolicy
+	// local is the state kept in memory for FailLocal, under limits divided between the replicas
+	local    *expiringMap[State]
+	replicas int
+}
+
+// Stats returns a snapshot of the bucket's counters
+func (b *Bucket) Stats() Stats {
+	return b.stats()
 }
 
 func (b *Bucket) getKey(keyID string) string {
-	return fmt.Sprintf("leaky::%s::%s", b.bucketName, keyID)
+	return b.key(b.bucketName, keyID)
 }
 
-func (b *Bucket) setState(updatedState bucketState, keyID string) {
+func (b *Bucket) setState(ctx context.Context, updatedState State, keyID string) {
+	b.putState(ctx, b.currentLimits(), updatedState, keyID)
+}
 
-	if err := b.redis.Set(ctx, b.getKey(keyID), updatedState, time.Hour).Err(); err != nil && err != redis.Nil {
-		log.Printf("Setting bucket state failed: %q\n", err)
+func (b *Bucket) putState(ctx context.Context, lim limits, updatedState State, keyID string) {
+	key := b.getKey(keyID)
+
+	if err := b.writeState(ctx, lim, key, updatedState); err != nil {
+		b.storeFailed(ctx, b.logger.Warn, "Setting bucket state failed", keyID, err)
+		b.localPut(lim, key, updatedState)
+		b.forget(key)
+		return
 	}
+
+	b.remember(lim, key, knownState{state: updatedState, exists: true})
 }
 
-func (b *Bucket) getState(keyID string) bucketState {
+func (b *Bucket) getState(ctx context.Context, keyID string) State {
+	state, _ := b.fetchState(ctx, b.currentLimits(), keyID)
+	return state
+}
 
-	lastState := bucketState{}
+// fetchState reads the state stored for a key and leaks it under the given limits,
+// reporting whether the store was read and had no state for the key
+func (b *Bucket) fetchState(ctx context.Context, lim limits, keyID string) (State, bool) {
+	key := b.getKey(keyID)
+
+	lastState, exists, err := b.readState(ctx, key)
+	if err != nil {
+		b.storeFailed(ctx, b.logger.Error, "Retrieving bucket state failed, resetting counters", keyID, err)
+		b.failOpens.Add(1)
+		state := b.failState(lim, key)
+		b.forget(key)
+		return state, false
+	}
+
+	b.remember(lim, key, knownState{state: lastState, exists: exists})
+
+	if !exists {
+		return b.fullState(lim), true
+	}
+
+	// Calculate how much the bucket has leaked since the last update
+	return b.leak(lim, lastState), false
+}
+
+// storeClient makes calls to the manager's store on behalf of a bucket
+type storeClient struct {
+	store    Store
+	clock    Clock
+	breaker  *breaker
+	hashTags bool
+	retry    retryPolicy
+	taker    Taker
+	// hashKeys replaces key IDs by their hash, an HMAC if keySecret is set, in the store
+	hashKeys  bool
+	keySecret []byte
+	metrics   Metrics
+	tracer    Tracer
+	logger    Logger
+	// name is the bucket's, for its metrics and traces
+	name          string
+	roundTrips    atomic.Uint64
+	failOpens     atomic.Uint64
+	shortCircuits atomic.Uint64
+}
+
+// storeClient returns a client of the manager's store for the named bucket
+func (m *ThrottleManager) storeClient(bucketName string) storeClient {
+	return storeClient{
+		store:     m.store,
+		clock:     m.clock,
+		breaker:   m.breaker,
+		hashTags:  m.hashTags,
+		hashKeys:  m.hashKeys,
+		keySecret: m.keySecret,
+		retry:     m.retry,
+		taker:     takerOf(m.store),
+		metrics:   m.metrics,
+		tracer:    m.tracer,
+		logger:    m.logger,
+		name:      bucketName,
+	}
+}
 
-	if err := b.redis.Get(ctx, b.getKey(keyID)).Scan(&lastState); err != nil {
-		if err != redis.Nil {
-			log.Printf("Retrieving bucket state failed, resetting counters: %s\n", err)
+// key returns the key a client's state in a bucket is stored under, with the key ID hashed if enabled,
+// and as a hash tag if enabled so Redis Cluster keeps all of a client's state in the same slot
+func (c *storeClient) key(bucketName string, keyID string) string {
+	return c.keyUnder("leaky", bucketName, keyID)
+}
+
+// keyUnder returns the key for the client under prefix and name, hashed and hash tagged as key is
+func (c *storeClient) keyUnder(prefix string, name string, keyID string) string {
+	if c.hashKeys {
+		keyID = c.hashKeyID(keyID)
+	}
+
+	if c.hashTags {
+		return fmt.Sprintf("%s::%s::{%s}", prefix, name, keyID)
+	}
+
+	return fmt.Sprintf("%s::%s::%s", prefix, name, keyID)
+}
+
+// stats returns a snapshot of the client's counters
+func (c *storeClient) stats() Stats {
+	return Stats{
+		RoundTrips:    c.roundTrips.Load(),
+		FailOpens:     c.failOpens.Load(),
+		ShortCircuits: c.shortCircuits.Load(),
+		Breaker:       c.breaker.current(),
+		BreakerTrips:  c.breaker.trips.Load(),
+	}
+}
+
+// takerOf returns the store as a Taker, or nil if it isn't one or has taking turned off
+func takerOf(store Store) Taker {
+	if s, ok := store.(*RedisStore); ok && !s.scripting {
+		return nil
+	}
+
+	taker, _ := store.(Taker)
+	return taker
+}
+
+// roundTrip makes a single round trip to the store through the circuit breaker, fn should make its call with ctx
+func (c *storeClient) roundTrip(ctx context.Context, fn func() error) error {
+	if !c.breaker.allow() {
+		c.shortCircuits.Add(1)
+		if record := traceFromContext(ctx); record != nil {
+			record.shortCircuited()
 		}
+		return errBreakerOpen
+	}
+
+	classifier, _ := c.store.(RetryClassifier)
+	err := c.retry.do(ctx, classifier, func() error {
+		c.roundTrips.Add(1)
+		return c.timed(ctx, fn)
+	})
 
-		lastState.SpaceRemaining = float64(b.size)
-		lastState.LastUpdate = time.Now()
-		return lastState
+	if errors.Is(err, context.Canceled) {
+		c.breaker.cancel()
+	} else {
+		c.breaker.record(err)
 	}
 
-	// Calculate how much the bucket has leaked and update the cache
-	elapsed := float64(time.Since(lastState.LastUpdate) / time.Millisecond)
-	newRemaining := math.Floor(lastState.SpaceRemaining + (elapsed * float64(b.leakRate)))
+	return err
+}
+
+func (b *Bucket) writeState(ctx context.Context, lim limits, key string, state State) error {
+	return b.roundTrip(ctx, func() error {
+		return b.store.Set(ctx, key, lim.stored(state), lim.ttl(state))
+	})
+}
+
+func (b *Bucket) readState(ctx context.Context, key string) (State, bool, error) {
+	var state State
+	var exists bool
+
+	err := b.roundTrip(ctx, func() error {
+		var err error
+		state, exists, err = b.store.Get(ctx, key)
+		return err
+	})
+
+	return state, exists, err
+}
 
-	updatedState := bucketState{
-		SpaceRemaining: math.Min(float64(b.size), newRemaining),
-		LastUpdate:     time.Now(),
+// newState is the state of the bucket with the given space remaining as of now
+func (b *Bucket) newState(lim limits, spaceRemaining float64) State {
+	return State{
+		SpaceRemaining: spaceRemaining,
+		LastUpdate:     b.clock.Now(),
+		Size:           lim.size,
+		Fingerprint:    lim.fingerprint,
 	}
+}
 
-	return updatedState
+// fullState is the state of a bucket with no drops in it
+func (b *Bucket) fullState(lim limits) State {
+	return b.newState(lim, float64(lim.size))
 }
 
-func (b *Bucket) fill(count int, keyID string) bool {
-	// First update our bucket state; time has passed so some drops have leaked
-	currState := b.getState(keyID)
+// leak returns the state after the drops leaked since its last update have been removed,
+// migrated to the limits first if it was written under others
+func (b *Bucket) leak(lim limits, lastState State) State {
+	if !lastState.TAT.IsZero() {
+		lastState = b.fromTAT(lim, lastState)
+	}
+	lastState = b.migrate(lim, lastState)
 
-	// Return whether we have space for the number of drops we've been asked to add to the bucket
-	if currState.SpaceRemaining < float64(count) {
-		return false
+	elapsed := float64(b.clock.Since(lastState.LastUpdate) / time.Millisecond)
+	// Fractions of a drop are kept, so slow leaks aren't lost to rounding each time the state is written
+	newRemaining := lastState.SpaceRemaining + (elapsed * float64(lim.leakRate))
+
+	return b.newState(lim, math.Min(float64(lim.size), newRemaining))
+}
+
+// current returns the leaked state for what is known to be stored under a key
+func (b *Bucket) current(lim limits, k knownState) State {
+	if !k.exists {
+		return b.fullState(lim)
 	}
 
-	b.setState(bucketState{SpaceRemaining: currState.SpaceRemaining - float64(count), LastUpdate: time.Now()}, keyID)
-	return true
+	return b.leak(lim, k.state)
+}
+
+// remember records what is stored under a key until it expires from the store
+func (b *Bucket) remember(lim limits, key string, k knownState) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// Once the store is back its state takes over from what failing locally kept
+	if b.local != nil {
+		b.local.delete(key)
+	}
+
+	if !k.exists {
+		b.known.delete(key)
+		return
+	}
+
+	// Expired entries are swept every so often, rather than by a goroutine each bucket would need stopping
+	now := b.clock.Now()
+	if now.Sub(b.lastSweep) >= defaultSweepInterval {
+		b.known.sweep(now)
+		b.lastSweep = now
+	}
+
+	// What is remembered is compared with what is read back, so is kept as it was stored
+	leaked := k.state
+	if !leaked.TAT.IsZero() {
+		leaked = b.fromTAT(lim, leaked)
+	}
+	b.known.set(key, lim.stored(k.state), now.Add(lim.ttl(leaked)), now)
+}
+
+func (b *Bucket) forget(key string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.known.delete(key)
+}
+
+func (b *Bucket) lookup(key string) knownState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	state, ok := b.known.get(key, b.clock.Now())
+	return knownState{state: state, exists: ok}
+}
+
+// take removes the number of drops decided from the space remaining in the bucket,
+// returning how many were taken and the state left behind
+func (b *Bucket) take(ctx context.Context, lim limits, keyID string, demand Demand) (int, State) {
+	if demand.Count == 0 {
+		return b.takeKey(ctx, lim, keyID, demand, true)
+	}
+
+	ctx, decided := b.observe(ctx, keyID)
+	taken, after := b.takeKey(ctx, lim, keyID, demand, true)
+	decided(taken > 0)
+	b.hookDecision(ctx, lim, keyID, demand, taken > 0, after)
+
+	return taken, after
+}
+
+// correctionAttempts is how many times takeKey corrects an optimistic write before giving up, when other
+// writes keep replacing the state it decided on
+const correctionAttempts = 5
+
+// takeKey is take, checking new keys against the bucket's key cap if guarded
+func (b *Bucket) takeKey(ctx context.Context, lim limits, keyID string, demand Demand, guarded bool) (int, State) {
+	if b.flights != nil {
+		return b.coalescedTake(ctx, lim, keyID, demand, guarded)
+	}
+
+	if b.taker != nil {
+		taken, after := b.atomicTake(ctx, lim, keyID, []Demand{demand}, guarded)
+		return taken[0], after[0]
+	}
+
+	key := b.getKey(keyID)
+
+	// Assume the store still holds what we last saw for this key (or nothing, if we've never seen it),
+	// time has passed since then so some drops have leaked
+	assumed := b.lookup(key)
+	predicted := b.current(lim, assumed)
+	want := demand.decide(predicted.SpaceRemaining)
+
+	// If we expect to be throttled there's nothing to write, so only read the state to confirm it,
+	// the same goes for stores which can't read and write in a single round trip, and for keys
+	// which might be new when the bucket is at its key cap
+	gs, canGetSet := b.store.(GetSetter)
+	if !canGetSet || want == 0 || (guarded && !assumed.exists && b.keysFull()) {
+		currState, isNew := b.fetchState(ctx, lim, keyID)
+		if isNew && guarded && b.keysFull() {
+			return b.overflow(ctx, lim, demand)
+		}
+
+		taken := demand.decide(currState.SpaceRemaining)
+		if taken == 0 {
+			return 0, currState
+		}
+
+		updated := b.newState(lim, currState.SpaceRemaining-float64(taken))
+		b.putState(ctx, lim, updated, keyID)
+		if isNew {
+			b.keyCreated()
+		}
+		return taken, updated
+	}
+
+	// Otherwise read the state and write the optimistic result in the same round trip,
+	// then verify the state we read was the one we assumed
+	updated := b.newState(lim, predicted.SpaceRemaining-float64(want))
+	actual := knownState{}
+
+	err := b.roundTrip(ctx, func() error {
+		var err error
+		actual.state, actual.exists, err = gs.GetSet(ctx, key, lim.stored(updated), lim.ttl(updated))
+		return err
+	})
+
+	if err == errBreakerOpen {
+		// Nothing was sent, so take the same path as a failed read
+		b.failOpens.Add(1)
+		taken, after := b.failTake(lim, key, []Demand{demand})
+		b.forget(key)
+		return taken[0], after[0]
+	}
+
+	var writeErr *WriteError
+	readFailed := false
+	if errors.As(err, &writeErr) {
+		b.storeFailed(ctx, b.logger.Warn, "Setting bucket state failed", keyID, writeErr.Err)
+	} else if err != nil {
+		// A failed read resets the counters, as it would outside the pipeline
+		b.storeFailed(ctx, b.logger.Error, "Retrieving bucket state failed, resetting counters", keyID, err)
+		b.failOpens.Add(1)
+		if b.failure != FailOpen {
+			taken, after := b.failTake(lim, key, []Demand{demand})
+			b.forget(key)
+			return taken[0], after[0]
+		}
+		actual = knownState{}
+		readFailed = true
+	}
+
+	created := !actual.exists && !readFailed
+	if actual.matches(assumed) {
+		// Our assumption held, so the optimistic write was the correct one
+		if err != nil {
+			b.forget(key)
+		} else {
+			b.remember(lim, key, knownState{state: updated, exists: true})
+		}
+		if created {
+			b.keyCreated()
+		}
+		return want, updated
+	}
+
+	// Our assumption was wrong, decide again from the state that was actually stored and correct the write.
+	// The correction is verified the same way, so another instance's write landing before it is decided on
+	// again rather than lost. What is stored until then is our last write, or what was read if it failed.
+	stored := knownState{state: lim.stored(updated), exists: true}
+	if writeErr != nil {
+		stored = actual
+	}
+
+	for attempt := 1; ; attempt++ {
+		// A missing key is a full bucket, so a rejection puts back the stored state as it has leaked
+		currState := b.current(lim, actual)
+		taken := demand.decide(currState.SpaceRemaining)
+		correction := currState
+		if taken > 0 {
+			correction = b.newState(lim, currState.SpaceRemaining-float64(taken))
+		}
+
+		var prev knownState
+		err := b.roundTrip(ctx, func() error {
+			var err error
+			prev.state, prev.exists, err = gs.GetSet(ctx, key, lim.stored(correction), lim.ttl(correction))
+			return err
+		})
+
+		if err != nil {
+			b.storeFailed(ctx, b.logger.Warn, "Correcting bucket state failed", keyID, err)
+			b.forget(key)
+		} else if prev.matches(stored) {
+			b.remember(lim, key, knownState{state: correction, exists: true})
+		} else if attempt < correctionAttempts {
+			actual, stored = prev, knownState{state: lim.stored(correction), exists: true}
+			continue
+		} else {
+			b.logger.Warn("Correcting bucket state kept conflicting with other writes", "bucket", b.bucketName, "key", key)
+			b.forget(key)
+		}
+
+		if taken == 0 {
+			return 0, currState
+		}
+		if created {
+			b.keyCreated()
+		}
+		return taken, correction
+	}
+}
+
+// atomicTake takes the demands in turn in a single call to the store's Taker, returning how many drops
+// each took and the state each left behind
+func (b *Bucket) atomicTake(ctx context.Context, lim limits, keyID string, demands []Demand, guarded bool) ([]int, []State) {
+	key := b.getKey(keyID)
+	taken := make([]int, len(demands))
+	after := make([]State, len(demands))
+
+	// The store would create a new key regardless of the key cap, so check the key exists first
+	if guarded && !b.lookup(key).exists && b.keysFull() {
+		if _, isNew := b.fetchState(ctx, lim, keyID); isNew && b.keysFull() {
+			for i, d := range demands {
+				taken[i], after[i] = b.overflow(ctx, lim, d)
+			}
+			return taken, after
+		}
+	}
+
+	var result TakeResult
+	err := b.roundTrip(ctx, func() error {
+		var err error
+		result, err = b.taker.Take(ctx, b.takeRequest(lim, key, demands))
+		return err
+	})
+
+	if err != nil {
+		b.storeFailed(ctx, b.logger.Error, "Taking from bucket failed, resetting counters", keyID, err)
+		b.failOpens.Add(1)
+		taken, after := b.failTake(lim, key, demands)
+		b.forget(key)
+		return taken, after
+	}
+
+	// Work back from the state left by the last demand to the state each one left
+	state := result.State
+	total := 0
+	for i := len(demands) - 1; i >= 0; i-- {
+		taken[i] = result.Taken[i]
+		after[i] = state
+		state.SpaceRemaining += float64(taken[i])
+		total += taken[i]
+	}
+
+	b.rememberTaken(lim, key, result, total)
+	return taken, after
+}
+
+// takeRequest asks the store's Taker to take the demands in turn from the state under key
+func (b *Bucket) takeRequest(lim limits, key string, demands []Demand) TakeRequest {
+	return TakeRequest{
+		Key:         key,
+		Now:         b.clock.Now(),
+		Size:        lim.size,
+		LeakRate:    lim.leakRate,
+		Fingerprint: lim.fingerprint,
+		Migration:   b.migration,
+		Demands:     demands,
+		MaxTTL:      lim.longestTTL(),
+		TTLMargin:   lim.ttlMargin,
+		GCRA:        lim.gcra,
+	}
+}
+
+// rememberTaken remembers the state the Taker left under key having taken total drops, counting the key if
+// it created it
+func (b *Bucket) rememberTaken(lim limits, key string, result TakeResult, total int) {
+	// Nothing is written when nothing is taken, the leaked state stands in for what is stored
+	b.remember(lim, key, knownState{state: result.State, exists: result.Existed || total > 0})
+	if total > 0 && !result.Existed {
+		b.keyCreated()
+	}
+}
+
+// Demand is a number of drops to take from a bucket
+type Demand struct {
+	Count int
+	// Partial takes as many of the drops as there is space for, rather than all of them or none
+	Partial bool
+	// Reserve takes all of the drops whether there is space for them or not, leaving the bucket
+	// short of space until they have leaked
+	Reserve bool
+	// Keep is how many drops of space must be left after taking them, kept for requests of a higher priority.
+	// Reservations ignore it.
+	Keep int
+}
+
+// decide returns how many drops to take from a bucket with the space remaining
+func (d Demand) decide(spaceRemaining float64) int {
+	if d.Reserve {
+		return d.Count
+	}
+
+	whole := wholeDrops(spaceRemaining - float64(d.Keep))
+	if d.Partial {
+		if whole < 1 {
+			return 0
+		}
+		return int(math.Min(float64(d.Count), whole))
+	}
+
+	if whole < float64(d.Count) {
+		return 0
+	}
+	return d.Count
+}
+
+// wholeDrops is the number of whole drops there is space for, only these can be taken
+func wholeDrops(spaceRemaining float64) float64 {
+	return math.Floor(spaceRemaining + leakEpsilon)
+}
+
+// exactly demands count drops if there is space for all of them, or none if not
+func exactly(count int) Demand {
+	return Demand{Count: count}
+}
+
+func (b *Bucket) fill(ctx context.Context, count int, keyID string) bool {
+	taken, _ := b.take(ctx, b.adapt(b.limitsFor(ctx, keyID)), keyID, exactly(count))
+	return taken == count
 }
 
 // Add adds drops to the bucket if there is space
 func (b *Bucket) Add(count int, keyID string) bool {
+	return b.AddContext(context.Background(), count, keyID)
+}
+
+// AddContext is Add, making its calls to the store with ctx so they respect its deadline and cancellation
+func (b *Bucket) AddContext(ctx context.Context, count int, keyID string) bool {
 
-	if b.fill(count, keyID) {
+	if b.fill(ctx, count, keyID) {
 		return true
 	}
 
 	return false
 }
 
-func (m *ThrottleManager) newBucket(handler Handler, size int, leakRatePerMin int, keyFunc KeyFunc, bucketName string) *Bucket {
+// AddUpTo adds as many of count drops to the bucket as there is space for, returning how many were added
+// and how long until the rest would fit at the bucket's leak rate. If the rest can never fit, because
+// there are more than the bucket can hold or it doesn't leak, the wait is InfDuration.
+func (b *Bucket) AddUpTo(count int, keyID string) (accepted int, retryAfter time.Duration) {
+	return b.AddUpToContext(context.Background(), count, keyID)
+}
+
+// AddUpToContext is AddUpTo, making its calls to the store with ctx
+func (b *Bucket) AddUpToContext(ctx context.Context, count int, keyID string) (accepted int, retryAfter time.Duration) {
+	lim := b.adapt(b.limitsFor(ctx, keyID))
+	accepted, after := b.take(ctx, lim, keyID, Demand{Count: count, Partial: true})
+
+	return accepted, lim.waitFor(count-accepted, after)
+}
+
+// Decide is AddContext describing the client's bucket after, for callers reporting the decision
+// such as rate limit services
+func (b *Bucket) Decide(ctx context.Context, count int, keyID string) (Decision, bool) {
+	lim := b.adapt(b.limitsFor(ctx, keyID))
+	taken, after := b.take(ctx, lim, keyID, exactly(count))
+
+	return newDecision(b.bucketName, keyID, lim, after), taken == count
+}
+
+// Remaining returns how many drops the client's bucket has space for without adding any,
+// and how long until it has fully leaked
+func (b *Bucket) Remaining(ctx context.Context, keyID string) (remaining int, resetAfter time.Duration) {
+	lim := b.adapt(b.limitsFor(ctx, keyID))
+	state, _ := b.fetchState(ctx, lim, keyID)
+
+	remaining = int(math.Max(0, wholeDrops(state.SpaceRemaining)))
+	return remaining, lim.waitFor(lim.size, state)
+}
+
+func (m *ThrottleManager) newBucket(handler Handler, lim limits, keyFunc KeyFunc, bucketName string, opts []Option) *Bucket {
 	bucket := &Bucket{
-		size:       size,
-		leakRate:   float64(leakRatePerMin) / (60.0 * 1000.0),
-		handler:    handler,
-		keyFunc:    keyFunc,
-		redis:      m.redis,
-		bucketName: bucketName,
-		state:      bucketState{LastUpdate: time.Now(), SpaceRemaining: float64(size)},
+		limits:      lim,
+		handler:     handler,
+		keyFunc:     keyFunc,
+		storeClient: m.storeClient(bucketName),
+		bucketName:  bucketName,
+		known:       newExpiringMap[State](knownMaxEntries),
+		replicas:    m.replicas,
+	}
+	for _, opt := range opts {
+		opt(bucket)
 	}
 
+	// Options may have renamed the bucket
+	bucket.name = bucket.bucketName
+	bucket.lastSweep = bucket.clock.Now()
+
+	m.register(bucket)
+	m.newMethodBuckets(bucket, opts)
+
 	return bucket
 }
 
 // ServeHTTP implements http.Handler
 func (b *Bucket) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b.serve(w, r, b.handler)
+}
 
-	if b.Add(1, b.keyFunc(*r)) {
-		b.handler(w, r)
-	} else {
-		http.Error(w, "Rate Limit Exceeded", http.StatusTooManyRequests)
+// Wrap returns next throttled by the bucket in place of its own handler, for wrapping many handlers
+// with the same bucket, and for adapters to frameworks which continue the chain from next
+func (b *Bucket) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b.serve(w, r, next.ServeHTTP)
+	})
+}
+
+// Admit takes the request's drops, one unless the bucket has a CostFunc, if the client's bucket has space for
+// them, setting the rate limit headers on h and Retry-After if it hasn't, for adapters to frameworks which
+// respond to rejections themselves.
+// Concurrency limits stacked on the bucket aren't applied, and adapting needs the outcome reported with Observe.
+func (b *Bucket) Admit(h http.Header, r *http.Request) (Decision, bool) {
+	if mb := b.forMethod(r); mb != b {
+		return mb.Admit(h, r)
+	}
+
+	d, _, _, ok := b.admitRequest(h, r, false)
+	return d, ok
+}
+
+// admitRequest is Admit, also returning the limits the request was decided under and the drops it took,
+// or only checking there is space for them and returning how many it should take if peek is set
+func (b *Bucket) admitRequest(h http.Header, r *http.Request, peek bool) (Decision, limits, int, bool) {
+	return b.shadowed(b.decideRequest(b.shadowHeader(h), r, peek))
+}
+
+// decideRequest is admitRequest, whether or not the bucket is in shadow mode
+func (b *Bucket) decideRequest(h http.Header, r *http.Request, peek bool) (Decision, limits, int, bool) {
+	if b.exempted(r) {
+		return b.unlimited(b.currentLimits(), "", Allowlisted)
+	}
+
+	lim, keyID, err := b.resolve(r)
+	if errors.Is(err, ErrSkip) {
+		return b.unlimited(b.currentLimits(), "", Allowlisted)
+	} else if err != nil {
+		b.logger.Warn("Keying request failed, rejecting it", "bucket", b.bucketName, "error", err)
+		return b.unlimited(b.currentLimits(), "", Denylisted)
 	}
+
+	return b.admit(r.Context(), h, lim, keyID, b.cost(r), b.keep(r), peek)
+}
+
+// AdmitKey is Admit for a client identified by keyID, for frameworks which don't use net/http.
+// Limit and key overrides in ctx still apply.
+func (b *Bucket) AdmitKey(ctx context.Context, h http.Header, keyID string) (Decision, bool) {
+	lim, keyID := b.resolveContext(ctx, func() string { return keyID })
+	d, _, _, ok := b.shadowed(b.admit(ctx, b.shadowHeader(h), lim, keyID, 1, 0, false))
+	return d, ok
+}
+
+func (b *Bucket) admit(ctx context.Context, h http.Header, lim limits, keyID string, cost int, keep int, peek bool) (Decision, limits, int, bool) {
+	lim = b.adapt(lim)
+
+	if access := b.listed(ctx, keyID); access != Unlisted {
+		return b.unlimited(lim, keyID, access)
+	}
+	if wait, blocked := b.blockedFor(ctx, keyID); blocked {
+		return b.blockedDecision(h, lim, keyID, wait)
+	}
+
+	cost = capCost(cost, lim)
+	demand := Demand{Count: cost, Keep: keep}
+	if peek {
+		demand = exactly(0)
+	}
+
+	taken, after := b.take(ctx, lim, keyID, demand)
+	setRateLimitHeaders(h, b.headers, b.bucketName, lim, after)
+
+	fits := taken == cost
+	if peek {
+		fits, taken = wholeDrops(after.SpaceRemaining-float64(keep)) >= float64(cost), cost
+	}
+
+	d := newDecision(b.bucketName, keyID, lim, after)
+	if !fits {
+		// Held requests reserve their drops, which would take the space kept for higher priorities
+		if wait := lim.waitFor(cost, after); keep == 0 && b.holds(ctx, wait, peek) {
+			return b.hold(ctx, h, lim, keyID, cost)
+		}
+
+		b.strike(ctx, keyID)
+		d.RetryAfter = lim.waitFor(cost+keep, after)
+		setRetryAfter(h, d.RetryAfter)
+		return d, lim, 0, false
+	}
+
+	return d, lim, taken, true
+}
+
+// unlimited is admit for a request the bucket doesn't limit, listed or exempt, which takes no drops
+func (b *Bucket) unlimited(lim limits, keyID string, access Access) (Decision, limits, int, bool) {
+	d, ok := b.listedDecision(lim, keyID, access)
+	return d, lim, 0, ok
+}
+
+// serve passes the request to handler if the client's bucket has space for it, or rejects it
+func (b *Bucket) serve(w http.ResponseWriter, r *http.Request, handler Handler) {
+	if mb := b.forMethod(r); mb != b {
+		mb.serve(w, r, handler)
+		return
+	}
+
+	d, lim, taken, ok := b.admitRequest(w.Header(), r, b.chargeOn != nil)
+	if !ok {
+		b.rejection.write(w, r, b.logger, b.bucketName, d.RetryAfter)
+		return
+	}
+
+	r = withDecision(r, d)
+
+	var sw *statusWriter
+	if b.adaptive != nil || taken > 0 && (b.refundOn != nil || b.chargeOn != nil) {
+		sw = &statusWriter{ResponseWriter: w}
+		w = sw
+	}
+
+	if b.adaptive != nil {
+		start := b.clock.Now()
+		defer func() {
+			b.Observe(b.clock.Since(start), sw.status >= http.StatusInternalServerError)
+		}()
+	}
+
+	if b.refundOn != nil && b.chargeOn == nil && taken > 0 {
+		defer b.refundFor(r.Context(), lim, d.KeyID, taken, sw)
+	}
+	if b.chargeOn != nil && taken > 0 {
+		defer b.chargeFor(r.Context(), lim, d.KeyID, taken, sw)
+	}
+
+	if b.concurrency != nil {
+		b.concurrency.serve(w, r, d.KeyID, handler, b.rejection, b.failure)
+		return
+	}
+	handler(w, r)
 }
 
 // ThrottlingHandler creates a new handler wrapper for use as an HTTP middleware
-func (m *ThrottleManager) ThrottlingHandler(handler Handler, size int, rate int, keyFunc KeyFunc, bucketName string) *Bucket {
-	return m.newBucket(handler, size, rate, keyFunc, bucketName)
+func (m *ThrottleManager) ThrottlingHandler(handler Handler, size int, rate int, keyFunc KeyFunc, bucketName string, opts ...Option) *Bucket {
+	return m.newBucket(handler, newLimits(size, perMinute(rate)), keyFunc, bucketName, opts)
+}
+
+// Throttle is ThrottlingHandler wrapping any http.Handler, such as a router or file server
+func (m *ThrottleManager) Throttle(next http.Handler, size int, rate int, keyFunc KeyFunc, bucketName string, opts ...Option) *Bucket {
+	return m.ThrottlingHandler(next.ServeHTTP, size, rate, keyFunc, bucketName, opts...)
+}
+
+// Middleware returns a standard middleware constructor, for chains such as chi, gorilla/mux, negroni or alice.
+// Every handler it wraps shares the same bucket, which can be found with Bucket by its name.
+func (m *ThrottleManager) Middleware(size int, rate int, keyFunc KeyFunc, bucketName string, opts ...Option) func(http.Handler) http.Handler {
+	return m.ThrottlingHandler(nil, size, rate, keyFunc, bucketName, opts...).Wrap
+}
+
+// LimitHandler creates a new handler wrapper applying a sustained rate with a separate burst
+func (m *ThrottleManager) LimitHandler(handler Handler, limit Limit, keyFunc KeyFunc, bucketName string, opts ...Option) *Bucket {
+	return m.newBucket(handler, limit.limits(), keyFunc, bucketName, opts)
+}
+
+// ThrottlingHandlerPer is ThrottlingHandler with the leak rate given as drops per a duration, such as
+// 0.5 per hour, for limits which can't be expressed in whole drops per minute
+func (m *ThrottleManager) ThrottlingHandlerPer(handler Handler, size int, rate float64, per time.Duration, keyFunc KeyFunc, bucketName string, opts ...Option) *Bucket {
+	return m.newBucket(handler, newLimits(size, perDuration(rate, per)), keyFunc, bucketName, opts)
 }
 
 // NewThrottleManager creates a new instance of bucket manager
-// it requires a Redis client for storing state
-func NewThrottleManager(redis *redis.Client) *ThrottleManager {
+// it requires a Redis client for storing state, which can be standalone, Sentinel backed or a cluster,
+// such as from redis.NewUniversalClient. Keys are hash tagged for a cluster client.
+func NewThrottleManager(client redis.UniversalClient, opts ...ManagerOption) *ThrottleManager {
+	if _, ok := client.(*redis.ClusterClient); ok {
+		opts = append([]ManagerOption{WithHashTags()}, opts...)
+	}
+
+	return NewThrottleManagerWithStore(NewRedisStore(client), opts...)
+}
+
+// NewThrottleManagerWithCluster creates a new instance of bucket manager
+// storing state in Redis Cluster, with hash tagged keys
+//
+// Deprecated: NewThrottleManager takes cluster clients
+func NewThrottleManagerWithCluster(cluster *redis.ClusterClient, opts ...ManagerOption) *ThrottleManager {
+	return NewThrottleManager(cluster, opts...)
+}
+
+// NewThrottleManagerWithStore creates a new instance of bucket manager
+// storing state in the given store
+func NewThrottleManagerWithStore(store Store, opts ...ManagerOption) *ThrottleManager {
 	bm := &ThrottleManager{
-		redis: redis,
+		store:   store,
+		clock:   wallClock{},
+		breaker: &breaker{},
+		logger:  stdLogger{},
+		buckets: make(map[string]*Bucket),
+	}
+
+	for _, opt := range opts {
+		opt(bm)
+	}
+
+	bm.breaker.clock = bm.clock
+	bm.breaker.logger = bm.logger
+
+	if s, ok := store.(*RedisStore); ok {
+		if err := s.LoadScripts(context.Background()); err != nil {
+			bm.logger.Error("Loading Redis scripts failed", "error", err)
+		}
 	}
 
 	return bm
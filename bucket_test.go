@@ -1,12 +1,15 @@
 // Tests for the leaky package
-// Some of these tests are time based an raise some interesting questions about using
-// actual time for testing. If it causes issues on different systems, I'll consider implementing
-// TimeProvider to fake the times for a more reproducible test.
+// Time based tests drive a testClock through WithBucketClock rather than waiting on actual time,
+// so they are reproducible on different systems.
 package leaky
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"strings"
 	"testing"
 	"time"
@@ -16,6 +19,7 @@ import (
 )
 
 var (
+	ctx     = context.Background()
 	testKey = "leaky::test::test-key"
 )
 
@@ -32,7 +36,7 @@ type Jig struct {
 	miniRedis       *miniredis.Miniredis
 }
 
-func prepareTestJig() *Jig {
+func prepareTestJig(opts ...RedisOption) *Jig {
 
 	mr, err := miniredis.Run()
 	if err != nil {
@@ -40,7 +44,7 @@ func prepareTestJig() *Jig {
 	}
 
 	rc := redis.NewClient(&redis.Options{Addr: mr.Addr()})
-	tm := NewThrottleManager(rc)
+	tm := NewThrottleManagerWithStore(NewRedisStore(rc, opts...))
 
 	jig := &Jig{
 		ThrottleManager: tm,
@@ -113,71 +117,75 @@ func TestThrottleOn(t *testing.T) {
 	}
 }
 
-func TestThrottleOnOff(t *testing.T) {
+func TestThrottleLeaks(t *testing.T) {
 	tj := prepareTestJig()
 	defer tj.Close()
 
-	// With a leak rate of 600/min (10/s) we should be able to add another drop to the bucket after ~100 milliseconds
-	handler := tj.ThrottleManager.ThrottlingHandler(handleFuncSuccessResponse, 1, 600, keyFunc, "test")
-	req, _ := http.NewRequest("GET", "", nil)
+	clock := &testClock{now: time.Now()}
+	handler := tj.ThrottleManager.ThrottlingHandler(handleFuncSuccessResponse, 1, 10, keyFunc, "test", WithBucketClock(clock))
 
-	w := httptest.NewRecorder()
-	handler.ServeHTTP(w, req)
-
-	if w.Code != http.StatusOK {
-		t.Errorf("Status not OK: %v\n", w.Code)
+	if !handler.Add(1, "test-key") {
+		t.Fatal("First drop rejected")
 	}
 
-	w = httptest.NewRecorder()
-	handler.ServeHTTP(w, req)
-
-	if w.Code != http.StatusTooManyRequests {
-		t.Errorf("Status not TooManyRequests: %v\n", w.Code)
+	// At 10/min a drop leaks every 6 seconds
+	clock.now = clock.now.Add(5999 * time.Millisecond)
+	if handler.Add(1, "test-key") {
+		t.Error("Drop admitted before one leaked")
 	}
 
-	// We've added some margin (50%) to be safe
-	time.Sleep(time.Millisecond * 150)
-
-	w = httptest.NewRecorder()
-	handler.ServeHTTP(w, req)
-
-	if w.Code != http.StatusOK {
-		t.Errorf("Status not OK: %v\n", w.Code)
+	clock.now = clock.now.Add(time.Millisecond)
+	if !handler.Add(1, "test-key") {
+		t.Error("Drop rejected after one leaked")
 	}
 }
 
-func TestStickyThrottle(t *testing.T) {
+func TestRemaining(t *testing.T) {
 	tj := prepareTestJig()
 	defer tj.Close()
 
-	// With a leak rate of 600/min (10/s) we should be able to add another drop to the bucket after ~100 milliseconds
-	handler := tj.ThrottleManager.ThrottlingHandler(handleFuncSuccessResponse, 1, 600, keyFunc, "test")
-	req, _ := http.NewRequest("GET", "", nil)
+	clock := &testClock{now: time.Now()}
+	bucket := tj.ThrottleManager.ThrottlingHandler(handleFuncSuccessResponse, 5, 60, keyFunc, "test", WithBucketClock(clock))
 
-	w := httptest.NewRecorder()
-	handler.ServeHTTP(w, req)
+	if remaining, reset := bucket.Remaining(ctx, "test-key"); remaining != 5 || reset != 0 {
+		t.Errorf("Empty bucket has %d remaining, resetting in %s", remaining, reset)
+	}
 
-	if w.Code != http.StatusOK {
-		t.Errorf("Status not OK: %v\n", w.Code)
+	bucket.Add(3, "test-key")
+
+	for i := 0; i < 2; i++ {
+		if remaining, reset := bucket.Remaining(ctx, "test-key"); remaining != 2 || reset != 3*time.Second {
+			t.Errorf("Bucket has %d remaining, resetting in %s, expected 2 in 3s", remaining, reset)
+		}
 	}
 
-	// If we add drops at a rate faster than the leak rate, we should be throttled until we slow down
-	// The bucket should allow ~10 of our drops through at this rate
-	var leakCount int
+	// A reservation can leave the bucket short, which is no space at all
+	bucket.Reserve(ctx, "test-key", 4)
+	if remaining, reset := bucket.Remaining(ctx, "test-key"); remaining != 0 || reset != 7*time.Second {
+		t.Errorf("Bucket has %d remaining, resetting in %s, expected none in 7s", remaining, reset)
+	}
+}
 
-	for i := 0; i <= 100; i++ {
-		w := httptest.NewRecorder()
-		handler.ServeHTTP(w, req)
+func TestThrottlingHandlerPer(t *testing.T) {
+	tj := prepareTestJig()
+	defer tj.Close()
 
-		if w.Code != http.StatusTooManyRequests {
-			leakCount++
-		}
+	clock := &testClock{now: time.Now()}
+	handler := tj.ThrottleManager.ThrottlingHandlerPer(handleFuncSuccessResponse, 1, 0.5, time.Hour, keyFunc, "test", WithBucketClock(clock))
+
+	if !handler.Add(1, "test-key") {
+		t.Fatal("First drop rejected")
+	}
 
-		time.Sleep(time.Millisecond * 10)
+	// Half a drop an hour is a drop every two hours
+	clock.now = clock.now.Add(2*time.Hour - time.Millisecond)
+	if handler.Add(1, "test-key") {
+		t.Error("Drop admitted before one leaked")
 	}
 
-	if leakCount > 10 {
-		t.Error("Bucket leaked too many drops")
+	clock.now = clock.now.Add(time.Millisecond)
+	if !handler.Add(1, "test-key") {
+		t.Error("Drop rejected after one leaked")
 	}
 }
 
@@ -222,7 +230,7 @@ func TestGetStateSpaceRemaining(t *testing.T) {
 
 	handler := tj.ThrottleManager.ThrottlingHandler(handleFuncSuccessResponse, 43, 0, keyFunc, "test")
 
-	testBucketState := bucketState{
+	testBucketState := State{
 		LastUpdate:     time.Now(),
 		SpaceRemaining: 43,
 	}
@@ -234,7 +242,7 @@ func TestGetStateSpaceRemaining(t *testing.T) {
 
 	tj.miniRedis.Set(testKey, string(data))
 
-	bucketState := handler.getState(testKey)
+	bucketState := handler.getState(ctx, testKey)
 
 	if testBucketState.SpaceRemaining != bucketState.SpaceRemaining {
 		t.Errorf("Bucket space remaining doesn't match: %f, %f", testBucketState.SpaceRemaining, bucketState.SpaceRemaining)
@@ -247,7 +255,7 @@ func TestSetStateFail(t *testing.T) {
 
 	handler := tj.ThrottleManager.ThrottlingHandler(handleFuncSuccessResponse, 43, 0, keyFunc, "test")
 
-	handler.setState(bucketState{LastUpdate: time.Now(), SpaceRemaining: 43}, testKey)
+	handler.setState(ctx, State{LastUpdate: time.Now(), SpaceRemaining: 43}, testKey)
 }
 
 func TestGetStateFail(t *testing.T) {
@@ -256,10 +264,267 @@ func TestGetStateFail(t *testing.T) {
 
 	handler := tj.ThrottleManager.ThrottlingHandler(handleFuncSuccessResponse, 43, 0, keyFunc, "test")
 
-	bucketState := handler.getState(testKey)
+	bucketState := handler.getState(ctx, testKey)
 
 	if bucketState.SpaceRemaining != 43 {
 		t.Error("Failure to get state was critical")
 	}
 
 }
+
+func TestFillSingleRoundTrip(t *testing.T) {
+	tj := prepareTestJig(WithScripting(false))
+	defer tj.Close()
+
+	handler := tj.ThrottleManager.ThrottlingHandler(handleFuncSuccessResponse, 10, 0, keyFunc, "test")
+
+	for i := 0; i < 10; i++ {
+		if !handler.Add(1, "test-key") {
+			t.Fatalf("Drop %d rejected", i)
+		}
+	}
+
+	if rt := handler.Stats().RoundTrips; rt != 10 {
+		t.Errorf("Expected one round trip per drop, got %d for 10 drops", rt)
+	}
+
+	// The bucket is full, so the rejection is confirmed with a single read
+	if handler.Add(1, "test-key") {
+		t.Error("Bucket overflow")
+	}
+
+	if rt := handler.Stats().RoundTrips; rt != 11 {
+		t.Errorf("Expected a single round trip for a rejection, got %d", rt-10)
+	}
+}
+
+func TestFillStaleAssumption(t *testing.T) {
+	tj := prepareTestJig(WithScripting(false))
+	defer tj.Close()
+
+	handler := tj.ThrottleManager.ThrottlingHandler(handleFuncSuccessResponse, 2, 0, keyFunc, "test")
+
+	if !handler.Add(1, "test-key") {
+		t.Fatal("First drop rejected")
+	}
+
+	// Another instance fills the bucket behind our back
+	tj.miniRedis.HSet(testKey, "remaining", "0", "last_update", time.Now().Format(time.RFC3339Nano))
+
+	if handler.Add(1, "test-key") {
+		t.Error("Drop admitted from a stale assumption")
+	}
+
+	// The optimistic write must have been corrected back to the stored state
+	if got := tj.miniRedis.HGet(testKey, "remaining"); got != "0" {
+		t.Errorf("Stored space remaining not restored: %s", got)
+	}
+}
+
+func TestFillCorrectionConflicts(t *testing.T) {
+	tj := prepareTestJig()
+	defer tj.Close()
+
+	hook := &pipelineHook{}
+	rc := redis.NewClient(&redis.Options{Addr: tj.miniRedis.Addr()})
+	rc.AddHook(hook)
+
+	tm := NewThrottleManagerWithStore(NewRedisStore(rc, WithScripting(false)))
+	handler := tm.ThrottlingHandler(handleFuncSuccessResponse, 3, 0, keyFunc, "test")
+
+	if !handler.Add(1, "test-key") {
+		t.Fatal("First drop rejected")
+	}
+
+	// Another instance takes a drop behind our back, then the last one before our write is corrected
+	tj.miniRedis.HSet(testKey, "remaining", "1", "last_update", time.Now().Format(time.RFC3339Nano))
+	hook.pipelines, hook.before = 2, func() {
+		tj.miniRedis.HSet(testKey, "remaining", "0", "last_update", time.Now().Format(time.RFC3339Nano))
+	}
+
+	if handler.Add(1, "test-key") {
+		t.Error("Drop admitted from the state another instance replaced")
+	}
+	if got := tj.miniRedis.HGet(testKey, "remaining"); got != "0" {
+		t.Errorf("Stored space remaining %s, expected the other instance's write kept", got)
+	}
+}
+
+// pipelineHook calls before ahead of the given number of pipelines, such as to write as another instance would
+type pipelineHook struct {
+	pipelines int
+	before    func()
+}
+
+func (h *pipelineHook) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (h *pipelineHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return next
+}
+
+func (h *pipelineHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		if h.pipelines--; h.pipelines == 0 {
+			h.before()
+		}
+		return next(ctx, cmds)
+	}
+}
+
+// failSetHook fails every HSET queued in a pipeline while letting the rest of the pipeline succeed
+type failSetHook struct{}
+
+func (failSetHook) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (failSetHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return next
+}
+
+func (failSetHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		err := next(ctx, cmds)
+		for _, cmd := range cmds {
+			if cmd.Name() == "hset" {
+				cmd.SetErr(errors.New("injected failure"))
+			}
+		}
+		return err
+	}
+}
+
+func TestFillPipelineSetFails(t *testing.T) {
+	tj := prepareTestJig()
+	defer tj.Close()
+
+	rc := redis.NewClient(&redis.Options{Addr: tj.miniRedis.Addr()})
+	rc.AddHook(failSetHook{})
+
+	tm := NewThrottleManagerWithStore(NewRedisStore(rc, WithScripting(false)))
+	handler := tm.ThrottlingHandler(handleFuncSuccessResponse, 1, 0, keyFunc, "test")
+
+	// The read succeeded, so the decision it supports stands even though the write failed (fail-open)
+	if !handler.Add(1, "test-key") {
+		t.Error("Drop rejected after a failed write")
+	}
+
+	if handler.lookup(testKey).exists {
+		t.Error("Failed write was remembered as the stored state")
+	}
+}
+
+func BenchmarkAdd(b *testing.B) {
+	tj := prepareTestJig()
+	defer tj.Close()
+
+	handler := tj.ThrottleManager.ThrottlingHandler(handleFuncSuccessResponse, b.N+1, 0, keyFunc, "bench")
+	start := tj.miniRedis.CommandCount()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		handler.Add(1, "test-key")
+	}
+
+	b.ReportMetric(float64(handler.Stats().RoundTrips)/float64(b.N), "roundtrips/op")
+	b.ReportMetric(float64(tj.miniRedis.CommandCount()-start)/float64(b.N), "commands/op")
+}
+
+// BenchmarkAddRedis compares the ways of taking drops on a real Redis at LEAKY_REDIS_ADDR, where round
+// trips cost what they do in production: a read then a write, the pipelined read and optimistic write,
+// and the take script.
+func BenchmarkAddRedis(b *testing.B) {
+	addr := os.Getenv("LEAKY_REDIS_ADDR")
+	if addr == "" {
+		b.Skip("LEAKY_REDIS_ADDR not set")
+	}
+
+	rc := redis.NewClient(&redis.Options{Addr: addr})
+	defer rc.Close()
+
+	for _, bench := range []struct {
+		name  string
+		store Store
+	}{
+		{"get then set", plainStore{NewRedisStore(rc, WithScripting(false))}},
+		{"pipelined", NewRedisStore(rc, WithScripting(false))},
+		{"script", NewRedisStore(rc)},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			tm := NewThrottleManagerWithStore(bench.store)
+			handler := tm.ThrottlingHandler(handleFuncSuccessResponse, b.N+1, 0, keyFunc, "bench")
+			keyID := fmt.Sprintf("bench-%d", time.Now().UnixNano())
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				handler.Add(1, keyID)
+			}
+
+			b.ReportMetric(float64(handler.Stats().RoundTrips)/float64(b.N), "roundtrips/op")
+		})
+	}
+}
+
+// plainStore hides everything but the Store methods of the store it wraps
+type plainStore struct {
+	Store
+}
+
+func TestStateTTL(t *testing.T) {
+	tj := prepareTestJig()
+	defer tj.Close()
+
+	// 10 a day takes a day to fully leak, longer than state is kept by default
+	daily := tj.ThrottleManager.ThrottlingHandlerPer(handleFuncSuccessResponse, 10, 10, 24*time.Hour, keyFunc, "daily")
+	daily.Add(10, "test-key")
+
+	if ttl := tj.miniRedis.TTL("leaky::daily::test-key"); ttl != time.Hour {
+		t.Errorf("Default TTL %s, expected an hour", ttl)
+	}
+
+	kept := tj.ThrottleManager.ThrottlingHandlerPer(handleFuncSuccessResponse, 10, 10, 24*time.Hour, keyFunc, "kept", WithStateTTL(48*time.Hour))
+	kept.Add(10, "test-key")
+
+	if ttl := tj.miniRedis.TTL("leaky::kept::test-key"); ttl != 24*time.Hour {
+		t.Errorf("TTL %s, expected the day it takes to leak", ttl)
+	}
+}
+
+func TestDerivedTTL(t *testing.T) {
+	for _, scripting := range []bool{true, false} {
+		tj := prepareTestJig(WithScripting(scripting))
+
+		bucket := tj.ThrottleManager.ThrottlingHandlerPer(handleFuncSuccessResponse, 10, 10, 24*time.Hour, keyFunc, "test",
+			WithDerivedTTL(time.Minute))
+		bucket.Add(4, "test-key")
+
+		// Four drops take 9.6 hours of the day a full bucket takes to leak
+		if ttl, want := tj.miniRedis.TTL(testKey), 576*time.Minute+time.Minute; ttl != want {
+			t.Errorf("Scripting %v: TTL %s, expected %s", scripting, ttl, want)
+		}
+
+		tj.Close()
+	}
+}
+
+func TestFractionalLeakKept(t *testing.T) {
+	for _, scripting := range []bool{true, false} {
+		tj := prepareTestJig(WithScripting(scripting))
+
+		clock := &testClock{now: time.Now()}
+		handler := tj.ThrottleManager.ThrottlingHandlerPer(handleFuncSuccessResponse, 2, 1, time.Hour, keyFunc, "test", WithBucketClock(clock))
+
+		// Each of these is taken with three quarters of a drop leaked since the last,
+		// which is only enough for the third if the leaked fractions are kept
+		for i := 0; i < 3; i++ {
+			if !handler.Add(1, "test-key") {
+				t.Errorf("Scripting %v: drop %d rejected", scripting, i)
+			}
+			clock.now = clock.now.Add(45 * time.Minute)
+		}
+
+		tj.Close()
+	}
+}
@@ -0,0 +1,235 @@
+package leaky
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"time"
+)
+
+// ChainedBucket limits each request by several buckets at once, each keying it its own way, such as 10 a
+// second per user and 1000 a second globally. The request's drops are only taken when every bucket has space
+// for them, then from every bucket, in a single atomic step if the store is a Transactor and, on Redis
+// Cluster, the buckets' keys for the request are in the same slot.
+type ChainedBucket struct {
+	buckets    []*Bucket
+	bucketName string
+	handler    Handler
+}
+
+// link is a bucket of a chain as it applies to a request
+type link struct {
+	bucket *Bucket
+	lim    limits
+	keyID  string
+	cost   int
+}
+
+// Chain creates a new handler wrapper admitting requests only when every one of the buckets has space for
+// them, from buckets created as usual with a nil handler. Each keeps its own key func, limits, cost and
+// hooks, but allowlists, penalty boxes, key caps, shadow mode, concurrency limits, refunds and adapting
+// have no effect on a chain. Limit overrides in the request's context apply to every bucket.
+func (m *ThrottleManager) Chain(handler Handler, bucketName string, buckets ...*Bucket) *ChainedBucket {
+	return &ChainedBucket{buckets: buckets, bucketName: bucketName, handler: handler}
+}
+
+// ServeHTTP implements http.Handler
+func (c *ChainedBucket) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.serve(w, r, c.handler)
+}
+
+// Wrap returns next throttled by the chain in place of its own handler
+func (c *ChainedBucket) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.serve(w, r, next.ServeHTTP)
+	})
+}
+
+func (c *ChainedBucket) serve(w http.ResponseWriter, r *http.Request, handler Handler) {
+	d, ok := c.Admit(w.Header(), r)
+	if !ok {
+		c.rejection().write(w, r, c.logger(), c.bucketName, d.RetryAfter)
+		return
+	}
+
+	handler(w, withDecision(r, d))
+}
+
+// Admit takes the request's drops from every bucket if they all have space for them, setting the rate limit
+// headers of the bucket with the least space left on h, and Retry-After if the request was rejected.
+// The decision is that bucket's, under the chain's name.
+func (c *ChainedBucket) Admit(h http.Header, r *http.Request) (Decision, bool) {
+	links := make([]link, 0, len(c.buckets))
+	for _, b := range c.buckets {
+		lim, keyID, err := b.resolve(r)
+		if errors.Is(err, ErrSkip) {
+			continue
+		} else if err != nil {
+			b.logger.Warn("Keying request failed, rejecting it", "bucket", b.bucketName, "error", err)
+			return Decision{Bucket: c.bucketName, RetryAfter: InfDuration, ResetAfter: InfDuration}, false
+		}
+
+		links = append(links, link{bucket: b, lim: lim, keyID: keyID, cost: capCost(b.cost(r), lim)})
+	}
+
+	if len(links) == 0 {
+		return Decision{Bucket: c.bucketName}, true
+	}
+
+	ctx, decided := observe(r.Context(), links[0].bucket.tracer, links[0].bucket.metrics, c.bucketName, links[0].keyID)
+	states, ok := takeAll(ctx, links)
+	decided(ok)
+
+	// The bucket with the least space left is the one the client is closest to the limit of
+	tightest := 0
+	for i, l := range links {
+		l.bucket.hookDecision(ctx, l.lim, l.keyID, exactly(l.cost), ok, states[i])
+		if states[i].SpaceRemaining < states[tightest].SpaceRemaining {
+			tightest = i
+		}
+	}
+
+	l := links[tightest]
+	setRateLimitHeaders(h, l.bucket.headers, c.bucketName, l.lim, states[tightest])
+	d := newDecision(c.bucketName, l.keyID, l.lim, states[tightest])
+
+	if !ok {
+		d.RetryAfter = 0
+		for i, l := range links {
+			if wait := l.lim.waitFor(l.cost, states[i]); wait > d.RetryAfter {
+				d.RetryAfter = wait
+			}
+		}
+		setRetryAfter(h, d.RetryAfter)
+	}
+
+	return d, ok
+}
+
+// takeAll takes each link's drops from its bucket if they all have space, returning the state each was left in
+func takeAll(ctx context.Context, links []link) ([]State, bool) {
+	first := links[0].bucket
+	tx, ok := first.store.(Transactor)
+	if !ok {
+		return takeInTurn(ctx, links)
+	}
+
+	keys := make([]string, len(links))
+	for i, l := range links {
+		keys[i] = l.bucket.getKey(l.keyID)
+	}
+
+	// Redis Cluster can't transact over keys in different slots, as the buckets' keys usually are
+	if rs, ok := first.store.(*RedisStore); ok && !rs.sameSlot(keys) {
+		return takeInTurn(ctx, links)
+	}
+
+	var states []State
+	var known []knownState
+	fits := false
+
+	err := first.roundTrip(ctx, func() error {
+		return tx.Transact(ctx, keys, func(stored []State, exists []bool) ([]State, []time.Duration) {
+			states, known, fits = make([]State, len(links)), make([]knownState, len(links)), true
+			total := 0
+			for i, l := range links {
+				known[i] = knownState{state: stored[i], exists: exists[i]}
+				states[i] = l.bucket.current(l.lim, known[i])
+				fits = fits && exactly(l.cost).decide(states[i].SpaceRemaining) == l.cost
+				total += l.cost
+			}
+
+			// Nothing is written when nothing is taken, the leaked states stand in for what is stored
+			if !fits || total == 0 {
+				return nil, nil
+			}
+
+			writes := make([]State, len(links))
+			ttls := make([]time.Duration, len(links))
+			for i, l := range links {
+				states[i] = l.bucket.newState(l.lim, states[i].SpaceRemaining-float64(l.cost))
+				known[i] = knownState{state: states[i], exists: true}
+				writes[i], ttls[i] = l.lim.stored(states[i]), l.lim.ttl(states[i])
+			}
+			return writes, ttls
+		})
+	})
+
+	if err != nil {
+		return failTakeAll(ctx, links, keys, err)
+	}
+
+	for i, l := range links {
+		l.bucket.remember(l.lim, keys[i], known[i])
+	}
+
+	return states, fits
+}
+
+// failTakeAll decides the request by each bucket's failure policy, as the store couldn't be used
+func failTakeAll(ctx context.Context, links []link, keys []string, err error) ([]State, bool) {
+	states := make([]State, len(links))
+	fits := true
+
+	for i, l := range links {
+		l.bucket.storeFailed(ctx, l.bucket.logger.Error, "Taking from buckets together failed, resetting counters", l.keyID, err)
+		l.bucket.failOpens.Add(1)
+
+		taken, after := l.bucket.failTake(l.lim, keys[i], []Demand{exactly(l.cost)})
+		l.bucket.forget(keys[i])
+
+		states[i] = after[0]
+		fits = fits && taken[0] == l.cost
+	}
+
+	return states, fits
+}
+
+// takeInTurn takes from each bucket in turn for stores which aren't Transactors, giving the drops back to the
+// buckets before if one hasn't space. Requests racing each other may see drops which are later given back.
+func takeInTurn(ctx context.Context, links []link) ([]State, bool) {
+	states := make([]State, len(links))
+
+	for i, l := range links {
+		var taken int
+		taken, states[i] = l.bucket.takeKey(ctx, l.lim, l.keyID, exactly(l.cost), true)
+		if taken == l.cost {
+			continue
+		}
+
+		for j := 0; j < i; j++ {
+			prev := links[j]
+			if err := prev.bucket.refund(ctx, prev.lim, prev.keyID, prev.cost); err != nil {
+				prev.bucket.storeFailed(ctx, prev.bucket.logger.Warn, "Giving back drops failed", prev.keyID, err)
+			}
+			states[j].SpaceRemaining = math.Min(float64(prev.lim.size), states[j].SpaceRemaining+float64(prev.cost))
+		}
+
+		// The buckets after weren't asked, so only the one without space is reported
+		for j := i + 1; j < len(links); j++ {
+			states[j] = links[j].bucket.fullState(links[j].lim)
+		}
+		return states, false
+	}
+
+	return states, true
+}
+
+// logger is the logger of the chain's first bucket
+func (c *ChainedBucket) logger() Logger {
+	if len(c.buckets) == 0 {
+		return discardLogger{}
+	}
+
+	return c.buckets[0].logger
+}
+
+// rejection is the response of the chain's first bucket to requests the chain rejects
+func (c *ChainedBucket) rejection() Rejection {
+	if len(c.buckets) == 0 {
+		return Rejection{}
+	}
+
+	return c.buckets[0].rejection
+}
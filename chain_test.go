@@ -0,0 +1,63 @@
+package leaky
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestChain(t *testing.T) {
+	tj := prepareTestJig()
+	defer tj.Close()
+
+	memory := NewMemoryStore()
+	defer memory.Close()
+
+	// The buckets' keys are hash tagged by their own key IDs, so on a cluster they are in different slots
+	cluster := redis.NewClusterClient(&redis.ClusterOptions{Addrs: []string{miniredis.RunT(t).Addr()}})
+	defer cluster.Close()
+
+	managers := map[string]*ThrottleManager{
+		"redis":   tj.ThrottleManager,
+		"memory":  NewThrottleManagerWithStore(memory),
+		"cluster": NewThrottleManager(cluster),
+	}
+
+	for name, tm := range managers {
+		t.Run(name, func(t *testing.T) {
+			perUser := tm.ThrottlingHandler(nil, 2, 0, KeyByHeader("X-User"), "user")
+			global := tm.ThrottlingHandler(nil, 3, 0, func(r http.Request) string { return "" }, "global")
+			chain := tm.Chain(handleFuncSuccessResponse, "api", perUser, global)
+
+			serve := func(user string) *httptest.ResponseRecorder {
+				r := httptest.NewRequest("GET", "/", nil)
+				r.Header.Set("X-User", user)
+				w := httptest.NewRecorder()
+				chain.ServeHTTP(w, r)
+				return w
+			}
+
+			for i, want := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+				if w := serve("a"); w.Code != want {
+					t.Errorf("Request %d from a: status %v, expected %v", i, w.Code, want)
+				}
+			}
+
+			// a's rejection took nothing from the global bucket, so b fits once
+			if w := serve("b"); w.Code != http.StatusOK || w.Header().Get("X-RateLimit-Remaining") != "0" {
+				t.Errorf("First request from b: status %v, remaining %s", w.Code, w.Header().Get("X-RateLimit-Remaining"))
+			}
+			if w := serve("b"); w.Code != http.StatusTooManyRequests {
+				t.Errorf("Second request from b not rejected by the global bucket: %v", w.Code)
+			}
+
+			// and the global bucket's rejection took nothing from b's
+			if remaining, _ := perUser.Remaining(ctx, "b"); remaining != 1 {
+				t.Errorf("b's bucket has %d remaining, expected 1", remaining)
+			}
+		})
+	}
+}
@@ -0,0 +1,34 @@
+package leaky
+
+import "time"
+
+// Clock provides the time used for leak calculations, allowing it to be controlled in tests
+type Clock interface {
+	Now() time.Time
+	Since(t time.Time) time.Duration
+}
+
+type wallClock struct{}
+
+func (wallClock) Now() time.Time {
+	return time.Now()
+}
+
+func (wallClock) Since(t time.Time) time.Duration {
+	return time.Since(t)
+}
+
+// WithClock sets the clock used by the manager and its buckets, the default is the wall clock
+func WithClock(clock Clock) ManagerOption {
+	return func(m *ThrottleManager) {
+		m.clock = clock
+	}
+}
+
+// WithBucketClock sets the clock used by a single bucket instead of the manager's,
+// such as to simulate one bucket's clients without affecting the rest
+func WithBucketClock(clock Clock) Option {
+	return func(b *Bucket) {
+		b.clock = clock
+	}
+}
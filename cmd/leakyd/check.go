@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/2bytes/leaky"
+)
+
+// errUnknownBucket is returned for checks of buckets not in the config
+var errUnknownBucket = errors.New("unknown bucket")
+
+// checkRequest asks for cost drops to be added to the client's bucket, 1 if not set
+type checkRequest struct {
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+	Cost   int    `json:"cost"`
+}
+
+// checkResponse is whether the drops were added, and the client's bucket after. The waits are in
+// milliseconds, -1 if the bucket never leaks.
+type checkResponse struct {
+	Allowed      bool  `json:"allowed"`
+	Remaining    int   `json:"remaining"`
+	Limit        int   `json:"limit"`
+	RetryAfterMs int64 `json:"retry_after_ms"`
+	ResetAfterMs int64 `json:"reset_after_ms"`
+}
+
+// check decides a request by the manager's buckets
+func check(ctx context.Context, tm *leaky.ThrottleManager, req checkRequest) (checkResponse, error) {
+	b, ok := tm.Bucket(req.Bucket)
+	if !ok {
+		return checkResponse{}, errUnknownBucket
+	}
+
+	cost := req.Cost
+	if cost <= 0 {
+		cost = 1
+	}
+
+	d, ok := b.Decide(ctx, cost, req.Key)
+
+	return checkResponse{
+		Allowed:      ok,
+		Remaining:    d.Remaining,
+		Limit:        d.Limit,
+		RetryAfterMs: millis(d.RetryAfter),
+		ResetAfterMs: millis(d.ResetAfter),
+	}, nil
+}
+
+func millis(d time.Duration) int64 {
+	if d == leaky.InfDuration {
+		return -1
+	}
+
+	return d.Milliseconds()
+}
+
+// checkHandler serves POST /check, answering 200 whether or not the drops were allowed
+func checkHandler(tm *leaky.ThrottleManager) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req checkRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req); err != nil {
+			http.Error(w, "invalid check: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		resp, err := check(r.Context(), tm, req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	})
+}
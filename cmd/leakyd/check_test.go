@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/2bytes/leaky/leakytest"
+)
+
+func TestCheckHandler(t *testing.T) {
+	tm := leakytest.NewTestManager(t)
+	tm.ThrottlingHandler(nil, 3, 60, nil, "api")
+	handler := checkHandler(tm.ThrottleManager)
+
+	post := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("POST", "/check", strings.NewReader(body)))
+		return w
+	}
+
+	w := post(`{"bucket":"api","key":"alice","cost":2}`)
+	if body := strings.TrimSpace(w.Body.String()); body != `{"allowed":true,"remaining":1,"limit":3,"retry_after_ms":0,"reset_after_ms":2000}` {
+		t.Errorf("Unexpected response %v %s", w.Code, body)
+	}
+
+	w = post(`{"bucket":"api","key":"alice","cost":2}`)
+	if body := strings.TrimSpace(w.Body.String()); body != `{"allowed":false,"remaining":1,"limit":3,"retry_after_ms":0,"reset_after_ms":2000}` {
+		t.Errorf("Unexpected response %v %s", w.Code, body)
+	}
+
+	if w := post(`{"bucket":"missing","key":"alice"}`); w.Code != http.StatusNotFound {
+		t.Errorf("Status not NotFound for an unknown bucket: %v", w.Code)
+	}
+	if w := post(`{`); w.Code != http.StatusBadRequest {
+		t.Errorf("Status not BadRequest for an invalid check: %v", w.Code)
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "leakyd.json")
+	err := os.WriteFile(path, []byte(`{
+		"redis": {"addr": "redis:6379"},
+		"buckets": [{"name": "api", "size": 10, "rate": 1, "per": "1s"}]
+	}`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Listen != ":8080" || cfg.Redis.Addr != "redis:6379" {
+		t.Errorf("Unexpected config %+v", cfg)
+	}
+
+	tm := leakytest.NewTestManager(t)
+	if _, err := cfg.Register(tm.ThrottleManager); err != nil {
+		t.Fatal(err)
+	}
+
+	b, ok := tm.Bucket("api")
+	if !ok {
+		t.Fatal("Bucket not registered")
+	}
+	if accepted, _ := b.AddUpTo(20, "alice"); accepted != 10 {
+		t.Errorf("Bucket of size %d, expected 10", accepted)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/2bytes/leaky/leakyconfig"
+)
+
+// config is read from the JSON file given by -config
+type config struct {
+	// Listen is the address the HTTP check API listens on, GRPCListen the gRPC one, which is off if empty
+	Listen     string `json:"listen"`
+	GRPCListen string `json:"grpc_listen"`
+
+	Redis struct {
+		Addr     string `json:"addr"`
+		Password string `json:"password"`
+		DB       int    `json:"db"`
+	} `json:"redis"`
+
+	// The buckets are registered on the manager, found by their names when checked
+	leakyconfig.Config
+}
+
+func loadConfig(path string) (*config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	cfg := &config{Listen: ":8080"}
+	cfg.Redis.Addr = "localhost:6379"
+
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(cfg); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+
+	return cfg, nil
+}
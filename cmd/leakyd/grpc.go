@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+
+	"github.com/2bytes/leaky"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// checkService is the gRPC equivalent of POST /check, taking and returning the same fields as a
+// google.protobuf.Struct, so any gRPC client can call it without generated code of its own
+var checkService = grpc.ServiceDesc{
+	ServiceName: "leaky.v1.Checker",
+	HandlerType: (*interface{})(nil),
+	Methods: []grpc.MethodDesc{{
+		MethodName: "Check",
+		Handler:    handleCheck,
+	}},
+	Metadata: "leakyd",
+}
+
+func handleCheck(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := &structpb.Struct{}
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+
+	call := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return grpcCheck(ctx, srv.(*leaky.ThrottleManager), req.(*structpb.Struct))
+	}
+	if interceptor == nil {
+		return call(ctx, in)
+	}
+
+	return interceptor(ctx, in, &grpc.UnaryServerInfo{Server: srv, FullMethod: "/leaky.v1.Checker/Check"}, call)
+}
+
+func grpcCheck(ctx context.Context, tm *leaky.ThrottleManager, in *structpb.Struct) (*structpb.Struct, error) {
+	fields := in.GetFields()
+	req := checkRequest{
+		Bucket: fields["bucket"].GetStringValue(),
+		Key:    fields["key"].GetStringValue(),
+		Cost:   int(fields["cost"].GetNumberValue()),
+	}
+
+	resp, err := check(ctx, tm, req)
+	if err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+
+	return structpb.NewStruct(map[string]interface{}{
+		"allowed":        resp.Allowed,
+		"remaining":      resp.Remaining,
+		"limit":          resp.Limit,
+		"retry_after_ms": resp.RetryAfterMs,
+		"reset_after_ms": resp.ResetAfterMs,
+	})
+}
@@ -0,0 +1,79 @@
+// Command leakyd serves Redis-backed leaky buckets to services not written in Go, over a small HTTP API
+// and its gRPC equivalent, with the buckets defined in a config file. SIGHUP applies changes to their limits.
+//
+//	leakyd -config leakyd.json
+//	curl -d '{"bucket":"api","key":"alice","cost":1}' localhost:8080/check
+//	{"allowed":true,"remaining":9,"limit":10,"retry_after_ms":0,"reset_after_ms":1000}
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"net"
+	"net/http"
+
+	"github.com/2bytes/leaky"
+	"github.com/2bytes/leaky/leakyconfig"
+	"github.com/redis/go-redis/v9"
+	"google.golang.org/grpc"
+)
+
+func main() {
+	path := flag.String("config", "leakyd.json", "path to the JSON config file")
+	flag.Parse()
+
+	cfg, err := loadConfig(*path)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	rc := redis.NewClient(&redis.Options{
+		Addr:     cfg.Redis.Addr,
+		Password: cfg.Redis.Password,
+		DB:       cfg.Redis.DB,
+	})
+
+	tm := leaky.NewThrottleManager(rc)
+	if _, err := cfg.Register(tm); err != nil {
+		log.Fatal(err)
+	}
+
+	// SIGHUP applies changed limits to the buckets, and registers new ones
+	watcher := &leakyconfig.Watcher{
+		Path:    *path,
+		Manager: tm,
+		Load: func(path string) (*leakyconfig.Config, error) {
+			cfg, err := loadConfig(path)
+			if err != nil {
+				return nil, err
+			}
+			return &cfg.Config, nil
+		},
+		OnApply: func(err error) {
+			if err != nil {
+				log.Printf("Reloading config failed: %s\n", err)
+			}
+		},
+	}
+	go watcher.Run(context.Background())
+
+	if cfg.GRPCListen != "" {
+		lis, err := net.Listen("tcp", cfg.GRPCListen)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		srv := grpc.NewServer()
+		srv.RegisterService(&checkService, tm)
+		go func() {
+			log.Fatal(srv.Serve(lis))
+		}()
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/check", checkHandler(tm))
+
+	log.Printf("leakyd listening on %s\n", cfg.Listen)
+	log.Fatal(http.ListenAndServe(cfg.Listen, mux))
+}
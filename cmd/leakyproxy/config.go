@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/2bytes/leaky/leakyconfig"
+)
+
+// config is read from the JSON file given by -config
+type config struct {
+	Listen   string `json:"listen"`
+	Upstream string `json:"upstream"`
+
+	Redis struct {
+		Addr     string `json:"addr"`
+		Password string `json:"password"`
+		DB       int    `json:"db"`
+	} `json:"redis"`
+
+	Routes []routeConfig `json:"routes"`
+}
+
+// routeConfig limits requests to paths matching Path, as a ServeMux pattern, by the bucket it defines,
+// named for the path if it isn't given a name
+type routeConfig struct {
+	Path string `json:"path"`
+	leakyconfig.Bucket
+}
+
+func loadConfig(path string) (*config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	cfg := &config{Listen: ":8080"}
+	cfg.Redis.Addr = "localhost:6379"
+
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(cfg); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+
+	if cfg.Upstream == "" {
+		return nil, fmt.Errorf("reading %s: no upstream", path)
+	}
+
+	for i := range cfg.Routes {
+		r := &cfg.Routes[i]
+		if r.Path == "" {
+			return nil, fmt.Errorf("reading %s: routes need a path", path)
+		}
+		if r.Name == "" {
+			r.Name = r.Path
+		}
+		if err := r.Validate(); err != nil {
+			return nil, fmt.Errorf("reading %s: route %s: %w", path, r.Path, err)
+		}
+	}
+
+	return cfg, nil
+}
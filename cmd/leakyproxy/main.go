@@ -0,0 +1,38 @@
+// Command leakyproxy is a reverse proxy throttling requests to an upstream by the buckets of the routes
+// they match, for throttling without changes to the application behind it
+//
+//	leakyproxy -config leakyproxy.json
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+
+	"github.com/2bytes/leaky"
+	"github.com/redis/go-redis/v9"
+)
+
+func main() {
+	path := flag.String("config", "leakyproxy.json", "path to the JSON config file")
+	flag.Parse()
+
+	cfg, err := loadConfig(*path)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	rc := redis.NewClient(&redis.Options{
+		Addr:     cfg.Redis.Addr,
+		Password: cfg.Redis.Password,
+		DB:       cfg.Redis.DB,
+	})
+
+	handler, err := newProxy(cfg, leaky.NewThrottleManager(rc))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("leakyproxy listening on %s, proxying to %s\n", cfg.Listen, cfg.Upstream)
+	log.Fatal(http.ListenAndServe(cfg.Listen, handler))
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+
+	"github.com/2bytes/leaky"
+)
+
+// newProxy routes requests to the upstream, throttled by the bucket of the route they match.
+// Requests matching no route aren't throttled.
+func newProxy(cfg *config, tm *leaky.ThrottleManager) (http.Handler, error) {
+	upstream, err := url.Parse(cfg.Upstream)
+	if err != nil {
+		return nil, err
+	}
+
+	proxy := httputil.NewSingleHostReverseProxy(upstream)
+
+	mux := http.NewServeMux()
+	routed := map[string]bool{}
+	for _, r := range cfg.Routes {
+		if r.Name == "" {
+			r.Name = r.Path
+		}
+
+		bucket, err := r.Register(tm)
+		if err != nil {
+			return nil, fmt.Errorf("route %s: %w", r.Path, err)
+		}
+
+		mux.Handle(r.Path, bucket.Wrap(proxy))
+		routed[r.Path] = true
+	}
+
+	if !routed["/"] {
+		mux.Handle("/", proxy)
+	}
+
+	return mux, nil
+}
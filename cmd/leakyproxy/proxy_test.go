@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/2bytes/leaky/leakyconfig"
+	"github.com/2bytes/leaky/leakytest"
+)
+
+func TestProxy(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("upstream " + r.URL.Path))
+	}))
+	defer upstream.Close()
+
+	cfg := &config{
+		Upstream: upstream.URL,
+		Routes: []routeConfig{
+			{Path: "/api/", Bucket: leakyconfig.Bucket{Size: 1, Rate: 60, Key: "header:X-Api-Key"}},
+		},
+	}
+
+	tm := leakytest.NewTestManager(t)
+	handler, err := newProxy(cfg, tm.ThrottleManager)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(path string, apiKey string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("X-Api-Key", apiKey)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := get("/api/hats", "alice"); w.Code != http.StatusOK || w.Body.String() != "upstream /api/hats" {
+		t.Errorf("Unexpected response %v %q", w.Code, w.Body.String())
+	}
+	if w := get("/api/hats", "alice"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("Status not TooManyRequests: %v", w.Code)
+	}
+	if w := get("/api/hats", "bob"); w.Code != http.StatusOK {
+		t.Errorf("Another client's status not OK: %v", w.Code)
+	}
+
+	// Paths matching no route aren't throttled
+	for i := 0; i < 3; i++ {
+		if w := get("/health", "alice"); w.Code != http.StatusOK {
+			t.Errorf("Unrouted path's status not OK: %v", w.Code)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package leaky
+
+import (
+	"context"
+	"sync"
+)
+
+// WithCoalescing makes concurrent requests for the same key share a single read of its state,
+// with the drops they add applied in turn and written back once. Requests arriving while the
+// shared state is being written wait their turn, so a key is never read while a write to it
+// from this process is outstanding. A request whose context is done stops waiting and is decided by the
+// bucket's failure policy.
+func WithCoalescing() Option {
+	return func(b *Bucket) {
+		b.flights = &flights{open: make(map[string]*flight)}
+	}
+}
+
+type flights struct {
+	mu   sync.Mutex
+	open map[string]*flight
+}
+
+// flight is a group of requests sharing a read of a key's state
+type flight struct {
+	requests []*flightRequest
+	closed   bool
+	prev     *flight
+	done     chan struct{}
+}
+
+type flightRequest struct {
+	demand Demand
+	taken  int
+	after  State
+}
+
+// coalescedTake is take with the read and write shared by every request in the same flight,
+// under the limits and context of the request which started the flight
+func (b *Bucket) coalescedTake(ctx context.Context, lim limits, keyID string, demand Demand, guarded bool) (int, State) {
+	key := b.getKey(keyID)
+	req := &flightRequest{demand: demand}
+
+	b.flights.mu.Lock()
+	f, ok := b.flights.open[key]
+	if ok && !f.closed {
+		f.requests = append(f.requests, req)
+		b.flights.mu.Unlock()
+
+		select {
+		case <-f.done:
+			return req.taken, req.after
+		case <-ctx.Done():
+			return b.abandonFlight(ctx, lim, key, keyID, f, req)
+		}
+	}
+
+	// Start a new flight, following on from the one being written if there is one
+	f = &flight{requests: []*flightRequest{req}, prev: f, done: make(chan struct{})}
+	b.flights.open[key] = f
+	b.flights.mu.Unlock()
+
+	if f.prev != nil {
+		<-f.prev.done
+		f.prev = nil
+	}
+
+	if b.taker != nil {
+		// The store takes every request's drops in one call, so the flight is closed before making it
+		requests := b.closeFlight(f)
+
+		demands := make([]Demand, len(requests))
+		for i, r := range requests {
+			demands[i] = r.demand
+		}
+
+		taken, after := b.atomicTake(ctx, lim, keyID, demands, guarded)
+		for i, r := range requests {
+			r.taken, r.after = taken[i], after[i]
+		}
+
+		return b.land(key, f, req)
+	}
+
+	state, isNew := b.fetchState(ctx, lim, keyID)
+	requests := b.closeFlight(f)
+
+	if isNew && guarded && b.keysFull() {
+		for _, r := range requests {
+			r.taken, r.after = b.overflow(ctx, lim, r.demand)
+		}
+	} else {
+		total := 0
+		for _, r := range requests {
+			r.taken = r.demand.decide(state.SpaceRemaining)
+			state.SpaceRemaining -= float64(r.taken)
+			r.after = state
+			total += r.taken
+		}
+
+		if total > 0 {
+			b.putState(ctx, lim, state, keyID)
+			if isNew {
+				b.keyCreated()
+			}
+		}
+	}
+
+	return b.land(key, f, req)
+}
+
+// abandonFlight withdraws a request whose context is done from the flight it was waiting on, deciding it
+// by the failure policy as if its own call to the store had been cancelled. The request's drops may still
+// be taken if the flight had already closed.
+func (b *Bucket) abandonFlight(ctx context.Context, lim limits, key string, keyID string, f *flight, req *flightRequest) (int, State) {
+	b.flights.mu.Lock()
+	if !f.closed {
+		for i, r := range f.requests {
+			if r == req {
+				f.requests = append(f.requests[:i:i], f.requests[i+1:]...)
+				break
+			}
+		}
+	}
+	b.flights.mu.Unlock()
+
+	b.storeFailed(ctx, b.logger.Error, "Waiting for coalesced take abandoned, resetting counters", keyID, ctx.Err())
+	b.failOpens.Add(1)
+	taken, after := b.failTake(lim, key, []Demand{req.demand})
+	return taken[0], after[0]
+}
+
+// closeFlight stops requests joining a flight, returning those which have
+func (b *Bucket) closeFlight(f *flight) []*flightRequest {
+	b.flights.mu.Lock()
+	defer b.flights.mu.Unlock()
+
+	f.closed = true
+	return f.requests
+}
+
+// land finishes a flight, releasing the requests waiting on it and the flight following it
+func (b *Bucket) land(key string, f *flight, req *flightRequest) (int, State) {
+	b.flights.mu.Lock()
+	if b.flights.open[key] == f {
+		delete(b.flights.open, key)
+	}
+	b.flights.mu.Unlock()
+
+	close(f.done)
+	return req.taken, req.after
+}
@@ -0,0 +1,119 @@
+package leaky
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func addConcurrently(bucket *Bucket, goroutines int, perGoroutine int) int {
+	var admitted atomic.Int64
+	var wg sync.WaitGroup
+
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < perGoroutine; i++ {
+				if bucket.Add(1, "test-key") {
+					admitted.Add(1)
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+	return int(admitted.Load())
+}
+
+func TestCoalescingConcurrentCorrectness(t *testing.T) {
+	tj := prepareTestJig()
+	defer tj.Close()
+
+	bucket := tj.ThrottleManager.ThrottlingHandler(handleFuncSuccessResponse, 50, 0, keyFunc, "test", WithCoalescing())
+
+	if admitted := addConcurrently(bucket, 100, 1); admitted != 50 {
+		t.Errorf("Admitted %d drops into a bucket of 50", admitted)
+	}
+
+	if bucket.Add(1, "test-key") {
+		t.Error("Bucket overflow")
+	}
+
+	if n := len(bucket.flights.open); n != 0 {
+		t.Errorf("Flights left open: %d", n)
+	}
+}
+
+func TestCoalescingSharesReads(t *testing.T) {
+	tj := prepareTestJig()
+	defer tj.Close()
+
+	bucket := tj.ThrottleManager.ThrottlingHandler(handleFuncSuccessResponse, 1000, 0, keyFunc, "test", WithCoalescing())
+
+	addConcurrently(bucket, 100, 5)
+
+	// Without coalescing every drop makes at least one round trip
+	if rt := bucket.Stats().RoundTrips; rt >= 500 {
+		t.Errorf("No round trips were shared: %d for 500 drops", rt)
+	}
+}
+
+func TestCoalescingWaiterCancelled(t *testing.T) {
+	tj := prepareTestJig()
+	defer tj.Close()
+
+	bucket := tj.ThrottleManager.ThrottlingHandler(handleFuncSuccessResponse, 10, 0, keyFunc, "test", WithCoalescing(), WithFailurePolicy(FailClosed))
+
+	// A flight which never lands, as if its store call were stuck
+	stuck := &flight{done: make(chan struct{})}
+	bucket.flights.open[testKey] = stuck
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	admitted := make(chan bool)
+	go func() {
+		admitted <- bucket.AddContext(ctx, 1, "test-key")
+	}()
+
+	select {
+	case ok := <-admitted:
+		if ok {
+			t.Error("Abandoned request admitted failing closed")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Request still waiting on the flight after its context was done")
+	}
+
+	if n := len(stuck.requests); n != 0 {
+		t.Errorf("%d requests left waiting on the flight", n)
+	}
+	if fo := bucket.Stats().FailOpens; fo != 1 {
+		t.Errorf("%d decisions counted without the store, expected 1", fo)
+	}
+}
+
+func benchmarkHotKey(b *testing.B, opts ...Option) {
+	tj := prepareTestJig()
+	defer tj.Close()
+
+	bucket := tj.ThrottleManager.ThrottlingHandler(handleFuncSuccessResponse, 1<<30, 0, keyFunc, "bench", opts...)
+	start := tj.miniRedis.CommandCount()
+
+	b.ResetTimer()
+	addConcurrently(bucket, 100, b.N/100+1)
+
+	b.ReportMetric(float64(tj.miniRedis.CommandCount()-start)/float64(b.N), "commands/op")
+	b.ReportMetric(float64(bucket.Stats().RoundTrips)/float64(b.N), "roundtrips/op")
+}
+
+func BenchmarkHotKey(b *testing.B) {
+	benchmarkHotKey(b)
+}
+
+func BenchmarkHotKeyCoalescing(b *testing.B) {
+	benchmarkHotKey(b, WithCoalescing())
+}
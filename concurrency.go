@@ -0,0 +1,346 @@
+package leaky
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// defaultSlotTTL is how long a slot is held for if it isn't released, such as when an instance crashes
+const defaultSlotTTL = time.Minute
+
+// ConcurrencyBucket limits the number of requests each client can have in flight at once,
+// a slot is taken as a request starts and given back when it completes rather than leaking over time
+type ConcurrencyBucket struct {
+	limit      int
+	slotTTL    time.Duration
+	bucketName string
+	handler    Handler
+	keyFunc    KeyFunc
+	rejection  Rejection
+
+	failure  FailurePolicy
+	replicas int
+	mu       sync.Mutex
+	// local counts the slots held on this instance for FailLocal, by key
+	local map[string]int
+
+	storeClient
+}
+
+// ConcurrencyOption configures a ConcurrencyBucket
+type ConcurrencyOption func(*ConcurrencyBucket)
+
+// WithSlotTTL sets how long a slot is held for if it's never released, the default is a minute.
+// Requests running for longer than this lose their slot, so it should be longer than the slowest request.
+func WithSlotTTL(ttl time.Duration) ConcurrencyOption {
+	return func(c *ConcurrencyBucket) {
+		c.slotTTL = ttl
+	}
+}
+
+// WithSlotFailurePolicy sets how requests are decided while the store can't be used, the default is FailOpen.
+// FailLocal limits the slots held on each instance, divided between them if the manager has WithReplicas.
+// A ConcurrencyBucket stacked on a Bucket by WithConcurrencyLimit applies the Bucket's policy instead.
+func WithSlotFailurePolicy(policy FailurePolicy) ConcurrencyOption {
+	return func(c *ConcurrencyBucket) {
+		c.failure = policy
+	}
+}
+
+// ConcurrencyHandler creates a new handler wrapper allowing each client limit requests in flight at once
+func (m *ThrottleManager) ConcurrencyHandler(handler Handler, limit int, keyFunc KeyFunc, bucketName string, opts ...ConcurrencyOption) *ConcurrencyBucket {
+	c := &ConcurrencyBucket{
+		limit:       limit,
+		slotTTL:     defaultSlotTTL,
+		bucketName:  bucketName,
+		handler:     handler,
+		keyFunc:     keyFunc,
+		replicas:    m.replicas,
+		local:       make(map[string]int),
+		storeClient: m.storeClient(bucketName),
+	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	return c
+}
+
+func (c *ConcurrencyBucket) getKey(keyID string) string {
+	return c.key(c.bucketName, keyID)
+}
+
+// Stats returns a snapshot of the bucket's counters
+func (c *ConcurrencyBucket) Stats() Stats {
+	return c.stats()
+}
+
+// Acquire takes a slot for the client if one is free, the returned release func gives it back
+// and is safe to call more than once
+func (c *ConcurrencyBucket) Acquire(keyID string) (release func(), ok bool) {
+	return c.AcquireContext(context.Background(), keyID)
+}
+
+// AcquireContext is Acquire, taking the slot with ctx. The slot is given back without it,
+// as the request it was taken for may have been cancelled by then.
+func (c *ConcurrencyBucket) AcquireContext(ctx context.Context, keyID string) (release func(), ok bool) {
+	return c.acquire(ctx, keyID, c.failure)
+}
+
+// acquire is AcquireContext, deciding by the failure policy if the store can't be used
+func (c *ConcurrencyBucket) acquire(ctx context.Context, keyID string, failure FailurePolicy) (release func(), ok bool) {
+	ctx, decided := c.observe(ctx, keyID)
+	key := c.getKey(keyID)
+	id := newSlotID()
+
+	err := c.updateSlots(ctx, key, func(slots map[string]time.Time) bool {
+		if ok = len(slots) < c.limit; ok {
+			slots[id] = c.clock.Now().Add(c.slotTTL)
+		}
+		return ok
+	})
+	if err != nil {
+		c.logFailure(c.logger.Error, "Taking concurrency slot failed, deciding by the failure policy", key, err)
+		c.failOpens.Add(1)
+		release, ok = c.failAcquire(key, failure)
+		decided(ok)
+		return release, ok
+	}
+
+	decided(ok)
+	if !ok {
+		return nil, false
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			c.release(key, id)
+		})
+	}, true
+}
+
+// failAcquire decides a request by the failure policy, as its slot couldn't be taken from the store
+func (c *ConcurrencyBucket) failAcquire(key string, failure FailurePolicy) (release func(), ok bool) {
+	switch failure {
+	case FailClosed:
+		return nil, false
+	case FailLocal:
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		if c.local[key] >= c.localLimit() {
+			return nil, false
+		}
+		c.local[key]++
+
+		var once sync.Once
+		return func() {
+			once.Do(func() {
+				c.mu.Lock()
+				defer c.mu.Unlock()
+
+				if c.local[key]--; c.local[key] <= 0 {
+					delete(c.local, key)
+				}
+			})
+		}, true
+	}
+
+	return func() {}, true
+}
+
+// localLimit is the number of slots each instance allows a client while failing locally, its share of
+// the limit if the manager knows how many replicas share it
+func (c *ConcurrencyBucket) localLimit() int {
+	if c.replicas <= 1 {
+		return c.limit
+	}
+
+	return (c.limit + c.replicas - 1) / c.replicas
+}
+
+func (c *ConcurrencyBucket) release(key string, id string) {
+	err := c.updateSlots(context.Background(), key, func(slots map[string]time.Time) bool {
+		if _, ok := slots[id]; !ok {
+			return false
+		}
+		delete(slots, id)
+		return true
+	})
+	if err != nil {
+		c.logFailure(c.logger.Warn, "Giving back concurrency slot failed, slot will expire", key, err)
+	}
+}
+
+// updateSlots calls update with the unexpired slots held for a key, storing them if it returns true. If the
+// store is a Transactor no other write can land in between, so requests racing each other can't both take the
+// last slot. Otherwise the slots are read then written back, and racing requests may exceed the limit.
+func (c *ConcurrencyBucket) updateSlots(ctx context.Context, key string, update func(slots map[string]time.Time) bool) error {
+	tx, ok := c.store.(Transactor)
+	if !ok {
+		state, err := c.readSlots(ctx, key)
+		if err != nil || !update(state.Slots) {
+			return err
+		}
+		return c.writeSlots(ctx, key, state)
+	}
+
+	return c.roundTrip(ctx, func() error {
+		return tx.Transact(ctx, []string{key}, func(states []State, _ []bool) ([]State, []time.Duration) {
+			state := states[0]
+			state.Slots = c.unexpired(state.Slots)
+			if !update(state.Slots) {
+				return nil, nil
+			}
+
+			state, ttl := c.stored(state)
+			return []State{state}, []time.Duration{ttl}
+		})
+	})
+}
+
+// readSlots returns the slots held for a key, without any that have expired
+func (c *ConcurrencyBucket) readSlots(ctx context.Context, key string) (State, error) {
+	var state State
+
+	err := c.roundTrip(ctx, func() error {
+		var err error
+		state, _, err = c.store.Get(ctx, key)
+		return err
+	})
+	if err != nil {
+		return state, err
+	}
+
+	state.Slots = c.unexpired(state.Slots)
+	return state, nil
+}
+
+// writeSlots stores the slots held for a key
+func (c *ConcurrencyBucket) writeSlots(ctx context.Context, key string, state State) error {
+	state, ttl := c.stored(state)
+	return c.roundTrip(ctx, func() error {
+		return c.store.Set(ctx, key, state, ttl)
+	})
+}
+
+// unexpired returns the slots which haven't expired, with room for another
+func (c *ConcurrencyBucket) unexpired(held map[string]time.Time) map[string]time.Time {
+	now := c.clock.Now()
+	slots := make(map[string]time.Time, len(held)+1)
+	for id, expires := range held {
+		if now.Before(expires) {
+			slots[id] = expires
+		}
+	}
+
+	return slots
+}
+
+// stored returns the state of slots to store, and the TTL keeping it until the last of them expires
+func (c *ConcurrencyBucket) stored(state State) (State, time.Duration) {
+	now := c.clock.Now()
+	ttl := time.Millisecond
+	for _, expires := range state.Slots {
+		if d := expires.Sub(now); d > ttl {
+			ttl = d
+		}
+	}
+
+	state.LastUpdate = now
+	return state, ttl
+}
+
+// WithConcurrencyLimit stacks a ConcurrencyBucket on a Bucket, so requests it admits are also limited to the
+// concurrency bucket's slots for the same client in the same middleware. The concurrency bucket's handler and
+// KeyFunc aren't used, and the Bucket's failure policy applies in place of its own. Requests rejected for lack
+// of a slot have already counted against the bucket's rate.
+func WithConcurrencyLimit(c *ConcurrencyBucket) Option {
+	return func(b *Bucket) {
+		b.concurrency = c
+	}
+}
+
+// ServeHTTP implements http.Handler
+func (c *ConcurrencyBucket) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.serve(w, r, c.keyFunc(*r), c.handler, c.rejection, c.failure)
+}
+
+// serve passes the request to handler holding one of the client's slots until it completes,
+// or rejects it with rejection if none are free, deciding by failure if the store can't be used
+func (c *ConcurrencyBucket) serve(w http.ResponseWriter, r *http.Request, keyID string, handler Handler, rejection Rejection, failure FailurePolicy) {
+	release, ok := c.acquire(r.Context(), keyID, failure)
+	if !ok {
+		rejection.write(w, r, c.logger, c.bucketName, 0)
+		return
+	}
+
+	sw := &slotWriter{ResponseWriter: w, release: release}
+	defer func() {
+		if !sw.hijacked {
+			release()
+		}
+	}()
+
+	handler(sw, r)
+}
+
+func newSlotID() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		panic(err)
+	}
+
+	return hex.EncodeToString(id)
+}
+
+// slotWriter holds on to a request's slot when its connection is hijacked,
+// giving it back when the connection is closed instead of when the handler returns
+type slotWriter struct {
+	http.ResponseWriter
+	release  func()
+	hijacked bool
+}
+
+func (w *slotWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return conn, rw, err
+	}
+
+	w.hijacked = true
+	return &slotConn{Conn: conn, release: w.release}, rw, nil
+}
+
+func (w *slotWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *slotWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+type slotConn struct {
+	net.Conn
+	release func()
+}
+
+func (c *slotConn) Close() error {
+	defer c.release()
+	return c.Conn.Close()
+}
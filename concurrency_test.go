@@ -0,0 +1,312 @@
+package leaky_test
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/2bytes/leaky"
+	"github.com/2bytes/leaky/leakytest"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestConcurrencyLimit(t *testing.T) {
+	tm := leakytest.NewTestManager(t)
+
+	entered := make(chan struct{})
+	finish := make(chan struct{})
+	handler := tm.ConcurrencyHandler(func(w http.ResponseWriter, r *http.Request) {
+		entered <- struct{}{}
+		<-finish
+	}, 3, keyFunc, "reports")
+
+	req, _ := http.NewRequest("GET", "", nil)
+
+	var wg sync.WaitGroup
+	completed := make(chan struct{}, 3)
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+			completed <- struct{}{}
+		}()
+		<-entered
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("Status not TooManyRequests with every slot held: %v\n", w.Code)
+	}
+
+	// Let one of the slow requests complete
+	finish <- struct{}{}
+	<-completed
+
+	go handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	select {
+	case <-entered:
+	case <-time.After(time.Second):
+		t.Error("Request not admitted after a slot was released")
+	}
+
+	close(finish)
+	wg.Wait()
+}
+
+func TestConcurrencySlotTTL(t *testing.T) {
+	tm := leakytest.NewTestManager(t)
+	handler := tm.ConcurrencyHandler(handleFuncSuccessResponse, 1, keyFunc, "reports", leaky.WithSlotTTL(time.Minute))
+
+	// A slot which is never released, as if the instance holding it crashed
+	if _, ok := handler.Acquire("test-key"); !ok {
+		t.Fatal("Slot not acquired")
+	}
+
+	if _, ok := handler.Acquire("test-key"); ok {
+		t.Error("Slot acquired past the limit")
+	}
+
+	tm.Clock.Advance(time.Minute)
+
+	if _, ok := handler.Acquire("test-key"); !ok {
+		t.Error("Slot not freed by its TTL")
+	}
+}
+
+func TestConcurrencyReleaseIdempotent(t *testing.T) {
+	tm := leakytest.NewTestManager(t)
+	handler := tm.ConcurrencyHandler(handleFuncSuccessResponse, 2, keyFunc, "reports")
+
+	first, _ := handler.Acquire("test-key")
+	handler.Acquire("test-key")
+
+	first()
+	first()
+
+	if _, ok := handler.Acquire("test-key"); !ok {
+		t.Error("Released slot not available")
+	}
+
+	if _, ok := handler.Acquire("test-key"); ok {
+		t.Error("Releasing twice freed two slots")
+	}
+}
+
+// hijackRecorder is a ResponseRecorder whose connection can be hijacked
+type hijackRecorder struct {
+	*httptest.ResponseRecorder
+	conn net.Conn
+}
+
+func (h *hijackRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return h.conn, bufio.NewReadWriter(bufio.NewReader(h.conn), bufio.NewWriter(h.conn)), nil
+}
+
+func TestConcurrencyHijackedConnection(t *testing.T) {
+	tm := leakytest.NewTestManager(t)
+
+	conns := make(chan net.Conn, 1)
+	handler := tm.ConcurrencyHandler(func(w http.ResponseWriter, r *http.Request) {
+		// Only the first request is made with a connection which can be hijacked
+		if conn, _, err := w.(http.Hijacker).Hijack(); err == nil {
+			conns <- conn
+		}
+	}, 1, keyFunc, "sockets")
+
+	req, _ := http.NewRequest("GET", "", nil)
+	server, client := net.Pipe()
+	defer client.Close()
+
+	handler.ServeHTTP(&hijackRecorder{ResponseRecorder: httptest.NewRecorder(), conn: server}, req)
+
+	// The handler has returned but the hijacked connection still holds the slot
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("Status not TooManyRequests with the connection open: %v\n", w.Code)
+	}
+
+	conn := <-conns
+	conn.Close()
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("Status not OK after the connection closed: %v\n", w.Code)
+	}
+}
+
+func TestConcurrencyStackedOnBucket(t *testing.T) {
+	tm := leakytest.NewTestManager(t)
+
+	entered := make(chan struct{})
+	finish := make(chan struct{})
+	inFlight := tm.ConcurrencyHandler(nil, 1, nil, "search-inflight")
+	handler := tm.ThrottlingHandler(func(w http.ResponseWriter, r *http.Request) {
+		entered <- struct{}{}
+		<-finish
+	}, 3, 60, keyFunc, "search", leaky.WithConcurrencyLimit(inFlight))
+
+	req, _ := http.NewRequest("GET", "", nil)
+
+	done := make(chan struct{})
+	go func() {
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+		close(done)
+	}()
+	<-entered
+
+	// The bucket has space, but the client's only slot is held
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("Status not TooManyRequests with the slot held: %v\n", w.Code)
+	}
+
+	finish <- struct{}{}
+	<-done
+
+	// The slot is free, and the bucket has space for one more
+	go handler.ServeHTTP(httptest.NewRecorder(), req)
+	select {
+	case <-entered:
+		finish <- struct{}{}
+	case <-time.After(time.Second):
+		t.Fatal("Request not admitted after the slot was released")
+	}
+
+	// Now the bucket is full, though the slot is free
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("Status not TooManyRequests with the bucket full: %v\n", w.Code)
+	}
+}
+
+func TestConcurrencyFailurePolicies(t *testing.T) {
+	tm := leakytest.NewTestManager(t, leaky.WithReplicas(2))
+	tm.Store.FailAll(errors.New("store down"))
+
+	open := tm.ConcurrencyHandler(nil, 4, keyFunc, "open")
+	closed := tm.ConcurrencyHandler(nil, 4, keyFunc, "closed", leaky.WithSlotFailurePolicy(leaky.FailClosed))
+	local := tm.ConcurrencyHandler(nil, 4, keyFunc, "local", leaky.WithSlotFailurePolicy(leaky.FailLocal))
+
+	var releases []func()
+	for i := 0; i < 3; i++ {
+		if _, ok := open.Acquire("test-key"); !ok {
+			t.Errorf("Failing open rejected acquire %d", i)
+		}
+		if _, ok := closed.Acquire("test-key"); ok {
+			t.Errorf("Failing closed admitted acquire %d", i)
+		}
+		// The instance holds its share of the limit between 2 replicas
+		release, ok := local.Acquire("test-key")
+		if ok != (i < 2) {
+			t.Errorf("Failing locally admitted acquire %d %t", i, ok)
+		}
+		if ok {
+			releases = append(releases, release)
+		}
+	}
+
+	releases[0]()
+	releases[0]()
+	if _, ok := local.Acquire("test-key"); !ok {
+		t.Error("Failing locally didn't free the released slot")
+	}
+	if _, ok := local.Acquire("test-key"); ok {
+		t.Error("Failing locally freed a slot for each release")
+	}
+
+	if fo := closed.Stats().FailOpens; fo != 3 {
+		t.Errorf("%d decisions counted without the store, expected 3", fo)
+	}
+}
+
+func TestConcurrencyStackedFailurePolicy(t *testing.T) {
+	tm := leakytest.NewTestManager(t)
+
+	entered := make(chan struct{})
+	finish := make(chan struct{})
+	inFlight := tm.ConcurrencyHandler(nil, 1, nil, "search-inflight")
+	handler := tm.ThrottlingHandler(func(w http.ResponseWriter, r *http.Request) {
+		entered <- struct{}{}
+		<-finish
+	}, 3, 60, keyFunc, "search", leaky.WithConcurrencyLimit(inFlight), leaky.WithFailurePolicy(leaky.FailLocal))
+
+	tm.Store.FailAll(errors.New("store down"))
+	req, _ := http.NewRequest("GET", "", nil)
+
+	done := make(chan struct{})
+	go func() {
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+		close(done)
+	}()
+	<-entered
+
+	// The bucket has space locally, and the slot is held locally by the bucket's policy
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("Status not TooManyRequests with the slot held locally: %v\n", w.Code)
+	}
+
+	finish <- struct{}{}
+	<-done
+}
+
+func TestConcurrencyRacingAcquires(t *testing.T) {
+	mr := miniredis.RunT(t)
+	memory := leaky.NewMemoryStore()
+	defer memory.Close()
+
+	managers := map[string]*leaky.ThrottleManager{
+		"redis":  leaky.NewThrottleManager(redis.NewClient(&redis.Options{Addr: mr.Addr()})),
+		"memory": leaky.NewThrottleManagerWithStore(memory),
+		"fake":   leakytest.NewTestManager(t).ThrottleManager,
+	}
+
+	for name, tm := range managers {
+		t.Run(name, func(t *testing.T) {
+			c := tm.ConcurrencyHandler(nil, 3, keyFunc, "reports")
+
+			var wg sync.WaitGroup
+			var mu sync.Mutex
+			acquired := 0
+			start := make(chan struct{})
+			for i := 0; i < 20; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					<-start
+					if _, ok := c.Acquire("test-key"); ok {
+						mu.Lock()
+						acquired++
+						mu.Unlock()
+					}
+				}()
+			}
+			close(start)
+			wg.Wait()
+
+			if acquired != 3 {
+				t.Errorf("%d slots acquired by racing requests, expected 3", acquired)
+			}
+			if fails := c.Stats().FailOpens; fails > 0 {
+				t.Errorf("%d acquires failed open", fails)
+			}
+		})
+	}
+}
@@ -0,0 +1,101 @@
+// Package connectadapter throttles connect-go services with leaky buckets, keyed by the same KeyFuncs
+// as HTTP endpoints
+//
+//	interceptor := connectadapter.NewInterceptor(tm.ThrottlingHandler(nil, 10, 60, leaky.KeyByIP, "rpc"))
+//	path, handler := greetv1connect.NewGreetServiceHandler(greeter, connect.WithInterceptors(interceptor))
+package connectadapter
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+
+	"connectrpc.com/connect"
+	"github.com/2bytes/leaky"
+)
+
+// errExhausted is the message of the errors for calls the bucket rejects
+var errExhausted = errors.New("rate limit exceeded")
+
+// Interceptor limits the calls handled, and the streams opened, to the bucket's limits
+type Interceptor struct {
+	bucket *leaky.Bucket
+}
+
+var _ connect.Interceptor = (*Interceptor)(nil)
+
+// NewInterceptor creates an interceptor throttling calls with the bucket. Its KeyFunc is given a request
+// made up of the call's HTTP method, headers and peer address, with the procedure as its path, so KeyFuncs
+// such as KeyByHeader and KeyByIP work as they do for HTTP endpoints. Calls rejected fail with
+// CodeResourceExhausted, and every call has the bucket's rate limit headers.
+func NewInterceptor(b *leaky.Bucket) *Interceptor {
+	return &Interceptor{bucket: b}
+}
+
+// WrapUnary implements connect.Interceptor
+func (i *Interceptor) WrapUnary(next connect.UnaryFunc) connect.UnaryFunc {
+	return func(ctx context.Context, req connect.AnyRequest) (connect.AnyResponse, error) {
+		if req.Spec().IsClient {
+			return next(ctx, req)
+		}
+
+		h := http.Header{}
+		d, ok := i.bucket.Admit(h, httpRequest(ctx, req.HTTPMethod(), req.Header(), req.Peer(), req.Spec()))
+		if !ok {
+			return nil, exhausted(h)
+		}
+
+		resp, err := next(leaky.ContextWithDecision(ctx, d), req)
+		if resp != nil {
+			copyHeader(resp.Header(), h)
+		}
+		return resp, err
+	}
+}
+
+// WrapStreamingClient implements connect.Interceptor, client streams aren't limited
+func (i *Interceptor) WrapStreamingClient(next connect.StreamingClientFunc) connect.StreamingClientFunc {
+	return next
+}
+
+// WrapStreamingHandler implements connect.Interceptor, limiting the streams opened
+func (i *Interceptor) WrapStreamingHandler(next connect.StreamingHandlerFunc) connect.StreamingHandlerFunc {
+	return func(ctx context.Context, conn connect.StreamingHandlerConn) error {
+		h := http.Header{}
+		d, ok := i.bucket.Admit(h, httpRequest(ctx, http.MethodPost, conn.RequestHeader(), conn.Peer(), conn.Spec()))
+		if !ok {
+			return exhausted(h)
+		}
+
+		copyHeader(conn.ResponseHeader(), h)
+		return next(leaky.ContextWithDecision(ctx, d), conn)
+	}
+}
+
+// httpRequest makes up the request the bucket's KeyFunc is given for a call
+func httpRequest(ctx context.Context, method string, header http.Header, p connect.Peer, spec connect.Spec) *http.Request {
+	r := &http.Request{
+		Method:     method,
+		URL:        &url.URL{Path: spec.Procedure},
+		Header:     header,
+		RemoteAddr: p.Addr,
+	}
+
+	return r.WithContext(ctx)
+}
+
+// exhausted is the error for a call the bucket rejected, with the rate limit headers and Retry-After
+func exhausted(h http.Header) error {
+	err := connect.NewError(connect.CodeResourceExhausted, errExhausted)
+	copyHeader(err.Meta(), h)
+	return err
+}
+
+func copyHeader(dst http.Header, src http.Header) {
+	for name, values := range src {
+		for _, v := range values {
+			dst.Add(name, v)
+		}
+	}
+}
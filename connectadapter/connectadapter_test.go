@@ -0,0 +1,53 @@
+package connectadapter
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"connectrpc.com/connect"
+	"github.com/2bytes/leaky"
+	"github.com/2bytes/leaky/leakytest"
+)
+
+type ping struct{}
+
+func TestWrapUnary(t *testing.T) {
+	tm := leakytest.NewTestManager(t)
+	interceptor := NewInterceptor(tm.ThrottlingHandler(nil, 1, 60, leaky.KeyByHeader("X-Client"), "rpc"))
+
+	call := interceptor.WrapUnary(func(ctx context.Context, req connect.AnyRequest) (connect.AnyResponse, error) {
+		if _, ok := leaky.DecisionFromContext(ctx); !ok {
+			t.Error("Decision not passed to the handler")
+		}
+		return connect.NewResponse(&ping{}), nil
+	})
+
+	req := func(client string) connect.AnyRequest {
+		r := connect.NewRequest(&ping{})
+		r.Header().Set("X-Client", client)
+		return r
+	}
+
+	resp, err := call(context.Background(), req("alice"))
+	if err != nil {
+		t.Fatalf("Call rejected: %s", err)
+	}
+	if resp.Header().Get("X-RateLimit-Remaining") != "0" {
+		t.Errorf("Rate limit headers not set: %v", resp.Header())
+	}
+
+	_, err = call(context.Background(), req("alice"))
+	var connectErr *connect.Error
+	if !errors.As(err, &connectErr) || connectErr.Code() != connect.CodeResourceExhausted {
+		t.Fatalf("Call over the limit not rejected: %v", err)
+	}
+	if connectErr.Meta().Get("Retry-After") != "1" {
+		t.Errorf("Retry-After not set: %v", connectErr.Meta())
+	}
+
+	// Clients are keyed as for HTTP endpoints
+	if _, err := call(context.Background(), req("bob")); err != nil {
+		t.Errorf("Another client's call rejected: %s", err)
+	}
+}
@@ -0,0 +1,68 @@
+package leaky
+
+import (
+	"math"
+	"net/http"
+)
+
+// CostFunc returns the number of drops a request takes from its client's bucket, such as more for
+// expensive endpoints like searches and exports than cheap ones
+type CostFunc func(r *http.Request) int
+
+// WithCostFunc has each request take the drops fn returns for it, in place of one. A request costing more
+// than the bucket holds is always rejected, and one costing nothing is always admitted.
+func WithCostFunc(fn CostFunc) Option {
+	return func(b *Bucket) {
+		b.costFunc = fn
+	}
+}
+
+// cost returns the drops the request takes, one unless the bucket has a CostFunc
+func (b *Bucket) cost(r *http.Request) int {
+	if b.costFunc == nil {
+		return 1
+	}
+
+	if cost := b.costFunc(r); cost > 0 {
+		return cost
+	}
+
+	return 0
+}
+
+// capCost limits a cost to one more than the bucket holds, which can't fit any more than a greater cost could,
+// so the cost plus the space kept for higher priorities can't overflow
+func capCost(cost int, lim limits) int {
+	if cost > lim.size {
+		return lim.size + 1
+	}
+
+	return cost
+}
+
+// CostByBytes is a CostFunc charging a drop for every bytesPerDrop bytes of the request body, rounded up,
+// so a bucket can limit the volume of data uploaded rather than the number of requests. Its size and rate
+// are then in units of bytesPerDrop, with 1 measuring them in bytes. Requests without a body cost nothing,
+// and those whose length isn't known before they are read, such as chunked uploads, cost more than any
+// bucket holds so are always rejected.
+func CostByBytes(bytesPerDrop int64) CostFunc {
+	if bytesPerDrop <= 0 {
+		bytesPerDrop = 1
+	}
+
+	return func(r *http.Request) int {
+		if r.ContentLength < 0 {
+			return math.MaxInt
+		}
+
+		drops := r.ContentLength / bytesPerDrop
+		if r.ContentLength%bytesPerDrop != 0 {
+			drops++
+		}
+		if drops > math.MaxInt32 {
+			return math.MaxInt
+		}
+
+		return int(drops)
+	}
+}
@@ -0,0 +1,127 @@
+package leaky_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/2bytes/leaky"
+	"github.com/2bytes/leaky/leakytest"
+)
+
+func TestCostFunc(t *testing.T) {
+	tm := leakytest.NewTestManager(t)
+	bucket := tm.ThrottlingHandler(handleFuncSuccessResponse, 10, 60, keyFunc, "test",
+		leaky.WithCostFunc(func(r *http.Request) int {
+			switch {
+			case strings.HasPrefix(r.URL.Path, "/export"):
+				return 6
+			case r.URL.Path == "/healthz":
+				return 0
+			}
+			return 1
+		}))
+
+	serve := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		bucket.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w
+	}
+
+	if w := serve("/export"); w.Code != http.StatusOK || w.Header().Get("X-RateLimit-Remaining") != "4" {
+		t.Errorf("Export: status %v, remaining %s", w.Code, w.Header().Get("X-RateLimit-Remaining"))
+	}
+
+	// Two drops leak in the two seconds until six fit
+	w := serve("/export")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "2" {
+		t.Errorf("Second export: status %v, Retry-After %s", w.Code, w.Header().Get("Retry-After"))
+	}
+
+	for i := 0; i < 4; i++ {
+		if w := serve("/search"); w.Code != http.StatusOK {
+			t.Errorf("Search %d: status %v", i, w.Code)
+		}
+	}
+	if w := serve("/healthz"); w.Code != http.StatusOK {
+		t.Errorf("Free request: status %v", w.Code)
+	}
+	if w := serve("/search"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("Search over the limit: status %v", w.Code)
+	}
+}
+
+func TestCostByBytes(t *testing.T) {
+	tm := leakytest.NewTestManager(t)
+	bucket := tm.ThrottlingHandler(handleFuncSuccessResponse, 100, 60, keyFunc, "uploads",
+		leaky.WithCostFunc(leaky.CostByBytes(1024)))
+
+	upload := func(body string, contentLength int64) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/upload", strings.NewReader(body))
+		req.ContentLength = contentLength
+
+		w := httptest.NewRecorder()
+		bucket.ServeHTTP(w, req)
+		return w
+	}
+
+	body := strings.Repeat("x", 50*1024+1)
+	if w := upload(body, int64(len(body))); w.Code != http.StatusOK || w.Header().Get("X-RateLimit-Remaining") != "49" {
+		t.Errorf("Upload: status %v, remaining %s", w.Code, w.Header().Get("X-RateLimit-Remaining"))
+	}
+	if w := upload(body, int64(len(body))); w.Code != http.StatusTooManyRequests {
+		t.Errorf("Upload over the limit: status %v", w.Code)
+	}
+
+	if w := upload("", 0); w.Code != http.StatusOK {
+		t.Errorf("Empty request: status %v", w.Code)
+	}
+	if w := upload("x", -1); w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "" {
+		t.Errorf("Upload of unknown length: status %v, Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+}
+
+func TestCostByBytesUnknownLength(t *testing.T) {
+	upload := func(bucket *leaky.Bucket) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/upload", strings.NewReader("x"))
+		req.ContentLength = -1
+
+		w := httptest.NewRecorder()
+		bucket.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("priority", func(t *testing.T) {
+		tm := leakytest.NewTestManager(t)
+
+		var denied leaky.Decision
+		normal := func(r *http.Request) leaky.Priority { return leaky.Normal }
+		bucket := tm.ThrottlingHandler(handleFuncSuccessResponse, 100, 60, keyFunc, "uploads",
+			leaky.WithCostFunc(leaky.CostByBytes(1)), leaky.WithPriority(normal, 10),
+			leaky.OnDeny(func(ctx context.Context, d leaky.Decision, cost int) { denied = d }))
+
+		if w := upload(bucket); w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "" {
+			t.Errorf("Upload of unknown length: status %v, Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+		}
+		if denied.RetryAfter != leaky.InfDuration {
+			t.Errorf("Upload of unknown length hooked with Retry-After %v, expected it never to fit", denied.RetryAfter)
+		}
+	})
+
+	t.Run("charge on", func(t *testing.T) {
+		tm := leakytest.NewTestManager(t)
+		bucket := tm.ThrottlingHandler(handleFuncSuccessResponse, 100, 60, keyFunc, "uploads",
+			leaky.WithCostFunc(leaky.CostByBytes(1)), leaky.WithChargeOn(leaky.Statuses(http.StatusOK)))
+
+		if w := upload(bucket); w.Code != http.StatusTooManyRequests {
+			t.Errorf("Upload of unknown length: status %v", w.Code)
+		}
+
+		// Nothing was reserved for the rejected upload, so the client isn't locked out
+		if remaining, _ := bucket.Remaining(context.Background(), "test-key"); remaining != 100 {
+			t.Errorf("Client left %d drops of space, expected 100", remaining)
+		}
+	})
+}
@@ -0,0 +1,57 @@
+package leaky
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"time"
+)
+
+// DecisionKey is the request context key a Decision is stored under
+var DecisionKey = &contextKey{"decision"}
+
+// Decision describes the limiter's decision to allow a request, for the handler it reaches,
+// or to reject it, for adapters responding to rejections themselves
+type Decision struct {
+	Bucket string
+	KeyID  string
+	// Remaining is how many more requests fit in the bucket now, out of Limit
+	Remaining int
+	Limit     int
+	// RetryAfter is how long until another request fits, zero if one already does
+	RetryAfter time.Duration
+	// ResetAfter is how long until the bucket has fully leaked, InfDuration if it never will
+	ResetAfter time.Duration
+	// Delay is how long the request was held until it fitted, by a bucket with WithDelay
+	Delay time.Duration
+	// Shadowed is set when the request would have been rejected, but was let through by a bucket in shadow mode
+	Shadowed bool
+}
+
+// DecisionFromContext returns the decision stored in ctx, if there is one
+func DecisionFromContext(ctx context.Context) (Decision, bool) {
+	d, ok := ctx.Value(DecisionKey).(Decision)
+	return d, ok
+}
+
+// newDecision describes a request allowed by a bucket with the given limits, leaving it in state
+func newDecision(bucketName string, keyID string, lim limits, state State) Decision {
+	return Decision{
+		Bucket:     bucketName,
+		KeyID:      keyID,
+		Remaining:  int(math.Max(0, wholeDrops(state.SpaceRemaining))),
+		Limit:      lim.size,
+		RetryAfter: lim.waitFor(1, state),
+		ResetAfter: lim.waitFor(lim.size, state),
+	}
+}
+
+// ContextWithDecision returns a copy of ctx carrying the decision, for adapters passing it on to handlers
+func ContextWithDecision(ctx context.Context, d Decision) context.Context {
+	return context.WithValue(ctx, DecisionKey, d)
+}
+
+// withDecision returns a copy of r with the decision in its context
+func withDecision(r *http.Request, d Decision) *http.Request {
+	return r.WithContext(ContextWithDecision(r.Context(), d))
+}
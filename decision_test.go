@@ -0,0 +1,64 @@
+package leaky_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/2bytes/leaky"
+	"github.com/2bytes/leaky/leakytest"
+)
+
+// echoDecision writes the limiter's decision on the request as the response
+func echoDecision(w http.ResponseWriter, r *http.Request) {
+	d, ok := leaky.DecisionFromContext(r.Context())
+	if !ok {
+		http.Error(w, "no decision", http.StatusInternalServerError)
+		return
+	}
+
+	fmt.Fprintf(w, "%s %s %d/%d %v", d.Bucket, d.KeyID, d.Remaining, d.Limit, d.RetryAfter)
+}
+
+func TestDecisionFromContext(t *testing.T) {
+	tm := leakytest.NewTestManager(t)
+	handler := tm.ThrottlingHandler(echoDecision, 3, 60, keyFunc, "test")
+
+	req, _ := http.NewRequest("GET", "", nil)
+	calls := tm.Store.Calls()
+
+	for _, want := range []string{"test test-key 2/3 0s", "test test-key 1/3 0s", "test test-key 0/3 1s"} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		if body := w.Body.String(); body != want {
+			t.Errorf("Decision %q, expected %q", body, want)
+		}
+	}
+
+	// The decision comes from the fill, one round trip per request
+	if n := tm.Store.Calls() - calls; n != 3 {
+		t.Errorf("%d store calls, expected 3", n)
+	}
+}
+
+func TestTieredDecisionFromContext(t *testing.T) {
+	tm := leakytest.NewTestManager(t)
+	handler := tm.TieredHandler(echoDecision, []leaky.Tier{
+		{Size: 3, Rate: 3, Per: time.Second},
+		{Size: 2, Rate: 2, Per: time.Minute},
+	}, keyFunc, "test")
+
+	req, _ := http.NewRequest("GET", "", nil)
+
+	for _, want := range []string{"test test-key 1/2 0s", "test test-key 0/2 30s"} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		if body := w.Body.String(); body != want {
+			t.Errorf("Decision %q, expected %q", body, want)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package leaky
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// WithDelay holds requests which don't fit in the client's bucket for up to budget until they do, rather than
+// rejecting them straight away, smoothing bursts. Held requests reserve their drops, so are admitted in the
+// order they arrived, and give them back if the request is cancelled while held. Those whose context would
+// end before they fit are rejected straight away. They count as rejected by the metrics and OnDeny hook, as
+// they didn't fit when they arrived. It has no effect in shadow mode or with WithChargeOn.
+func WithDelay(budget time.Duration) Option {
+	return func(b *Bucket) {
+		b.delay = budget
+	}
+}
+
+// holds reports whether a request which didn't fit is held until it does, rather than rejected
+func (b *Bucket) holds(ctx context.Context, wait time.Duration, peek bool) bool {
+	return b.delay > 0 && wait <= b.delay && !peek && !b.shadow && beforeDeadline(ctx, wait)
+}
+
+// hold reserves the request's drops and waits until they fit, rejecting the request if it has to wait
+// longer than the budget or is cancelled first
+func (b *Bucket) hold(ctx context.Context, h http.Header, lim limits, keyID string, cost int) (Decision, limits, int, bool) {
+	taken, after, wait := b.reserveHeld(ctx, lim, keyID, cost)
+
+	d := newDecision(b.bucketName, keyID, lim, after)
+	if taken < cost || wait > b.delay {
+		b.giveBack(lim, keyID, taken)
+		b.strike(ctx, keyID)
+		d.RetryAfter = wait
+		setRetryAfter(h, wait)
+		return d, lim, 0, false
+	}
+
+	setRateLimitHeaders(h, b.headers, b.bucketName, lim, after)
+
+	if err := b.sleepHeld(ctx, lim, keyID, taken, wait); err != nil {
+		d.RetryAfter = wait
+		return d, lim, 0, false
+	}
+
+	d.Delay = wait
+	return d, lim, taken, true
+}
+
+// reserveHeld reserves drops to be used once they fit, without reporting a decision, returning how many
+// were taken, the state they left and how long until they would have fitted had they not been taken yet
+func (b *Bucket) reserveHeld(ctx context.Context, lim limits, keyID string, n int) (int, State, time.Duration) {
+	taken, after := b.takeKey(ctx, lim, keyID, Demand{Count: n, Reserve: true}, true)
+
+	// Others may have reserved drops since they were found not to fit, so the wait may have grown
+	before := after
+	before.SpaceRemaining += float64(taken)
+	return taken, after, lim.waitFor(n, before)
+}
+
+// sleepHeld waits until reserved drops fit, giving them back if ctx is done first
+func (b *Bucket) sleepHeld(ctx context.Context, lim limits, keyID string, taken int, wait time.Duration) error {
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		b.giveBack(lim, keyID, taken)
+		return ctx.Err()
+	}
+}
+
+// giveBack refunds drops a held request reserved but won't use, after its own context may have ended
+func (b *Bucket) giveBack(lim limits, keyID string, taken int) {
+	if taken == 0 {
+		return
+	}
+
+	if err := b.refund(context.Background(), lim, keyID, taken); err != nil {
+		b.storeFailed(context.Background(), b.logger.Warn, "Giving back held drops failed", keyID, err)
+	}
+}
+
+// beforeDeadline reports whether the wait is over before the deadline of ctx, if it has one
+func beforeDeadline(ctx context.Context, wait time.Duration) bool {
+	deadline, ok := ctx.Deadline()
+	return !ok || time.Until(deadline) >= wait
+}
@@ -0,0 +1,68 @@
+package leaky
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDelay(t *testing.T) {
+	tj := prepareTestJig()
+	defer tj.Close()
+
+	// A drop leaks every 100ms
+	bucket := tj.ThrottleManager.ThrottlingHandler(handleFuncSuccessResponse, 1, 600, keyFunc, "test", WithDelay(time.Second))
+	req, _ := http.NewRequest("GET", "", nil)
+
+	bucket.ServeHTTP(httptest.NewRecorder(), req)
+
+	start := time.Now()
+	w := httptest.NewRecorder()
+	bucket.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("Held request: status %v", w.Code)
+	}
+	if held := time.Since(start); held < 90*time.Millisecond {
+		t.Errorf("Request held for %v, expected 100ms", held)
+	}
+}
+
+func TestDelayOverBudget(t *testing.T) {
+	tj := prepareTestJig()
+	defer tj.Close()
+
+	bucket := tj.ThrottleManager.ThrottlingHandler(handleFuncSuccessResponse, 1, 60, keyFunc, "test", WithDelay(100*time.Millisecond))
+	req, _ := http.NewRequest("GET", "", nil)
+
+	bucket.ServeHTTP(httptest.NewRecorder(), req)
+
+	w := httptest.NewRecorder()
+	bucket.ServeHTTP(w, req)
+
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "1" {
+		t.Errorf("Request over the budget: status %v, Retry-After %s", w.Code, w.Header().Get("Retry-After"))
+	}
+}
+
+func TestDelayCancelled(t *testing.T) {
+	tj := prepareTestJig()
+	defer tj.Close()
+
+	bucket := tj.ThrottleManager.ThrottlingHandler(handleFuncSuccessResponse, 1, 60, keyFunc, "test", WithDelay(5*time.Second))
+	bucket.Add(1, "test-key")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+
+	if d, ok := bucket.AdmitKey(ctx, http.Header{}, "test-key"); ok {
+		t.Errorf("Cancelled request admitted: %+v", d)
+	}
+
+	// The held drop was given back, leaving only the first
+	if state := bucket.getState(context.Background(), "test-key"); state.SpaceRemaining < -0.5 {
+		t.Errorf("Space remaining %v, expected the held drop back", state.SpaceRemaining)
+	}
+}
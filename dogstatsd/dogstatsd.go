@@ -0,0 +1,141 @@
+// Package dogstatsd sends the decisions of leaky buckets and the latency of their store to a StatsD or
+// DogStatsD agent over UDP, for Datadog or other StatsD backends without scraping infrastructure
+//
+//	sink, err := dogstatsd.New("127.0.0.1:8125", dogstatsd.WithTags("env:prod"))
+//	if err != nil {
+//		return err
+//	}
+//	defer sink.Close()
+//	tm := leaky.NewThrottleManager(rc, leaky.WithMetrics(sink))
+package dogstatsd
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/2bytes/leaky"
+)
+
+// Sink sends the count leaky.decisions and the timing leaky.store.latency, tagged with the bucket's name
+// as bucket and the outcome as outcome. Without tags they are sent as leaky.decisions.<bucket>.<outcome>
+// and leaky.store.latency.<bucket>.<outcome> instead.
+type Sink struct {
+	conn      net.Conn
+	namespace string
+	tags      []string
+	plain     bool
+}
+
+var _ leaky.Metrics = (*Sink)(nil)
+
+// Option configures a Sink
+type Option func(*Sink)
+
+// WithNamespace sets the prefix of the metrics' names, the default is leaky
+func WithNamespace(namespace string) Option {
+	return func(s *Sink) {
+		s.namespace = namespace
+	}
+}
+
+// WithTags adds tags to every metric, such as env:prod
+func WithTags(tags ...string) Option {
+	return func(s *Sink) {
+		s.tags = append(s.tags, tags...)
+	}
+}
+
+// WithoutTags sends metrics as plain StatsD, which doesn't support tags, putting the bucket and outcome in the
+// metrics' names
+func WithoutTags() Option {
+	return func(s *Sink) {
+		s.plain = true
+	}
+}
+
+// New creates a sink sending metrics to the agent listening for UDP at addr
+func New(addr string, opts ...Option) (*Sink, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Sink{conn: conn, namespace: "leaky"}
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	return s, nil
+}
+
+// Close closes the sink's connection to the agent
+func (s *Sink) Close() error {
+	return s.conn.Close()
+}
+
+// Decided implements leaky.Metrics, the outcome is allowed or rejected
+func (s *Sink) Decided(bucketName string, allowed bool) {
+	outcome := "allowed"
+	if !allowed {
+		outcome = "rejected"
+	}
+
+	s.send("decisions", "1", "c", bucketName, outcome)
+}
+
+// RoundTrip implements leaky.Metrics, the outcome is ok or error
+func (s *Sink) RoundTrip(bucketName string, latency time.Duration, err error) {
+	outcome := "ok"
+	if err != nil {
+		outcome = "error"
+	}
+
+	ms := strconv.FormatFloat(float64(latency)/float64(time.Millisecond), 'f', -1, 64)
+	s.send("store.latency", ms, "ms", bucketName, outcome)
+}
+
+// send writes a single metric in its own datagram. Errors are ignored, as StatsD metrics are
+// sent best effort.
+func (s *Sink) send(name, value, kind, bucketName, outcome string) {
+	var b strings.Builder
+	b.WriteString(s.namespace)
+	b.WriteByte('.')
+	b.WriteString(name)
+
+	if s.plain {
+		b.WriteByte('.')
+		b.WriteString(sanitize(bucketName, ".:|@#"))
+		b.WriteByte('.')
+		b.WriteString(outcome)
+	}
+
+	b.WriteByte(':')
+	b.WriteString(value)
+	b.WriteByte('|')
+	b.WriteString(kind)
+
+	if !s.plain {
+		b.WriteString("|#bucket:")
+		b.WriteString(sanitize(bucketName, ",|@#"))
+		b.WriteString(",outcome:")
+		b.WriteString(outcome)
+		for _, tag := range s.tags {
+			b.WriteByte(',')
+			b.WriteString(tag)
+		}
+	}
+
+	s.conn.Write([]byte(b.String()))
+}
+
+// sanitize replaces the characters special to the protocol, and whitespace, with underscores
+func sanitize(s string, special string) string {
+	return strings.Map(func(r rune) rune {
+		if strings.ContainsRune(special, r) || r == ' ' || r == '\n' || r == '\t' {
+			return '_'
+		}
+		return r
+	}, s)
+}
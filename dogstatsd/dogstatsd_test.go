@@ -0,0 +1,75 @@
+package dogstatsd
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/2bytes/leaky"
+	"github.com/2bytes/leaky/leakytest"
+)
+
+// listen returns a UDP listener and a func receiving the next datagram sent to it
+func listen(t *testing.T) (string, func() string) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return conn.LocalAddr().String(), func() string {
+		buf := make([]byte, 1024)
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(buf[:n])
+	}
+}
+
+func TestSink(t *testing.T) {
+	addr, receive := listen(t)
+
+	sink, err := New(addr, WithTags("env:test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+
+	tm := leakytest.NewTestManager(t, leaky.WithMetrics(sink))
+	handler := tm.ThrottlingHandler(func(w http.ResponseWriter, r *http.Request) {}, 1, 0,
+		func(r http.Request) string { return "client" }, "api")
+	req, _ := http.NewRequest("GET", "", nil)
+
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if got := receive(); got != "leaky.store.latency:0|ms|#bucket:api,outcome:ok,env:test" {
+		t.Errorf("Latency sent as %q", got)
+	}
+	if got := receive(); got != "leaky.decisions:1|c|#bucket:api,outcome:allowed,env:test" {
+		t.Errorf("Decision sent as %q", got)
+	}
+
+	sink.RoundTrip("api", 1500*time.Microsecond, errors.New("store down"))
+	if got := receive(); got != "leaky.store.latency:1.5|ms|#bucket:api,outcome:error,env:test" {
+		t.Errorf("Failed round trip sent as %q", got)
+	}
+}
+
+func TestSinkWithoutTags(t *testing.T) {
+	addr, receive := listen(t)
+
+	sink, err := New(addr, WithoutTags(), WithNamespace("app.limits"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+
+	sink.Decided("api:v1", false)
+	if got := receive(); got != "app.limits.decisions.api_v1.rejected:1|c" {
+		t.Errorf("Decision sent as %q", got)
+	}
+}
@@ -0,0 +1,300 @@
+// Package dynamostore provides a leaky.Store keeping bucket state in a DynamoDB table,
+// for deployments such as Lambda with nowhere to run Redis
+//
+// The table needs a string partition key named "key", and TTL enabled on the "expires" attribute
+// so DynamoDB deletes state which is no longer needed.
+//
+//	cfg, _ := config.LoadDefaultConfig(ctx)
+//	tm := leaky.NewThrottleManagerWithStore(dynamostore.New(dynamodb.NewFromConfig(cfg), "throttling"))
+package dynamostore
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/2bytes/leaky"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Attribute names of the table's items
+const (
+	KeyAttribute     = "key"
+	StateAttribute   = "state"
+	ExpiresAttribute = "expires"
+	// VersionAttribute is replaced by every write, GetSet only writes if it is unchanged since it read the item
+	VersionAttribute = "version"
+)
+
+// maxAttempts is how many times GetSet and Transact retry a write which lost a race with another instance
+const maxAttempts = 5
+
+// ErrConflict is returned by GetSet and Transact when every attempt to write lost a race with another instance
+var ErrConflict = errors.New("dynamostore: too many conflicting writes")
+
+// API is the part of the DynamoDB client the store uses, it is implemented by *dynamodb.Client
+type API interface {
+	GetItem(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error)
+	PutItem(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error)
+	TransactWriteItems(ctx context.Context, params *dynamodb.TransactWriteItemsInput, optFns ...func(*dynamodb.Options)) (*dynamodb.TransactWriteItemsOutput, error)
+}
+
+// Store keeps bucket state in a DynamoDB table as JSON. Reads are strongly consistent, and GetSet replaces
+// the state it read with a PutItem conditional on the item's version, trying again if another write landed
+// in between, though it takes two round trips. Transact does the same for several keys at once with
+// TransactWriteItems.
+type Store struct {
+	client API
+	table  string
+	now    func() time.Time
+}
+
+// New creates a store keeping state in the named table
+func New(client API, table string) *Store {
+	return &Store{client: client, table: table, now: time.Now}
+}
+
+// Get implements leaky.Store
+func (s *Store) Get(ctx context.Context, key string) (leaky.State, bool, error) {
+	item, err := s.getItem(ctx, key)
+	if err != nil {
+		return leaky.State{}, false, err
+	}
+
+	return s.decode(item)
+}
+
+// Set implements leaky.Store
+func (s *Store) Set(ctx context.Context, key string, state leaky.State, ttl time.Duration) error {
+	item, err := s.encode(key, state, ttl)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(s.table),
+		Item:      item,
+	})
+	return err
+}
+
+// GetSet implements leaky.GetSetter
+func (s *Store) GetSet(ctx context.Context, key string, state leaky.State, ttl time.Duration) (leaky.State, bool, error) {
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		read, err := s.getItem(ctx, key)
+		if err != nil {
+			return leaky.State{}, false, err
+		}
+
+		prev, exists, err := s.decode(read)
+		if err != nil {
+			return prev, false, err
+		}
+
+		item, err := s.encode(key, state, ttl)
+		if err != nil {
+			return prev, exists, &leaky.WriteError{Err: err}
+		}
+
+		put := &dynamodb.PutItemInput{TableName: aws.String(s.table), Item: item}
+		onlyIfUnchanged(put, read)
+
+		_, err = s.client.PutItem(ctx, put)
+		switch {
+		case err == nil:
+			return prev, exists, nil
+		case conflicted(err):
+			continue
+		default:
+			return prev, exists, &leaky.WriteError{Err: err}
+		}
+	}
+
+	return leaky.State{}, false, ErrConflict
+}
+
+// Transact implements leaky.Transactor, reading the items under keys then replacing them with a single
+// PutItem or TransactWriteItems conditional on each item's version, calling update again on the items
+// read if another write landed in between
+func (s *Store) Transact(ctx context.Context, keys []string, update func(states []leaky.State, exists []bool) ([]leaky.State, []time.Duration)) error {
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		items := make([]map[string]types.AttributeValue, len(keys))
+		states := make([]leaky.State, len(keys))
+		exists := make([]bool, len(keys))
+		for i, key := range keys {
+			var err error
+			if items[i], err = s.getItem(ctx, key); err != nil {
+				return err
+			}
+			if states[i], exists[i], err = s.decode(items[i]); err != nil {
+				return err
+			}
+		}
+
+		writes, ttls := update(states, exists)
+		if len(writes) == 0 {
+			return nil
+		}
+
+		puts := make([]*dynamodb.PutItemInput, len(writes))
+		for i, state := range writes {
+			item, err := s.encode(keys[i], state, ttls[i])
+			if err != nil {
+				return err
+			}
+			puts[i] = &dynamodb.PutItemInput{TableName: aws.String(s.table), Item: item}
+			onlyIfUnchanged(puts[i], items[i])
+		}
+
+		err := s.putAll(ctx, puts)
+		if err == nil || !conflicted(err) {
+			return err
+		}
+	}
+
+	return ErrConflict
+}
+
+// putAll makes the puts atomically, as a transaction if there is more than one
+func (s *Store) putAll(ctx context.Context, puts []*dynamodb.PutItemInput) error {
+	if len(puts) == 1 {
+		_, err := s.client.PutItem(ctx, puts[0])
+		return err
+	}
+
+	items := make([]types.TransactWriteItem, len(puts))
+	for i, put := range puts {
+		items[i] = types.TransactWriteItem{Put: &types.Put{
+			TableName:                 put.TableName,
+			Item:                      put.Item,
+			ConditionExpression:       put.ConditionExpression,
+			ExpressionAttributeNames:  put.ExpressionAttributeNames,
+			ExpressionAttributeValues: put.ExpressionAttributeValues,
+		}}
+	}
+
+	_, err := s.client.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{TransactItems: items})
+	return err
+}
+
+// conflicted reports whether a write failed because another write changed an item first
+func conflicted(err error) bool {
+	var failed *types.ConditionalCheckFailedException
+	if errors.As(err, &failed) {
+		return true
+	}
+
+	var canceled *types.TransactionCanceledException
+	if !errors.As(err, &canceled) {
+		return false
+	}
+	for _, reason := range canceled.CancellationReasons {
+		if code := aws.ToString(reason.Code); code == "ConditionalCheckFailed" || code == "TransactionConflict" {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Store) getItem(ctx context.Context, key string) (map[string]types.AttributeValue, error) {
+	out, err := s.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(s.table),
+		Key:            map[string]types.AttributeValue{KeyAttribute: &types.AttributeValueMemberS{Value: key}},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return out.Item, nil
+}
+
+// onlyIfUnchanged makes the write only replace the item read, or only write a new one if there was none.
+// Items written by earlier versions have no version, and are only replaced if they still haven't.
+func onlyIfUnchanged(put *dynamodb.PutItemInput, item map[string]types.AttributeValue) {
+	if len(item) == 0 {
+		put.ConditionExpression = aws.String("attribute_not_exists(#key)")
+		put.ExpressionAttributeNames = map[string]string{"#key": KeyAttribute}
+		return
+	}
+
+	put.ExpressionAttributeNames = map[string]string{"#version": VersionAttribute}
+	version, ok := item[VersionAttribute]
+	if !ok {
+		put.ConditionExpression = aws.String("attribute_not_exists(#version)")
+		return
+	}
+
+	put.ConditionExpression = aws.String("#version = :version")
+	put.ExpressionAttributeValues = map[string]types.AttributeValue{":version": version}
+}
+
+func (s *Store) encode(key string, state leaky.State, ttl time.Duration) (map[string]types.AttributeValue, error) {
+	value, err := json.Marshal(state)
+	if err != nil {
+		return nil, err
+	}
+
+	// TTL attributes are whole seconds, rounding up keeps the state at least as long as asked
+	expires := s.now().Add(ttl)
+	seconds := int64(math.Ceil(float64(expires.UnixNano()) / float64(time.Second)))
+
+	return map[string]types.AttributeValue{
+		KeyAttribute:     &types.AttributeValueMemberS{Value: key},
+		StateAttribute:   &types.AttributeValueMemberS{Value: string(value)},
+		ExpiresAttribute: &types.AttributeValueMemberN{Value: strconv.FormatInt(seconds, 10)},
+		VersionAttribute: &types.AttributeValueMemberS{Value: newVersion()},
+	}, nil
+}
+
+// newVersion returns a random version for an item, so no two writes, even by Set, leave the same one
+func newVersion() string {
+	version := make([]byte, 8)
+	if _, err := rand.Read(version); err != nil {
+		panic(err)
+	}
+
+	return hex.EncodeToString(version)
+}
+
+// decode returns the state in an item, and false if there is no item or it has expired,
+// DynamoDB can take days to delete expired items so they have to be checked for when read
+func (s *Store) decode(item map[string]types.AttributeValue) (leaky.State, bool, error) {
+	state := leaky.State{}
+	if len(item) == 0 {
+		return state, false, nil
+	}
+
+	expires, ok := item[ExpiresAttribute].(*types.AttributeValueMemberN)
+	if !ok {
+		return state, false, fmt.Errorf("dynamostore: item has no %q number", ExpiresAttribute)
+	}
+
+	seconds, err := strconv.ParseInt(expires.Value, 10, 64)
+	if err != nil {
+		return state, false, err
+	}
+
+	if !s.now().Before(time.Unix(seconds, 0)) {
+		return state, false, nil
+	}
+
+	value, ok := item[StateAttribute].(*types.AttributeValueMemberS)
+	if !ok {
+		return state, false, fmt.Errorf("dynamostore: item has no %q string", StateAttribute)
+	}
+
+	if err := json.Unmarshal([]byte(value.Value), &state); err != nil {
+		return state, false, err
+	}
+
+	return state, true, nil
+}
@@ -0,0 +1,288 @@
+package dynamostore
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/2bytes/leaky"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// fakeTable is an in-memory table implementing the API, without TTL deletion. It checks the conditions
+// GetSet and Transact write with.
+type fakeTable struct {
+	items map[string]map[string]types.AttributeValue
+	// beforePut is called as each item is put, before its condition is checked, such as to write as
+	// another instance would
+	beforePut func()
+}
+
+func (f *fakeTable) GetItem(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+	key := params.Key[KeyAttribute].(*types.AttributeValueMemberS).Value
+	return &dynamodb.GetItemOutput{Item: f.items[key]}, nil
+}
+
+func (f *fakeTable) PutItem(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+	if before := f.beforePut; before != nil {
+		before()
+	}
+
+	key := params.Item[KeyAttribute].(*types.AttributeValueMemberS).Value
+	current := f.items[key]
+
+	met, err := conditionMet(current, params.ConditionExpression, params.ExpressionAttributeValues)
+	if err != nil {
+		return nil, err
+	}
+	if !met {
+		return nil, &types.ConditionalCheckFailedException{Message: aws.String("The conditional request failed")}
+	}
+
+	out := &dynamodb.PutItemOutput{}
+	if params.ReturnValues == types.ReturnValueAllOld {
+		out.Attributes = current
+	}
+
+	f.items[key] = params.Item
+	return out, nil
+}
+
+// TransactWriteItems puts every item if all of their conditions are met, otherwise none of them
+func (f *fakeTable) TransactWriteItems(ctx context.Context, params *dynamodb.TransactWriteItemsInput, optFns ...func(*dynamodb.Options)) (*dynamodb.TransactWriteItemsOutput, error) {
+	if before := f.beforePut; before != nil {
+		before()
+	}
+
+	reasons := make([]types.CancellationReason, len(params.TransactItems))
+	canceled := false
+	for i, item := range params.TransactItems {
+		key := item.Put.Item[KeyAttribute].(*types.AttributeValueMemberS).Value
+		met, err := conditionMet(f.items[key], item.Put.ConditionExpression, item.Put.ExpressionAttributeValues)
+		if err != nil {
+			return nil, err
+		}
+
+		reasons[i].Code = aws.String("None")
+		if !met {
+			reasons[i].Code, canceled = aws.String("ConditionalCheckFailed"), true
+		}
+	}
+	if canceled {
+		return nil, &types.TransactionCanceledException{CancellationReasons: reasons}
+	}
+
+	for _, item := range params.TransactItems {
+		f.items[item.Put.Item[KeyAttribute].(*types.AttributeValueMemberS).Value] = item.Put.Item
+	}
+	return &dynamodb.TransactWriteItemsOutput{}, nil
+}
+
+// conditionMet checks the conditions the store writes with against the current item
+func conditionMet(current map[string]types.AttributeValue, condition *string, values map[string]types.AttributeValue) (bool, error) {
+	switch aws.ToString(condition) {
+	case "":
+		return true, nil
+	case "attribute_not_exists(#key)":
+		return current == nil, nil
+	case "attribute_not_exists(#version)":
+		_, exists := current[VersionAttribute]
+		return current != nil && !exists, nil
+	case "#version = :version":
+		version, _ := current[VersionAttribute].(*types.AttributeValueMemberS)
+		expected := values[":version"].(*types.AttributeValueMemberS)
+		return version != nil && version.Value == expected.Value, nil
+	default:
+		return false, errors.New("unexpected condition " + aws.ToString(condition))
+	}
+}
+
+func newTestStore() (*Store, *time.Time) {
+	now := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	store := New(&fakeTable{items: make(map[string]map[string]types.AttributeValue)}, "test")
+	store.now = func() time.Time { return now }
+
+	return store, &now
+}
+
+func TestGetSetRetriesConflictingWrite(t *testing.T) {
+	store, now := newTestStore()
+	ctx := context.Background()
+	table := store.client.(*fakeTable)
+
+	if err := store.Set(ctx, "key", leaky.State{LastUpdate: *now, SpaceRemaining: 4}, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another instance writes between the first read and put, so the first put must fail and be tried again
+	table.beforePut = func() {
+		table.beforePut = nil
+		if err := store.Set(ctx, "key", leaky.State{LastUpdate: *now, SpaceRemaining: 2}, time.Minute); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	prev, ok, err := store.GetSet(ctx, "key", leaky.State{LastUpdate: *now, SpaceRemaining: 3}, time.Minute)
+	if err != nil || !ok || prev.SpaceRemaining != 2 {
+		t.Errorf("GetSet returned %+v, %v, %v, expected the other instance's state", prev, ok, err)
+	}
+
+	if got, _, _ := store.Get(ctx, "key"); got.SpaceRemaining != 3 {
+		t.Errorf("Stored state %+v, expected GetSet's", got)
+	}
+}
+
+func TestGetSetConflicts(t *testing.T) {
+	store, now := newTestStore()
+	ctx := context.Background()
+	table := store.client.(*fakeTable)
+
+	// Every put loses the race to another instance's write
+	table.beforePut = func() {
+		before := table.beforePut
+		table.beforePut = nil
+		defer func() { table.beforePut = before }()
+
+		if err := store.Set(ctx, "key", leaky.State{LastUpdate: *now, SpaceRemaining: 1}, time.Minute); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, _, err := store.GetSet(ctx, "key", leaky.State{LastUpdate: *now}, time.Minute); !errors.Is(err, ErrConflict) {
+		t.Errorf("GetSet returned %v, expected ErrConflict", err)
+	}
+}
+
+func TestGetSetReplacesUnversionedItem(t *testing.T) {
+	store, now := newTestStore()
+	ctx := context.Background()
+	table := store.client.(*fakeTable)
+
+	// As written by an earlier version, without a version attribute
+	item, err := store.encode("key", leaky.State{LastUpdate: *now, SpaceRemaining: 4}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	delete(item, VersionAttribute)
+	table.items["key"] = item
+
+	prev, ok, err := store.GetSet(ctx, "key", leaky.State{LastUpdate: *now, SpaceRemaining: 3}, time.Minute)
+	if err != nil || !ok || prev.SpaceRemaining != 4 {
+		t.Errorf("GetSet returned %+v, %v, %v, expected the unversioned state", prev, ok, err)
+	}
+}
+
+func TestGetSet(t *testing.T) {
+	store, now := newTestStore()
+	ctx := context.Background()
+
+	first := leaky.State{LastUpdate: *now, SpaceRemaining: 4}
+	if prev, ok, err := store.GetSet(ctx, "key", first, time.Minute); ok || err != nil {
+		t.Fatalf("GetSet of a new key returned %+v, %v, %v", prev, ok, err)
+	}
+
+	second := leaky.State{LastUpdate: *now, SpaceRemaining: 3}
+	prev, ok, err := store.GetSet(ctx, "key", second, time.Minute)
+	if err != nil || !ok || prev.SpaceRemaining != 4 {
+		t.Errorf("GetSet returned %+v, %v, %v, expected the first state", prev, ok, err)
+	}
+
+	if got, ok, err := store.Get(ctx, "key"); err != nil || !ok || got.SpaceRemaining != 3 {
+		t.Errorf("Get returned %+v, %v, %v, expected the second state", got, ok, err)
+	}
+}
+
+func TestExpiredItemsIgnored(t *testing.T) {
+	store, now := newTestStore()
+	ctx := context.Background()
+
+	if err := store.Set(ctx, "key", leaky.State{SpaceRemaining: 1}, 1500*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+
+	// The expiry rounds up to whole seconds
+	*now = now.Add(time.Second)
+	if _, ok, _ := store.Get(ctx, "key"); !ok {
+		t.Error("State expired early")
+	}
+
+	*now = now.Add(time.Second)
+	if _, ok, _ := store.Get(ctx, "key"); ok {
+		t.Error("Expired state returned by Get")
+	}
+
+	if _, ok, _ := store.GetSet(ctx, "key", leaky.State{}, time.Minute); ok {
+		t.Error("Expired state returned by GetSet")
+	}
+}
+
+func TestTransact(t *testing.T) {
+	for _, keys := range [][]string{{"a"}, {"a", "b"}} {
+		store, now := newTestStore()
+		ctx := context.Background()
+		table := store.client.(*fakeTable)
+
+		// Another instance writes the last key between the first read and write, so update must be called again
+		last := keys[len(keys)-1]
+		table.beforePut = func() {
+			table.beforePut = nil
+			if err := store.Set(ctx, last, leaky.State{LastUpdate: *now, SpaceRemaining: 2}, time.Minute); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		calls := 0
+		err := store.Transact(ctx, keys, func(states []leaky.State, exists []bool) ([]leaky.State, []time.Duration) {
+			calls++
+			ttls := make([]time.Duration, len(states))
+			for i := range states {
+				states[i].SpaceRemaining++
+				ttls[i] = time.Minute
+			}
+			return states, ttls
+		})
+		if err != nil || calls != 2 {
+			t.Errorf("Transact over %v returned %v after %d updates, expected a second update", keys, err, calls)
+		}
+
+		for i, key := range keys {
+			want := 1.0
+			if i == len(keys)-1 {
+				want = 3
+			}
+			if state, _, _ := store.Get(ctx, key); state.SpaceRemaining != want {
+				t.Errorf("Key %s stored %+v after Transact over %v, expected %v remaining", key, state, keys, want)
+			}
+		}
+	}
+}
+
+func TestTransactConflicts(t *testing.T) {
+	store, now := newTestStore()
+	ctx := context.Background()
+	table := store.client.(*fakeTable)
+
+	// Every write loses the race to another instance's
+	table.beforePut = func() {
+		before := table.beforePut
+		table.beforePut = nil
+		defer func() { table.beforePut = before }()
+
+		if err := store.Set(ctx, "b", leaky.State{LastUpdate: *now, SpaceRemaining: 1}, time.Minute); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := store.Transact(ctx, []string{"a", "b"}, func(states []leaky.State, exists []bool) ([]leaky.State, []time.Duration) {
+		return states, []time.Duration{time.Minute, time.Minute}
+	})
+	if !errors.Is(err, ErrConflict) {
+		t.Errorf("Transact returned %v, expected ErrConflict", err)
+	}
+	if _, ok, _ := store.Get(ctx, "a"); ok {
+		t.Error("Key written by a transaction which never committed")
+	}
+}
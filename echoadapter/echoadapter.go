@@ -0,0 +1,53 @@
+// Package echoadapter throttles Echo routes with leaky buckets
+//
+//	e := echo.New()
+//	e.Use(echoadapter.Middleware(tm, 10, 60, echo.Context.RealIP, "api"))
+package echoadapter
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/2bytes/leaky"
+	"github.com/labstack/echo/v4"
+)
+
+// KeyFunc identifies the client making a request from its Echo context
+type KeyFunc func(c echo.Context) string
+
+// Middleware creates a bucket with the manager, as ThrottlingHandler, throttling the routes it is used on
+func Middleware(tm *leaky.ThrottleManager, size int, rate int, keyFunc KeyFunc, bucketName string, opts ...leaky.Option) echo.MiddlewareFunc {
+	b := tm.ThrottlingHandler(nil, size, rate, func(r http.Request) string { return "" }, bucketName, opts...)
+	return New(b, keyFunc)
+}
+
+// New throttles the routes it is used on with the bucket, identifying clients by keyFunc, or the bucket's own
+// KeyFunc if it is nil. Rejected requests return echo.ErrTooManyRequests, for the app's HTTPErrorHandler to
+// respond with, after the rate limit headers and Retry-After are set on the response. The bucket's Rejection
+// and any concurrency limit stacked on it aren't used. Handlers further on find the bucket's decision in the
+// request's context, and their latency and errors are reported to buckets adapting to them.
+func New(b *leaky.Bucket, keyFunc KeyFunc) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+
+			admit := req
+			if keyFunc != nil {
+				admit = req.WithContext(leaky.WithKeyOverride(req.Context(), keyFunc(c)))
+			}
+
+			d, ok := b.Admit(c.Response().Header(), admit)
+			if !ok {
+				return echo.ErrTooManyRequests
+			}
+
+			c.SetRequest(req.WithContext(leaky.ContextWithDecision(req.Context(), d)))
+
+			start := time.Now()
+			err := next(c)
+			b.Observe(time.Since(start), err != nil || c.Response().Status >= http.StatusInternalServerError)
+
+			return err
+		}
+	}
+}
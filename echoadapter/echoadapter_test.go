@@ -0,0 +1,48 @@
+package echoadapter
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/2bytes/leaky"
+	"github.com/2bytes/leaky/leakytest"
+	"github.com/labstack/echo/v4"
+)
+
+func TestMiddleware(t *testing.T) {
+	tm := leakytest.NewTestManager(t)
+
+	e := echo.New()
+	e.Use(Middleware(tm.ThrottleManager, 1, 60, func(c echo.Context) string { return c.QueryParam("client") }, "test"))
+	e.GET("/", func(c echo.Context) error {
+		d, ok := leaky.DecisionFromContext(c.Request().Context())
+		if !ok {
+			t.Error("Decision not passed down the chain")
+		}
+		return c.String(http.StatusOK, d.KeyID)
+	})
+
+	w := httptest.NewRecorder()
+	e.ServeHTTP(w, httptest.NewRequest("GET", "/?client=alice", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "alice" {
+		t.Errorf("Unexpected response %v %q", w.Code, w.Body.String())
+	}
+
+	// Rejections go through the app's error handler
+	w = httptest.NewRecorder()
+	e.ServeHTTP(w, httptest.NewRequest("GET", "/?client=alice", nil))
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("Status not TooManyRequests: %v", w.Code)
+	}
+	if w.Header().Get("Retry-After") != "1" || w.Header().Get("X-RateLimit-Remaining") != "0" {
+		t.Errorf("Rate limit headers not set: %v", w.Header())
+	}
+
+	// Clients are identified from the Echo context
+	w = httptest.NewRecorder()
+	e.ServeHTTP(w, httptest.NewRequest("GET", "/?client=bob", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("Status not OK for another client: %v", w.Code)
+	}
+}
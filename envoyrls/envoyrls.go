@@ -0,0 +1,91 @@
+// Package envoyrls serves Envoy's rate limit service gRPC protocol from a ThrottleManager's buckets, so Envoy,
+// Istio or Contour can delegate their rate limit decisions to the same buckets as Go services
+//
+//	tm.ThrottlingHandler(nil, 100, 600, nil, "ingress.remote_address")
+//	srv := grpc.NewServer()
+//	rlsv3.RegisterRateLimitServiceServer(srv, envoyrls.NewServer(tm, nil))
+package envoyrls
+
+import (
+	"context"
+	"strings"
+
+	"github.com/2bytes/leaky"
+	ratelimitv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
+	rlsv3 "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// Mapper maps a descriptor of the domain to the bucket limiting it and the client's key in it,
+// ok is false for descriptors which aren't limited
+type Mapper func(domain string, descriptor *ratelimitv3.RateLimitDescriptor) (bucketName string, keyID string, ok bool)
+
+// DefaultMapper names the bucket after the domain and the descriptor's entry keys joined by '.', and keys it
+// by the entries' values joined by '|'. The descriptor [{remote_address, 10.0.0.1}] of the domain ingress is
+// limited by the bucket ingress.remote_address, for the client 10.0.0.1.
+func DefaultMapper(domain string, descriptor *ratelimitv3.RateLimitDescriptor) (string, string, bool) {
+	names := []string{domain}
+	values := make([]string, 0, len(descriptor.Entries))
+	for _, e := range descriptor.Entries {
+		names = append(names, e.Key)
+		values = append(values, e.Value)
+	}
+
+	return strings.Join(names, "."), strings.Join(values, "|"), true
+}
+
+// Server implements the rate limit service by the manager's buckets
+type Server struct {
+	rlsv3.UnimplementedRateLimitServiceServer
+
+	tm     *leaky.ThrottleManager
+	mapper Mapper
+}
+
+// NewServer creates a rate limit service deciding by the buckets the manager has created, found by their name
+// from each descriptor by mapper, or DefaultMapper if it is nil. Descriptors without a bucket aren't limited.
+func NewServer(tm *leaky.ThrottleManager, mapper Mapper) *Server {
+	if mapper == nil {
+		mapper = DefaultMapper
+	}
+
+	return &Server{tm: tm, mapper: mapper}
+}
+
+// ShouldRateLimit adds the request's hits to the bucket of every descriptor with space for them, as Envoy's
+// own service does, and is over the limit if any of them hasn't
+func (s *Server) ShouldRateLimit(ctx context.Context, req *rlsv3.RateLimitRequest) (*rlsv3.RateLimitResponse, error) {
+	hits := int(req.HitsAddend)
+	if hits == 0 {
+		hits = 1
+	}
+
+	resp := &rlsv3.RateLimitResponse{OverallCode: rlsv3.RateLimitResponse_OK}
+	for _, descriptor := range req.Descriptors {
+		status := &rlsv3.RateLimitResponse_DescriptorStatus{Code: rlsv3.RateLimitResponse_OK}
+		resp.Statuses = append(resp.Statuses, status)
+
+		name, keyID, ok := s.mapper(req.Domain, descriptor)
+		if !ok {
+			continue
+		}
+
+		b, ok := s.tm.Bucket(name)
+		if !ok {
+			continue
+		}
+
+		d, ok := b.Decide(ctx, hits, keyID)
+		if !ok {
+			status.Code = rlsv3.RateLimitResponse_OVER_LIMIT
+			resp.OverallCode = rlsv3.RateLimitResponse_OVER_LIMIT
+		}
+
+		status.LimitRemaining = uint32(d.Remaining)
+		if d.ResetAfter != leaky.InfDuration {
+			status.DurationUntilReset = durationpb.New(d.ResetAfter)
+		}
+	}
+
+	return resp, nil
+}
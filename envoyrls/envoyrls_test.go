@@ -0,0 +1,58 @@
+package envoyrls
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/2bytes/leaky/leakytest"
+	ratelimitv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
+	rlsv3 "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+)
+
+func request(addr string) *rlsv3.RateLimitRequest {
+	return &rlsv3.RateLimitRequest{
+		Domain: "ingress",
+		Descriptors: []*ratelimitv3.RateLimitDescriptor{
+			{Entries: []*ratelimitv3.RateLimitDescriptor_Entry{{Key: "remote_address", Value: addr}}},
+			{Entries: []*ratelimitv3.RateLimitDescriptor_Entry{{Key: "path", Value: "/"}}},
+		},
+	}
+}
+
+func TestShouldRateLimit(t *testing.T) {
+	tm := leakytest.NewTestManager(t)
+	tm.ThrottlingHandler(nil, 2, 60, nil, "ingress.remote_address")
+	srv := NewServer(tm.ThrottleManager, nil)
+
+	for i := 0; i < 3; i++ {
+		resp, err := srv.ShouldRateLimit(context.Background(), request("10.0.0.1"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := rlsv3.RateLimitResponse_OK
+		if i == 2 {
+			expected = rlsv3.RateLimitResponse_OVER_LIMIT
+		}
+		if resp.OverallCode != expected {
+			t.Errorf("Request %d %s, expected %s", i, resp.OverallCode, expected)
+		}
+
+		// The path has no bucket so isn't limited
+		if resp.Statuses[1].Code != rlsv3.RateLimitResponse_OK {
+			t.Errorf("Request %d limited by a descriptor without a bucket", i)
+		}
+	}
+
+	resp, _ := srv.ShouldRateLimit(context.Background(), request("10.0.0.1"))
+	status := resp.Statuses[0]
+	if status.LimitRemaining != 0 || status.DurationUntilReset.AsDuration() != 2*time.Second {
+		t.Errorf("Remaining %d, reset in %s", status.LimitRemaining, status.DurationUntilReset.AsDuration())
+	}
+
+	resp, _ = srv.ShouldRateLimit(context.Background(), request("10.0.0.2"))
+	if resp.OverallCode != rlsv3.RateLimitResponse_OK {
+		t.Errorf("Another client %s", resp.OverallCode)
+	}
+}
@@ -0,0 +1,25 @@
+module github.com/2bytes/leaky/envoyrls
+
+go 1.20
+
+require (
+	github.com/2bytes/leaky v0.1.1
+	github.com/envoyproxy/go-control-plane v0.11.1
+	google.golang.org/protobuf v1.31.0
+)
+
+require (
+	github.com/cespare/xxhash/v2 v2.2.0 // indirect
+	github.com/cncf/xds/go v0.0.0-20230607035331-e9ce68804cb4 // indirect
+	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
+	github.com/envoyproxy/protoc-gen-validate v1.0.2 // indirect
+	github.com/golang/protobuf v1.5.3 // indirect
+	github.com/redis/go-redis/v9 v9.0.2 // indirect
+	golang.org/x/net v0.12.0 // indirect
+	golang.org/x/sys v0.10.0 // indirect
+	golang.org/x/text v0.11.0 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20230711160842-782d3b101e98 // indirect
+	google.golang.org/grpc v1.58.3 // indirect
+)
+
+replace github.com/2bytes/leaky => ../
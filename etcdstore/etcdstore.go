@@ -0,0 +1,300 @@
+// Package etcdstore provides a leaky.Store keeping bucket state in etcd,
+// for clusters which already run etcd and would rather not add Redis
+//
+//	client, _ := clientv3.New(clientv3.Config{Endpoints: []string{"10.0.0.1:2379"}})
+//	tm := leaky.NewThrottleManagerWithStore(etcdstore.New(client))
+package etcdstore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/2bytes/leaky"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// maxAttempts is how many times GetSet and Transact retry a write which lost a race with another instance
+const maxAttempts = 5
+
+// ErrConflict is returned by GetSet and Transact when every attempt to write lost a race with another instance
+var ErrConflict = errors.New("etcdstore: too many conflicting writes")
+
+// Client is the part of the etcd client the store uses, it is implemented by *clientv3.Client
+type Client interface {
+	Get(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.GetResponse, error)
+	Do(ctx context.Context, op clientv3.Op) (clientv3.OpResponse, error)
+	Txn(ctx context.Context) clientv3.Txn
+	Grant(ctx context.Context, ttl int64) (*clientv3.LeaseGrantResponse, error)
+}
+
+// Store keeps bucket state in etcd as JSON values, expiring them with leases. Writes expiring at about the
+// same time share a lease, so most don't have to grant one, keeping states up to an eighth longer than asked,
+// or a second for TTLs under eight seconds. GetSet and Transact write in a transaction conditional on the keys'
+// mod revisions being the ones read, so no other write can land between reading the previous states and
+// writing the new ones.
+type Store struct {
+	client Client
+	now    func() time.Time
+
+	mu sync.Mutex
+	// leases are those granted for the writes expiring in each slot, by the Unix time in nanoseconds it ends
+	leases map[int64]clientv3.LeaseID
+}
+
+// New creates a store keeping state in the etcd cluster of client
+func New(client Client) *Store {
+	return &Store{client: client, now: time.Now, leases: make(map[int64]clientv3.LeaseID)}
+}
+
+// Get implements leaky.Store
+func (s *Store) Get(ctx context.Context, key string) (leaky.State, bool, error) {
+	resp, err := s.client.Get(ctx, key)
+	if err != nil {
+		return leaky.State{}, false, err
+	}
+
+	state, _, ok, err := decode(resp.Kvs)
+	return state, ok, err
+}
+
+// Set implements leaky.Store
+func (s *Store) Set(ctx context.Context, key string, state leaky.State, ttl time.Duration) error {
+	put, end, err := s.put(ctx, key, state, ttl)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.client.Do(ctx, put)
+	if s.leaseLost(err, end) {
+		if put, _, err = s.put(ctx, key, state, ttl); err != nil {
+			return err
+		}
+		_, err = s.client.Do(ctx, put)
+	}
+
+	return err
+}
+
+// GetSet implements leaky.GetSetter
+func (s *Store) GetSet(ctx context.Context, key string, state leaky.State, ttl time.Duration) (leaky.State, bool, error) {
+	resp, err := s.client.Get(ctx, key)
+	if err != nil {
+		return leaky.State{}, false, err
+	}
+	kvs := resp.Kvs
+
+	put, end, err := s.put(ctx, key, state, ttl)
+	if err != nil {
+		prev, _, ok, _ := decode(kvs)
+		return prev, ok, &leaky.WriteError{Err: err}
+	}
+
+	renewed := false
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		prev, revision, ok, err := decode(kvs)
+		if err != nil {
+			return prev, false, err
+		}
+
+		// A key which doesn't exist has a mod revision of 0
+		txn, err := s.client.Txn(ctx).
+			If(clientv3.Compare(clientv3.ModRevision(key), "=", revision)).
+			Then(put).
+			Else(clientv3.OpGet(key)).
+			Commit()
+		if !renewed && s.leaseLost(err, end) {
+			renewed = true
+			if put, _, err = s.put(ctx, key, state, ttl); err != nil {
+				return prev, ok, &leaky.WriteError{Err: err}
+			}
+			continue
+		}
+		if err != nil {
+			return prev, ok, &leaky.WriteError{Err: err}
+		}
+
+		if txn.Succeeded {
+			return prev, ok, nil
+		}
+
+		// The else branch read what replaced the state, try again against that
+		kvs = txn.Responses[0].GetResponseRange().Kvs
+	}
+
+	return leaky.State{}, false, ErrConflict
+}
+
+// Transact implements leaky.Transactor, writing the states in a transaction conditional on each key's mod
+// revision being the one read, and calling update again on what replaced them if another write landed first
+func (s *Store) Transact(ctx context.Context, keys []string, update func(states []leaky.State, exists []bool) ([]leaky.State, []time.Duration)) error {
+	kvs := make([][]*mvccpb.KeyValue, len(keys))
+	gets := make([]clientv3.Op, len(keys))
+	for i, key := range keys {
+		resp, err := s.client.Get(ctx, key)
+		if err != nil {
+			return err
+		}
+		kvs[i], gets[i] = resp.Kvs, clientv3.OpGet(key)
+	}
+
+	renewed := false
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		states := make([]leaky.State, len(keys))
+		exists := make([]bool, len(keys))
+		cmps := make([]clientv3.Cmp, len(keys))
+		for i, key := range keys {
+			var revision int64
+			var err error
+			if states[i], revision, exists[i], err = decode(kvs[i]); err != nil {
+				return err
+			}
+			cmps[i] = clientv3.Compare(clientv3.ModRevision(key), "=", revision)
+		}
+
+		writes, ttls := update(states, exists)
+		if len(writes) == 0 {
+			return nil
+		}
+
+		puts := make([]clientv3.Op, len(writes))
+		ends := make([]int64, len(writes))
+		for i, state := range writes {
+			var err error
+			if puts[i], ends[i], err = s.put(ctx, keys[i], state, ttls[i]); err != nil {
+				return err
+			}
+		}
+
+		txn, err := s.client.Txn(ctx).If(cmps...).Then(puts...).Else(gets...).Commit()
+		if !renewed && errors.Is(err, rpctypes.ErrLeaseNotFound) {
+			// Which lease was lost isn't known, so the writes' leases are all forgotten
+			for _, end := range ends {
+				s.leaseLost(err, end)
+			}
+			renewed = true
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if txn.Succeeded {
+			return nil
+		}
+
+		// The else branch read what replaced the states, try again against that
+		for i := range keys {
+			kvs[i] = txn.Responses[i].GetResponseRange().Kvs
+		}
+	}
+
+	return ErrConflict
+}
+
+// put returns the operation writing the state under the lease for ttl, and the end of the lease's slot
+func (s *Store) put(ctx context.Context, key string, state leaky.State, ttl time.Duration) (clientv3.Op, int64, error) {
+	value, err := json.Marshal(state)
+	if err != nil {
+		return clientv3.Op{}, 0, err
+	}
+
+	lease, end, err := s.lease(ctx, ttl)
+	if err != nil {
+		return clientv3.Op{}, 0, err
+	}
+
+	return clientv3.OpPut(key, string(value), clientv3.WithLease(lease)), end, nil
+}
+
+// lease returns a lease lasting at least ttl, shared by the writes whose TTLs end in the same slot, and the
+// end of the slot. Only the first write in a slot grants the lease, so each slot costs one round trip more.
+func (s *Store) lease(ctx context.Context, ttl time.Duration) (clientv3.LeaseID, int64, error) {
+	now := s.now()
+	end := slotEnd(now, ttl)
+
+	s.mu.Lock()
+	lease, ok := s.leases[end.UnixNano()]
+	s.mu.Unlock()
+	if ok {
+		return lease, end.UnixNano(), nil
+	}
+
+	// Writes racing each other into a new slot may each grant a lease, only the last is kept
+	resp, err := s.client.Grant(ctx, leaseTTL(end.Sub(now)))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Leases of slots which have ended have expired, so are forgotten
+	for slot := range s.leases {
+		if slot <= now.UnixNano() {
+			delete(s.leases, slot)
+		}
+	}
+	s.leases[end.UnixNano()] = resp.ID
+
+	return resp.ID, end.UnixNano(), nil
+}
+
+// leaseLost reports whether a write failed because the slot's lease had gone, such as having been revoked,
+// forgetting it so the write can be tried again with another
+func (s *Store) leaseLost(err error, end int64) bool {
+	if !errors.Is(err, rpctypes.ErrLeaseNotFound) {
+		return false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.leases, end)
+	return true
+}
+
+// slotEnd returns the end of the slot a key written now for ttl expires in. Slots are an eighth of the TTL,
+// rounded down to a power of two seconds and at least a second, so similar TTLs fall in the same slot.
+// They are counted from the Unix epoch, so every instance has the same slots.
+func slotEnd(now time.Time, ttl time.Duration) time.Time {
+	step := slotStep(ttl)
+	expires := now.Add(ttl).UnixNano()
+
+	return time.Unix(0, (expires/int64(step)+1)*int64(step))
+}
+
+// slotStep returns the length of the slots for ttl
+func slotStep(ttl time.Duration) time.Duration {
+	step := time.Second
+	for step*16 <= ttl {
+		step *= 2
+	}
+
+	return step
+}
+
+// decode returns the state in the key values of a read and the revision it was last written at,
+// and false if there is no state
+func decode(kvs []*mvccpb.KeyValue) (leaky.State, int64, bool, error) {
+	state := leaky.State{}
+	if len(kvs) == 0 {
+		return state, 0, false, nil
+	}
+
+	if err := json.Unmarshal(kvs[0].Value, &state); err != nil {
+		return state, 0, false, err
+	}
+
+	return state, kvs[0].ModRevision, true, nil
+}
+
+// leaseTTL converts a TTL to a lease TTL, which is in whole seconds, rounding up so the key is kept at least as long
+func leaseTTL(ttl time.Duration) int64 {
+	return int64(math.Max(1, math.Ceil(ttl.Seconds())))
+}
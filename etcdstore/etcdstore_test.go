@@ -0,0 +1,360 @@
+package etcdstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/2bytes/leaky"
+	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+func TestLeaseTTL(t *testing.T) {
+	for _, test := range []struct {
+		ttl  time.Duration
+		want int64
+	}{
+		{time.Millisecond, 1},
+		{1500 * time.Millisecond, 2},
+		{time.Hour, 3600},
+	} {
+		if got := leaseTTL(test.ttl); got != test.want {
+			t.Errorf("Lease TTL of %v is %d, expected %d", test.ttl, got, test.want)
+		}
+	}
+}
+
+func TestDecode(t *testing.T) {
+	if _, revision, ok, err := decode(nil); ok || revision != 0 || err != nil {
+		t.Errorf("Decoding no key values returned %d, %v, %v", revision, ok, err)
+	}
+
+	kvs := []*mvccpb.KeyValue{{Value: []byte(`{"space_remaining":3}`), ModRevision: 42}}
+	state, revision, ok, err := decode(kvs)
+	if err != nil || !ok || revision != 42 || state.SpaceRemaining != 3 {
+		t.Errorf("Decoded %+v at revision %d, %v, %v", state, revision, ok, err)
+	}
+}
+
+// fakeEtcd is an in-memory etcd implementing the Client, keeping each key's value and mod revision
+type fakeEtcd struct {
+	values    map[string]*mvccpb.KeyValue
+	revision  int64
+	grants    int
+	leaseLost bool
+	// beforeCommit is called as each transaction commits, before its comparison, such as to write as
+	// another instance would
+	beforeCommit func()
+}
+
+func newFakeEtcd() *fakeEtcd {
+	return &fakeEtcd{values: make(map[string]*mvccpb.KeyValue)}
+}
+
+func (f *fakeEtcd) Get(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.GetResponse, error) {
+	return f.get(key), nil
+}
+
+func (f *fakeEtcd) Do(ctx context.Context, op clientv3.Op) (clientv3.OpResponse, error) {
+	if f.leaseLost {
+		f.leaseLost = false
+		return clientv3.OpResponse{}, rpctypes.ErrLeaseNotFound
+	}
+
+	f.apply(op)
+	return clientv3.OpResponse{}, nil
+}
+
+func (f *fakeEtcd) Txn(ctx context.Context) clientv3.Txn {
+	return &fakeTxn{etcd: f}
+}
+
+func (f *fakeEtcd) Grant(ctx context.Context, ttl int64) (*clientv3.LeaseGrantResponse, error) {
+	f.grants++
+	return &clientv3.LeaseGrantResponse{ID: clientv3.LeaseID(f.grants), TTL: ttl}, nil
+}
+
+func (f *fakeEtcd) get(key string) *clientv3.GetResponse {
+	resp := &clientv3.GetResponse{}
+	if kv, ok := f.values[key]; ok {
+		resp.Kvs = []*mvccpb.KeyValue{kv}
+	}
+	return resp
+}
+
+func (f *fakeEtcd) apply(op clientv3.Op) {
+	f.revision++
+	key := string(op.KeyBytes())
+	f.values[key] = &mvccpb.KeyValue{Key: op.KeyBytes(), Value: op.ValueBytes(), ModRevision: f.revision}
+}
+
+// fakeTxn is a transaction of mod revision comparisons, puts and gets, as GetSet and Transact make
+type fakeTxn struct {
+	etcd       *fakeEtcd
+	cmps       []clientv3.Cmp
+	then, orse []clientv3.Op
+}
+
+func (t *fakeTxn) If(cs ...clientv3.Cmp) clientv3.Txn {
+	t.cmps = cs
+	return t
+}
+
+func (t *fakeTxn) Then(ops ...clientv3.Op) clientv3.Txn {
+	t.then = ops
+	return t
+}
+
+func (t *fakeTxn) Else(ops ...clientv3.Op) clientv3.Txn {
+	t.orse = ops
+	return t
+}
+
+func (t *fakeTxn) Commit() (*clientv3.TxnResponse, error) {
+	if before := t.etcd.beforeCommit; before != nil {
+		before()
+	}
+	if t.etcd.leaseLost {
+		t.etcd.leaseLost = false
+		return nil, rpctypes.ErrLeaseNotFound
+	}
+
+	succeeded := true
+	for _, cmp := range t.cmps {
+		var revision int64
+		if kv, ok := t.etcd.values[string(cmp.Key)]; ok {
+			revision = kv.ModRevision
+		}
+		succeeded = succeeded && revision == cmp.TargetUnion.(*pb.Compare_ModRevision).ModRevision
+	}
+
+	if succeeded {
+		for _, op := range t.then {
+			t.etcd.apply(op)
+		}
+		return &clientv3.TxnResponse{Succeeded: true}, nil
+	}
+
+	resp := &clientv3.TxnResponse{}
+	for _, op := range t.orse {
+		get := (*pb.RangeResponse)(t.etcd.get(string(op.KeyBytes())))
+		resp.Responses = append(resp.Responses, &pb.ResponseOp{Response: &pb.ResponseOp_ResponseRange{ResponseRange: get}})
+	}
+	return resp, nil
+}
+
+func newTestStore() (*Store, *fakeEtcd, *time.Time) {
+	etcd := newFakeEtcd()
+	now := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	store := New(etcd)
+	store.now = func() time.Time { return now }
+
+	return store, etcd, &now
+}
+
+func TestLeasesShared(t *testing.T) {
+	store, etcd, now := newTestStore()
+	ctx := context.Background()
+
+	// TTLs ending within the same slot, of 4 seconds for a minute, share a lease
+	for i, ttl := range []time.Duration{60 * time.Second, 61 * time.Second, 62500 * time.Millisecond} {
+		if err := store.Set(ctx, fmt.Sprintf("key%d", i), leaky.State{SpaceRemaining: 1}, ttl); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if etcd.grants != 1 {
+		t.Errorf("%d leases granted for writes expiring together, expected 1", etcd.grants)
+	}
+
+	*now = now.Add(10 * time.Second)
+	if err := store.Set(ctx, "key", leaky.State{SpaceRemaining: 1}, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if etcd.grants != 2 {
+		t.Errorf("%d leases granted, expected another for a later slot", etcd.grants)
+	}
+
+	// Slots which have ended are forgotten
+	*now = now.Add(time.Hour)
+	if err := store.Set(ctx, "key", leaky.State{SpaceRemaining: 1}, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if len(store.leases) != 1 {
+		t.Errorf("%d leases remembered, expected only the current one", len(store.leases))
+	}
+}
+
+func TestSlotEnd(t *testing.T) {
+	now := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	for _, test := range []struct {
+		ttl  time.Duration
+		step time.Duration
+	}{
+		{time.Millisecond, time.Second},
+		{1500 * time.Millisecond, time.Second},
+		{time.Minute, 4 * time.Second},
+		{time.Hour, 256 * time.Second},
+	} {
+		if step := slotStep(test.ttl); step != test.step {
+			t.Errorf("Slots for a TTL of %v are %v, expected %v", test.ttl, step, test.step)
+		}
+
+		end := slotEnd(now, test.ttl)
+		if end.UnixNano()%int64(test.step) != 0 {
+			t.Errorf("Slot for a TTL of %v ends at %v, not on a slot boundary", test.ttl, end)
+		}
+		if kept := end.Sub(now); kept <= test.ttl || kept > test.ttl+test.step {
+			t.Errorf("Slot for a TTL of %v keeps the key for %v", test.ttl, kept)
+		}
+	}
+}
+
+func TestSetRenewsLostLease(t *testing.T) {
+	store, etcd, _ := newTestStore()
+	ctx := context.Background()
+
+	if err := store.Set(ctx, "key", leaky.State{SpaceRemaining: 1}, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	etcd.leaseLost = true
+	if err := store.Set(ctx, "key", leaky.State{SpaceRemaining: 2}, time.Minute); err != nil {
+		t.Fatalf("Set with a lost lease returned %v", err)
+	}
+	if etcd.grants != 2 {
+		t.Errorf("%d leases granted, expected another for the lost one", etcd.grants)
+	}
+	if state, _, _ := store.Get(ctx, "key"); state.SpaceRemaining != 2 {
+		t.Errorf("Stored %+v, expected the second write", state)
+	}
+}
+
+func TestGetSetRetriesConflictingWrite(t *testing.T) {
+	store, etcd, _ := newTestStore()
+	ctx := context.Background()
+
+	if err := store.Set(ctx, "key", leaky.State{SpaceRemaining: 4}, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another instance writes between the read and the first commit, so it must be tried again
+	etcd.beforeCommit = func() {
+		etcd.beforeCommit = nil
+		if err := store.Set(ctx, "key", leaky.State{SpaceRemaining: 2}, time.Minute); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	prev, ok, err := store.GetSet(ctx, "key", leaky.State{SpaceRemaining: 3}, time.Minute)
+	if err != nil || !ok || prev.SpaceRemaining != 2 {
+		t.Errorf("GetSet returned %+v, %v, %v, expected the other instance's state", prev, ok, err)
+	}
+	if state, _, _ := store.Get(ctx, "key"); state.SpaceRemaining != 3 {
+		t.Errorf("Stored %+v, expected GetSet's state", state)
+	}
+}
+
+func TestGetSetConflicts(t *testing.T) {
+	store, etcd, _ := newTestStore()
+	ctx := context.Background()
+
+	// Every commit loses the race to another instance's write
+	etcd.beforeCommit = func() {
+		etcd.apply(clientv3.OpPut("key", `{"space_remaining":1}`))
+	}
+
+	if _, _, err := store.GetSet(ctx, "key", leaky.State{}, time.Minute); !errors.Is(err, ErrConflict) {
+		t.Errorf("GetSet returned %v, expected ErrConflict", err)
+	}
+}
+
+func TestGetSetRenewsLostLease(t *testing.T) {
+	store, etcd, _ := newTestStore()
+	ctx := context.Background()
+
+	etcd.leaseLost = true
+	if _, ok, err := store.GetSet(ctx, "key", leaky.State{SpaceRemaining: 3}, time.Minute); ok || err != nil {
+		t.Fatalf("GetSet with a lost lease returned %v, %v", ok, err)
+	}
+	if state, _, _ := store.Get(ctx, "key"); state.SpaceRemaining != 3 {
+		t.Errorf("Stored %+v, expected GetSet's state", state)
+	}
+}
+
+func TestTransact(t *testing.T) {
+	store, etcd, _ := newTestStore()
+	ctx := context.Background()
+
+	if err := store.Set(ctx, "a", leaky.State{SpaceRemaining: 4}, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another instance writes one of the keys between the read and the first commit, so update must be
+	// called again on what it wrote
+	etcd.beforeCommit = func() {
+		etcd.beforeCommit = nil
+		if err := store.Set(ctx, "b", leaky.State{SpaceRemaining: 2}, time.Minute); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var read [][]float64
+	err := store.Transact(ctx, []string{"a", "b"}, func(states []leaky.State, exists []bool) ([]leaky.State, []time.Duration) {
+		read = append(read, []float64{states[0].SpaceRemaining, states[1].SpaceRemaining})
+		for i := range states {
+			states[i].SpaceRemaining--
+		}
+		return states, []time.Duration{time.Minute, time.Minute}
+	})
+	if err != nil || len(read) != 2 || read[1][0] != 4 || read[1][1] != 2 {
+		t.Fatalf("Transact returned %v having read %v, expected the other instance's write read again", err, read)
+	}
+
+	for key, want := range map[string]float64{"a": 3, "b": 1} {
+		if state, _, _ := store.Get(ctx, key); state.SpaceRemaining != want {
+			t.Errorf("Key %s stored %+v, expected %v remaining", key, state, want)
+		}
+	}
+}
+
+func TestTransactConflicts(t *testing.T) {
+	store, etcd, _ := newTestStore()
+	ctx := context.Background()
+
+	// Every commit loses the race to another instance's write
+	etcd.beforeCommit = func() {
+		etcd.apply(clientv3.OpPut("b", `{"space_remaining":1}`))
+	}
+
+	err := store.Transact(ctx, []string{"a", "b"}, func(states []leaky.State, exists []bool) ([]leaky.State, []time.Duration) {
+		return states, []time.Duration{time.Minute, time.Minute}
+	})
+	if !errors.Is(err, ErrConflict) {
+		t.Errorf("Transact returned %v, expected ErrConflict", err)
+	}
+	if _, ok, _ := store.Get(ctx, "a"); ok {
+		t.Error("Key written by a transaction which never committed")
+	}
+}
+
+func TestTransactRenewsLostLease(t *testing.T) {
+	store, etcd, _ := newTestStore()
+	ctx := context.Background()
+
+	etcd.leaseLost = true
+	err := store.Transact(ctx, []string{"key"}, func(states []leaky.State, exists []bool) ([]leaky.State, []time.Duration) {
+		return []leaky.State{{SpaceRemaining: 3}}, []time.Duration{time.Minute}
+	})
+	if err != nil {
+		t.Fatalf("Transact with a lost lease returned %v", err)
+	}
+	if state, _, _ := store.Get(ctx, "key"); state.SpaceRemaining != 3 || etcd.grants != 2 {
+		t.Errorf("Stored %+v with %d leases granted, expected Transact's state under a new lease", state, etcd.grants)
+	}
+}
@@ -0,0 +1,42 @@
+package leaky
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+)
+
+// WithExemptNetworks admits requests from addresses in any of the networks without limiting them, such as
+// health checkers or internal services. The address is the one the request came from, checked before the
+// KeyFunc so exempt requests make no call to the store.
+func WithExemptNetworks(networks ...netip.Prefix) Option {
+	return func(b *Bucket) {
+		b.exempt = append(b.exempt, networks...)
+	}
+}
+
+// exempted reports whether the request came from an exempt network
+func (b *Bucket) exempted(r *http.Request) bool {
+	if len(b.exempt) == 0 {
+		return false
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+
+	for _, network := range b.exempt {
+		if network.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,44 @@
+package leaky_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"github.com/2bytes/leaky"
+	"github.com/2bytes/leaky/leakytest"
+)
+
+func TestExemptNetworks(t *testing.T) {
+	tm := leakytest.NewTestManager(t)
+	bucket := tm.ThrottlingHandler(handleFuncSuccessResponse, 1, 0, leaky.KeyByIP, "test",
+		leaky.WithExemptNetworks(netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("fd00::/8")))
+
+	serve := func(remoteAddr string) int {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = remoteAddr
+
+		w := httptest.NewRecorder()
+		bucket.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	for _, addr := range []string{"10.1.2.3:1234", "[fd00::1]:1234", "[::ffff:10.0.0.1]:1234"} {
+		for i := 0; i < 3; i++ {
+			if code := serve(addr); code != http.StatusOK {
+				t.Errorf("Exempt request %d from %s: status %v", i, addr, code)
+			}
+		}
+	}
+
+	if roundTrips := bucket.Stats().RoundTrips; roundTrips != 0 {
+		t.Errorf("Exempt requests made %d round trips", roundTrips)
+	}
+
+	for i, want := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		if code := serve("192.0.2.1:1234"); code != want {
+			t.Errorf("Request %d from outside the networks: status %v, expected %v", i, code, want)
+		}
+	}
+}
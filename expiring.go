@@ -0,0 +1,128 @@
+package leaky
+
+import (
+	"container/heap"
+	"strings"
+	"time"
+)
+
+// expiringMap holds values until a deadline, optionally capped in size.
+// Past its deadline an entry is worth nothing and goes first, when the cap forces an eviction
+// the entry closest to its deadline is the one which loses least. It isn't safe for concurrent use.
+type expiringMap[V any] struct {
+	max     int
+	entries map[string]*expiringEntry[V]
+	queue   deadlineQueue[V]
+}
+
+type expiringEntry[V any] struct {
+	key      string
+	value    V
+	deadline time.Time
+	index    int
+}
+
+func newExpiringMap[V any](max int) *expiringMap[V] {
+	return &expiringMap[V]{
+		max:     max,
+		entries: make(map[string]*expiringEntry[V]),
+	}
+}
+
+// get returns the value stored under key if it hasn't passed its deadline
+func (m *expiringMap[V]) get(key string, now time.Time) (V, bool) {
+	e, ok := m.entries[key]
+	if !ok || !now.Before(e.deadline) {
+		var zero V
+		return zero, false
+	}
+
+	return e.value, true
+}
+
+// countPrefix counts the keys starting with prefix which haven't passed their deadline
+func (m *expiringMap[V]) countPrefix(prefix string, now time.Time) int {
+	count := 0
+	for key, e := range m.entries {
+		if strings.HasPrefix(key, prefix) && now.Before(e.deadline) {
+			count++
+		}
+	}
+
+	return count
+}
+
+// set stores value under key until deadline, evicting entries if the cap is exceeded
+func (m *expiringMap[V]) set(key string, value V, deadline time.Time, now time.Time) {
+	if e, ok := m.entries[key]; ok {
+		e.value = value
+		e.deadline = deadline
+		heap.Fix(&m.queue, e.index)
+		return
+	}
+
+	e := &expiringEntry[V]{key: key, value: value, deadline: deadline}
+	m.entries[key] = e
+	heap.Push(&m.queue, e)
+
+	if m.max > 0 && len(m.entries) > m.max {
+		m.sweep(now)
+
+		for len(m.entries) > m.max {
+			m.delete(m.queue[0].key)
+		}
+	}
+}
+
+func (m *expiringMap[V]) delete(key string) {
+	e, ok := m.entries[key]
+	if !ok {
+		return
+	}
+
+	delete(m.entries, key)
+	heap.Remove(&m.queue, e.index)
+}
+
+// sweep removes every entry past its deadline
+func (m *expiringMap[V]) sweep(now time.Time) {
+	for len(m.queue) > 0 && !now.Before(m.queue[0].deadline) {
+		m.delete(m.queue[0].key)
+	}
+}
+
+func (m *expiringMap[V]) len() int {
+	return len(m.entries)
+}
+
+// deadlineQueue is a min-heap of entries ordered by deadline
+type deadlineQueue[V any] []*expiringEntry[V]
+
+func (q deadlineQueue[V]) Len() int {
+	return len(q)
+}
+
+func (q deadlineQueue[V]) Less(i, j int) bool {
+	return q[i].deadline.Before(q[j].deadline)
+}
+
+func (q deadlineQueue[V]) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *deadlineQueue[V]) Push(x any) {
+	e := x.(*expiringEntry[V])
+	e.index = len(*q)
+	*q = append(*q, e)
+}
+
+func (q *deadlineQueue[V]) Pop() any {
+	old := *q
+	n := len(old)
+	e := old[n-1]
+	old[n-1] = nil
+	*q = old[:n-1]
+	return e
+}
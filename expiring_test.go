@@ -0,0 +1,55 @@
+package leaky
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExpiringMapEvictsExpiredFirst(t *testing.T) {
+	now := time.Now()
+	m := newExpiringMap[int](2)
+
+	m.set("expired", 1, now.Add(time.Second), now)
+	m.set("later", 2, now.Add(time.Hour), now)
+
+	now = now.Add(time.Minute)
+	m.set("new", 3, now.Add(time.Minute), now)
+
+	if _, ok := m.entries["expired"]; ok {
+		t.Error("Expired entry kept over the cap")
+	}
+
+	if _, ok := m.get("later", now); !ok {
+		t.Error("Entry below capacity evicted while an expired one was available")
+	}
+}
+
+func TestExpiringMapCapForcesEviction(t *testing.T) {
+	now := time.Now()
+	m := newExpiringMap[int](2)
+
+	m.set("soonest", 1, now.Add(time.Second), now)
+	m.set("latest", 2, now.Add(time.Hour), now)
+	m.set("middle", 3, now.Add(time.Minute), now)
+
+	if m.len() != 2 {
+		t.Errorf("Cap not applied: %d entries", m.len())
+	}
+
+	if _, ok := m.get("soonest", now); ok {
+		t.Error("Evicted an entry other than the one closest to its deadline")
+	}
+}
+
+func TestExpiringMapUpdate(t *testing.T) {
+	now := time.Now()
+	m := newExpiringMap[int](0)
+
+	m.set("key", 1, now.Add(time.Second), now)
+	m.set("key", 2, now.Add(time.Hour), now)
+	m.sweep(now.Add(time.Minute))
+
+	if v, ok := m.get("key", now.Add(time.Minute)); !ok || v != 2 {
+		t.Errorf("Updated entry lost: %v, %v", v, ok)
+	}
+}
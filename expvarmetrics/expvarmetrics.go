@@ -0,0 +1,48 @@
+// Package expvarmetrics publishes counters of the decisions of leaky buckets and the calls they make to the
+// store with expvar, for basic visibility without a metrics stack. Importing it publishes the counters,
+// served as JSON by expvar's handler at /debug/vars.
+//
+//	tm := leaky.NewThrottleManager(rc, leaky.WithMetrics(expvarmetrics.Metrics{}))
+package expvarmetrics
+
+import (
+	"expvar"
+	"time"
+
+	"github.com/2bytes/leaky"
+)
+
+// The counters, each a map from the bucket's name to its count
+var (
+	// Allowed and Denied count the requests each bucket decided
+	Allowed = expvar.NewMap("leaky.allowed")
+	Denied  = expvar.NewMap("leaky.denied")
+	// RoundTrips counts the calls each bucket made to the store, and Errors those which failed
+	RoundTrips = expvar.NewMap("leaky.round_trips")
+	Errors     = expvar.NewMap("leaky.errors")
+	// StoreSeconds is the total time each bucket's calls to the store took
+	StoreSeconds = expvar.NewMap("leaky.store_seconds")
+)
+
+// Metrics adds to the published counters, any number of managers can share them
+type Metrics struct{}
+
+var _ leaky.Metrics = Metrics{}
+
+// Decided implements leaky.Metrics
+func (Metrics) Decided(bucketName string, allowed bool) {
+	if allowed {
+		Allowed.Add(bucketName, 1)
+	} else {
+		Denied.Add(bucketName, 1)
+	}
+}
+
+// RoundTrip implements leaky.Metrics
+func (Metrics) RoundTrip(bucketName string, latency time.Duration, err error) {
+	RoundTrips.Add(bucketName, 1)
+	StoreSeconds.AddFloat(bucketName, latency.Seconds())
+	if err != nil {
+		Errors.Add(bucketName, 1)
+	}
+}
@@ -0,0 +1,54 @@
+package expvarmetrics
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/2bytes/leaky"
+	"github.com/2bytes/leaky/leakytest"
+)
+
+// count returns the count of the bucket in the published map
+func count(t *testing.T, name string, bucketName string) string {
+	m, ok := expvar.Get(name).(*expvar.Map)
+	if !ok {
+		t.Fatalf("%s not published", name)
+	}
+
+	v := m.Get(bucketName)
+	if v == nil {
+		return "0"
+	}
+	return v.String()
+}
+
+func TestMetrics(t *testing.T) {
+	tm := leakytest.NewTestManager(t, leaky.WithMetrics(Metrics{}))
+	handler := tm.ThrottlingHandler(func(w http.ResponseWriter, r *http.Request) {}, 1, 0,
+		func(r http.Request) string { return "client" }, "expvar-test")
+	req, _ := http.NewRequest("GET", "", nil)
+
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	tm.Store.FailNext(errors.New("store down"))
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if got := count(t, "leaky.allowed", "expvar-test"); got != "2" {
+		t.Errorf("Counted %s allowed", got)
+	}
+	if got := count(t, "leaky.denied", "expvar-test"); got != "1" {
+		t.Errorf("Counted %s denied", got)
+	}
+	if got := count(t, "leaky.errors", "expvar-test"); got != "1" {
+		t.Errorf("Counted %s errors", got)
+	}
+
+	rt := handler.Stats().RoundTrips
+	if got := count(t, "leaky.round_trips", "expvar-test"); got != fmt.Sprint(rt) {
+		t.Errorf("Counted %s round trips, bucket made %d", got, rt)
+	}
+}
@@ -0,0 +1,121 @@
+package leaky
+
+import "math"
+
+// FailurePolicy decides the requests a bucket can't decide from the store, because the store failed
+// or the circuit breaker is open
+type FailurePolicy int
+
+const (
+	// FailOpen allows requests as if the client's bucket were empty, this is the default
+	FailOpen FailurePolicy = iota
+	// FailClosed rejects requests, for endpoints such as logins which mustn't be left unlimited
+	FailClosed
+	// FailLocal limits requests by state kept in the memory of each instance, starting from the state it last
+	// saw in the store. Each instance applies the bucket's limits on its own, divided between them if the
+	// manager has WithReplicas, until the store is back and its state takes over again.
+	FailLocal
+)
+
+// WithReplicas sets how many instances share the manager's store, so buckets failing locally can divide
+// their limits between them
+func WithReplicas(n int) ManagerOption {
+	return func(m *ThrottleManager) {
+		m.replicas = n
+	}
+}
+
+// WithFailurePolicy sets how the bucket decides requests while the store can't be used, the default is FailOpen
+func WithFailurePolicy(policy FailurePolicy) Option {
+	return func(b *Bucket) {
+		b.failure = policy
+		if policy == FailLocal && b.local == nil {
+			b.local = newExpiringMap[State](knownMaxEntries)
+		}
+	}
+}
+
+// failState is the state a client's bucket is taken to be in when it couldn't be read from the store,
+// it must be called before what was known to be stored for the key is forgotten
+func (b *Bucket) failState(lim limits, key string) State {
+	switch b.failure {
+	case FailClosed:
+		return b.newState(lim, 0)
+	case FailLocal:
+		local := b.localLimits(lim)
+
+		b.mu.Lock()
+		kept, ok := b.local.get(key, b.clock.Now())
+		b.mu.Unlock()
+
+		var state State
+		if ok {
+			// The space kept is of this instance's share of the limits
+			kept.Size, kept.Fingerprint = local.size, local.fingerprint
+			state = b.leak(local, kept)
+		} else if known := b.lookup(key); known.exists {
+			// Carry on from what was last seen in the store, migrated to this instance's share
+			state = b.leak(local, known.state)
+		} else {
+			state = b.fullState(local)
+		}
+
+		// Stamped with the bucket's limits, like the state which would have been written to the store
+		state.Size, state.Fingerprint = lim.size, lim.fingerprint
+		return state
+	}
+
+	return b.fullState(lim)
+}
+
+// localLimits are the limits applied by this instance alone, its share of the limits if the manager
+// knows how many replicas share them
+func (b *Bucket) localLimits(lim limits) limits {
+	if b.replicas <= 1 {
+		return lim
+	}
+
+	n := float64(b.replicas)
+	size := int(math.Ceil(float64(lim.size) / n))
+
+	return newLimits(size, lim.leakRate/n).withTTLOf(lim).withAlgorithmOf(lim)
+}
+
+// failTake decides demands without the store by the failure policy, returning how many drops each took
+// and the state each left behind
+func (b *Bucket) failTake(lim limits, key string, demands []Demand) ([]int, []State) {
+	taken := make([]int, len(demands))
+	after := make([]State, len(demands))
+
+	state := b.failState(lim, key)
+	total := 0
+	for i, d := range demands {
+		// Even reservations are refused, they would be admitted once their wait is over
+		if b.failure != FailClosed {
+			taken[i] = d.decide(state.SpaceRemaining)
+		}
+		state.SpaceRemaining -= float64(taken[i])
+		after[i] = state
+		total += taken[i]
+	}
+
+	if total > 0 {
+		b.localPut(lim, key, state)
+	}
+
+	return taken, after
+}
+
+// localPut keeps the state in memory for FailLocal, in place of the store it couldn't be written to
+func (b *Bucket) localPut(lim limits, key string, state State) {
+	if b.failure != FailLocal {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	local := b.localLimits(lim)
+	now := b.clock.Now()
+	b.local.set(key, state, now.Add(local.ttl(state)), now)
+}
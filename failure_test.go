@@ -0,0 +1,116 @@
+package leaky
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFailurePolicies(t *testing.T) {
+	paths := map[string][]RedisOption{
+		"script":   nil,
+		"pipeline": {WithScripting(false)},
+	}
+
+	for name, opts := range paths {
+		for _, coalesce := range []bool{false, true} {
+			tj := prepareTestJig(opts...)
+			tj.Close()
+
+			bucketOpts := func(policy FailurePolicy) []Option {
+				opts := []Option{WithFailurePolicy(policy)}
+				if coalesce {
+					opts = append(opts, WithCoalescing())
+				}
+				return opts
+			}
+
+			open := tj.ThrottleManager.ThrottlingHandler(handleFuncSuccessResponse, 2, 0, keyFunc, "open", bucketOpts(FailOpen)...)
+			closed := tj.ThrottleManager.ThrottlingHandler(handleFuncSuccessResponse, 2, 0, keyFunc, "closed", bucketOpts(FailClosed)...)
+			local := tj.ThrottleManager.ThrottlingHandler(handleFuncSuccessResponse, 2, 0, keyFunc, "local", bucketOpts(FailLocal)...)
+
+			for i := 0; i < 3; i++ {
+				if !open.Add(1, "test-key") {
+					t.Errorf("%s, coalescing %t: failing open rejected drop %d", name, coalesce, i)
+				}
+				if closed.Add(1, "test-key") {
+					t.Errorf("%s, coalescing %t: failing closed admitted drop %d", name, coalesce, i)
+				}
+				// The instance's own bucket fills up
+				if admitted := local.Add(1, "test-key"); admitted != (i < 2) {
+					t.Errorf("%s, coalescing %t: failing locally admitted drop %d %t", name, coalesce, i, admitted)
+				}
+			}
+
+			if fo := closed.Stats().FailOpens; fo != 3 {
+				t.Errorf("%s, coalescing %t: %d decisions counted without the store, expected 3", name, coalesce, fo)
+			}
+		}
+	}
+}
+
+func TestFailClosedRejectsRequests(t *testing.T) {
+	tj := prepareTestJig()
+	tj.Close()
+
+	bucket := tj.ThrottleManager.ThrottlingHandler(handleFuncSuccessResponse, 10, 60, keyFunc, "login", WithFailurePolicy(FailClosed))
+
+	req, _ := http.NewRequest("POST", "", nil)
+	w := httptest.NewRecorder()
+	bucket.ServeHTTP(w, req)
+
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("Status not TooManyRequests with the store down: %v", w.Code)
+	}
+
+	if wait := bucket.Reserve(ctx, "test-key", 1); wait != InfDuration {
+		t.Errorf("Reservation made with the store down, waiting %s", wait)
+	}
+}
+
+func TestFailLocalDividesBetweenReplicas(t *testing.T) {
+	tj := prepareTestJig()
+	tj.Close()
+
+	tm := NewThrottleManagerWithStore(tj.ThrottleManager.store, WithReplicas(2))
+	bucket := tm.ThrottlingHandler(handleFuncSuccessResponse, 4, 0, keyFunc, "local", WithFailurePolicy(FailLocal))
+
+	for i := 0; i < 3; i++ {
+		if admitted := bucket.Add(1, "test-key"); admitted != (i < 2) {
+			t.Errorf("Failing locally with 2 replicas admitted drop %d %t", i, admitted)
+		}
+	}
+}
+
+func TestFailLocalResyncs(t *testing.T) {
+	tj := prepareTestJig()
+	defer tj.Close()
+
+	bucket := tj.ThrottleManager.ThrottlingHandler(handleFuncSuccessResponse, 4, 0, keyFunc, "local", WithFailurePolicy(FailLocal))
+
+	if accepted, _ := bucket.AddUpTo(3, "test-key"); accepted != 3 {
+		t.Fatal("Drops not added with the store up")
+	}
+
+	tj.miniRedis.Close()
+
+	// Carries on from the state last seen in the store
+	if !bucket.Add(1, "test-key") {
+		t.Error("Failing locally rejected the drop left in the stored state")
+	}
+	if bucket.Add(1, "test-key") {
+		t.Error("Failing locally admitted a drop beyond the stored state")
+	}
+
+	if err := tj.miniRedis.Restart(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The store's state takes over again, which didn't see the drop added locally
+	if !bucket.Add(1, "test-key") {
+		t.Error("Drop left in the store rejected once it was back")
+	}
+	if bucket.Add(1, "test-key") {
+		t.Error("Drop admitted beyond the store's state once it was back")
+	}
+}
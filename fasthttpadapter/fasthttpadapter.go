@@ -0,0 +1,61 @@
+// Package fasthttpadapter throttles fasthttp request handlers with leaky buckets directly, without
+// going through net/http
+//
+//	handler := fasthttpadapter.New(tm.ThrottlingHandler(nil, 10, 60, nil, "proxy"), nil, proxy.Handler)
+//	fasthttp.ListenAndServe(":8080", handler)
+package fasthttpadapter
+
+import (
+	"net/http"
+
+	"github.com/2bytes/leaky"
+	"github.com/valyala/fasthttp"
+)
+
+// decisionKey is the user value the bucket's decision is stored under
+const decisionKey = "leaky.decision"
+
+// KeyFunc identifies the client making a request from its fasthttp context
+type KeyFunc func(ctx *fasthttp.RequestCtx) string
+
+// KeyByIP keys on the IP address the request came from
+func KeyByIP(ctx *fasthttp.RequestCtx) string {
+	return ctx.RemoteIP().String()
+}
+
+// New throttles next with the bucket, identifying clients by keyFunc or KeyByIP if it is nil.
+// The rate limit headers are set on every response, and requests the bucket rejects are answered with
+// 429 Too Many Requests and Retry-After without reaching next. The bucket's Rejection and KeyFunc, and any
+// concurrency limit stacked on it, aren't used.
+func New(b *leaky.Bucket, keyFunc KeyFunc, next fasthttp.RequestHandler) fasthttp.RequestHandler {
+	if keyFunc == nil {
+		keyFunc = KeyByIP
+	}
+
+	return func(ctx *fasthttp.RequestCtx) {
+		h := http.Header{}
+		d, ok := b.AdmitKey(ctx, h, keyFunc(ctx))
+		for name, values := range h {
+			for _, v := range values {
+				ctx.Response.Header.Add(name, v)
+			}
+		}
+
+		if !ok {
+			// Not ctx.Error, which resets the response and so the headers set above
+			ctx.SetStatusCode(fasthttp.StatusTooManyRequests)
+			ctx.SetContentType("text/plain; charset=utf-8")
+			ctx.SetBodyString("Rate Limit Exceeded")
+			return
+		}
+
+		ctx.SetUserValue(decisionKey, d)
+		next(ctx)
+	}
+}
+
+// DecisionFromRequestCtx returns the decision of the bucket which admitted the request, if there is one
+func DecisionFromRequestCtx(ctx *fasthttp.RequestCtx) (leaky.Decision, bool) {
+	d, ok := ctx.UserValue(decisionKey).(leaky.Decision)
+	return d, ok
+}
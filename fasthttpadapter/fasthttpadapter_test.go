@@ -0,0 +1,59 @@
+package fasthttpadapter
+
+import (
+	"net"
+	"testing"
+
+	"github.com/2bytes/leaky/leakytest"
+	"github.com/valyala/fasthttp"
+)
+
+func request(ip string) *fasthttp.RequestCtx {
+	var req fasthttp.Request
+	req.SetRequestURI("/")
+
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Init(&req, &net.TCPAddr{IP: net.ParseIP(ip), Port: 1234}, nil)
+	return ctx
+}
+
+func TestNew(t *testing.T) {
+	tm := leakytest.NewTestManager(t)
+
+	reached := 0
+	handler := New(tm.ThrottlingHandler(nil, 1, 60, nil, "test"), nil, func(ctx *fasthttp.RequestCtx) {
+		if _, ok := DecisionFromRequestCtx(ctx); !ok {
+			t.Error("Decision not passed to the handler")
+		}
+		reached++
+	})
+
+	ctx := request("10.0.0.1")
+	handler(ctx)
+	if ctx.Response.StatusCode() != fasthttp.StatusOK {
+		t.Errorf("Status not OK: %v", ctx.Response.StatusCode())
+	}
+	if remaining := string(ctx.Response.Header.Peek("X-RateLimit-Remaining")); remaining != "0" {
+		t.Errorf("X-RateLimit-Remaining %q", remaining)
+	}
+
+	ctx = request("10.0.0.1")
+	handler(ctx)
+	if ctx.Response.StatusCode() != fasthttp.StatusTooManyRequests {
+		t.Errorf("Status not TooManyRequests: %v", ctx.Response.StatusCode())
+	}
+	if retry := string(ctx.Response.Header.Peek("Retry-After")); retry != "1" {
+		t.Errorf("Retry-After %q", retry)
+	}
+	if limit := string(ctx.Response.Header.Peek("X-RateLimit-Limit")); limit != "1" {
+		t.Errorf("X-RateLimit-Limit %q on the rejection", limit)
+	}
+	if body := string(ctx.Response.Body()); body != "Rate Limit Exceeded" {
+		t.Errorf("Rejection body %q", body)
+	}
+
+	handler(request("10.0.0.2"))
+	if reached != 2 {
+		t.Errorf("Handler reached %d times, expected 2", reached)
+	}
+}
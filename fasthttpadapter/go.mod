@@ -0,0 +1,19 @@
+module github.com/2bytes/leaky/fasthttpadapter
+
+go 1.20
+
+require (
+	github.com/2bytes/leaky v0.1.1
+	github.com/valyala/fasthttp v1.50.0
+)
+
+require (
+	github.com/andybalholm/brotli v1.0.5 // indirect
+	github.com/cespare/xxhash/v2 v2.2.0 // indirect
+	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
+	github.com/klauspost/compress v1.16.3 // indirect
+	github.com/redis/go-redis/v9 v9.0.2 // indirect
+	github.com/valyala/bytebufferpool v1.0.0 // indirect
+)
+
+replace github.com/2bytes/leaky => ../
@@ -0,0 +1,50 @@
+// Package fiberadapter throttles Fiber routes with leaky buckets. Fiber is built on fasthttp rather than
+// net/http, so clients are identified from the Fiber context and the bucket is used without an http.Request.
+//
+//	app := fiber.New()
+//	app.Use(fiberadapter.Middleware(tm, 10, 60, (*fiber.Ctx).IP, "api"))
+package fiberadapter
+
+import (
+	"net/http"
+
+	"github.com/2bytes/leaky"
+	"github.com/gofiber/fiber/v2"
+)
+
+// KeyFunc identifies the client making a request from its Fiber context
+type KeyFunc func(c *fiber.Ctx) string
+
+// Middleware creates a bucket with the manager, as ThrottlingHandler, throttling the routes it is used on
+func Middleware(tm *leaky.ThrottleManager, size int, rate int, keyFunc KeyFunc, bucketName string, opts ...leaky.Option) fiber.Handler {
+	b := tm.ThrottlingHandler(nil, size, rate, func(r http.Request) string { return "" }, bucketName, opts...)
+	return New(b, keyFunc)
+}
+
+// New throttles the routes it is used on with the bucket, identifying clients by keyFunc, or by their IP
+// address if it is nil. Rejected requests return fiber.ErrTooManyRequests, for the app's ErrorHandler to
+// respond with, after the rate limit headers and Retry-After are set on the response. The bucket's Rejection
+// and KeyFunc, and any concurrency limit stacked on it, aren't used. Handlers further on find the bucket's
+// decision in the user context.
+func New(b *leaky.Bucket, keyFunc KeyFunc) fiber.Handler {
+	if keyFunc == nil {
+		keyFunc = (*fiber.Ctx).IP
+	}
+
+	return func(c *fiber.Ctx) error {
+		h := http.Header{}
+		d, ok := b.AdmitKey(c.UserContext(), h, keyFunc(c))
+		for name, values := range h {
+			for _, v := range values {
+				c.Response().Header.Add(name, v)
+			}
+		}
+
+		if !ok {
+			return fiber.ErrTooManyRequests
+		}
+
+		c.SetUserContext(leaky.ContextWithDecision(c.UserContext(), d))
+		return c.Next()
+	}
+}
@@ -0,0 +1,52 @@
+package fiberadapter
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/2bytes/leaky"
+	"github.com/2bytes/leaky/leakytest"
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestMiddleware(t *testing.T) {
+	tm := leakytest.NewTestManager(t)
+
+	app := fiber.New()
+	app.Use(Middleware(tm.ThrottleManager, 1, 60, func(c *fiber.Ctx) string { return c.Query("client") }, "test"))
+	app.Get("/", func(c *fiber.Ctx) error {
+		d, ok := leaky.DecisionFromContext(c.UserContext())
+		if !ok {
+			t.Error("Decision not passed down the chain")
+		}
+		return c.SendString(d.KeyID)
+	})
+
+	resp, err := app.Test(httptest.NewRequest("GET", "/?client=alice", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Status not OK: %v", resp.StatusCode)
+	}
+
+	resp, err = app.Test(httptest.NewRequest("GET", "/?client=alice", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("Status not TooManyRequests: %v", resp.StatusCode)
+	}
+	if resp.Header.Get("Retry-After") != "1" || resp.Header.Get("X-RateLimit-Remaining") != "0" {
+		t.Errorf("Rate limit headers not set: %v", resp.Header)
+	}
+
+	resp, err = app.Test(httptest.NewRequest("GET", "/?client=bob", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Status not OK for another client: %v", resp.StatusCode)
+	}
+}
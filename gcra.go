@@ -0,0 +1,59 @@
+package leaky
+
+import (
+	"math"
+	"time"
+)
+
+// WithGCRA stores each client's state as the single time of the generic cell rate algorithm, the theoretical
+// arrival time at which their bucket will have fully leaked, rather than the space remaining and when it was
+// last updated. Requests are admitted just as they are otherwise, with half the state stored. State stored
+// before is migrated, and buckets which don't leak store their state as usual.
+func WithGCRA() Option {
+	return func(b *Bucket) {
+		b.limits = b.limits.withGCRA(true)
+	}
+}
+
+// withGCRA returns the limits storing state by GCRA if enabled
+func (l limits) withGCRA(enabled bool) limits {
+	l.gcra = enabled
+
+	algorithm := algorithmLeaky
+	if enabled {
+		algorithm = algorithmGCRA
+	}
+	l.fingerprint = configFingerprint(algorithm, l.size, l.leakRate)
+
+	return l
+}
+
+// withAlgorithmOf returns the limits storing state the same way as other does
+func (l limits) withAlgorithmOf(other limits) limits {
+	return l.withGCRA(other.gcra)
+}
+
+// stored returns the state as it is written to the store, as its theoretical arrival time for GCRA
+func (l limits) stored(state State) State {
+	if !l.gcra || l.leakRate <= 0 || !state.TAT.IsZero() {
+		return state
+	}
+
+	drain := (float64(l.size) - state.SpaceRemaining) / l.leakRate
+	return State{
+		TAT:         state.LastUpdate.Add(time.Duration(drain * float64(time.Millisecond))),
+		Fingerprint: state.Fingerprint,
+	}
+}
+
+// fromTAT returns the space remaining now in a bucket stored as its theoretical arrival time, keeping the
+// fingerprint it was stored under so it can be migrated. It has no size, so can only be clamped.
+func (b *Bucket) fromTAT(lim limits, state State) State {
+	backlog := float64(state.TAT.Sub(b.clock.Now())) / float64(time.Millisecond)
+
+	leaked := b.newState(lim, float64(lim.size)-math.Max(0, backlog)*lim.leakRate)
+	leaked.Fingerprint = state.Fingerprint
+	leaked.Size = 0
+
+	return leaked
+}
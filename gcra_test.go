@@ -0,0 +1,97 @@
+package leaky
+
+import (
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGCRAMatchesLeaky(t *testing.T) {
+	for _, scripting := range []bool{true, false} {
+		tj := prepareTestJig(WithScripting(scripting))
+
+		clock := &testClock{now: time.Date(2023, 3, 1, 12, 0, 0, 0, time.UTC)}
+		leaky := tj.ThrottleManager.ThrottlingHandler(handleFuncSuccessResponse, 5, 7, keyFunc, "leaky", WithBucketClock(clock))
+		gcra := tj.ThrottleManager.ThrottlingHandler(handleFuncSuccessResponse, 5, 7, keyFunc, "gcra", WithBucketClock(clock), WithGCRA())
+
+		steps := []struct {
+			advance time.Duration
+			count   int
+		}{
+			{0, 3}, {0, 3}, {time.Second, 2}, {4 * time.Second, 1}, {3*time.Second + 7*time.Millisecond, 2},
+			{0, 5}, {13 * time.Second, 4}, {time.Minute, 5}, {0, 1},
+		}
+
+		for i, step := range steps {
+			clock.now = clock.now.Add(step.advance)
+
+			leakyTaken, leakyWait := leaky.AddUpTo(step.count, "test-key")
+			gcraTaken, gcraWait := gcra.AddUpTo(step.count, "test-key")
+			if leakyTaken != gcraTaken || leakyWait != gcraWait {
+				t.Errorf("Scripting %t, step %d: GCRA took %d waiting %s, leaky bucket took %d waiting %s",
+					scripting, i, gcraTaken, gcraWait, leakyTaken, leakyWait)
+			}
+
+			leakyLeft, _ := leaky.Remaining(ctx, "test-key")
+			gcraLeft, _ := gcra.Remaining(ctx, "test-key")
+			if leakyLeft != gcraLeft {
+				t.Errorf("Scripting %t, step %d: GCRA has %d remaining, leaky bucket %d", scripting, i, gcraLeft, leakyLeft)
+			}
+		}
+
+		tj.Close()
+	}
+}
+
+func TestGCRAStoresTAT(t *testing.T) {
+	for _, scripting := range []bool{true, false} {
+		tj := prepareTestJig(WithScripting(scripting))
+
+		now := time.Date(2023, 3, 1, 12, 0, 0, 0, time.UTC)
+		clock := &testClock{now: now}
+		bucket := tj.ThrottleManager.ThrottlingHandler(handleFuncSuccessResponse, 5, 60, keyFunc, "test", WithBucketClock(clock), WithGCRA())
+
+		if !bucket.Add(3, "test-key") {
+			t.Fatal("Drops rejected")
+		}
+
+		fields, err := tj.miniRedis.HKeys(testKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(fields)
+		if strings.Join(fields, ",") != "fingerprint,tat" {
+			t.Errorf("Scripting %t: stored fields %v, expected only the fingerprint and TAT", scripting, fields)
+		}
+
+		// Three drops at one a second are leaked three seconds from now
+		tat, err := time.Parse(time.RFC3339Nano, tj.miniRedis.HGet(testKey, "tat"))
+		if err != nil || !tat.Equal(now.Add(3*time.Second)) {
+			t.Errorf("Scripting %t: stored TAT %s, %v", scripting, tat, err)
+		}
+
+		tj.Close()
+	}
+}
+
+func TestGCRAMigration(t *testing.T) {
+	tj := prepareTestJig()
+	defer tj.Close()
+
+	clock := &testClock{now: time.Now()}
+	before := tj.ThrottleManager.ThrottlingHandler(handleFuncSuccessResponse, 5, 60, keyFunc, "test", WithBucketClock(clock))
+	before.Add(3, "test-key")
+
+	gcra := tj.ThrottleManager.ThrottlingHandler(handleFuncSuccessResponse, 5, 60, keyFunc, "test", WithBucketClock(clock), WithGCRA())
+	if remaining, _ := gcra.Remaining(ctx, "test-key"); remaining != 2 {
+		t.Errorf("GCRA has %d remaining of the leaky bucket's state, expected 2", remaining)
+	}
+
+	gcra.Add(1, "test-key")
+
+	after := tj.ThrottleManager.ThrottlingHandler(handleFuncSuccessResponse, 5, 60, keyFunc, "test", WithBucketClock(clock))
+	if remaining, _ := after.Remaining(ctx, "test-key"); remaining != 1 {
+		t.Errorf("Leaky bucket has %d remaining of GCRA's state, expected 1", remaining)
+	}
+}
@@ -0,0 +1,35 @@
+// Package ginadapter throttles Gin routes with leaky buckets
+//
+//	r := gin.New()
+//	r.Use(ginadapter.Middleware(tm, 10, 60, keyFunc, "api"))
+package ginadapter
+
+import (
+	"net/http"
+
+	"github.com/2bytes/leaky"
+	"github.com/gin-gonic/gin"
+)
+
+// Middleware creates a bucket with the manager, as ThrottlingHandler, throttling the routes it is used on
+func Middleware(tm *leaky.ThrottleManager, size int, rate int, keyFunc leaky.KeyFunc, bucketName string, opts ...leaky.Option) gin.HandlerFunc {
+	return New(tm.ThrottlingHandler(nil, size, rate, keyFunc, bucketName, opts...))
+}
+
+// New throttles the routes it is used on with the bucket, in place of its own handler. The rate limit headers
+// are set on the Gin context's writer, and requests the bucket rejects are aborted after the rejection is
+// written, so no later handlers run. The rest of the chain sees the request carrying the bucket's decision.
+func New(b *leaky.Bucket) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		passed := false
+		b.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			passed = true
+			c.Request = r
+			c.Next()
+		})).ServeHTTP(c.Writer, c.Request)
+
+		if !passed {
+			c.Abort()
+		}
+	}
+}
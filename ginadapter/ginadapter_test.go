@@ -0,0 +1,53 @@
+package ginadapter
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/2bytes/leaky"
+	"github.com/2bytes/leaky/leakytest"
+	"github.com/gin-gonic/gin"
+)
+
+func keyFunc(r http.Request) string {
+	return "test-key"
+}
+
+func TestMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tm := leakytest.NewTestManager(t)
+
+	reached := 0
+	r := gin.New()
+	r.Use(Middleware(tm.ThrottleManager, 1, 60, keyFunc, "test"))
+	r.GET("/", func(c *gin.Context) {
+		reached++
+		if _, ok := leaky.DecisionFromContext(c.Request.Context()); !ok {
+			t.Error("Decision not passed down the chain")
+		}
+		c.String(http.StatusOK, "ok")
+	})
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("Status not OK: %v", w.Code)
+	}
+	if w.Header().Get("X-RateLimit-Remaining") != "0" {
+		t.Errorf("Rate limit headers not set: %v", w.Header())
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("Status not TooManyRequests: %v", w.Code)
+	}
+	if w.Header().Get("Retry-After") != "1" {
+		t.Errorf("Retry-After not set: %v", w.Header())
+	}
+
+	if reached != 1 {
+		t.Errorf("Handler reached %d times, the rejected request wasn't aborted", reached)
+	}
+}
@@ -5,6 +5,7 @@ go 1.20
 require (
 	github.com/alicebob/miniredis/v2 v2.30.0
 	github.com/redis/go-redis/v9 v9.0.2
+	go.uber.org/goleak v1.2.1
 )
 
 require (
@@ -0,0 +1,149 @@
+// Package grpcadapter throttles gRPC services with leaky buckets, limiting calls and the messages
+// received on streams so long-lived streams can't get round the limits
+//
+//	calls := tm.ThrottlingHandler(nil, 10, 60, nil, "calls")
+//	messages := tm.ThrottlingHandler(nil, 100, 600, nil, "messages")
+//	srv := grpc.NewServer(
+//		grpc.UnaryInterceptor(grpcadapter.UnaryServerInterceptor(calls, nil)),
+//		grpc.StreamInterceptor(grpcadapter.StreamServerInterceptor(calls, messages, nil)),
+//	)
+package grpcadapter
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/2bytes/leaky"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// KeyFunc identifies the client making a call to the method named fullMethod
+type KeyFunc func(ctx context.Context, fullMethod string) string
+
+// KeyByPeer keys on the address of the peer making the call, without its port
+func KeyByPeer(ctx context.Context, fullMethod string) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return leaky.MissingKey
+	}
+
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		return p.Addr.String()
+	}
+
+	return host
+}
+
+// UnaryServerInterceptor limits the calls clients make with the bucket, identifying them by keyFunc or
+// KeyByPeer if it is nil. Calls rejected fail with ResourceExhausted, with RetryInfo saying when to retry,
+// and every call has the bucket's rate limit headers as header metadata.
+func UnaryServerInterceptor(b *leaky.Bucket, keyFunc KeyFunc) grpc.UnaryServerInterceptor {
+	if keyFunc == nil {
+		keyFunc = KeyByPeer
+	}
+
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		h := http.Header{}
+		d, ok := b.AdmitKey(ctx, h, keyFunc(ctx, info.FullMethod))
+		grpc.SetHeader(ctx, headerMetadata(h))
+
+		if !ok {
+			return nil, exhausted(d)
+		}
+
+		return handler(leaky.ContextWithDecision(ctx, d), req)
+	}
+}
+
+// StreamServerInterceptor limits the streams clients open with the streams bucket, and every message received
+// on them with the messages bucket, either of which can be nil. Clients are identified once per stream, by
+// keyFunc or KeyByPeer if it is nil. Streams rejected fail with ResourceExhausted, as do receives of messages
+// over the limit, which the handler should return to end the stream.
+func StreamServerInterceptor(streams *leaky.Bucket, messages *leaky.Bucket, keyFunc KeyFunc) grpc.StreamServerInterceptor {
+	if keyFunc == nil {
+		keyFunc = KeyByPeer
+	}
+
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx := ss.Context()
+		keyID := keyFunc(ctx, info.FullMethod)
+
+		if streams != nil {
+			h := http.Header{}
+			d, ok := streams.AdmitKey(ctx, h, keyID)
+			ss.SetHeader(headerMetadata(h))
+
+			if !ok {
+				return exhausted(d)
+			}
+			ctx = leaky.ContextWithDecision(ctx, d)
+		}
+
+		ss = &limitedStream{ServerStream: ss, ctx: ctx, messages: messages, keyID: keyID}
+		return handler(srv, ss)
+	}
+}
+
+// limitedStream limits the messages received on a stream
+type limitedStream struct {
+	grpc.ServerStream
+	ctx      context.Context
+	messages *leaky.Bucket
+	keyID    string
+}
+
+func (s *limitedStream) Context() context.Context {
+	return s.ctx
+}
+
+// RecvMsg receives a message, then fails if the client is over their limit of messages. Messages are counted
+// once received, so a client waiting to send isn't counted.
+func (s *limitedStream) RecvMsg(m interface{}) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+
+	if s.messages == nil {
+		return nil
+	}
+
+	if d, ok := s.messages.AdmitKey(s.ctx, http.Header{}, s.keyID); !ok {
+		return exhausted(d)
+	}
+
+	return nil
+}
+
+// exhausted is the error for a call or message rejected by the decision, with how long until
+// the client may retry if it's known
+func exhausted(d leaky.Decision) error {
+	st := status.New(codes.ResourceExhausted, "rate limit exceeded")
+	if d.RetryAfter <= 0 || d.RetryAfter == leaky.InfDuration {
+		return st.Err()
+	}
+
+	if detailed, err := st.WithDetails(&errdetails.RetryInfo{RetryDelay: durationpb.New(d.RetryAfter)}); err == nil {
+		st = detailed
+	}
+
+	return st.Err()
+}
+
+// headerMetadata converts the rate limit headers to metadata, whose keys are lower case
+func headerMetadata(h http.Header) metadata.MD {
+	md := metadata.MD{}
+	for name, values := range h {
+		md.Append(strings.ToLower(name), values...)
+	}
+
+	return md
+}
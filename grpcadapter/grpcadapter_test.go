@@ -0,0 +1,77 @@
+package grpcadapter
+
+import (
+	"context"
+	"testing"
+
+	"github.com/2bytes/leaky/leakytest"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// testStream is a stream with a message always waiting to be received
+type testStream struct {
+	grpc.ServerStream
+	header metadata.MD
+}
+
+func (s *testStream) Context() context.Context {
+	return context.Background()
+}
+
+func (s *testStream) SetHeader(md metadata.MD) error {
+	s.header = metadata.Join(s.header, md)
+	return nil
+}
+
+func (s *testStream) RecvMsg(m interface{}) error {
+	return nil
+}
+
+func keyFunc(ctx context.Context, fullMethod string) string {
+	return "test-key"
+}
+
+func TestStreamMessagesLimited(t *testing.T) {
+	tm := leakytest.NewTestManager(t)
+	streams := tm.ThrottlingHandler(nil, 1, 60, nil, "streams")
+	messages := tm.ThrottlingHandler(nil, 3, 60, nil, "messages")
+
+	interceptor := StreamServerInterceptor(streams, messages, keyFunc)
+	info := &grpc.StreamServerInfo{FullMethod: "/test.Service/Stream"}
+
+	received := 0
+	handler := func(srv interface{}, ss grpc.ServerStream) error {
+		for {
+			if err := ss.RecvMsg(nil); err != nil {
+				return err
+			}
+			received++
+		}
+	}
+
+	ss := &testStream{}
+	err := interceptor(nil, ss, info, handler)
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("Stream ended with %v, expected ResourceExhausted", err)
+	}
+	if received != 3 {
+		t.Errorf("%d messages received, expected 3", received)
+	}
+	if v := ss.header.Get("x-ratelimit-remaining"); len(v) != 1 || v[0] != "0" {
+		t.Errorf("Rate limit headers not sent: %v", ss.header)
+	}
+
+	// The client can't open another stream
+	err = interceptor(nil, &testStream{}, info, handler)
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("Stream opened over the limit: %v", err)
+	}
+
+	st, _ := status.FromError(err)
+	if len(st.Details()) != 1 {
+		t.Errorf("Rejection without retry info: %v", st.Details())
+	}
+}
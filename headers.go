@@ -0,0 +1,127 @@
+package leaky
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HeaderScheme decides the headers a bucket describes the client's limit with on its responses
+type HeaderScheme int
+
+const (
+	// XRateLimitHeaders sends the de facto X-RateLimit-Limit, X-RateLimit-Remaining and X-RateLimit-Reset
+	// headers, with the reset in seconds until the client's bucket has fully leaked. This is the default.
+	XRateLimitHeaders HeaderScheme = iota
+	// NoRateLimitHeaders sends none, rejected requests still have Retry-After
+	NoRateLimitHeaders
+	// IETFRateLimitHeaders sends the RateLimit-Policy and RateLimit fields of the IETF draft
+	// draft-ietf-httpapi-ratelimit-headers, naming the policy after the bucket. Its quota is the bucket's size
+	// and its window how long a full bucket takes to leak, the reset is when the client's bucket has fully leaked.
+	// A TieredBucket lists a policy for each of its tiers.
+	IETFRateLimitHeaders
+)
+
+// WithHeaderScheme sets the headers describing the client's limit sent on every response, allowed or rejected
+func WithHeaderScheme(scheme HeaderScheme) Option {
+	return func(b *Bucket) {
+		b.headers = scheme
+	}
+}
+
+// setRateLimitHeaders describes the client's bucket, left in state under the limits, by the scheme
+func setRateLimitHeaders(h http.Header, scheme HeaderScheme, bucketName string, lim limits, state State) {
+	setPolicyHeaders(h, scheme, []policy{{name: bucketName, lim: lim, state: state}})
+}
+
+// policy is one of the limits a client is held to, such as a tier of a TieredBucket, and the state
+// their bucket for it was left in
+type policy struct {
+	name  string
+	lim   limits
+	state State
+}
+
+// remaining is how many more requests fit under the policy
+func (p policy) remaining() int {
+	return int(math.Max(0, wholeDrops(p.state.SpaceRemaining)))
+}
+
+// reset is the seconds until the client's bucket has fully leaked, empty if it never will
+func (p policy) reset() string {
+	if p.lim.leakRate <= 0 {
+		return ""
+	}
+
+	return strconv.FormatInt(seconds(p.lim.drainTime(math.Max(0, float64(p.lim.size)-p.state.SpaceRemaining))), 10)
+}
+
+// setPolicyHeaders describes every policy the client is held to by the scheme. The X-RateLimit headers
+// can only describe one, so describe the policy with the fewest requests remaining.
+func setPolicyHeaders(h http.Header, scheme HeaderScheme, policies []policy) {
+	switch scheme {
+	case XRateLimitHeaders:
+		p := policies[0]
+		for _, other := range policies[1:] {
+			if other.remaining() < p.remaining() {
+				p = other
+			}
+		}
+
+		h.Set("X-RateLimit-Limit", strconv.Itoa(p.lim.size))
+		h.Set("X-RateLimit-Remaining", strconv.Itoa(p.remaining()))
+		if reset := p.reset(); reset != "" {
+			h.Set("X-RateLimit-Reset", reset)
+		}
+	case IETFRateLimitHeaders:
+		policyFields := make([]string, len(policies))
+		limitFields := make([]string, len(policies))
+		for i, p := range policies {
+			name := sfString(p.name)
+			policyFields[i] = name + ";q=" + strconv.Itoa(p.lim.size)
+			limitFields[i] = name + ";r=" + strconv.Itoa(p.remaining())
+			if reset := p.reset(); reset != "" {
+				policyFields[i] += ";w=" + strconv.FormatInt(seconds(p.lim.drainTime(float64(p.lim.size))), 10)
+				limitFields[i] += ";t=" + reset
+			}
+		}
+		h.Set("RateLimit-Policy", strings.Join(policyFields, ", "))
+		h.Set("RateLimit", strings.Join(limitFields, ", "))
+	}
+}
+
+// sfString quotes s as a structured field string, which can only hold printable ASCII,
+// dropping any other characters
+func sfString(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c < 0x20 || c > 0x7e {
+			continue
+		}
+		if c == '"' || c == '\\' {
+			b.WriteByte('\\')
+		}
+		b.WriteByte(c)
+	}
+	b.WriteByte('"')
+
+	return b.String()
+}
+
+// setRetryAfter sets the Retry-After header to the wait in whole seconds, unless the wait is forever
+func setRetryAfter(h http.Header, wait time.Duration) {
+	if wait == InfDuration {
+		return
+	}
+
+	h.Set("Retry-After", strconv.FormatInt(seconds(wait), 10))
+}
+
+// seconds rounds the duration up to whole seconds, so a client waiting that long finds it has passed
+func seconds(d time.Duration) int64 {
+	return int64(math.Ceil(d.Seconds()))
+}
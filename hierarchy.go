@@ -0,0 +1,55 @@
+package leaky
+
+import (
+	"strings"
+	"time"
+)
+
+// Level is one level of a hierarchy of limits, such as a tenant's organization, a user within it and an
+// endpoint they call. Key identifies the request at this level alone, such as the user, and is scoped by the
+// keys of the levels above, so two organizations' users with the same name have separate buckets.
+// Rate drops leak every Per from a bucket of Size, Per is a minute if not set.
+type Level struct {
+	Name string
+	Key  KeyFunc
+	Size int
+	Rate int
+	Per  time.Duration
+	// Options configure this level's bucket, after those given for every level
+	Options []Option
+}
+
+// HierarchyHandler creates a new handler wrapper admitting requests only when every level of the hierarchy,
+// in order from the top, has space for them, such as an organization-wide cap and a cap per seat.
+// The levels are a chain, so the drops are taken from every level or none. Each level's bucket is named after
+// the hierarchy and the level, such as "api::org", so can be found with Bucket to set a single client's limits
+// at that level with SetKeyLimits, keyed by LevelKey, when it has WithKeyLimits.
+func (m *ThrottleManager) HierarchyHandler(handler Handler, levels []Level, bucketName string, opts ...Option) *ChainedBucket {
+	buckets := make([]*Bucket, len(levels))
+	path := make([]KeyFunc, 0, len(levels))
+
+	for i, level := range levels {
+		path = append(path, level.Key)
+		keyFunc := CombineKeyFuncs("/", path...)
+
+		lim := Tier{Size: level.Size, Rate: level.Rate, Per: level.Per}.limits()
+		levelOpts := append(append([]Option(nil), opts...), level.Options...)
+		buckets[i] = m.newBucket(nil, lim, keyFunc, bucketName+"::"+level.Name, levelOpts)
+	}
+
+	return m.Chain(handler, bucketName, buckets...)
+}
+
+// LevelKey returns the key a level's bucket keeps state under for the keys of the levels down to it,
+// such as LevelKey("acme", "alice") for the user alice of the organization acme
+func LevelKey(keys ...string) string {
+	var key strings.Builder
+	for i, part := range keys {
+		if i > 0 {
+			key.WriteString("/")
+		}
+		writeKeyPart(&key, part, '/')
+	}
+
+	return key.String()
+}
@@ -0,0 +1,59 @@
+package leaky_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/2bytes/leaky"
+	"github.com/2bytes/leaky/leakytest"
+)
+
+func TestHierarchy(t *testing.T) {
+	tm := leakytest.NewTestManager(t)
+	handler := tm.HierarchyHandler(handleFuncSuccessResponse, []leaky.Level{
+		{Name: "org", Key: leaky.KeyByHeader("X-Org"), Size: 3, Options: []leaky.Option{leaky.WithKeyLimits(0)}},
+		{Name: "user", Key: leaky.KeyByHeader("X-User"), Size: 2},
+	}, "api")
+
+	serve := func(org string, user string) int {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("X-Org", org)
+		r.Header.Set("X-User", user)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	for i, want := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		if code := serve("acme", "alice"); code != want {
+			t.Errorf("Request %d from alice: status %v, expected %v", i, code, want)
+		}
+	}
+
+	// The organization has room for one more of any of its users
+	if code := serve("acme", "bob"); code != http.StatusOK {
+		t.Errorf("First request from bob: status %v", code)
+	}
+	if code := serve("acme", "bob"); code != http.StatusTooManyRequests {
+		t.Errorf("Request over the organization's cap: status %v", code)
+	}
+
+	// Users are scoped by their organization
+	if code := serve("globex", "alice"); code != http.StatusOK {
+		t.Errorf("Alice of another organization: status %v", code)
+	}
+
+	// An organization's cap can be set apart from the others'
+	org, _ := tm.Bucket("api::org")
+	if err := org.SetKeyLimits(context.Background(), leaky.LevelKey("initech"), leaky.KeyLimits{Size: 1}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		if code := serve("initech", "peter"); code != want {
+			t.Errorf("Request %d under the organization's own cap: status %v, expected %v", i, code, want)
+		}
+	}
+}
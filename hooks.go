@@ -0,0 +1,58 @@
+package leaky
+
+import "context"
+
+// DecisionHook is called with each decision a bucket makes and the drops the request demanded, from the
+// context of the request. It is called on the path of the request, so should return quickly.
+type DecisionHook func(ctx context.Context, d Decision, cost int)
+
+// StoreErrorHook is called with each failed call a bucket makes to the store for a client, before the
+// request is decided by the failure policy. Calls cut short by the circuit breaker aren't errors.
+type StoreErrorHook func(ctx context.Context, bucketName string, keyID string, err error)
+
+// OnAllow calls hook with each request the bucket allows, such as for auditing
+func OnAllow(hook DecisionHook) Option {
+	return func(b *Bucket) {
+		b.onAllow = hook
+	}
+}
+
+// OnDeny calls hook with each request the bucket rejects, such as for alerting or blocking abusive
+// clients. The decision's RetryAfter is how long until the drops demanded fit.
+func OnDeny(hook DecisionHook) Option {
+	return func(b *Bucket) {
+		b.onDeny = hook
+	}
+}
+
+// OnStoreError calls hook with each failed call the bucket makes to the store
+func OnStoreError(hook StoreErrorHook) Option {
+	return func(b *Bucket) {
+		b.onStoreError = hook
+	}
+}
+
+// hookDecision calls the hook for the decision to take drops, leaving the client's bucket in state
+func (b *Bucket) hookDecision(ctx context.Context, lim limits, keyID string, demand Demand, allowed bool, state State) {
+	if allowed && b.onAllow != nil {
+		b.onAllow(ctx, newDecision(b.bucketName, keyID, lim, state), demand.Count)
+	} else if !allowed && b.onDeny != nil {
+		d := newDecision(b.bucketName, keyID, lim, state)
+		d.RetryAfter = lim.waitFor(demand.Count+demand.Keep, state)
+		b.onDeny(ctx, d, demand.Count)
+	}
+}
+
+// storeFailed logs a failed call to the store for the client and calls the hook, unless the breaker
+// cut it short
+func (b *Bucket) storeFailed(ctx context.Context, logf func(msg string, args ...any), msg string, keyID string, err error) {
+	if err == errBreakerOpen {
+		return
+	}
+
+	logf(msg, "bucket", b.bucketName, "key", b.getKey(keyID), "error", err)
+
+	if b.onStoreError != nil {
+		b.onStoreError(ctx, b.bucketName, keyID, err)
+	}
+}
@@ -0,0 +1,76 @@
+package leaky
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestDecisionHooks(t *testing.T) {
+	tj := prepareTestJig()
+	defer tj.Close()
+
+	var allowed, denied []Decision
+	var costs []int
+	bucket := tj.ThrottleManager.ThrottlingHandler(handleFuncSuccessResponse, 3, 1, keyFunc, "test",
+		OnAllow(func(ctx context.Context, d Decision, cost int) {
+			allowed = append(allowed, d)
+			costs = append(costs, cost)
+		}),
+		OnDeny(func(ctx context.Context, d Decision, cost int) {
+			denied = append(denied, d)
+			costs = append(costs, cost)
+		}),
+	)
+
+	bucket.Add(2, "client")
+	bucket.Add(2, "client")
+
+	if len(allowed) != 1 || len(denied) != 1 {
+		t.Fatalf("Hooks called for %d allowed and %d denied, expected 1 of each", len(allowed), len(denied))
+	}
+	if costs[0] != 2 || costs[1] != 2 {
+		t.Errorf("Hooks given costs %v", costs)
+	}
+
+	if d := allowed[0]; d.KeyID != "client" || d.Bucket != "test" || d.Remaining != 1 || d.Limit != 3 {
+		t.Errorf("Allowed decision wrong: %+v", d)
+	}
+	// The bucket leaks a drop a minute, so two fit once one has leaked
+	if d := denied[0]; d.Remaining != 1 || d.RetryAfter <= 0 || d.RetryAfter > time.Minute {
+		t.Errorf("Denied decision wrong: %+v", d)
+	}
+}
+
+func TestStoreErrorHook(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mr.Close()
+
+	rc := redis.NewClient(&redis.Options{Addr: mr.Addr(), MaxRetries: -1})
+	tm := NewThrottleManager(rc, WithLogger(nil))
+
+	var errs []error
+	var keyIDs []string
+	bucket := tm.ThrottlingHandler(handleFuncSuccessResponse, 3, 1, keyFunc, "test",
+		OnStoreError(func(ctx context.Context, bucketName string, keyID string, err error) {
+			errs = append(errs, err)
+			keyIDs = append(keyIDs, keyID)
+		}),
+	)
+
+	mr.Close()
+
+	if !bucket.Add(1, "client") {
+		t.Error("Request not allowed while the store failed")
+	}
+
+	if len(errs) != 1 || errs[0] == nil || keyIDs[0] != "client" {
+		t.Errorf("Hook called with %v for %v", errs, keyIDs)
+	}
+}
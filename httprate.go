@@ -0,0 +1,49 @@
+package leaky
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Limit returns a middleware constructor allowing each client requests per window, shaped like httprate.Limit
+// so chi users can swap in buckets shared through the store. Clients are keyed by the KeyFuncs given WithKeyFuncs,
+// or all requests share a bucket if there are none. A client can make all their requests at once, and then one
+// each window / requests. The bucket is named for its limit unless given WithBucketName, so limits alike share
+// state unless keyed apart, such as by KeyByPath.
+func (m *ThrottleManager) Limit(requests int, window time.Duration, opts ...Option) func(http.Handler) http.Handler {
+	lim := Limit{Rate: float64(requests), Per: window, Burst: requests}
+	name := fmt.Sprintf("limit:%d:%s", requests, window)
+	keyAll := func(r http.Request) string { return "" }
+
+	return m.LimitHandler(nil, lim, keyAll, name, opts...).Wrap
+}
+
+// LimitAll is Limit with every request sharing the one bucket
+func (m *ThrottleManager) LimitAll(requests int, window time.Duration, opts ...Option) func(http.Handler) http.Handler {
+	return m.Limit(requests, window, opts...)
+}
+
+// LimitByIP is Limit keyed by KeyByIP
+func (m *ThrottleManager) LimitByIP(requests int, window time.Duration, opts ...Option) func(http.Handler) http.Handler {
+	return m.Limit(requests, window, append([]Option{WithKeyFuncs(KeyByIP)}, opts...)...)
+}
+
+// WithKeyFuncs keys clients by every one of the KeyFuncs, combined with CombineKeyFuncs, in place of the
+// bucket's KeyFunc
+func WithKeyFuncs(fns ...KeyFunc) Option {
+	return func(b *Bucket) {
+		if len(fns) == 1 {
+			b.keyFunc = fns[0]
+			return
+		}
+		b.keyFunc = CombineKeyFuncs("", fns...)
+	}
+}
+
+// WithBucketName names the bucket in place of the name it was created with
+func WithBucketName(name string) Option {
+	return func(b *Bucket) {
+		b.bucketName = name
+	}
+}
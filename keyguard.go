@@ -0,0 +1,158 @@
+package leaky
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// keyCountInterval is how often the keys of a bucket with a key cap are counted in the store
+const keyCountInterval = 10 * time.Second
+
+// overflowKeyID is the key new clients share once a bucket reaches its key cap with OverflowShared,
+// the NUL can't appear in a header so the key can't be taken by a real client
+const overflowKeyID = "\x00overflow"
+
+// OverflowPolicy decides what happens to new clients once a bucket has reached its key cap
+type OverflowPolicy int
+
+const (
+	// OverflowReject rejects requests from new clients
+	OverflowReject OverflowPolicy = iota
+	// OverflowShared puts every new client into a single shared bucket, with the limits set by WithOverflowLimits
+	OverflowShared
+)
+
+// WithMaxKeys caps the number of clients a bucket keeps state for, protecting the store from a client
+// rotating through identities such as source IPs. Clients are counted approximately: stores implementing
+// KeyCounter are counted every so often in the background, other stores by the clients created in the
+// longest time state is kept for. Only requests from clients without state are checked against the cap.
+func WithMaxKeys(max int, policy OverflowPolicy) Option {
+	return func(b *Bucket) {
+		b.keyGuard = &keyGuard{
+			max:      max,
+			policy:   policy,
+			overflow: newLimits(10, perMinute(60)),
+		}
+	}
+}
+
+// WithOverflowLimits sets the size and leak rate per minute of the bucket shared by new clients with
+// OverflowShared, the default is 10 and 60. It must come after WithMaxKeys.
+func WithOverflowLimits(size int, rate int) Option {
+	return func(b *Bucket) {
+		if b.keyGuard != nil {
+			b.keyGuard.overflow = newLimits(size, perMinute(rate))
+		}
+	}
+}
+
+// KeyCounter is implemented by stores which can count the keys stored under a prefix
+type KeyCounter interface {
+	CountKeys(ctx context.Context, prefix string) (int, error)
+}
+
+// keyGuard estimates how many keys a bucket has in the store
+type keyGuard struct {
+	max      int
+	policy   OverflowPolicy
+	overflow limits
+
+	mu sync.Mutex
+	// counted is the number of keys found by the last count, and created the number created since
+	counted   int
+	created   int
+	countedAt time.Time
+	counting  bool
+	// windowStart begins the window created counts keys in when the store can't count them,
+	// previous is the number created in the window before
+	windowStart time.Time
+	previous    int
+}
+
+// keysFull reports whether the bucket is at its key cap, counting the keys again if the count is stale
+func (b *Bucket) keysFull() bool {
+	g := b.keyGuard
+	if g == nil {
+		return false
+	}
+
+	now := b.clock.Now()
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if counter, ok := b.store.(KeyCounter); ok {
+		if !g.counting && now.Sub(g.countedAt) >= keyCountInterval {
+			g.counting = true
+			go b.countKeys(counter)
+		}
+		return g.counted+g.created >= g.max
+	}
+
+	// Nothing outlives the bucket's state TTL, so keys created in the last two windows of that length are an upper bound
+	window := b.currentLimits().longestTTL()
+	if elapsed := now.Sub(g.windowStart); elapsed >= window {
+		if elapsed < 2*window {
+			g.previous = g.created
+		} else {
+			g.previous = 0
+		}
+		g.created = 0
+		g.windowStart = now
+	}
+
+	return g.previous+g.created >= g.max
+}
+
+// keyCreated records that the bucket has created a key in the store
+func (b *Bucket) keyCreated() {
+	g := b.keyGuard
+	if g == nil {
+		return
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.created++
+}
+
+// countKeys counts the bucket's keys in the background, outliving the request which started it
+func (b *Bucket) countKeys(counter KeyCounter) {
+	var count int
+	ctx := context.Background()
+
+	err := b.roundTrip(ctx, func() error {
+		var err error
+		count, err = counter.CountKeys(ctx, fmt.Sprintf("leaky::%s::", b.bucketName))
+		return err
+	})
+
+	g := b.keyGuard
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.counting = false
+	g.countedAt = b.clock.Now()
+
+	if err != nil {
+		if err != errBreakerOpen {
+			b.logger.Error("Counting bucket keys failed", "bucket", b.bucketName, "error", err)
+		}
+		return
+	}
+
+	g.counted = count
+	g.created = 0
+}
+
+// overflow decides a request from a new client once the bucket is at its key cap
+func (b *Bucket) overflow(ctx context.Context, lim limits, demand Demand) (int, State) {
+	if b.keyGuard.policy == OverflowShared {
+		return b.takeKey(ctx, b.keyGuard.overflow, overflowKeyID, demand, false)
+	}
+
+	return 0, b.newState(lim, 0)
+}
@@ -0,0 +1,81 @@
+package leaky_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/2bytes/leaky"
+	"github.com/2bytes/leaky/leakytest"
+)
+
+func TestMaxKeysReject(t *testing.T) {
+	tm := leakytest.NewTestManager(t)
+	bucket := tm.ThrottlingHandler(handleFuncSuccessResponse, 10, 60, keyFunc, "test",
+		leaky.WithMaxKeys(3, leaky.OverflowReject))
+
+	for i := 0; i < 3; i++ {
+		if ok := bucket.Add(1, fmt.Sprint("client-", i)); !ok {
+			t.Errorf("Client %d under the key cap rejected", i)
+		}
+	}
+
+	if ok := bucket.Add(1, "client-3"); ok {
+		t.Error("New client over the key cap accepted")
+	}
+
+	if ok := bucket.Add(1, "client-0"); !ok {
+		t.Error("Existing client rejected at the key cap")
+	}
+
+	if keys := len(tm.Store.Keys()); keys != 3 {
+		t.Errorf("Store holds %d keys, expected 3", keys)
+	}
+}
+
+func TestMaxKeysShared(t *testing.T) {
+	tm := leakytest.NewTestManager(t)
+	bucket := tm.ThrottlingHandler(handleFuncSuccessResponse, 10, 60, keyFunc, "test",
+		leaky.WithMaxKeys(1, leaky.OverflowShared), leaky.WithOverflowLimits(2, 0))
+
+	if ok := bucket.Add(1, "client-0"); !ok {
+		t.Error("Client under the key cap rejected")
+	}
+
+	// New clients share the overflow bucket's two drops between them
+	for i, want := range []bool{true, true, false} {
+		if ok := bucket.Add(1, fmt.Sprint("new-client-", i)); ok != want {
+			t.Errorf("New client %d: accepted %v, expected %v", i, ok, want)
+		}
+	}
+
+	if keys := len(tm.Store.Keys()); keys != 2 {
+		t.Errorf("Store holds %d keys, expected the client and the overflow bucket", keys)
+	}
+}
+
+func TestMaxKeysRecount(t *testing.T) {
+	tm := leakytest.NewTestManager(t)
+	bucket := tm.ThrottlingHandler(handleFuncSuccessResponse, 10, 600, keyFunc, "test",
+		leaky.WithMaxKeys(2, leaky.OverflowReject))
+
+	bucket.Add(1, "client-0")
+	bucket.Add(1, "client-1")
+	if ok := bucket.Add(1, "client-2"); ok {
+		t.Fatal("New client over the key cap accepted")
+	}
+
+	// Once the clients' state has expired a recount frees their places, it runs in the background
+	tm.Clock.Advance(time.Minute)
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		if ok := bucket.Add(1, "client-2"); ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("New client still rejected after the keys expired")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
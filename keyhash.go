@@ -0,0 +1,33 @@
+package leaky
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+)
+
+// WithHashedKeys hashes each client's key ID before it is used in the store, so identifiers such as
+// addresses or emails never reach it as they are, and arbitrarily long identifiers don't make long keys.
+// Key IDs are replaced by the first 128 bits of their SHA-256, or of their HMAC-SHA256 with secret if it
+// isn't empty, which stops anyone reading the store recovering small spaces of identifiers, such as IPv4
+// addresses, by hashing every one. Changing it starts every client with an empty bucket.
+func WithHashedKeys(secret string) ManagerOption {
+	return func(m *ThrottleManager) {
+		m.hashKeys = true
+		m.keySecret = []byte(secret)
+	}
+}
+
+// hashKeyID returns the hex hash of the key ID stored in place of it
+func (c *storeClient) hashKeyID(keyID string) string {
+	var h hash.Hash
+	if len(c.keySecret) > 0 {
+		h = hmac.New(sha256.New, c.keySecret)
+	} else {
+		h = sha256.New()
+	}
+
+	h.Write([]byte(keyID))
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
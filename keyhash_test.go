@@ -0,0 +1,32 @@
+package leaky
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func TestHashedKeys(t *testing.T) {
+	tj := prepareTestJig()
+	defer tj.Close()
+
+	rc := redis.NewClient(&redis.Options{Addr: tj.miniRedis.Addr()})
+	tm := NewThrottleManager(rc, WithHashedKeys(""))
+	bucket := tm.ThrottlingHandler(handleFuncSuccessResponse, 1, 0, keyFunc, "test")
+
+	email := "alice@example.com"
+	if !bucket.Add(1, email) || bucket.Add(1, email) {
+		t.Error("Hashed key not limited")
+	}
+
+	keys := tj.miniRedis.Keys()
+	if len(keys) != 1 || strings.Contains(keys[0], "alice") || len(keys[0]) != len("leaky::test::")+32 {
+		t.Errorf("Stored keys %q", keys)
+	}
+
+	secret := NewThrottleManager(rc, WithHashedKeys("s3cret"))
+	if key := secret.ThrottlingHandler(handleFuncSuccessResponse, 1, 0, keyFunc, "test").getKey(email); key == keys[0] {
+		t.Error("Key hashed the same with a secret")
+	}
+}
@@ -0,0 +1,141 @@
+package leaky
+
+import (
+	"context"
+	"time"
+)
+
+// KeyLimits are the size and leak rate per minute of a single client's bucket, in place of the bucket's
+// defaults, such as for a customer whose plan gives them more capacity
+type KeyLimits struct {
+	Size int `json:"size"`
+	Rate int `json:"rate"`
+}
+
+// WithKeyLimits has the bucket apply the limits stored for each client by SetKeyLimits, remembering what it
+// read for cacheTTL so most requests don't make another round trip. Limits overridden by the request's
+// context take precedence, and if the store fails the bucket's defaults apply.
+func WithKeyLimits(cacheTTL time.Duration) Option {
+	return func(b *Bucket) {
+		b.keyLimits = newExpiringMap[*KeyLimits](knownMaxEntries)
+		b.keyLimitsTTL = cacheTTL
+	}
+}
+
+// SetKeyLimits stores limits for the client, applied in place of the bucket's by every instance using
+// WithKeyLimits until ttl has passed or they are cleared. Other instances keep applying what they last
+// read until it expires from their cache.
+func (b *Bucket) SetKeyLimits(ctx context.Context, keyID string, kl KeyLimits, ttl time.Duration) error {
+	return b.writeKeyLimits(ctx, keyID, &kl, ttl)
+}
+
+// ClearKeyLimits removes the limits stored for the client, so the bucket's defaults apply to them again
+func (b *Bucket) ClearKeyLimits(ctx context.Context, keyID string) error {
+	// Stores can't delete, so a record without limits replaces them until it expires
+	return b.writeKeyLimits(ctx, keyID, nil, stateTTL)
+}
+
+// KeyLimits returns the limits stored for the client, and false if there are none
+func (b *Bucket) KeyLimits(ctx context.Context, keyID string) (KeyLimits, bool, error) {
+	kl, err := b.readKeyLimits(ctx, keyID)
+	if err != nil || kl == nil {
+		return KeyLimits{}, false, err
+	}
+
+	return *kl, true, nil
+}
+
+func (b *Bucket) writeKeyLimits(ctx context.Context, keyID string, kl *KeyLimits, ttl time.Duration) error {
+	if err := b.writeRecord(ctx, "limits", keyID, State{KeyLimits: kl}, ttl); err != nil {
+		return err
+	}
+
+	b.cacheKeyLimits(keyID, kl)
+	return nil
+}
+
+func (b *Bucket) readKeyLimits(ctx context.Context, keyID string) (*KeyLimits, error) {
+	state, err := b.readRecord(ctx, "limits", keyID)
+	if err != nil {
+		return nil, err
+	}
+
+	b.cacheKeyLimits(keyID, state.KeyLimits)
+	return state.KeyLimits, nil
+}
+
+// recordKey is the key a record of kind is stored under for the client, in the same slot as their bucket
+// state. Records have their own prefix, so no client's key ID can make a state key which is a record's.
+func (b *Bucket) recordKey(kind string, keyID string) string {
+	return b.keyUnder("leaky-record", b.bucketName+"::"+kind, keyID)
+}
+
+// writeRecord stores a record of kind for the client, such as their limits
+func (b *Bucket) writeRecord(ctx context.Context, kind string, keyID string, record State, ttl time.Duration) error {
+	return b.roundTrip(ctx, func() error {
+		return b.store.Set(ctx, b.recordKey(kind, keyID), record, ttl)
+	})
+}
+
+// readRecord reads the record of kind stored for the client, empty if there is none
+func (b *Bucket) readRecord(ctx context.Context, kind string, keyID string) (State, error) {
+	var record State
+
+	err := b.roundTrip(ctx, func() error {
+		var err error
+		record, _, err = b.store.Get(ctx, b.recordKey(kind, keyID))
+		return err
+	})
+
+	return record, err
+}
+
+// cacheKeyLimits remembers the client's stored limits, or that they have none, if the bucket applies them
+func (b *Bucket) cacheKeyLimits(keyID string, kl *KeyLimits) {
+	if b.keyLimits == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.clock.Now()
+	b.keyLimits.set(keyID, kl, now.Add(b.keyLimitsTTL), now)
+}
+
+// storedKeyLimits returns the limits stored for the client if the bucket applies them, from its cache
+// if they were read recently
+func (b *Bucket) storedKeyLimits(ctx context.Context, keyID string) (*KeyLimits, bool) {
+	if b.keyLimits == nil {
+		return nil, false
+	}
+
+	b.mu.Lock()
+	kl, ok := b.keyLimits.get(keyID, b.clock.Now())
+	b.mu.Unlock()
+
+	if !ok {
+		var err error
+		if kl, err = b.readKeyLimits(ctx, keyID); err != nil {
+			b.storeFailed(ctx, b.logger.Warn, "Retrieving key limits failed, applying the bucket's", keyID, err)
+			return nil, false
+		}
+	}
+
+	return kl, kl != nil
+}
+
+// limitsFor returns the limits stored for the client if the bucket applies them, or else the bucket's
+func (b *Bucket) limitsFor(ctx context.Context, keyID string) limits {
+	return b.keyLimitsOr(ctx, keyID, b.currentLimits())
+}
+
+// keyLimitsOr returns the limits stored for the client if the bucket applies them, or else def
+func (b *Bucket) keyLimitsOr(ctx context.Context, keyID string, def limits) limits {
+	kl, ok := b.storedKeyLimits(ctx, keyID)
+	if !ok {
+		return def
+	}
+
+	return newLimits(kl.Size, perMinute(kl.Rate)).withTTLOf(def).withAlgorithmOf(def)
+}
@@ -0,0 +1,127 @@
+package leaky
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestKeyLimits(t *testing.T) {
+	tj := prepareTestJig()
+	defer tj.Close()
+
+	ctx := context.Background()
+	bucket := tj.ThrottleManager.ThrottlingHandler(handleFuncSuccessResponse, 1, 0, keyFunc, "test", WithKeyLimits(0))
+
+	if err := bucket.SetKeyLimits(ctx, "premium", KeyLimits{Size: 10}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	if kl, ok, err := bucket.KeyLimits(ctx, "premium"); err != nil || !ok || kl.Size != 10 {
+		t.Fatalf("Read key limits %+v, %v, %v", kl, ok, err)
+	}
+	if _, ok, _ := bucket.KeyLimits(ctx, "standard"); ok {
+		t.Error("Key limits read for a client without any")
+	}
+
+	if accepted, _ := bucket.AddUpTo(20, "premium"); accepted != 10 {
+		t.Errorf("Premium client accepted %d drops, expected 10", accepted)
+	}
+	if accepted, _ := bucket.AddUpTo(20, "standard"); accepted != 1 {
+		t.Errorf("Standard client accepted %d drops, expected 1", accepted)
+	}
+
+	// Limits in the context take precedence
+	if err := bucket.SetKeyLimits(ctx, "vip", KeyLimits{Size: 10}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if d, ok := bucket.AdmitKey(WithLimitOverride(ctx, 20, 0), http.Header{}, "vip"); !ok || d.Limit != 20 {
+		t.Errorf("Context override not applied over key limits: %+v", d)
+	}
+
+	if err := bucket.ClearKeyLimits(ctx, "premium"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := bucket.KeyLimits(ctx, "premium"); ok {
+		t.Error("Key limits read once cleared")
+	}
+	if d, _ := bucket.Decide(ctx, 0, "premium"); d.Limit != 1 {
+		t.Errorf("Cleared client limited to %d, expected the bucket's 1", d.Limit)
+	}
+}
+
+func TestKeyLimitsNotApplied(t *testing.T) {
+	tj := prepareTestJig()
+	defer tj.Close()
+
+	ctx := context.Background()
+	bucket := tj.ThrottleManager.ThrottlingHandler(handleFuncSuccessResponse, 1, 0, keyFunc, "test")
+
+	if err := bucket.SetKeyLimits(ctx, "premium", KeyLimits{Size: 10}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	if accepted, _ := bucket.AddUpTo(20, "premium"); accepted != 1 {
+		t.Errorf("Key limits applied without WithKeyLimits, accepted %d drops", accepted)
+	}
+}
+
+func TestKeyLimitsStoreDown(t *testing.T) {
+	tj := prepareTestJig()
+
+	ctx := context.Background()
+	bucket := tj.ThrottleManager.ThrottlingHandler(handleFuncSuccessResponse, 1, 0, keyFunc, "test",
+		WithKeyLimits(time.Minute))
+
+	if err := bucket.SetKeyLimits(ctx, "premium", KeyLimits{Size: 10}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	tj.Close()
+
+	// The limits are cached, and the bucket fails open without its state
+	if d, ok := bucket.Decide(ctx, 5, "premium"); !ok || d.Limit != 10 {
+		t.Errorf("Cached key limits not applied with the store down: %+v", d)
+	}
+	if d, _ := bucket.Decide(ctx, 0, "standard"); d.Limit != 1 {
+		t.Errorf("Bucket's limits not applied with the store down: %+v", d)
+	}
+}
+
+func TestRecordKeysCollision(t *testing.T) {
+	tj := prepareTestJig()
+	defer tj.Close()
+
+	ctx := context.Background()
+	bucket := tj.ThrottleManager.ThrottlingHandler(handleFuncSuccessResponse, 1, 0, keyFunc, "api",
+		WithKeyLimits(0), WithAccessLists(0), WithPenaltyBox(PenaltyBox{Threshold: 1, Block: time.Hour}))
+
+	if err := bucket.DenyKey(ctx, "victim", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := bucket.SetKeyLimits(ctx, "victim", KeyLimits{Size: 10}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	bucket.AdmitKey(ctx, http.Header{}, "offender")
+	if _, ok := bucket.AdmitKey(ctx, http.Header{}, "offender"); ok {
+		t.Fatal("Client over their limit admitted")
+	}
+
+	// Clients whose key IDs look like a record's kind and key ID have their own state, not the record
+	for _, keyID := range []string{"access::victim", "limits::victim", "penalty::offender"} {
+		if !bucket.Add(1, keyID) {
+			t.Errorf("Client %q rejected, its state read from a record", keyID)
+		}
+	}
+
+	if access, err := bucket.KeyAccess(ctx, "victim"); err != nil || access != Denylisted {
+		t.Errorf("Access %q, %v after another client's request, expected the deny kept", access, err)
+	}
+	if kl, ok, err := bucket.KeyLimits(ctx, "victim"); err != nil || !ok || kl.Size != 10 {
+		t.Errorf("Key limits %+v, %v, %v after another client's request, expected them kept", kl, ok, err)
+	}
+	if p, err := bucket.Penalty(ctx, "offender"); err != nil || p.Blocks != 1 {
+		t.Errorf("Penalty %+v, %v after another client's request, expected the block kept", p, err)
+	}
+}
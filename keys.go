@@ -0,0 +1,214 @@
+package leaky
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// MissingKey can be returned by a KeyFunc to mark the value it keys on as absent rather than empty,
+// CombineKeyFuncs keeps the two distinct. It's a NUL character, which is never valid in a header.
+const MissingKey = "\x00"
+
+// ErrSkip can be returned by a KeyFuncE to let the request through without limiting it, such as for
+// requests the bucket doesn't apply to
+var ErrSkip = errors.New("leaky: skip limiting")
+
+// KeyFuncE identifies the client making a request as KeyFunc does, from a pointer to the request so its
+// context and body can be read, and can fail. Returning ErrSkip lets the request through without limiting it.
+type KeyFuncE func(r *http.Request) (string, error)
+
+// WithKeyFuncE keys clients by fn in place of the bucket's KeyFunc. A request fn fails to key, with any
+// error other than ErrSkip, is rejected, so clients can't escape their limit by sending requests which
+// can't be keyed.
+func WithKeyFuncE(fn KeyFuncE) Option {
+	return func(b *Bucket) {
+		b.keyFuncE = fn
+	}
+}
+
+// defaultKeySep is used by CombineKeyFuncs when no separator is given
+const defaultKeySep = "|"
+
+// CombineKeyFuncs creates a KeyFunc keying on the results of several others, for limits on more than one
+// dimension such as tenant and endpoint. The parts are escaped before being joined with sep, so a part
+// containing sep can't collide with a different combination of parts, and a part returned as MissingKey
+// is kept distinct from an empty one.
+func CombineKeyFuncs(sep string, fns ...KeyFunc) KeyFunc {
+	if sep == "" {
+		sep = defaultKeySep
+	}
+
+	return func(r http.Request) string {
+		var key strings.Builder
+
+		for i, fn := range fns {
+			if i > 0 {
+				key.WriteString(sep)
+			}
+			writeKeyPart(&key, fn(r), sep[0])
+		}
+
+		return key.String()
+	}
+}
+
+// writeKeyPart writes a present part prefixed with '=', so a missing part is written as nothing at all.
+// Backslashes and the first character of the separator are escaped, so an unescaped occurrence of
+// it always starts the separator.
+func writeKeyPart(key *strings.Builder, part string, sepStart byte) {
+	if part == MissingKey {
+		return
+	}
+
+	key.WriteByte('=')
+
+	for i := 0; i < len(part); i++ {
+		if c := part[i]; c == '\\' || c == sepStart {
+			key.WriteByte('\\')
+		}
+		key.WriteByte(part[i])
+	}
+}
+
+// KeyByHeader keys on the value of a request header, or MissingKey if the request doesn't have it
+func KeyByHeader(name string) KeyFunc {
+	return func(r http.Request) string {
+		values := r.Header.Values(name)
+		if len(values) == 0 {
+			return MissingKey
+		}
+
+		return values[0]
+	}
+}
+
+// KeyByMethod keys on the request method
+func KeyByMethod(r http.Request) string {
+	return r.Method
+}
+
+// KeyByPath keys on the request path, for limits per endpoint
+func KeyByPath(r http.Request) string {
+	if r.URL == nil {
+		return MissingKey
+	}
+
+	return r.URL.Path
+}
+
+// KeyByHost keys on the host the request was made to, for limits per virtual host, or for an outgoing request
+// without its Host set, the host of its URL
+func KeyByHost(r http.Request) string {
+	if r.Host == "" && r.URL != nil {
+		return r.URL.Host
+	}
+	return r.Host
+}
+
+// KeyByIP keys on the IP address the request came from, without its port. Behind a proxy this is
+// the proxy's address.
+func KeyByIP(r http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+// KeyByClientIP keys on the IP address of the client, read from the Forwarded, X-Forwarded-For or X-Real-IP
+// header only when the request came from one of the trusted proxies, so clients can't choose their own key by
+// sending the headers themselves. Of the addresses a chain of proxies appended, the last not itself a trusted
+// proxy is the client's. Requests from elsewhere, or without the headers, are keyed by the address they
+// came from as KeyByIP.
+func KeyByClientIP(trusted ...netip.Prefix) KeyFunc {
+	isTrusted := func(addr netip.Addr) bool {
+		for _, network := range trusted {
+			if network.Contains(addr) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return func(r http.Request) string {
+		peer := KeyByIP(r)
+		if addr, ok := parseAddr(peer); !ok || !isTrusted(addr) {
+			return peer
+		}
+
+		chain := forwardedFor(r.Header)
+		for i := len(chain) - 1; i >= 0; i-- {
+			addr, ok := parseAddr(chain[i])
+			if !ok {
+				// Nothing before an address which can't be read can be trusted
+				break
+			}
+			if !isTrusted(addr) || i == 0 {
+				return addr.String()
+			}
+		}
+
+		return peer
+	}
+}
+
+// forwardedFor returns the addresses the proxies forwarding a request recorded, the client's first,
+// from the first of the Forwarded, X-Forwarded-For and X-Real-IP headers the request has
+func forwardedFor(h http.Header) []string {
+	var chain []string
+
+	if values := h.Values("Forwarded"); len(values) > 0 {
+		for _, value := range values {
+			for _, element := range strings.Split(value, ",") {
+				chain = append(chain, forwardedElementFor(element))
+			}
+		}
+		return chain
+	}
+
+	if values := h.Values("X-Forwarded-For"); len(values) > 0 {
+		for _, value := range values {
+			for _, addr := range strings.Split(value, ",") {
+				chain = append(chain, strings.TrimSpace(addr))
+			}
+		}
+		return chain
+	}
+
+	if realIP := h.Get("X-Real-IP"); realIP != "" {
+		return []string{strings.TrimSpace(realIP)}
+	}
+
+	return nil
+}
+
+// forwardedElementFor returns the for parameter of an element of a Forwarded header, such as
+// `for="[2001:db8::1]:4711";proto=https`, or an empty string if it has none
+func forwardedElementFor(element string) string {
+	for _, pair := range strings.Split(element, ";") {
+		name, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if ok && strings.EqualFold(name, "for") {
+			return strings.Trim(value, `"`)
+		}
+	}
+
+	return ""
+}
+
+// parseAddr parses an IP address, with or without a port, IPv6 addresses with a port in brackets
+func parseAddr(s string) (netip.Addr, bool) {
+	if addrPort, err := netip.ParseAddrPort(s); err == nil {
+		return addrPort.Addr().Unmap(), true
+	}
+
+	addr, err := netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(s, "["), "]"))
+	if err != nil {
+		return netip.Addr{}, false
+	}
+
+	return addr.Unmap(), true
+}
@@ -0,0 +1,77 @@
+package keys
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+
+	"github.com/2bytes/leaky"
+)
+
+// MaxPartLen is the longest a part of a key joined by Join is kept as it is, once escaped.
+// Longer parts are replaced by a hash, so a client can't make its key as long as it likes.
+const MaxPartLen = 64
+
+// Join keys on the results of several KeyFuncs, such as a user and an endpoint, or an address and a hash of
+// the User-Agent. The encoding is stable, and no two different combinations of parts produce the same key:
+// present parts are escaped and marked, so a part containing the separator, an empty part and a missing one
+// are all distinct. Parts longer than MaxPartLen are replaced by a hash of them, bounding the key's length.
+func Join(fns ...leaky.KeyFunc) leaky.KeyFunc {
+	return func(r http.Request) string {
+		var key strings.Builder
+
+		for i, fn := range fns {
+			if i > 0 {
+				key.WriteByte('|')
+			}
+			writePart(&key, fn(r))
+		}
+
+		return key.String()
+	}
+}
+
+// writePart writes a present part prefixed with '=', with backslashes and separators escaped, or a hash
+// of it prefixed with '#' if that is too long. A missing part is written as nothing at all.
+func writePart(key *strings.Builder, part string) {
+	if part == leaky.MissingKey {
+		return
+	}
+
+	var escaped strings.Builder
+	for i := 0; i < len(part); i++ {
+		if c := part[i]; c == '\\' || c == '|' {
+			escaped.WriteByte('\\')
+		}
+		escaped.WriteByte(part[i])
+	}
+
+	if escaped.Len() > MaxPartLen {
+		key.WriteByte('#')
+		key.WriteString(hash(part))
+		return
+	}
+
+	key.WriteByte('=')
+	key.WriteString(escaped.String())
+}
+
+// Hash keys on a hash of the KeyFunc's result, for parts which are long or which shouldn't be stored as they
+// are, such as a User-Agent. A missing part stays missing.
+func Hash(fn leaky.KeyFunc) leaky.KeyFunc {
+	return func(r http.Request) string {
+		part := fn(r)
+		if part == leaky.MissingKey {
+			return part
+		}
+
+		return hash(part)
+	}
+}
+
+// hash returns the first 128 bits of the SHA-256 of s in hex
+func hash(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:16])
+}
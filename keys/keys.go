@@ -0,0 +1,101 @@
+// Package keys provides KeyFuncs identifying clients by the parts of a request they are usually known by.
+// Each returns leaky.MissingKey when the request doesn't have its part, so they can be combined with Join
+// without an absent part colliding with an empty one, or tried in turn with FirstOf.
+//
+//	keyFunc := keys.Join(keys.FirstOf(keys.BearerToken, keys.ClientIP()), keys.Hash(keys.Header("User-Agent")))
+package keys
+
+import (
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/2bytes/leaky"
+)
+
+// Header keys on the value of a request header, trimmed of spaces
+func Header(name string) leaky.KeyFunc {
+	return func(r http.Request) string {
+		values := r.Header.Values(name)
+		if len(values) == 0 {
+			return leaky.MissingKey
+		}
+
+		return strings.TrimSpace(values[0])
+	}
+}
+
+// BearerToken keys on the token of a bearer Authorization header
+func BearerToken(r http.Request) string {
+	scheme, token, ok := strings.Cut(strings.TrimSpace(r.Header.Get("Authorization")), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return leaky.MissingKey
+	}
+
+	token = strings.TrimSpace(token)
+	if token == "" {
+		return leaky.MissingKey
+	}
+
+	return token
+}
+
+// BasicAuthUser keys on the username of a basic Authorization header. The password isn't checked,
+// so this keys on who a client claims to be.
+func BasicAuthUser(r http.Request) string {
+	user, _, ok := r.BasicAuth()
+	if !ok {
+		return leaky.MissingKey
+	}
+
+	return user
+}
+
+// Cookie keys on the value of a cookie, such as a session ID
+func Cookie(name string) leaky.KeyFunc {
+	return func(r http.Request) string {
+		cookie, err := r.Cookie(name)
+		if err != nil {
+			return leaky.MissingKey
+		}
+
+		return cookie.Value
+	}
+}
+
+// Query keys on the value of a query parameter, such as an API key
+func Query(name string) leaky.KeyFunc {
+	return func(r http.Request) string {
+		if r.URL == nil {
+			return leaky.MissingKey
+		}
+
+		values, ok := r.URL.Query()[name]
+		if !ok || len(values) == 0 {
+			return leaky.MissingKey
+		}
+
+		return values[0]
+	}
+}
+
+// ClientIP keys on the client's IP address, read from forwarding headers only when the request came
+// from one of the trusted proxies, as leaky.KeyByClientIP. Without any it is the address the request came from.
+func ClientIP(trusted ...netip.Prefix) leaky.KeyFunc {
+	return leaky.KeyByClientIP(trusted...)
+}
+
+// FirstOf keys on the first of the KeyFuncs to find its part in the request, or leaky.MissingKey if none do.
+// Keys are prefixed by the position of the KeyFunc which found them, so a token can't collide with an address.
+func FirstOf(fns ...leaky.KeyFunc) leaky.KeyFunc {
+	return func(r http.Request) string {
+		for i, fn := range fns {
+			if key := fn(r); key != leaky.MissingKey {
+				return strconv.Itoa(i) + ":" + key
+			}
+		}
+
+		return leaky.MissingKey
+	}
+}
@@ -0,0 +1,155 @@
+package keys
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/2bytes/leaky"
+)
+
+func TestKeyFuncs(t *testing.T) {
+	req := httptest.NewRequest("GET", "/search?api_key=k123&q=x", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	req.Header.Set("X-Tenant", " acme ")
+	req.Header.Set("Authorization", "bearer  t0ken")
+	req.AddCookie(&http.Cookie{Name: "session", Value: "s456"})
+
+	tests := []struct {
+		name    string
+		keyFunc leaky.KeyFunc
+		want    string
+	}{
+		{"header", Header("X-Tenant"), "acme"},
+		{"missing header", Header("X-Missing"), leaky.MissingKey},
+		{"bearer token", BearerToken, "t0ken"},
+		{"basic auth user", BasicAuthUser, leaky.MissingKey},
+		{"cookie", Cookie("session"), "s456"},
+		{"missing cookie", Cookie("other"), leaky.MissingKey},
+		{"query", Query("api_key"), "k123"},
+		{"missing query", Query("other"), leaky.MissingKey},
+		{"client IP", ClientIP(), "192.0.2.1"},
+	}
+
+	for _, tt := range tests {
+		if key := tt.keyFunc(*req); key != tt.want {
+			t.Errorf("%s: key %q, expected %q", tt.name, key, tt.want)
+		}
+	}
+}
+
+func TestBasicAuthUser(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.SetBasicAuth("alice", "secret")
+
+	if key := BasicAuthUser(*req); key != "alice" {
+		t.Errorf("Key %q, expected alice", key)
+	}
+	if key := BearerToken(*req); key != leaky.MissingKey {
+		t.Errorf("Basic credentials keyed as a bearer token %q", key)
+	}
+}
+
+func TestClientIPBehindProxy(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("X-Forwarded-For", "198.51.100.1")
+
+	if key := ClientIP(netip.MustParsePrefix("10.0.0.0/8"))(*req); key != "198.51.100.1" {
+		t.Errorf("Key %q, expected the forwarded address", key)
+	}
+}
+
+func TestFirstOf(t *testing.T) {
+	keyFunc := FirstOf(BearerToken, Header("X-Api-Key"), ClientIP())
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	if key := keyFunc(*req); key != "2:192.0.2.1" {
+		t.Errorf("Key %q, expected the address", key)
+	}
+
+	req.Header.Set("X-Api-Key", "192.0.2.1")
+	if key := keyFunc(*req); key != "1:192.0.2.1" {
+		t.Errorf("Key %q, expected the API key kept distinct from the address", key)
+	}
+
+	req.Header.Set("Authorization", "Bearer t0ken")
+	if key := keyFunc(*req); key != "0:t0ken" {
+		t.Errorf("Key %q, expected the token", key)
+	}
+
+	if key := FirstOf(Header("X-Missing"))(*req); key != leaky.MissingKey {
+		t.Errorf("Key %q, expected MissingKey", key)
+	}
+}
+
+func TestCombined(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Tenant", "acme")
+
+	key := leaky.CombineKeyFuncs("", Header("X-Tenant"), Cookie("session"))(*req)
+	if key != "=acme|" {
+		t.Errorf("Key %q, expected the missing cookie left out", key)
+	}
+}
+
+func static(key string) leaky.KeyFunc {
+	return func(r http.Request) string {
+		return key
+	}
+}
+
+func TestJoin(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+
+	if key := Join(static("alice"), static("/api/search"))(*req); key != "=alice|=/api/search" {
+		t.Errorf("Unexpected key %q", key)
+	}
+
+	pairs := [][2][]string{
+		{{"a|b", "c"}, {"a", "b|c"}},
+		{{`a\`, "b"}, {"a", `\b`}},
+		{{"", "a"}, {leaky.MissingKey, "a"}},
+		{{"#" + hash(strings.Repeat("x", 100)), ""}, {strings.Repeat("x", 100), ""}},
+	}
+	for _, pair := range pairs {
+		first := Join(static(pair[0][0]), static(pair[0][1]))(*req)
+		second := Join(static(pair[1][0]), static(pair[1][1]))(*req)
+		if first == second {
+			t.Errorf("%q and %q produced the same key %q", pair[0], pair[1], first)
+		}
+	}
+}
+
+func TestJoinBoundsLength(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+
+	long := Join(static(strings.Repeat("x", 10000)), static("a"))(*req)
+	if len(long) > 2*(MaxPartLen+2) {
+		t.Errorf("Key %d bytes long", len(long))
+	}
+	if long == Join(static(strings.Repeat("x", 10001)), static("a"))(*req) {
+		t.Error("Different long parts produced the same key")
+	}
+
+	// A part escaped beyond the limit is hashed too
+	if key := Join(static(strings.Repeat("|", MaxPartLen)))(*req); key[0] != '#' {
+		t.Errorf("Escaped part not hashed: %q", key)
+	}
+}
+
+func TestHash(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("User-Agent", "Mozilla/5.0 (X11; Linux x86_64)")
+
+	key := Hash(Header("User-Agent"))(*req)
+	if len(key) != 32 || strings.Contains(key, "Mozilla") {
+		t.Errorf("Unexpected hash %q", key)
+	}
+	if Hash(Header("X-Missing"))(*req) != leaky.MissingKey {
+		t.Error("Missing part hashed")
+	}
+}
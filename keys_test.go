@@ -0,0 +1,149 @@
+package leaky
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func staticKey(key string) KeyFunc {
+	return func(r http.Request) string {
+		return key
+	}
+}
+
+func TestCombineKeyFuncsCollision(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/", nil)
+
+	// Naively concatenated, both of these are "a|b|c"
+	first := CombineKeyFuncs("|", staticKey("a|b"), staticKey("c"))(*req)
+	second := CombineKeyFuncs("|", staticKey("a"), staticKey("b|c"))(*req)
+
+	if first == second {
+		t.Errorf("Different parts produced the same key: %q", first)
+	}
+}
+
+func TestCombineKeyFuncsEscapes(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/", nil)
+
+	tests := [][2][]string{
+		{{`a\`, "b"}, {"a", `\b`}},
+		{{"a:", "b"}, {"a", ":b"}},
+		{{"a::", ""}, {"a", ":"}},
+		{{"", ""}, {MissingKey, MissingKey}},
+		{{"", "a"}, {MissingKey, "a"}},
+	}
+
+	for _, tt := range tests {
+		first := CombineKeyFuncs("::", staticKey(tt[0][0]), staticKey(tt[0][1]))(*req)
+		second := CombineKeyFuncs("::", staticKey(tt[1][0]), staticKey(tt[1][1]))(*req)
+
+		if first == second {
+			t.Errorf("%q and %q produced the same key: %q", tt[0], tt[1], first)
+		}
+	}
+}
+
+func TestCombineKeyFuncsDimensions(t *testing.T) {
+	req, _ := http.NewRequest("POST", "http://example.com/api/reports", nil)
+	req.Header.Set("X-Tenant", "acme")
+
+	key := CombineKeyFuncs("", KeyByHeader("X-Tenant"), KeyByMethod, KeyByPath)(*req)
+	if key != "=acme|=POST|=/api/reports" {
+		t.Errorf("Unexpected key: %q", key)
+	}
+
+	req.Header.Del("X-Tenant")
+	missing := CombineKeyFuncs("", KeyByHeader("X-Tenant"), KeyByPath)(*req)
+
+	req.Header.Set("X-Tenant", "")
+	empty := CombineKeyFuncs("", KeyByHeader("X-Tenant"), KeyByPath)(*req)
+
+	if missing == empty {
+		t.Errorf("Missing and empty header produced the same key: %q", missing)
+	}
+}
+
+func TestKeyByClientIP(t *testing.T) {
+	keyFunc := KeyByClientIP(netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("fd00::/8"))
+
+	tests := []struct {
+		remoteAddr string
+		header     string
+		value      string
+		want       string
+	}{
+		// Headers from clients which aren't trusted proxies are ignored
+		{"192.0.2.1:1234", "X-Forwarded-For", "198.51.100.1", "192.0.2.1"},
+		{"10.0.0.1:1234", "", "", "10.0.0.1"},
+		{"10.0.0.1:1234", "X-Forwarded-For", "198.51.100.1", "198.51.100.1"},
+		// A client can't prepend itself a different address
+		{"10.0.0.1:1234", "X-Forwarded-For", "203.0.113.9, 198.51.100.1, 10.0.0.2", "198.51.100.1"},
+		{"10.0.0.1:1234", "X-Forwarded-For", "10.0.0.3, 10.0.0.2", "10.0.0.3"},
+		{"10.0.0.1:1234", "X-Forwarded-For", "nonsense, 10.0.0.2", "10.0.0.1"},
+		{"[fd00::1]:1234", "Forwarded", `for=198.51.100.1;proto=https, for="[fd00::2]:4711"`, "198.51.100.1"},
+		{"10.0.0.1:1234", "Forwarded", `for="[2001:db8::1]:4711"`, "2001:db8::1"},
+		{"10.0.0.1:1234", "X-Real-IP", "198.51.100.1", "198.51.100.1"},
+	}
+
+	for _, tt := range tests {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.RemoteAddr = tt.remoteAddr
+		if tt.header != "" {
+			req.Header.Set(tt.header, tt.value)
+		}
+
+		if key := keyFunc(*req); key != tt.want {
+			t.Errorf("From %s with %s %q: key %q, expected %q", tt.remoteAddr, tt.header, tt.value, key, tt.want)
+		}
+	}
+}
+
+func TestKeyFuncE(t *testing.T) {
+	tj := prepareTestJig()
+	defer tj.Close()
+
+	errNoToken := errors.New("no token")
+	bucket := tj.ThrottleManager.ThrottlingHandler(handleFuncSuccessResponse, 1, 0, nil, "test",
+		WithKeyFuncE(func(r *http.Request) (string, error) {
+			if r.URL.Path == "/healthz" {
+				return "", ErrSkip
+			}
+
+			token := r.Header.Get("Authorization")
+			if token == "" {
+				return "", errNoToken
+			}
+			return token, nil
+		}))
+
+	serve := func(path string, token string) int {
+		req := httptest.NewRequest("GET", path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", token)
+		}
+
+		w := httptest.NewRecorder()
+		bucket.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	for i, want := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		if code := serve("/", "t0ken"); code != want {
+			t.Errorf("Request %d: status %v, expected %v", i, code, want)
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		if code := serve("/healthz", ""); code != http.StatusOK {
+			t.Errorf("Skipped request %d: status %v", i, code)
+		}
+	}
+
+	if code := serve("/", ""); code != http.StatusTooManyRequests {
+		t.Errorf("Request which couldn't be keyed: status %v", code)
+	}
+}
@@ -0,0 +1,265 @@
+// Package leakyconfig defines buckets in configuration rather than code, read from JSON, or YAML decoded
+// into the same types, and registers them on a manager
+//
+//	cfg, err := leakyconfig.Load("limits.json")
+//	if err != nil {
+//		return err
+//	}
+//	buckets, err := cfg.Register(tm)
+package leakyconfig
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/2bytes/leaky"
+	"github.com/2bytes/leaky/keys"
+)
+
+// Config defines the buckets to register on a manager
+type Config struct {
+	Buckets []Bucket `json:"buckets" yaml:"buckets"`
+}
+
+// Bucket defines a bucket of Size leaking Rate drops every Per, a minute if not set.
+// Clients are keyed by Key, which is "ip" for their address, "header:<name>" for a request header,
+// "cookie:<name>" or "query:<name>" for a cookie or query parameter, "bearer" for a bearer token, "user" for
+// a basic auth username, "path", "host" or "method" for those of the request, or "all" for every client
+// to share the bucket, and can join several with "+", such as "header:X-Api-Key+path".
+// Clients are keyed by IP if it isn't set.
+type Bucket struct {
+	Name string   `json:"name" yaml:"name"`
+	Size int      `json:"size" yaml:"size"`
+	Rate float64  `json:"rate" yaml:"rate"`
+	Per  Duration `json:"per" yaml:"per"`
+	Key  string   `json:"key" yaml:"key"`
+	// Rejection is the response sent to requests over the limit, 429 Too Many Requests if not set
+	Rejection *Rejection `json:"rejection" yaml:"rejection"`
+	// FailurePolicy is "open", "closed" or "local", as the leaky.FailurePolicy of the same name,
+	// open if not set
+	FailurePolicy string `json:"failure_policy" yaml:"failure_policy"`
+	// Exempt are networks in CIDR notation, such as "10.0.0.0/8", whose requests aren't limited
+	Exempt []string `json:"exempt" yaml:"exempt"`
+	// Shadow lets every request through, only reporting those over the limit, as leaky.WithShadowMode
+	Shadow bool `json:"shadow" yaml:"shadow"`
+}
+
+// Rejection is the configuration of a leaky.Rejection
+type Rejection struct {
+	Status      int    `json:"status" yaml:"status"`
+	Body        string `json:"body" yaml:"body"`
+	ContentType string `json:"content_type" yaml:"content_type"`
+}
+
+// Duration is a time.Duration written as a string such as "1m30s"
+type Duration time.Duration
+
+// UnmarshalText implements encoding.TextUnmarshaler
+func (d *Duration) UnmarshalText(b []byte) error {
+	parsed, err := time.ParseDuration(string(b))
+	if err != nil {
+		return err
+	}
+
+	*d = Duration(parsed)
+	return nil
+}
+
+// MarshalText implements encoding.TextMarshaler
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+// Load reads the JSON config file at path
+func Load(path string) (*Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	cfg, err := Parse(f)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+
+	return cfg, nil
+}
+
+// Parse reads a JSON config, rejecting fields it doesn't know and buckets which aren't valid
+func Parse(r io.Reader) (*Config, error) {
+	cfg := &Config{}
+
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(cfg); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// Validate checks every bucket has a name, a size and settings it knows, and that no two share a name
+func (cfg *Config) Validate() error {
+	names := map[string]bool{}
+	for _, b := range cfg.Buckets {
+		if err := b.Validate(); err != nil {
+			return err
+		}
+		if names[b.Name] {
+			return fmt.Errorf("bucket %s defined twice", b.Name)
+		}
+		names[b.Name] = true
+	}
+
+	return nil
+}
+
+// Validate checks the bucket has a name, a size and settings it knows
+func (b Bucket) Validate() error {
+	if b.Name == "" || b.Size <= 0 {
+		return fmt.Errorf("buckets need a name and a size")
+	}
+
+	if _, err := b.KeyFunc(); err != nil {
+		return fmt.Errorf("bucket %s: %w", b.Name, err)
+	}
+	if _, err := b.Options(); err != nil {
+		return fmt.Errorf("bucket %s: %w", b.Name, err)
+	}
+
+	return nil
+}
+
+// Register creates the buckets on the manager, without handlers, returning them by name.
+// Each can wrap handlers with Wrap, or be found on the manager by its name.
+func (cfg *Config) Register(tm *leaky.ThrottleManager) (map[string]*leaky.Bucket, error) {
+	buckets := make(map[string]*leaky.Bucket, len(cfg.Buckets))
+	for _, b := range cfg.Buckets {
+		bucket, err := b.Register(tm)
+		if err != nil {
+			return nil, err
+		}
+		buckets[b.Name] = bucket
+	}
+
+	return buckets, nil
+}
+
+// Register creates the bucket on the manager, without a handler
+func (b Bucket) Register(tm *leaky.ThrottleManager, opts ...leaky.Option) (*leaky.Bucket, error) {
+	if err := b.Validate(); err != nil {
+		return nil, err
+	}
+
+	keyFunc, _ := b.KeyFunc()
+	configured, _ := b.Options()
+
+	return tm.ThrottlingHandlerPer(nil, b.Size, b.Rate, b.per(), keyFunc, b.Name, append(configured, opts...)...), nil
+}
+
+// per is how often the bucket leaks Rate drops
+func (b Bucket) per() time.Duration {
+	if b.Per <= 0 {
+		return time.Minute
+	}
+
+	return time.Duration(b.Per)
+}
+
+// KeyFunc returns the KeyFunc named by the bucket's key
+func (b Bucket) KeyFunc() (leaky.KeyFunc, error) {
+	parts := strings.Split(b.Key, "+")
+	if len(parts) == 1 {
+		return keyFunc(parts[0])
+	}
+
+	fns := make([]leaky.KeyFunc, len(parts))
+	for i, part := range parts {
+		fn, err := keyFunc(part)
+		if err != nil {
+			return nil, err
+		}
+		fns[i] = fn
+	}
+
+	return leaky.CombineKeyFuncs("", fns...), nil
+}
+
+func keyFunc(name string) (leaky.KeyFunc, error) {
+	switch {
+	case name == "" || name == "ip":
+		return leaky.KeyByIP, nil
+	case name == "all":
+		return func(r http.Request) string { return "" }, nil
+	case name == "path":
+		return leaky.KeyByPath, nil
+	case name == "host":
+		return leaky.KeyByHost, nil
+	case name == "method":
+		return leaky.KeyByMethod, nil
+	case name == "bearer":
+		return keys.BearerToken, nil
+	case name == "user":
+		return keys.BasicAuthUser, nil
+	case strings.HasPrefix(name, "header:"):
+		return leaky.KeyByHeader(strings.TrimPrefix(name, "header:")), nil
+	case strings.HasPrefix(name, "cookie:"):
+		return keys.Cookie(strings.TrimPrefix(name, "cookie:")), nil
+	case strings.HasPrefix(name, "query:"):
+		return keys.Query(strings.TrimPrefix(name, "query:")), nil
+	}
+
+	return nil, fmt.Errorf("unknown key %q", name)
+}
+
+// Options returns the options setting the bucket's rejection, failure policy, exempt networks and shadow mode
+func (b Bucket) Options() ([]leaky.Option, error) {
+	var opts []leaky.Option
+
+	if rj := b.Rejection; rj != nil {
+		opts = append(opts, leaky.WithRejection(leaky.Rejection{
+			Status:      rj.Status,
+			Body:        rj.Body,
+			ContentType: rj.ContentType,
+		}))
+	}
+
+	switch b.FailurePolicy {
+	case "", "open":
+	case "closed":
+		opts = append(opts, leaky.WithFailurePolicy(leaky.FailClosed))
+	case "local":
+		opts = append(opts, leaky.WithFailurePolicy(leaky.FailLocal))
+	default:
+		return nil, fmt.Errorf("unknown failure policy %q", b.FailurePolicy)
+	}
+
+	if len(b.Exempt) > 0 {
+		networks := make([]netip.Prefix, len(b.Exempt))
+		for i, cidr := range b.Exempt {
+			network, err := netip.ParsePrefix(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("exempt network: %w", err)
+			}
+			networks[i] = network.Masked()
+		}
+		opts = append(opts, leaky.WithExemptNetworks(networks...))
+	}
+
+	if b.Shadow {
+		opts = append(opts, leaky.WithShadowMode())
+	}
+
+	return opts, nil
+}
@@ -0,0 +1,99 @@
+package leakyconfig
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/2bytes/leaky/leakytest"
+)
+
+func TestParse(t *testing.T) {
+	cfg, err := Parse(strings.NewReader(`{
+		"buckets": [
+			{"name": "api", "size": 10, "rate": 1, "per": "1s", "key": "header:X-Api-Key+path"},
+			{"name": "login", "size": 5, "rate": 1, "failure_policy": "closed",
+				"rejection": {"status": 503, "body": "Slow down\n"}}
+		]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(cfg.Buckets) != 2 {
+		t.Fatalf("Read %d buckets", len(cfg.Buckets))
+	}
+	if b := cfg.Buckets[0]; b.Name != "api" || b.Size != 10 || time.Duration(b.Per) != time.Second {
+		t.Errorf("Unexpected bucket %+v", b)
+	}
+	if b := cfg.Buckets[1]; b.per() != time.Minute || b.Rejection.Status != 503 {
+		t.Errorf("Unexpected bucket %+v", b)
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, config := range []string{
+		`{"buckets": [{"size": 10}]}`,
+		`{"buckets": [{"name": "api"}]}`,
+		`{"buckets": [{"name": "api", "size": 10, "key": "cookie"}]}`,
+		`{"buckets": [{"name": "api", "size": 10, "failure_policy": "sometimes"}]}`,
+		`{"buckets": [{"name": "api", "size": 10, "per": "soon"}]}`,
+		`{"buckets": [{"name": "api", "size": 10}, {"name": "api", "size": 5}]}`,
+		`{"buckets": [{"name": "api", "size": 10, "burst": 5}]}`,
+		`{"buckets": [{"name": "api", "size": 10, "exempt": ["10.0.0.0"]}]}`,
+	} {
+		if _, err := Parse(strings.NewReader(config)); err == nil {
+			t.Errorf("Invalid config accepted: %s", config)
+		}
+	}
+}
+
+func TestKeyFunc(t *testing.T) {
+	for _, key := range []string{"", "ip", "all", "path", "host", "method", "header:X-Api-Key", "ip+path",
+		"bearer", "user", "cookie:session", "query:api_key"} {
+		if _, err := (Bucket{Key: key}).KeyFunc(); err != nil {
+			t.Errorf("Key %q: %s", key, err)
+		}
+	}
+
+	if _, err := (Bucket{Key: "ip+cookie"}).KeyFunc(); err == nil {
+		t.Error("Unknown key accepted")
+	}
+}
+
+func TestRegister(t *testing.T) {
+	cfg := &Config{Buckets: []Bucket{
+		{Name: "api", Size: 1, Rate: 60, Key: "header:X-Api-Key", Rejection: &Rejection{Status: 503}},
+	}}
+
+	tm := leakytest.NewTestManager(t)
+	buckets, err := cfg.Register(tm.ThrottleManager)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if b, ok := tm.Bucket("api"); !ok || b != buckets["api"] {
+		t.Fatal("Bucket not registered on the manager")
+	}
+
+	handler := buckets["api"].Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	get := func(apiKey string) int {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-Api-Key", apiKey)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	if code := get("alice"); code != http.StatusOK {
+		t.Errorf("Status not OK: %v", code)
+	}
+	if code := get("alice"); code != http.StatusServiceUnavailable {
+		t.Errorf("Status not the rejection's: %v", code)
+	}
+	if code := get("bob"); code != http.StatusOK {
+		t.Errorf("Another client's status not OK: %v", code)
+	}
+}
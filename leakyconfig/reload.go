@@ -0,0 +1,109 @@
+package leakyconfig
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/2bytes/leaky"
+)
+
+// Apply applies the config to a manager its buckets may already be registered on, all of them or, if the
+// config isn't valid, none. Buckets already registered take their new size and rate while in use, keeping
+// clients' state, and the rest are registered. Only the limits of registered buckets change, their keys,
+// rejections and failure policies are kept until they are created again, and buckets no longer defined
+// are left as they were.
+func (cfg *Config) Apply(tm *leaky.ThrottleManager) (map[string]*leaky.Bucket, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	buckets := make(map[string]*leaky.Bucket, len(cfg.Buckets))
+	for _, b := range cfg.Buckets {
+		if bucket, ok := tm.Bucket(b.Name); ok {
+			bucket.SetLimit(leaky.Limit{Rate: b.Rate, Per: b.per(), Burst: b.Size})
+			buckets[b.Name] = bucket
+			continue
+		}
+
+		bucket, err := b.Register(tm)
+		if err != nil {
+			return nil, err
+		}
+		buckets[b.Name] = bucket
+	}
+
+	return buckets, nil
+}
+
+// Watcher applies a config file to a manager each time the process receives SIGHUP, and each time the file
+// changes if it is given an interval to check it at
+type Watcher struct {
+	Path    string
+	Manager *leaky.ThrottleManager
+	// Load reads the file, Load if not set, or yamlconfig.Load for YAML
+	Load func(path string) (*Config, error)
+	// Interval is how often the file is checked for changes, by its modification time and size,
+	// it is only applied on SIGHUP if not set
+	Interval time.Duration
+	// OnApply is called after each attempt to apply the file, with the error if it couldn't be read
+	// or applied, when the buckets are left as they were
+	OnApply func(err error)
+}
+
+// Run applies the file as it starts, so it registers the buckets if they aren't already, and then
+// each time it is asked to until ctx is done
+func (w *Watcher) Run(ctx context.Context) error {
+	load := w.Load
+	if load == nil {
+		load = Load
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var tick <-chan time.Time
+	if w.Interval > 0 {
+		ticker := time.NewTicker(w.Interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	last, _ := os.Stat(w.Path)
+	w.onApply(w.apply(load))
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-hup:
+		case <-tick:
+			info, err := os.Stat(w.Path)
+			if err != nil || (last != nil && info.ModTime().Equal(last.ModTime()) && info.Size() == last.Size()) {
+				continue
+			}
+			last = info
+		}
+
+		w.onApply(w.apply(load))
+	}
+}
+
+func (w *Watcher) onApply(err error) {
+	if w.OnApply != nil {
+		w.OnApply(err)
+	}
+}
+
+func (w *Watcher) apply(load func(path string) (*Config, error)) error {
+	cfg, err := load(w.Path)
+	if err != nil {
+		return err
+	}
+
+	_, err = cfg.Apply(w.Manager)
+	return err
+}
@@ -0,0 +1,102 @@
+package leakyconfig
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/2bytes/leaky/leakytest"
+)
+
+func TestApply(t *testing.T) {
+	tm := leakytest.NewTestManager(t)
+
+	cfg := &Config{Buckets: []Bucket{{Name: "api", Size: 10, Rate: 60}}}
+	buckets, err := cfg.Register(tm.ThrottleManager)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := buckets["api"]
+	if !api.Add(5, "alice") {
+		t.Fatal("Drops rejected before applying")
+	}
+
+	cfg = &Config{Buckets: []Bucket{{Name: "api", Size: 20, Rate: 60}, {Name: "search", Size: 5, Rate: 60}}}
+	buckets, err = cfg.Apply(tm.ThrottleManager)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if buckets["api"] != api {
+		t.Error("Registered bucket replaced rather than changed")
+	}
+	// Half the bucket was left, and still is at the new size
+	if accepted, _ := api.AddUpTo(100, "alice"); accepted != 10 {
+		t.Errorf("Bucket had %d space remaining after applying, expected 10", accepted)
+	}
+	if _, ok := tm.Bucket("search"); !ok {
+		t.Error("New bucket not registered")
+	}
+
+	cfg = &Config{Buckets: []Bucket{{Name: "api", Size: 1}, {Name: "broken"}}}
+	if _, err := cfg.Apply(tm.ThrottleManager); err == nil {
+		t.Error("Invalid config applied")
+	}
+	if accepted, _ := api.AddUpTo(100, "bob"); accepted != 20 {
+		t.Errorf("Bucket changed by an invalid config, had %d space for a new client", accepted)
+	}
+}
+
+func TestWatcher(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "limits.json")
+	write := func(config string) {
+		if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`{"buckets": [{"name": "api", "size": 10, "rate": 60}]}`)
+
+	tm := leakytest.NewTestManager(t)
+	applied := make(chan error, 1)
+	w := &Watcher{
+		Path:     path,
+		Manager:  tm.ThrottleManager,
+		Interval: 5 * time.Millisecond,
+		OnApply:  func(err error) { applied <- err },
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- w.Run(ctx) }()
+
+	// The file is applied as the watcher starts, registering the bucket
+	if err := <-applied; err != nil {
+		t.Fatal(err)
+	}
+	api, ok := tm.Bucket("api")
+	if !ok {
+		t.Fatal("Bucket not registered")
+	}
+
+	write(`{"buckets": [{"name": "api", "size": 100, "rate": 60}]}`)
+
+	select {
+	case err := <-applied:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Changed file not applied")
+	}
+
+	if accepted, _ := api.AddUpTo(1000, "alice"); accepted != 100 {
+		t.Errorf("Bucket of size %d after applying, expected 100", accepted)
+	}
+
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Errorf("Watcher stopped with %v", err)
+	}
+}
@@ -0,0 +1,55 @@
+// Package yamlconfig reads leakyconfig bucket definitions from YAML
+//
+//	buckets:
+//	  - name: api
+//	    size: 20
+//	    rate: 60
+//	    key: header:X-Api-Key
+//	  - name: login
+//	    size: 5
+//	    rate: 1
+//	    per: 1m
+//	    failure_policy: closed
+package yamlconfig
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/2bytes/leaky/leakyconfig"
+	"gopkg.in/yaml.v3"
+)
+
+// Load reads the YAML config file at path
+func Load(path string) (*leakyconfig.Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	cfg, err := Parse(f)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+
+	return cfg, nil
+}
+
+// Parse reads a YAML config, rejecting fields it doesn't know and buckets which aren't valid
+func Parse(r io.Reader) (*leakyconfig.Config, error) {
+	cfg := &leakyconfig.Config{}
+
+	dec := yaml.NewDecoder(r)
+	dec.KnownFields(true)
+	if err := dec.Decode(cfg); err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
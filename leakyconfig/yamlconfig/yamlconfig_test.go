@@ -0,0 +1,46 @@
+package yamlconfig
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	cfg, err := Parse(strings.NewReader(`
+buckets:
+  - name: api
+    size: 20
+    rate: 60
+    key: header:X-Api-Key
+  - name: login
+    size: 5
+    rate: 1
+    per: 30s
+    failure_policy: closed
+    rejection:
+      status: 503
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(cfg.Buckets) != 2 || cfg.Buckets[0].Key != "header:X-Api-Key" {
+		t.Fatalf("Unexpected config %+v", cfg)
+	}
+	if b := cfg.Buckets[1]; time.Duration(b.Per) != 30*time.Second || b.Rejection.Status != 503 {
+		t.Errorf("Unexpected bucket %+v", b)
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, config := range []string{
+		"buckets:\n  - name: api\n",
+		"buckets:\n  - name: api\n    size: 10\n    burst: 5\n",
+		"buckets:\n  - name: api\n    size: 10\n    per: soon\n",
+	} {
+		if _, err := Parse(strings.NewReader(config)); err == nil {
+			t.Errorf("Invalid config accepted: %q", config)
+		}
+	}
+}
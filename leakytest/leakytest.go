@@ -0,0 +1,66 @@
+// Package leakytest provides a fake store and clock for testing code which uses leaky,
+// without a Redis server and without waiting for buckets to leak in real time.
+//
+// The typical pattern is to build a handler on a test manager, then Advance the clock
+// to let the bucket leak between requests:
+//
+//	tm := leakytest.NewTestManager(t)
+//	handler := tm.ThrottlingHandler(myHandler, 1, 60, keyFunc, "api")
+//
+//	handler.ServeHTTP(w, req) // 200
+//	handler.ServeHTTP(w, req) // 429
+//
+//	tm.Clock.Advance(time.Second) // one drop leaks at 60 per minute
+//	handler.ServeHTTP(w, req) // 200
+package leakytest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/2bytes/leaky"
+)
+
+// Epoch is the time a FakeClock created by NewTestManager starts at
+var Epoch = time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// TestManager is a ThrottleManager wired to a fake store and clock
+type TestManager struct {
+	*leaky.ThrottleManager
+	Store *FakeStore
+	Clock *FakeClock
+}
+
+// NewTestManager creates a ThrottleManager backed by a FakeStore and a FakeClock starting at Epoch.
+// The store is closed when the test finishes, so anything still using the manager gets an error.
+func NewTestManager(t testing.TB, opts ...leaky.ManagerOption) *TestManager {
+	t.Helper()
+
+	clock := NewFakeClock(Epoch)
+	store := NewFakeStore(clock)
+
+	return newTestManager(t, store, store, clock, opts)
+}
+
+// NewTakingTestManager creates a TestManager backed by a TakingFakeStore, so buckets take drops through
+// the store as they do on Redis
+func NewTakingTestManager(t testing.TB, opts ...leaky.ManagerOption) *TestManager {
+	t.Helper()
+
+	clock := NewFakeClock(Epoch)
+	store := NewTakingFakeStore(clock)
+
+	return newTestManager(t, store, store.FakeStore, clock, opts)
+}
+
+func newTestManager(t testing.TB, store leaky.Store, fake *FakeStore, clock *FakeClock, opts []leaky.ManagerOption) *TestManager {
+	t.Cleanup(fake.Close)
+
+	opts = append([]leaky.ManagerOption{leaky.WithClock(clock)}, opts...)
+
+	return &TestManager{
+		ThrottleManager: leaky.NewThrottleManagerWithStore(store, opts...),
+		Store:           fake,
+		Clock:           clock,
+	}
+}
@@ -0,0 +1,128 @@
+package leakytest
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/2bytes/leaky"
+)
+
+func TestFakeClockAdvance(t *testing.T) {
+	clock := NewFakeClock(Epoch)
+	clock.Advance(time.Minute)
+
+	if got := clock.Since(Epoch); got != time.Minute {
+		t.Errorf("Clock didn't advance: %s", got)
+	}
+}
+
+func TestFakeStoreExpiry(t *testing.T) {
+	clock := NewFakeClock(Epoch)
+	store := NewFakeStore(clock)
+
+	if err := store.Set(context.Background(), "key", leaky.State{SpaceRemaining: 3}, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	clock.Advance(time.Minute - time.Nanosecond)
+	if _, ok := store.State("key"); !ok {
+		t.Error("State expired early")
+	}
+
+	clock.Advance(time.Nanosecond)
+	if _, ok := store.State("key"); ok {
+		t.Error("State didn't expire")
+	}
+}
+
+func TestFakeStoreErrors(t *testing.T) {
+	store := NewFakeStore(NewFakeClock(Epoch))
+	injected := errors.New("injected")
+
+	store.FailNext(injected)
+	if _, _, err := store.Get(context.Background(), "key"); err != injected {
+		t.Errorf("Injected error not returned: %v", err)
+	}
+
+	if _, _, err := store.Get(context.Background(), "key"); err != nil {
+		t.Errorf("Injected error returned twice: %v", err)
+	}
+
+	store.Close()
+	if err := store.Set(context.Background(), "key", leaky.State{}, time.Minute); err != ErrClosed {
+		t.Errorf("Closed store didn't fail: %v", err)
+	}
+
+	if calls := store.Calls(); calls != 3 {
+		t.Errorf("Calls not counted: %d", calls)
+	}
+}
+
+func TestTestManager(t *testing.T) {
+	tm := NewTestManager(t)
+
+	handler := tm.ThrottlingHandler(func(w http.ResponseWriter, r *http.Request) {}, 1, 60, func(r http.Request) string {
+		return "client"
+	}, "api")
+	req, _ := http.NewRequest("GET", "", nil)
+
+	codes := []int{}
+	for _, advance := range []time.Duration{0, 0, time.Second} {
+		tm.Clock.Advance(advance)
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		codes = append(codes, w.Code)
+	}
+
+	if codes[0] != http.StatusOK || codes[1] != http.StatusTooManyRequests || codes[2] != http.StatusOK {
+		t.Errorf("Unexpected status codes: %v", codes)
+	}
+
+	if keys := tm.Store.Keys(); len(keys) != 1 || keys[0] != "leaky::api::client" {
+		t.Errorf("Unexpected keys stored: %v", keys)
+	}
+}
+
+func TestTakingFakeStore(t *testing.T) {
+	clock := NewFakeClock(Epoch)
+	store := NewTakingFakeStore(clock)
+
+	// A drop a second into a bucket of three
+	take := func(demands ...leaky.Demand) leaky.TakeResult {
+		t.Helper()
+		result, err := store.Take(context.Background(), leaky.TakeRequest{
+			Key: "key", Now: clock.Now(), Size: 3, LeakRate: 0.001, Demands: demands, MaxTTL: time.Hour,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+
+	if r := take(leaky.Demand{Count: 2}); r.Existed || r.Taken[0] != 2 || r.State.SpaceRemaining != 1 {
+		t.Errorf("First take %+v, expected two drops from a new bucket", r)
+	}
+	if r := take(leaky.Demand{Count: 2}, leaky.Demand{Count: 2, Partial: true}); !r.Existed || r.Taken[0] != 0 || r.Taken[1] != 1 {
+		t.Errorf("Take %+v, expected none of two drops then one of them partially", r)
+	}
+
+	clock.Advance(1500 * time.Millisecond)
+	if r := take(leaky.Demand{Count: 1}); r.Taken[0] != 1 || r.State.SpaceRemaining != 0.5 {
+		t.Errorf("Take %+v, expected the drop which leaked and half of another left", r)
+	}
+
+	// Kept until the bucket has fully leaked
+	clock.Advance(2499 * time.Millisecond)
+	if _, ok := store.State("key"); !ok {
+		t.Error("State expired before the bucket leaked")
+	}
+	clock.Advance(time.Millisecond)
+	if _, ok := store.State("key"); ok {
+		t.Error("State kept once the bucket leaked")
+	}
+}
@@ -0,0 +1,218 @@
+package leakytest
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/2bytes/leaky"
+)
+
+// ErrClosed is returned by a FakeStore once it has been closed
+var ErrClosed = errors.New("leakytest: store closed")
+
+type entry struct {
+	state   leaky.State
+	expires time.Time
+}
+
+// FakeStore is an in-memory leaky.Store with injectable errors, expiring entries by its clock
+type FakeStore struct {
+	clock leaky.Clock
+
+	mu       sync.Mutex
+	entries  map[string]entry
+	calls    int
+	failNext []error
+	failAll  error
+	closed   bool
+}
+
+// NewFakeStore creates an empty FakeStore expiring entries by clock
+func NewFakeStore(clock leaky.Clock) *FakeStore {
+	return &FakeStore{
+		clock:   clock,
+		entries: make(map[string]entry),
+	}
+}
+
+// Get implements leaky.Store
+func (s *FakeStore) Get(ctx context.Context, key string) (leaky.State, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.call(); err != nil {
+		return leaky.State{}, false, err
+	}
+
+	state, ok := s.lookup(key)
+	return state, ok, nil
+}
+
+// Set implements leaky.Store
+func (s *FakeStore) Set(ctx context.Context, key string, state leaky.State, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.call(); err != nil {
+		return err
+	}
+
+	s.entries[key] = entry{state: state, expires: s.clock.Now().Add(ttl)}
+	return nil
+}
+
+// GetSet implements leaky.GetSetter
+func (s *FakeStore) GetSet(ctx context.Context, key string, state leaky.State, ttl time.Duration) (leaky.State, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.call(); err != nil {
+		return leaky.State{}, false, err
+	}
+
+	prev, ok := s.lookup(key)
+	s.entries[key] = entry{state: state, expires: s.clock.Now().Add(ttl)}
+
+	return prev, ok, nil
+}
+
+// Transact implements leaky.Transactor, counting as a single call
+func (s *FakeStore) Transact(ctx context.Context, keys []string, update func(states []leaky.State, exists []bool) ([]leaky.State, []time.Duration)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.call(); err != nil {
+		return err
+	}
+
+	states := make([]leaky.State, len(keys))
+	exists := make([]bool, len(keys))
+	for i, key := range keys {
+		states[i], exists[i] = s.lookup(key)
+	}
+
+	writes, ttls := update(states, exists)
+	for i, state := range writes {
+		s.entries[keys[i]] = entry{state: state, expires: s.clock.Now().Add(ttls[i])}
+	}
+
+	return nil
+}
+
+// CountKeys implements leaky.KeyCounter
+func (s *FakeStore) CountKeys(ctx context.Context, prefix string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.call(); err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for key := range s.entries {
+		if _, ok := s.lookup(key); ok && strings.HasPrefix(key, prefix) {
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+// FailNext makes the next call to the store fail with err, calls queue up errors in order
+func (s *FakeStore) FailNext(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.failNext = append(s.failNext, err)
+}
+
+// FailAll makes every call to the store fail with err until it is called again with nil
+func (s *FakeStore) FailAll(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.failAll = err
+}
+
+// Put stores state under key without counting as a call, as if written by another instance
+func (s *FakeStore) Put(key string, state leaky.State, ttl time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.entries[key] = entry{state: state, expires: s.clock.Now().Add(ttl)}
+}
+
+// State returns the unexpired state stored under key without counting as a call
+func (s *FakeStore) State(key string) (leaky.State, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.lookup(key)
+}
+
+// Keys returns the unexpired keys in the store, sorted
+func (s *FakeStore) Keys() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys := make([]string, 0, len(s.entries))
+	for key := range s.entries {
+		if _, ok := s.lookup(key); ok {
+			keys = append(keys, key)
+		}
+	}
+
+	sort.Strings(keys)
+	return keys
+}
+
+// Calls returns the number of calls made to the store, including failed ones
+func (s *FakeStore) Calls() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.calls
+}
+
+// Close makes every later call to the store fail with ErrClosed
+func (s *FakeStore) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+}
+
+// call counts a call and returns the error it should fail with, if any
+func (s *FakeStore) call() error {
+	s.calls++
+
+	if s.closed {
+		return ErrClosed
+	}
+
+	if len(s.failNext) > 0 {
+		err := s.failNext[0]
+		s.failNext = s.failNext[1:]
+		return err
+	}
+
+	return s.failAll
+}
+
+func (s *FakeStore) lookup(key string) (leaky.State, bool) {
+	e, ok := s.entries[key]
+	if !ok {
+		return leaky.State{}, false
+	}
+
+	if !s.clock.Now().Before(e.expires) {
+		delete(s.entries, key)
+		return leaky.State{}, false
+	}
+
+	return e.state, true
+}
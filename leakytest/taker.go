@@ -0,0 +1,123 @@
+package leakytest
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"github.com/2bytes/leaky"
+)
+
+// leakEpsilon absorbs the rounding error of leak rates which aren't exact in binary, as the bucket does
+const leakEpsilon = 1e-9
+
+// TakingFakeStore is a FakeStore which is also a leaky.Taker, leaking and taking drops itself as
+// RedisStore's take script does, so buckets on it take the path they do on Redis rather than GetSet's
+type TakingFakeStore struct {
+	*FakeStore
+}
+
+// NewTakingFakeStore creates an empty TakingFakeStore expiring entries by clock
+func NewTakingFakeStore(clock leaky.Clock) *TakingFakeStore {
+	return &TakingFakeStore{FakeStore: NewFakeStore(clock)}
+}
+
+// Take implements leaky.Taker, counting as a single call
+func (s *TakingFakeStore) Take(ctx context.Context, req leaky.TakeRequest) (leaky.TakeResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.call(); err != nil {
+		return leaky.TakeResult{}, err
+	}
+
+	stored, existed := s.lookup(req.Key)
+	space := float64(req.Size)
+	if existed {
+		space = leak(req, stored)
+	}
+
+	result := leaky.TakeResult{Taken: make([]int, len(req.Demands)), Existed: existed}
+	total := 0
+	for i, d := range req.Demands {
+		result.Taken[i] = decide(d, space)
+		space -= float64(result.Taken[i])
+		total += result.Taken[i]
+	}
+
+	result.State = leaky.State{LastUpdate: req.Now, SpaceRemaining: space, Size: req.Size, Fingerprint: req.Fingerprint}
+	if total == 0 {
+		return result, nil
+	}
+
+	state := result.State
+	if req.GCRA && req.LeakRate > 0 {
+		drain := (float64(req.Size) - space) / req.LeakRate
+		state = leaky.State{TAT: req.Now.Add(time.Duration(drain * float64(time.Millisecond))), Fingerprint: req.Fingerprint}
+	}
+
+	ttl := req.MaxTTL
+	if req.LeakRate > 0 {
+		drain := time.Duration(math.Ceil((float64(req.Size)-space)/req.LeakRate)) * time.Millisecond
+		ttl = drain + req.TTLMargin
+		if ttl > req.MaxTTL {
+			ttl = req.MaxTTL
+		}
+		if ttl < time.Millisecond {
+			ttl = time.Millisecond
+		}
+	}
+
+	s.entries[req.Key] = entry{state: state, expires: s.clock.Now().Add(ttl)}
+	return result, nil
+}
+
+// leak returns the space remaining as of the request in the stored state, migrating it first if it
+// was written under another config
+func leak(req leaky.TakeRequest, state leaky.State) float64 {
+	size := float64(req.Size)
+
+	remaining, last := state.SpaceRemaining, state.LastUpdate
+	if !state.TAT.IsZero() {
+		backlog := float64(state.TAT.Sub(req.Now)) / float64(time.Millisecond)
+		remaining, last = size-math.Max(0, backlog)*req.LeakRate, req.Now
+	}
+
+	if state.Fingerprint != req.Fingerprint {
+		switch {
+		case req.Migration == leaky.MigrateReset:
+			remaining, last = size, req.Now
+		case req.Migration == leaky.MigrateProportional && state.Size > 0:
+			remaining = remaining * size / float64(state.Size)
+		default:
+			remaining = math.Min(remaining, size)
+		}
+	}
+
+	// Whole milliseconds elapsed, fractions of a drop are kept
+	elapsed := float64(req.Now.Sub(last) / time.Millisecond)
+	return math.Min(size, remaining+elapsed*req.LeakRate)
+}
+
+// decide returns how many drops of the demand there is space for
+func decide(d leaky.Demand, space float64) int {
+	if d.Reserve {
+		return d.Count
+	}
+
+	whole := int(math.Floor(space - float64(d.Keep) + leakEpsilon))
+	if d.Partial {
+		if whole < 1 {
+			return 0
+		}
+		if whole < d.Count {
+			return whole
+		}
+		return d.Count
+	}
+
+	if whole < d.Count {
+		return 0
+	}
+	return d.Count
+}
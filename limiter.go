@@ -0,0 +1,59 @@
+package leaky
+
+import (
+	"context"
+	"time"
+)
+
+// Limiter limits operations other than HTTP requests, such as jobs, messages consumed or scheduled tasks, by
+// buckets kept in the manager's store, so every worker sharing it shares the limit. Each operation is limited
+// by the bucket of the key given, there is no handler or KeyFunc.
+type Limiter struct {
+	bucket *Bucket
+}
+
+// Limiter creates a new limiter of buckets applying limit. Options about HTTP requests, such as costs,
+// priorities and method limits, have no effect on it.
+func (m *ThrottleManager) Limiter(limit Limit, bucketName string, opts ...Option) *Limiter {
+	return &Limiter{bucket: m.newBucket(nil, limit.limits(), nil, bucketName, opts)}
+}
+
+// Allow takes a drop from the key's bucket if there is space for it
+func (l *Limiter) Allow(ctx context.Context, key string) bool {
+	return l.bucket.AllowN(ctx, key, 1)
+}
+
+// AllowN takes n drops from the key's bucket if there is space for all of them
+func (l *Limiter) AllowN(ctx context.Context, key string, n int) bool {
+	return l.bucket.AllowN(ctx, key, n)
+}
+
+// Reserve takes n drops from the key's bucket whether or not there is space for them, as Bucket.Reserve does
+func (l *Limiter) Reserve(ctx context.Context, key string, n int) time.Duration {
+	return l.bucket.Reserve(ctx, key, n)
+}
+
+// Wait blocks until a drop can be taken from the key's bucket, or ctx is done
+func (l *Limiter) Wait(ctx context.Context, key string) error {
+	return l.bucket.WaitN(ctx, key, 1)
+}
+
+// WaitN blocks until n drops can be taken from the key's bucket, or ctx is done, as Bucket.WaitN does
+func (l *Limiter) WaitN(ctx context.Context, key string, n int) error {
+	return l.bucket.WaitN(ctx, key, n)
+}
+
+// Remaining returns how many drops the key's bucket has space for and how long until it has fully leaked
+func (l *Limiter) Remaining(ctx context.Context, key string) (remaining int, resetAfter time.Duration) {
+	return l.bucket.Remaining(ctx, key)
+}
+
+// Reset empties the key's bucket, so its operations are allowed again straight away
+func (l *Limiter) Reset(ctx context.Context, key string) error {
+	return l.bucket.Reset(ctx, key)
+}
+
+// Bucket returns the limiter's bucket, to change its limits or set a key's own
+func (l *Limiter) Bucket() *Bucket {
+	return l.bucket
+}
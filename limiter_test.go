@@ -0,0 +1,46 @@
+package leaky_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/2bytes/leaky"
+	"github.com/2bytes/leaky/leakytest"
+)
+
+func TestLimiter(t *testing.T) {
+	tm := leakytest.NewTestManager(t)
+	ctx := context.Background()
+
+	limiter := tm.Limiter(leaky.Limit{Rate: 1, Per: time.Second, Burst: 2}, "jobs")
+
+	for i, want := range []bool{true, true, false} {
+		if got := limiter.Allow(ctx, "worker"); got != want {
+			t.Errorf("Job %d allowed %v, expected %v", i, got, want)
+		}
+	}
+	if !limiter.Allow(ctx, "other") {
+		t.Error("Another key's job limited by the first key's bucket")
+	}
+
+	if remaining, _ := limiter.Remaining(ctx, "worker"); remaining != 0 {
+		t.Errorf("Remaining %d, expected 0", remaining)
+	}
+
+	tm.Clock.Advance(time.Second)
+	if !limiter.Allow(ctx, "worker") {
+		t.Error("Job not allowed once a drop had leaked")
+	}
+
+	if err := limiter.Reset(ctx, "worker"); err != nil {
+		t.Fatalf("Reset returned %v", err)
+	}
+	if !limiter.AllowN(ctx, "worker", 2) {
+		t.Error("Jobs not allowed after a reset")
+	}
+
+	if bucket, ok := tm.Bucket("jobs"); !ok || bucket != limiter.Bucket() {
+		t.Error("Limiter's bucket not registered with the manager")
+	}
+}
@@ -0,0 +1,174 @@
+package leaky
+
+import (
+	"math"
+	"time"
+)
+
+// limits are the size and leak rate a bucket applies to a request
+type limits struct {
+	size int
+	// leakRate is in drops per millisecond
+	leakRate    float64
+	fingerprint string
+	// maxTTL is the longest state is kept for, unless deriveTTL is set when it is kept
+	// until the bucket has fully leaked plus ttlMargin however long that takes
+	maxTTL    time.Duration
+	deriveTTL bool
+	ttlMargin time.Duration
+	// gcra stores state as the time the bucket will have fully leaked
+	gcra bool
+}
+
+// Limit is a rate sustained over time, and the burst of drops which can be added at once.
+// The burst is the size of the bucket, so a client which has been idle can make that many requests
+// at once before being held to the rate.
+type Limit struct {
+	Rate float64
+	// Per is the duration Rate is over, a minute if not set
+	Per time.Duration
+	// Burst defaults to the rate, rounded up, so a client can use a whole period's worth at once
+	Burst int
+}
+
+// limits converts the limit to the limits of a bucket
+func (l Limit) limits() limits {
+	per := l.Per
+	if per <= 0 {
+		per = time.Minute
+	}
+
+	burst := l.Burst
+	if burst <= 0 {
+		burst = int(math.Ceil(l.Rate))
+	}
+
+	return newLimits(burst, perDuration(l.Rate, per))
+}
+
+// SetLimits changes the bucket's size and leak rate per minute while it is in use, as SetLimit
+func (b *Bucket) SetLimits(size int, rate int) {
+	b.setLimits(newLimits(size, perMinute(rate)))
+}
+
+// SetLimit changes the bucket's size and leak rate while it is in use, keeping its other settings.
+// Each client's stored state is migrated to the new limit by the bucket's MigrationPolicy when they are next seen,
+// as it would be after a deploy changing it.
+func (b *Bucket) SetLimit(l Limit) {
+	b.setLimits(l.limits())
+}
+
+// Limit returns the bucket's size and leak rate as they are now, with the rate per minute
+func (b *Bucket) Limit() Limit {
+	lim := b.currentLimits()
+	return Limit{Rate: lim.leakRate * float64(time.Minute/time.Millisecond), Per: time.Minute, Burst: lim.size}
+}
+
+func (b *Bucket) setLimits(lim limits) {
+	b.limitsMu.Lock()
+	defer b.limitsMu.Unlock()
+
+	b.limits = lim.withTTLOf(b.limits).withAlgorithmOf(b.limits)
+}
+
+// currentLimits are the bucket's limits, as last set
+func (b *Bucket) currentLimits() limits {
+	b.limitsMu.RLock()
+	defer b.limitsMu.RUnlock()
+
+	return b.limits
+}
+
+func newLimits(size int, leakRate float64) limits {
+	return limits{
+		size:        size,
+		leakRate:    leakRate,
+		fingerprint: configFingerprint(algorithmLeaky, size, leakRate),
+		maxTTL:      stateTTL,
+	}
+}
+
+// WithStateTTL sets the longest a client's state is kept in the store after their last request, the default
+// is an hour. State is dropped sooner once the bucket has fully leaked, so it only needs raising for buckets
+// which take longer than that to leak, such as 10 a day, which would otherwise forget clients' drops.
+func WithStateTTL(ttl time.Duration) Option {
+	return func(b *Bucket) {
+		b.limits.maxTTL = ttl
+	}
+}
+
+// WithDerivedTTL keeps each client's state until their bucket has fully leaked plus margin, however long that
+// takes, rather than for at most the state TTL. The margin allows for clocks differing between instances.
+func WithDerivedTTL(margin time.Duration) Option {
+	return func(b *Bucket) {
+		b.limits.deriveTTL = true
+		b.limits.ttlMargin = margin
+	}
+}
+
+// withTTLOf returns the limits keeping state for as long as other does
+func (l limits) withTTLOf(other limits) limits {
+	l.maxTTL = other.maxTTL
+	l.deriveTTL = other.deriveTTL
+	l.ttlMargin = other.ttlMargin
+	return l
+}
+
+// perMinute converts a leak rate per minute to drops per millisecond
+func perMinute(rate int) float64 {
+	return float64(rate) / (60.0 * 1000.0)
+}
+
+// perDuration converts a leak rate per a duration to drops per millisecond
+func perDuration(rate float64, per time.Duration) float64 {
+	return rate / (float64(per) / float64(time.Millisecond))
+}
+
+// ttl returns how long the state needs keeping, once the bucket has fully leaked
+// it is no different to having no state at all
+func (l limits) ttl(state State) time.Duration {
+	if l.leakRate <= 0 {
+		return l.maxTTL
+	}
+
+	refill := l.drainTime(float64(l.size)-state.SpaceRemaining) + l.ttlMargin
+	if longest := l.longestTTL(); refill > longest {
+		return longest
+	}
+
+	// A zero TTL would keep the state forever
+	if refill < time.Millisecond {
+		return time.Millisecond
+	}
+
+	return refill
+}
+
+// longestTTL is the longest state is kept for, which is how long a full bucket takes to leak
+// plus the margin if the TTL is derived
+func (l limits) longestTTL() time.Duration {
+	if !l.deriveTTL || l.leakRate <= 0 {
+		return l.maxTTL
+	}
+
+	return l.drainTime(float64(l.size)) + l.ttlMargin
+}
+
+// drainTime is how long the bucket takes to leak drops, in whole milliseconds
+func (l limits) drainTime(drops float64) time.Duration {
+	return time.Duration(math.Ceil(drops/l.leakRate)) * time.Millisecond
+}
+
+// waitFor returns how long until there is space for count drops in a bucket left in the given state
+func (l limits) waitFor(count int, state State) time.Duration {
+	deficit := float64(count) - state.SpaceRemaining
+	if count <= 0 || deficit <= leakEpsilon {
+		return 0
+	}
+
+	if count > l.size || l.leakRate <= 0 {
+		return InfDuration
+	}
+
+	return time.Duration(math.Ceil(deficit/l.leakRate)) * time.Millisecond
+}
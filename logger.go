@@ -0,0 +1,71 @@
+package leaky
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Logger logs what goes wrong in a manager's buckets, and is satisfied by *slog.Logger. The args are
+// alternating keys and values, such as "bucket" and the bucket's name.
+type Logger interface {
+	Info(msg string, args ...any)
+	Warn(msg string, args ...any)
+	Error(msg string, args ...any)
+}
+
+// WithLogger logs to l in place of the standard logger, a nil Logger silences the manager
+func WithLogger(l Logger) ManagerOption {
+	return func(m *ThrottleManager) {
+		if l == nil {
+			l = discardLogger{}
+		}
+		m.logger = l
+	}
+}
+
+// StdLogger returns the Logger managers use unless given WithLogger, for stores and adapters to log
+// the same way
+func StdLogger() Logger {
+	return stdLogger{}
+}
+
+// stdLogger logs to the standard logger, as msg followed by its args as key=value
+type stdLogger struct{}
+
+func (stdLogger) Info(msg string, args ...any)  { log.Print(format(msg, args)) }
+func (stdLogger) Warn(msg string, args ...any)  { log.Print(format(msg, args)) }
+func (stdLogger) Error(msg string, args ...any) { log.Print(format(msg, args)) }
+
+func format(msg string, args []any) string {
+	var b strings.Builder
+	b.WriteString(msg)
+
+	for i := 0; i < len(args); i += 2 {
+		if i == 0 {
+			b.WriteByte(':')
+		}
+		if i+1 < len(args) {
+			fmt.Fprintf(&b, " %v=%q", args[i], fmt.Sprint(args[i+1]))
+		} else {
+			fmt.Fprintf(&b, " %q", fmt.Sprint(args[i]))
+		}
+	}
+
+	return b.String()
+}
+
+type discardLogger struct{}
+
+func (discardLogger) Info(msg string, args ...any)  {}
+func (discardLogger) Warn(msg string, args ...any)  {}
+func (discardLogger) Error(msg string, args ...any) {}
+
+// logFailure logs a failed call to the store for the key, unless the breaker cut it short
+func (c *storeClient) logFailure(logf func(msg string, args ...any), msg string, key string, err error) {
+	if err == errBreakerOpen {
+		return
+	}
+
+	logf(msg, "bucket", c.name, "key", key, "error", err)
+}
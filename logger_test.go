@@ -0,0 +1,91 @@
+package leaky
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+type recordedLogger struct {
+	mu   sync.Mutex
+	logs []string
+}
+
+func (l *recordedLogger) Info(msg string, args ...any)  { l.log("INFO", msg, args) }
+func (l *recordedLogger) Warn(msg string, args ...any)  { l.log("WARN", msg, args) }
+func (l *recordedLogger) Error(msg string, args ...any) { l.log("ERROR", msg, args) }
+
+func (l *recordedLogger) log(level string, msg string, args []any) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.logs = append(l.logs, level+" "+format(msg, args))
+}
+
+func TestLogger(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mr.Close()
+
+	logger := &recordedLogger{}
+	rc := redis.NewClient(&redis.Options{Addr: mr.Addr(), MaxRetries: -1})
+	tm := NewThrottleManager(rc, WithLogger(logger))
+
+	handler := tm.ThrottlingHandler(handleFuncSuccessResponse, 10, 0, keyFunc, "test")
+	req, _ := http.NewRequest("GET", "", nil)
+
+	mr.Close()
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if len(logger.logs) == 0 {
+		t.Fatal("Store failure not logged")
+	}
+
+	key := handler.getKey(keyFunc(*req))
+	prefix := fmt.Sprintf(`ERROR Taking from bucket failed, resetting counters: bucket="test" key=%q error=`, key)
+	if got := logger.logs[0]; !strings.HasPrefix(got, prefix) {
+		t.Errorf("Store failure logged as %q", got)
+	}
+}
+
+func TestLoggerSilenced(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mr.Close()
+
+	rc := redis.NewClient(&redis.Options{Addr: mr.Addr(), MaxRetries: -1})
+	tm := NewThrottleManager(rc, WithLogger(nil), WithBreaker(1, 0))
+
+	handler := tm.ThrottlingHandler(handleFuncSuccessResponse, 10, 0, keyFunc, "test")
+	req, _ := http.NewRequest("GET", "", nil)
+
+	mr.Close()
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("Status not OK with logs silenced: %v", w.Code)
+	}
+}
+
+func TestFormat(t *testing.T) {
+	got := format("Setting bucket state failed", []any{"bucket", "test", "error", errors.New("down"), "odd"})
+	if want := `Setting bucket state failed: bucket="test" error="down" "odd"`; got != want {
+		t.Errorf("Formatted %q, expected %q", got, want)
+	}
+
+	if got := format("Store circuit breaker open", nil); got != "Store circuit breaker open" {
+		t.Errorf("Formatted %q without args", got)
+	}
+}
@@ -0,0 +1,211 @@
+// Package memcachestore provides a leaky.Store keeping bucket state in Memcached
+//
+//	client := memcache.New("10.0.0.1:11211", "10.0.0.2:11211")
+//	tm := leaky.NewThrottleManagerWithStore(memcachestore.New(client))
+package memcachestore
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"math"
+	"time"
+
+	"github.com/2bytes/leaky"
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+// maxAttempts is how many times GetSet retries a write which lost a race with another instance
+const maxAttempts = 5
+
+// maxRelativeExpiration is the longest expiration Memcached takes as seconds from now, rather than a Unix time
+const maxRelativeExpiration = 30 * 24 * time.Hour
+
+// ErrConflict is returned by GetSet and Transact when every attempt to write lost a race with another instance
+var ErrConflict = errors.New("memcachestore: too many conflicting writes")
+
+// ErrPartialTransaction is returned by Transact when a key was replaced by another write once the keys
+// before it had been written, which are left as written
+var ErrPartialTransaction = errors.New("memcachestore: transaction conflicted after writing some of its keys")
+
+// Client is the part of the Memcached client the store uses, it is implemented by *memcache.Client
+type Client interface {
+	Get(key string) (*memcache.Item, error)
+	Set(item *memcache.Item) error
+	Add(item *memcache.Item) error
+	CompareAndSwap(item *memcache.Item) error
+}
+
+// Store keeps bucket state in Memcached as JSON values. GetSet and Transact replace each key
+// compare-and-swap, so no other write can land on it between reading its previous state and writing the
+// new one, though it takes two round trips. Transactions over several keys aren't atomic, see Transact.
+type Store struct {
+	client Client
+}
+
+// New creates a store keeping state in the Memcached servers of client
+func New(client Client) *Store {
+	return &Store{client: client}
+}
+
+// Get implements leaky.Store
+func (s *Store) Get(ctx context.Context, key string) (leaky.State, bool, error) {
+	state, item, err := s.get(key)
+	return state, item != nil, err
+}
+
+// Set implements leaky.Store
+func (s *Store) Set(ctx context.Context, key string, state leaky.State, ttl time.Duration) error {
+	item, err := newItem(key, state, ttl)
+	if err != nil {
+		return err
+	}
+
+	return s.client.Set(item)
+}
+
+// GetSet implements leaky.GetSetter
+func (s *Store) GetSet(ctx context.Context, key string, state leaky.State, ttl time.Duration) (leaky.State, bool, error) {
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		prev, current, err := s.get(key)
+		if err != nil {
+			return prev, false, err
+		}
+
+		err = s.replace(key, current, state, ttl)
+		switch {
+		case err == nil:
+			return prev, current != nil, nil
+		case conflicted(err):
+			continue
+		default:
+			return prev, current != nil, &leaky.WriteError{Err: err}
+		}
+	}
+
+	return leaky.State{}, false, ErrConflict
+}
+
+// Transact implements leaky.Transactor, replacing each key compare-and-swap as GetSet does and calling
+// update again on the states read if the first key was replaced before it could be written. Memcached
+// can't replace several keys at once, so if a later key was replaced once the keys before it have been
+// written, Transact returns ErrPartialTransaction rather than update those a second time.
+func (s *Store) Transact(ctx context.Context, keys []string, update func(states []leaky.State, exists []bool) ([]leaky.State, []time.Duration)) error {
+attempts:
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		states := make([]leaky.State, len(keys))
+		exists := make([]bool, len(keys))
+		items := make([]*memcache.Item, len(keys))
+		for i, key := range keys {
+			var err error
+			if states[i], items[i], err = s.get(key); err != nil {
+				return err
+			}
+			exists[i] = items[i] != nil
+		}
+
+		writes, ttls := update(states, exists)
+		for i, state := range writes {
+			err := s.replace(keys[i], items[i], state, ttls[i])
+			switch {
+			case err == nil:
+			case conflicted(err) && i == 0:
+				continue attempts
+			case conflicted(err):
+				return ErrPartialTransaction
+			default:
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	return ErrConflict
+}
+
+// replace writes state under key if the item read from it, or nil if there was none, hasn't been
+// replaced since
+func (s *Store) replace(key string, current *memcache.Item, state leaky.State, ttl time.Duration) error {
+	item, err := newItem(key, state, ttl)
+	if err != nil {
+		return err
+	}
+
+	if current == nil {
+		return s.client.Add(item)
+	}
+
+	// Swapping the item read carries its CAS ID, the write fails if anything has replaced it since
+	current.Value, current.Expiration = item.Value, item.Expiration
+	return s.client.CompareAndSwap(current)
+}
+
+// conflicted reports whether a write failed because another one landed first
+func conflicted(err error) bool {
+	return err == memcache.ErrNotStored || err == memcache.ErrCASConflict
+}
+
+// get returns the state stored under key and the item it was read from, which is nil if there is none
+func (s *Store) get(key string) (leaky.State, *memcache.Item, error) {
+	state := leaky.State{}
+
+	item, err := s.client.Get(itemKey(key))
+	if err != nil {
+		if err == memcache.ErrCacheMiss {
+			return state, nil, nil
+		}
+		return state, nil, err
+	}
+
+	if err := json.Unmarshal(item.Value, &state); err != nil {
+		return state, nil, err
+	}
+
+	return state, item, nil
+}
+
+func newItem(key string, state leaky.State, ttl time.Duration) (*memcache.Item, error) {
+	value, err := json.Marshal(state)
+	if err != nil {
+		return nil, err
+	}
+
+	return &memcache.Item{Key: itemKey(key), Value: value, Expiration: expiration(ttl)}, nil
+}
+
+// expiration converts a TTL to a Memcached expiration, which is in whole seconds and never expires at zero
+func expiration(ttl time.Duration) int32 {
+	if ttl > maxRelativeExpiration {
+		return int32(time.Now().Add(ttl).Unix())
+	}
+
+	return int32(math.Max(1, math.Ceil(ttl.Seconds())))
+}
+
+// itemKey returns key if Memcached accepts it, otherwise a hash of it. Memcached keys are at most
+// 250 bytes without spaces or control characters, which a client's key may well have.
+func itemKey(key string) string {
+	if legalKey(key) {
+		return key
+	}
+
+	sum := sha256.Sum256([]byte(key))
+	return "leaky-sha256:" + hex.EncodeToString(sum[:])
+}
+
+func legalKey(key string) bool {
+	if len(key) > 250 {
+		return false
+	}
+
+	for i := 0; i < len(key); i++ {
+		if key[i] <= ' ' || key[i] == 0x7f {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,221 @@
+package memcachestore
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/2bytes/leaky"
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+func TestItemKey(t *testing.T) {
+	if key := itemKey("leaky::api::alice"); key != "leaky::api::alice" {
+		t.Errorf("Legal key changed to %q", key)
+	}
+
+	for _, key := range []string{"leaky::api::\x00", "leaky::api::a b", "leaky::api::" + strings.Repeat("a", 250)} {
+		hashed := itemKey(key)
+		if !legalKey(hashed) {
+			t.Errorf("Key %q hashed to illegal key %q", key, hashed)
+		}
+		if hashed == itemKey(key+"x") {
+			t.Errorf("Keys %q and %q hashed to the same key", key, key+"x")
+		}
+	}
+}
+
+func TestExpiration(t *testing.T) {
+	for _, test := range []struct {
+		ttl  time.Duration
+		want int32
+	}{
+		{time.Millisecond, 1},
+		{1500 * time.Millisecond, 2},
+		{time.Hour, 3600},
+	} {
+		if got := expiration(test.ttl); got != test.want {
+			t.Errorf("Expiration of %v is %d, expected %d", test.ttl, got, test.want)
+		}
+	}
+
+	// Past 30 days the expiration is a Unix time
+	if got := int64(expiration(40 * 24 * time.Hour)); got < time.Now().Unix() {
+		t.Errorf("Expiration %d of 40 days isn't a Unix time", got)
+	}
+}
+
+// fakeMemcache is an in-memory Memcached implementing the Client. Items' CAS IDs are unexported, so it
+// remembers the version of each item it has returned, which CompareAndSwap compares with the stored one.
+type fakeMemcache struct {
+	values   map[string][]byte
+	versions map[string]int
+	read     map[*memcache.Item]int
+	// beforeWrite is called before each Add or CompareAndSwap, such as to write as another instance would
+	beforeWrite func()
+}
+
+func newFakeMemcache() *fakeMemcache {
+	return &fakeMemcache{values: make(map[string][]byte), versions: make(map[string]int), read: make(map[*memcache.Item]int)}
+}
+
+func (f *fakeMemcache) Get(key string) (*memcache.Item, error) {
+	value, ok := f.values[key]
+	if !ok {
+		return nil, memcache.ErrCacheMiss
+	}
+
+	item := &memcache.Item{Key: key, Value: value}
+	f.read[item] = f.versions[key]
+	return item, nil
+}
+
+func (f *fakeMemcache) Set(item *memcache.Item) error {
+	f.values[item.Key] = item.Value
+	f.versions[item.Key]++
+	return nil
+}
+
+func (f *fakeMemcache) Add(item *memcache.Item) error {
+	f.wrote()
+	if _, ok := f.values[item.Key]; ok {
+		return memcache.ErrNotStored
+	}
+	return f.Set(item)
+}
+
+func (f *fakeMemcache) CompareAndSwap(item *memcache.Item) error {
+	f.wrote()
+	version, ok := f.read[item]
+	if _, exists := f.values[item.Key]; !ok || !exists {
+		return memcache.ErrNotStored
+	}
+	if version != f.versions[item.Key] {
+		return memcache.ErrCASConflict
+	}
+	return f.Set(item)
+}
+
+func (f *fakeMemcache) wrote() {
+	if f.beforeWrite != nil {
+		f.beforeWrite()
+	}
+}
+
+func TestGetSet(t *testing.T) {
+	store := New(newFakeMemcache())
+	ctx := context.Background()
+
+	if prev, ok, err := store.GetSet(ctx, "key", leaky.State{SpaceRemaining: 1}, time.Minute); err != nil || ok || prev.SpaceRemaining != 0 {
+		t.Fatalf("GetSet of a new key returned %+v, %v, %v", prev, ok, err)
+	}
+	if prev, ok, err := store.GetSet(ctx, "key", leaky.State{SpaceRemaining: 2}, time.Minute); err != nil || !ok || prev.SpaceRemaining != 1 {
+		t.Fatalf("GetSet returned %+v, %v, %v, expected the state it replaced", prev, ok, err)
+	}
+	if state, ok, err := store.Get(ctx, "key"); err != nil || !ok || state.SpaceRemaining != 2 {
+		t.Errorf("Get returned %+v, %v, %v after GetSet", state, ok, err)
+	}
+}
+
+func TestGetSetRetriesConflictingWrite(t *testing.T) {
+	for _, existing := range []bool{false, true} {
+		mc := newFakeMemcache()
+		store := New(mc)
+		ctx := context.Background()
+
+		if existing {
+			if err := store.Set(ctx, "key", leaky.State{SpaceRemaining: 4}, time.Minute); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// Another instance writes between the read and the first write, so it must be tried again
+		mc.beforeWrite = func() {
+			mc.beforeWrite = nil
+			if err := store.Set(ctx, "key", leaky.State{SpaceRemaining: 2}, time.Minute); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		prev, ok, err := store.GetSet(ctx, "key", leaky.State{SpaceRemaining: 3}, time.Minute)
+		if err != nil || !ok || prev.SpaceRemaining != 2 {
+			t.Errorf("GetSet of an existing key %v returned %+v, %v, %v, expected the other instance's state", existing, prev, ok, err)
+		}
+		if state, _, _ := store.Get(ctx, "key"); state.SpaceRemaining != 3 {
+			t.Errorf("Stored %+v, expected GetSet's state", state)
+		}
+	}
+}
+
+func TestGetSetConflicts(t *testing.T) {
+	mc := newFakeMemcache()
+	store := New(mc)
+
+	// Every write loses the race to another instance's write
+	mc.beforeWrite = func() {
+		mc.Set(&memcache.Item{Key: "key", Value: []byte(`{"space_remaining":1}`)})
+	}
+
+	if _, _, err := store.GetSet(context.Background(), "key", leaky.State{}, time.Minute); !errors.Is(err, ErrConflict) {
+		t.Errorf("GetSet returned %v, expected ErrConflict", err)
+	}
+}
+
+func TestTransactRetriesConflictingWrite(t *testing.T) {
+	mc := newFakeMemcache()
+	store := New(mc)
+	ctx := context.Background()
+
+	if err := store.Set(ctx, "key", leaky.State{SpaceRemaining: 4}, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another instance writes between the read and the first write, so update must be called again
+	mc.beforeWrite = func() {
+		mc.beforeWrite = nil
+		if err := store.Set(ctx, "key", leaky.State{SpaceRemaining: 2}, time.Minute); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var read []float64
+	err := store.Transact(ctx, []string{"key"}, func(states []leaky.State, exists []bool) ([]leaky.State, []time.Duration) {
+		read = append(read, states[0].SpaceRemaining)
+		states[0].SpaceRemaining--
+		return states, []time.Duration{time.Minute}
+	})
+	if err != nil || len(read) != 2 || read[1] != 2 {
+		t.Errorf("Transact returned %v having read %v, expected the other instance's state read again", err, read)
+	}
+	if state, _, _ := store.Get(ctx, "key"); state.SpaceRemaining != 1 {
+		t.Errorf("Stored %+v, expected the update of the other instance's state", state)
+	}
+}
+
+func TestTransactPartial(t *testing.T) {
+	mc := newFakeMemcache()
+	store := New(mc)
+	ctx := context.Background()
+
+	// Another instance writes the second key after the first has been written
+	writes := 0
+	mc.beforeWrite = func() {
+		if writes++; writes == 2 {
+			mc.Set(&memcache.Item{Key: "b", Value: []byte(`{"space_remaining":1}`)})
+		}
+	}
+
+	calls := 0
+	err := store.Transact(ctx, []string{"a", "b"}, func(states []leaky.State, exists []bool) ([]leaky.State, []time.Duration) {
+		calls++
+		return []leaky.State{{SpaceRemaining: 3}, {SpaceRemaining: 3}}, []time.Duration{time.Minute, time.Minute}
+	})
+	if !errors.Is(err, ErrPartialTransaction) || calls != 1 {
+		t.Errorf("Transact returned %v after %d updates, expected ErrPartialTransaction after one", err, calls)
+	}
+	if state, _, _ := store.Get(ctx, "b"); state.SpaceRemaining != 1 {
+		t.Errorf("Stored %+v, expected the other instance's write kept", state)
+	}
+}
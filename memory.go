@@ -0,0 +1,171 @@
+package leaky
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	defaultSweepInterval = time.Minute
+)
+
+// MemoryStore is a Store keeping state in process memory, for services running a single instance.
+// Entries expire with the TTL they were stored with, a background goroutine sweeps expired entries
+// until the store is closed.
+type MemoryStore struct {
+	clock    Clock
+	interval time.Duration
+	max      int
+
+	mu      sync.Mutex
+	entries *expiringMap[State]
+
+	stop chan struct{}
+	done chan struct{}
+	once sync.Once
+}
+
+// MemoryOption configures a MemoryStore
+type MemoryOption func(*MemoryStore)
+
+// WithSweepInterval sets how often expired entries are swept, the default is a minute
+func WithSweepInterval(interval time.Duration) MemoryOption {
+	return func(s *MemoryStore) {
+		s.interval = interval
+	}
+}
+
+// WithMaxEntries caps the number of entries held. When exceeded, expired entries are evicted first,
+// then the entries which will have fully leaked soonest.
+func WithMaxEntries(max int) MemoryOption {
+	return func(s *MemoryStore) {
+		s.max = max
+	}
+}
+
+// WithMemoryClock sets the clock entries expire by, it should be the clock used by the manager
+func WithMemoryClock(clock Clock) MemoryOption {
+	return func(s *MemoryStore) {
+		s.clock = clock
+	}
+}
+
+// NewMemoryStore creates an empty MemoryStore and starts its sweeper, Close must be called to stop it
+func NewMemoryStore(opts ...MemoryOption) *MemoryStore {
+	s := &MemoryStore{
+		clock:    wallClock{},
+		interval: defaultSweepInterval,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	s.entries = newExpiringMap[State](s.max)
+
+	go s.sweeper()
+
+	return s
+}
+
+// Get implements Store
+func (s *MemoryStore) Get(ctx context.Context, key string) (State, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	state, ok := s.entries.get(key, s.clock.Now())
+	return state, ok, nil
+}
+
+// Set implements Store
+func (s *MemoryStore) Set(ctx context.Context, key string, state State, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.clock.Now()
+	s.entries.set(key, state, now.Add(ttl), now)
+	return nil
+}
+
+// GetSet implements GetSetter
+func (s *MemoryStore) GetSet(ctx context.Context, key string, state State, ttl time.Duration) (State, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.clock.Now()
+	prev, ok := s.entries.get(key, now)
+	s.entries.set(key, state, now.Add(ttl), now)
+
+	return prev, ok, nil
+}
+
+// Transact implements Transactor, holding the store's lock while update runs
+func (s *MemoryStore) Transact(ctx context.Context, keys []string, update func(states []State, exists []bool) ([]State, []time.Duration)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.clock.Now()
+	states := make([]State, len(keys))
+	exists := make([]bool, len(keys))
+	for i, key := range keys {
+		states[i], exists[i] = s.entries.get(key, now)
+	}
+
+	writes, ttls := update(states, exists)
+	for i, state := range writes {
+		s.entries.set(keys[i], state, now.Add(ttls[i]), now)
+	}
+
+	return nil
+}
+
+// CountKeys implements KeyCounter
+func (s *MemoryStore) CountKeys(ctx context.Context, prefix string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.entries.countPrefix(prefix, s.clock.Now()), nil
+}
+
+// Len returns the number of entries held, including expired entries not yet swept
+func (s *MemoryStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.entries.len()
+}
+
+// Sweep removes expired entries now rather than waiting for the sweeper
+func (s *MemoryStore) Sweep() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.entries.sweep(s.clock.Now())
+}
+
+// Close stops the sweeper and waits for it to exit
+func (s *MemoryStore) Close() {
+	s.once.Do(func() {
+		close(s.stop)
+	})
+	<-s.done
+}
+
+func (s *MemoryStore) sweeper() {
+	defer close(s.done)
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.Sweep()
+		case <-s.stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package leaky
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"go.uber.org/goleak"
+)
+
+type testClock struct {
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	return c.now
+}
+
+func (c *testClock) Since(t time.Time) time.Duration {
+	return c.now.Sub(t)
+}
+
+func TestMemoryStoreChurn(t *testing.T) {
+	clock := &testClock{now: time.Now()}
+	store := NewMemoryStore(WithMemoryClock(clock), WithMaxEntries(1000))
+	defer store.Close()
+
+	tm := NewThrottleManagerWithStore(store, WithClock(clock))
+	bucket := tm.ThrottlingHandler(handleFuncSuccessResponse, 10, 600, keyFunc, "test")
+
+	for i := 0; i < 100000; i++ {
+		bucket.Add(1, fmt.Sprintf("client-%d", i))
+		clock.now = clock.now.Add(time.Millisecond)
+
+		if n := store.Len(); n > 1000 {
+			t.Fatalf("Store grew past its cap: %d", n)
+		}
+	}
+
+	// Each client refills 100 milliseconds after its drop, so only the most recent ones are kept
+	store.Sweep()
+	if n := store.Len(); n > 100 {
+		t.Errorf("Store didn't stabilise: %d entries", n)
+	}
+
+	// The bucket's cache of stored state is swept as it's written to
+	clock.now = clock.now.Add(defaultSweepInterval)
+	bucket.Add(1, "last-client")
+
+	if n := bucket.known.len(); n != 1 {
+		t.Errorf("Bucket cache didn't stabilise: %d entries", n)
+	}
+}
+
+func TestMemoryStoreSweeper(t *testing.T) {
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+	store := NewMemoryStore(WithSweepInterval(time.Millisecond))
+
+	if err := store.Set(context.Background(), "key", State{}, time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for store.Len() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Sweeper didn't remove the expired entry")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	store.Close()
+	store.Close()
+}
+
+func TestMemoryStoreGetSet(t *testing.T) {
+	store := NewMemoryStore()
+	defer store.Close()
+
+	if _, ok, _ := store.GetSet(context.Background(), "key", State{SpaceRemaining: 1}, time.Minute); ok {
+		t.Error("Empty store returned a previous state")
+	}
+
+	prev, ok, _ := store.GetSet(context.Background(), "key", State{SpaceRemaining: 2}, time.Minute)
+	if !ok || prev.SpaceRemaining != 1 {
+		t.Errorf("Previous state not returned: %v", prev)
+	}
+}
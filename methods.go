@@ -0,0 +1,47 @@
+package leaky
+
+import (
+	"net/http"
+	"strings"
+)
+
+// WithMethodLimit limits requests using the HTTP method by a bucket of their own, of size leaking rate drops
+// a minute, such as tighter limits for POST than GET. The method's bucket has the bucket's other options
+// and is named after it and the method, such as "api::POST", so requests using other methods don't take
+// from it. Requests are only limited by their method when admitted by ServeHTTP, Wrap or Admit.
+func WithMethodLimit(method string, size int, rate int) Option {
+	return func(b *Bucket) {
+		if b.methodLimits == nil {
+			b.methodLimits = make(map[string]limits)
+		}
+		b.methodLimits[strings.ToUpper(method)] = newLimits(size, perMinute(rate))
+	}
+}
+
+// withoutMethodLimits stops a method's bucket creating buckets of its own from the options it shares
+func withoutMethodLimits(b *Bucket) {
+	b.methodLimits = nil
+}
+
+// newMethodBuckets creates the buckets of the bucket's method limits, with the options it was created with
+func (m *ThrottleManager) newMethodBuckets(b *Bucket, opts []Option) {
+	if len(b.methodLimits) == 0 {
+		return
+	}
+
+	opts = append(append([]Option(nil), opts...), withoutMethodLimits)
+
+	b.methods = make(map[string]*Bucket, len(b.methodLimits))
+	for method, lim := range b.methodLimits {
+		b.methods[method] = m.newBucket(nil, lim, b.keyFunc, b.bucketName+"::"+method, opts)
+	}
+}
+
+// forMethod returns the bucket limiting the request's method, the bucket itself unless it has a method limit
+func (b *Bucket) forMethod(r *http.Request) *Bucket {
+	if mb, ok := b.methods[r.Method]; ok {
+		return mb
+	}
+
+	return b
+}
@@ -0,0 +1,42 @@
+package leaky_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/2bytes/leaky"
+	"github.com/2bytes/leaky/leakytest"
+)
+
+func TestMethodLimit(t *testing.T) {
+	tm := leakytest.NewTestManager(t)
+	bucket := tm.ThrottlingHandler(handleFuncSuccessResponse, 2, 0, keyFunc, "api", leaky.WithMethodLimit("post", 1, 0))
+
+	for i, tc := range []struct {
+		method string
+		want   int
+	}{
+		{"POST", http.StatusOK},
+		{"POST", http.StatusTooManyRequests},
+		{"GET", http.StatusOK},
+		{"GET", http.StatusOK},
+		// Methods without a limit of their own share the bucket's
+		{"DELETE", http.StatusTooManyRequests},
+	} {
+		w := httptest.NewRecorder()
+		bucket.ServeHTTP(w, httptest.NewRequest(tc.method, "/", nil))
+
+		if w.Code != tc.want {
+			t.Errorf("Request %d, %s: status %v, expected %v", i, tc.method, w.Code, tc.want)
+		}
+	}
+
+	if d, ok := bucket.Admit(http.Header{}, httptest.NewRequest("POST", "/", nil)); ok || d.Bucket != "api::POST" || d.Limit != 1 {
+		t.Errorf("Admitted by the method's bucket: %+v, %v", d, ok)
+	}
+
+	if _, ok := tm.Bucket("api::POST"); !ok {
+		t.Error("Method's bucket not found by its name")
+	}
+}
@@ -0,0 +1,46 @@
+package leaky
+
+import (
+	"context"
+	"time"
+)
+
+// Metrics receives the decisions buckets make and how long their round trips to the store take, to export
+// them to a metrics system. Its methods are called on the path of every request, so mustn't block.
+type Metrics interface {
+	// Decided is called for each request a bucket decides, allowed or not, including those decided
+	// by the failure policy
+	Decided(bucketName string, allowed bool)
+	// RoundTrip is called for each round trip a bucket makes to the store, counting every retry,
+	// with the error it failed with if it did
+	RoundTrip(bucketName string, latency time.Duration, err error)
+}
+
+// WithMetrics reports the decisions of the manager's buckets and the latency of their store to m
+func WithMetrics(m Metrics) ManagerOption {
+	return func(tm *ThrottleManager) {
+		tm.metrics = m
+	}
+}
+
+// timed makes a call to the store, reporting its latency to the metrics and the trace of the decision
+// it was made for, if there are any
+func (c *storeClient) timed(ctx context.Context, fn func() error) error {
+	record := traceFromContext(ctx)
+	if c.metrics == nil && record == nil {
+		return fn()
+	}
+
+	start := c.clock.Now()
+	err := fn()
+	latency := c.clock.Now().Sub(start)
+
+	if c.metrics != nil {
+		c.metrics.RoundTrip(c.name, latency, err)
+	}
+	if record != nil {
+		record.roundTrip(latency, err)
+	}
+
+	return err
+}
@@ -0,0 +1,96 @@
+package leaky
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+type recordedMetrics struct {
+	mu         sync.Mutex
+	allowed    map[string]int
+	rejected   map[string]int
+	roundTrips map[string]int
+	failed     map[string]int
+}
+
+func newRecordedMetrics() *recordedMetrics {
+	return &recordedMetrics{
+		allowed:    map[string]int{},
+		rejected:   map[string]int{},
+		roundTrips: map[string]int{},
+		failed:     map[string]int{},
+	}
+}
+
+func (m *recordedMetrics) Decided(bucketName string, allowed bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if allowed {
+		m.allowed[bucketName]++
+	} else {
+		m.rejected[bucketName]++
+	}
+}
+
+func (m *recordedMetrics) RoundTrip(bucketName string, latency time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.roundTrips[bucketName]++
+	if err != nil {
+		m.failed[bucketName]++
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mr.Close()
+
+	metrics := newRecordedMetrics()
+	rc := redis.NewClient(&redis.Options{Addr: mr.Addr(), MaxRetries: -1})
+	tm := NewThrottleManager(rc, WithMetrics(metrics))
+
+	handler := tm.ThrottlingHandler(handleFuncSuccessResponse, 2, 0, keyFunc, "test")
+	window := tm.WindowHandler(handleFuncSuccessResponse, 1, time.Minute, keyFunc, "window")
+	req, _ := http.NewRequest("GET", "", nil)
+
+	for i := 0; i < 3; i++ {
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+		window.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	if metrics.allowed["test"] != 2 || metrics.rejected["test"] != 1 {
+		t.Errorf("Bucket decisions not recorded, %d allowed and %d rejected", metrics.allowed["test"], metrics.rejected["test"])
+	}
+	if metrics.allowed["window"] != 1 || metrics.rejected["window"] != 2 {
+		t.Errorf("Window decisions not recorded, %d allowed and %d rejected", metrics.allowed["window"], metrics.rejected["window"])
+	}
+
+	if rt := handler.Stats().RoundTrips; uint64(metrics.roundTrips["test"]) != rt {
+		t.Errorf("Recorded %d round trips, bucket made %d", metrics.roundTrips["test"], rt)
+	}
+	if metrics.failed["test"] != 0 {
+		t.Errorf("Recorded %d failed round trips", metrics.failed["test"])
+	}
+
+	mr.Close()
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if metrics.failed["test"] == 0 {
+		t.Error("Failed round trip not recorded")
+	}
+	// A failed store allows the request
+	if metrics.allowed["test"] != 3 {
+		t.Errorf("Request allowed by the failure policy not recorded, %d allowed", metrics.allowed["test"])
+	}
+}
@@ -0,0 +1,67 @@
+package leaky
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"strconv"
+)
+
+// Algorithms identifying how state is stored in a bucket's config fingerprint
+const (
+	algorithmLeaky = "leaky"
+	algorithmGCRA  = "gcra"
+)
+
+// MigrationPolicy decides what happens to stored state written under a different bucket config,
+// such as after a deploy changing the size or leak rate of a bucket
+type MigrationPolicy int
+
+const (
+	// MigrateProportional scales the space remaining to the new size, so a client with half
+	// their bucket left still has half left. This is the default.
+	MigrateProportional MigrationPolicy = iota
+	// MigrateReset discards the stored state, leaving the client a full bucket
+	MigrateReset
+	// MigrateClamp keeps the space remaining, limited to the new size
+	MigrateClamp
+)
+
+// WithMigration sets the policy applied to state stored under a different bucket config
+func WithMigration(policy MigrationPolicy) Option {
+	return func(b *Bucket) {
+		b.migration = policy
+	}
+}
+
+// configFingerprint identifies the config state is written under
+func configFingerprint(algorithm string, size int, leakRate float64) string {
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%s:%d:%s", algorithm, size, strconv.FormatFloat(leakRate, 'g', -1, 64))
+
+	return strconv.FormatUint(h.Sum64(), 16)
+}
+
+// migrate brings state written under a different config in line with the limits.
+// State from before fingerprints were stored doesn't record its size, so can only be clamped,
+// as can state stored by GCRA.
+func (b *Bucket) migrate(lim limits, state State) State {
+	if state.Fingerprint == lim.fingerprint {
+		return state
+	}
+
+	migrated := state
+	migrated.Fingerprint = lim.fingerprint
+	migrated.Size = lim.size
+
+	switch {
+	case b.migration == MigrateReset:
+		return b.fullState(lim)
+	case b.migration == MigrateProportional && state.Size > 0:
+		migrated.SpaceRemaining = state.SpaceRemaining * float64(lim.size) / float64(state.Size)
+	default:
+		migrated.SpaceRemaining = math.Min(state.SpaceRemaining, float64(lim.size))
+	}
+
+	return migrated
+}
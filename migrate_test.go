@@ -0,0 +1,115 @@
+package leaky_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/2bytes/leaky"
+	"github.com/2bytes/leaky/leakytest"
+)
+
+func TestMigration(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   leaky.MigrationPolicy
+		fromSize int
+		used     int
+		toSize   int
+		want     int
+	}{
+		{"shrink proportional", leaky.MigrateProportional, 100, 20, 10, 8},
+		{"shrink reset", leaky.MigrateReset, 100, 20, 10, 10},
+		{"shrink clamp", leaky.MigrateClamp, 100, 20, 10, 10},
+		{"grow proportional", leaky.MigrateProportional, 10, 5, 100, 50},
+		{"grow reset", leaky.MigrateReset, 10, 5, 100, 100},
+		{"grow clamp", leaky.MigrateClamp, 10, 5, 100, 5},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tm := leakytest.NewTestManager(t)
+
+			before := tm.ThrottlingHandler(handleFuncSuccessResponse, tt.fromSize, 0, keyFunc, "test")
+			if !before.Add(tt.used, "test-key") {
+				t.Fatal("Drops rejected before the config change")
+			}
+
+			after := tm.ThrottlingHandler(handleFuncSuccessResponse, tt.toSize, 0, keyFunc, "test", leaky.WithMigration(tt.policy))
+
+			if after.Add(tt.want+1, "test-key") {
+				t.Errorf("Migrated bucket has more than %d space remaining", tt.want)
+			}
+
+			if !after.Add(tt.want, "test-key") {
+				t.Errorf("Migrated bucket has less than %d space remaining", tt.want)
+			}
+		})
+	}
+}
+
+func TestMigrationUnchangedConfig(t *testing.T) {
+	tm := leakytest.NewTestManager(t)
+
+	before := tm.ThrottlingHandler(handleFuncSuccessResponse, 10, 0, keyFunc, "test", leaky.WithMigration(leaky.MigrateReset))
+	before.Add(4, "test-key")
+
+	after := tm.ThrottlingHandler(handleFuncSuccessResponse, 10, 0, keyFunc, "test", leaky.WithMigration(leaky.MigrateReset))
+
+	if after.Add(7, "test-key") {
+		t.Error("State reset without a config change")
+	}
+}
+
+func TestMigrationLegacyState(t *testing.T) {
+	tm := leakytest.NewTestManager(t)
+
+	// State written before fingerprints were stored has no size to scale from
+	tm.Store.Put("leaky::test::test-key", leaky.State{LastUpdate: tm.Clock.Now(), SpaceRemaining: 4}, time.Hour)
+
+	bucket := tm.ThrottlingHandler(handleFuncSuccessResponse, 10, 0, keyFunc, "test")
+
+	if bucket.Add(5, "test-key") || !bucket.Add(4, "test-key") {
+		t.Error("Legacy state not kept as it was")
+	}
+}
+
+func TestSetLimit(t *testing.T) {
+	tm := leakytest.NewTestManager(t)
+
+	bucket := tm.ThrottlingHandler(handleFuncSuccessResponse, 10, 0, keyFunc, "test")
+	if !bucket.Add(5, "test-key") {
+		t.Fatal("Drops rejected before the limit changed")
+	}
+
+	bucket.SetLimit(leaky.Limit{Rate: 60, Burst: 100})
+
+	// Half the bucket was left, and is migrated to half of the new size
+	if accepted, _ := bucket.AddUpTo(200, "test-key"); accepted != 50 {
+		t.Errorf("Bucket had %d space remaining after the limit changed, expected 50", accepted)
+	}
+
+	tm.Clock.Advance(time.Second)
+	if !bucket.Add(1, "test-key") {
+		t.Error("Bucket didn't leak at the new rate")
+	}
+}
+
+func TestManagerSetLimits(t *testing.T) {
+	tm := leakytest.NewTestManager(t)
+
+	bucket := tm.ThrottlingHandler(handleFuncSuccessResponse, 10, 60, keyFunc, "test")
+	if err := tm.SetLimits("test", 4, 30); err != nil {
+		t.Fatal(err)
+	}
+
+	if l := bucket.Limit(); l.Burst != 4 || l.Rate != 30 || l.Per != time.Minute {
+		t.Errorf("Bucket limit %+v after setting it", l)
+	}
+	if accepted, _ := bucket.AddUpTo(10, "test-key"); accepted != 4 {
+		t.Errorf("Bucket of size %d, expected 4", accepted)
+	}
+
+	if err := tm.SetLimits("missing", 4, 30); err != leaky.ErrUnknownBucket {
+		t.Errorf("Setting the limits of an unknown bucket returned %v", err)
+	}
+}
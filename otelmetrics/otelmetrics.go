@@ -0,0 +1,78 @@
+// Package otelmetrics exports the decisions of leaky buckets and the latency of their store as
+// OpenTelemetry metrics
+//
+//	metrics, err := otelmetrics.New(otel.GetMeterProvider())
+//	if err != nil {
+//		return err
+//	}
+//	tm := leaky.NewThrottleManager(rc, leaky.WithMetrics(metrics))
+package otelmetrics
+
+import (
+	"context"
+	"time"
+
+	"github.com/2bytes/leaky"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// The name of the meter the metrics are recorded by
+const meterName = "github.com/2bytes/leaky"
+
+// Metrics records a counter of decisions, leaky.decisions, and a histogram of store latency in seconds,
+// leaky.store.duration, both with the bucket's name as the leaky.bucket attribute and the outcome as
+// leaky.outcome
+type Metrics struct {
+	decisions metric.Int64Counter
+	latency   metric.Float64Histogram
+}
+
+var _ leaky.Metrics = (*Metrics)(nil)
+
+// New creates the metrics with a meter from the provider
+func New(provider metric.MeterProvider) (*Metrics, error) {
+	meter := provider.Meter(meterName)
+
+	decisions, err := meter.Int64Counter("leaky.decisions",
+		metric.WithDescription("Requests decided by leaky buckets"),
+		metric.WithUnit("{request}"))
+	if err != nil {
+		return nil, err
+	}
+
+	latency, err := meter.Float64Histogram("leaky.store.duration",
+		metric.WithDescription("Latency of leaky bucket round trips to the store"),
+		metric.WithUnit("s"))
+	if err != nil {
+		return nil, err
+	}
+
+	return &Metrics{decisions: decisions, latency: latency}, nil
+}
+
+// Decided implements leaky.Metrics, the outcome is allowed or rejected
+func (m *Metrics) Decided(bucketName string, allowed bool) {
+	outcome := "allowed"
+	if !allowed {
+		outcome = "rejected"
+	}
+
+	m.decisions.Add(context.Background(), 1, metric.WithAttributes(
+		attribute.String("leaky.bucket", bucketName),
+		attribute.String("leaky.outcome", outcome),
+	))
+}
+
+// RoundTrip implements leaky.Metrics, the outcome is ok or error
+func (m *Metrics) RoundTrip(bucketName string, latency time.Duration, err error) {
+	outcome := "ok"
+	if err != nil {
+		outcome = "error"
+	}
+
+	m.latency.Record(context.Background(), latency.Seconds(), metric.WithAttributes(
+		attribute.String("leaky.bucket", bucketName),
+		attribute.String("leaky.outcome", outcome),
+	))
+}
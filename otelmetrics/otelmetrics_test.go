@@ -0,0 +1,65 @@
+package otelmetrics
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/2bytes/leaky"
+	"github.com/2bytes/leaky/leakytest"
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+func TestMetrics(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	metrics, err := New(sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tm := leakytest.NewTestManager(t, leaky.WithMetrics(metrics))
+	handler := tm.ThrottlingHandler(func(w http.ResponseWriter, r *http.Request) {}, 2, 0,
+		func(r http.Request) string { return "client" }, "test")
+	req, _ := http.NewRequest("GET", "", nil)
+
+	for i := 0; i < 3; i++ {
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	var rm metricdata.ResourceMetrics
+	if err := reader.Collect(context.Background(), &rm); err != nil {
+		t.Fatal(err)
+	}
+
+	decisions := map[string]int64{}
+	var roundTrips uint64
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			switch data := m.Data.(type) {
+			case metricdata.Sum[int64]:
+				for _, dp := range data.DataPoints {
+					if bucket, _ := dp.Attributes.Value("leaky.bucket"); bucket != attribute.StringValue("test") {
+						t.Errorf("Decision recorded for bucket %q", bucket.Emit())
+					}
+					outcome, _ := dp.Attributes.Value("leaky.outcome")
+					decisions[outcome.AsString()] += dp.Value
+				}
+			case metricdata.Histogram[float64]:
+				for _, dp := range data.DataPoints {
+					roundTrips += dp.Count
+				}
+			}
+		}
+	}
+
+	if decisions["allowed"] != 2 || decisions["rejected"] != 1 {
+		t.Errorf("Decisions not recorded: %v", decisions)
+	}
+
+	if rt := handler.Stats().RoundTrips; roundTrips != rt {
+		t.Errorf("Recorded %d round trips, bucket made %d", roundTrips, rt)
+	}
+}
@@ -0,0 +1,68 @@
+// Package oteltrace traces the decisions of leaky buckets as OpenTelemetry spans, each a child of the
+// span of the request decided, so the cost of throttling shows up in distributed traces
+//
+//	tm := leaky.NewThrottleManager(rc, leaky.WithTracer(oteltrace.New(otel.GetTracerProvider())))
+package oteltrace
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+
+	"github.com/2bytes/leaky"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// The name of the tracer the spans are started by, and of the spans
+const (
+	tracerName = "github.com/2bytes/leaky"
+	spanName   = "leaky.decide"
+)
+
+// Tracer starts a span for each decision, with the bucket's name as the leaky.bucket attribute, a hash of
+// the client's key ID as leaky.key_hash so clients can be told apart without recording who they are,
+// the outcome as leaky.outcome, and the round trips to the store and their total latency in seconds as
+// leaky.store.round_trips and leaky.store.latency. Errors of the store are recorded on the span as events.
+type Tracer struct {
+	tracer trace.Tracer
+}
+
+var _ leaky.Tracer = (*Tracer)(nil)
+
+// New creates the tracer with a tracer from the provider
+func New(provider trace.TracerProvider) *Tracer {
+	return &Tracer{tracer: provider.Tracer(tracerName)}
+}
+
+// StartDecision implements leaky.Tracer
+func (t *Tracer) StartDecision(ctx context.Context, bucketName string, keyID string) (context.Context, func(leaky.DecisionTrace)) {
+	ctx, span := t.tracer.Start(ctx, spanName, trace.WithSpanKind(trace.SpanKindInternal), trace.WithAttributes(
+		attribute.String("leaky.bucket", bucketName),
+		attribute.String("leaky.key_hash", keyHash(keyID)),
+	))
+
+	return ctx, func(d leaky.DecisionTrace) {
+		outcome := "allowed"
+		if !d.Allowed {
+			outcome = "rejected"
+		}
+
+		span.SetAttributes(
+			attribute.String("leaky.outcome", outcome),
+			attribute.Int("leaky.store.round_trips", d.RoundTrips),
+			attribute.Float64("leaky.store.latency", d.StoreLatency.Seconds()),
+		)
+		if d.Err != nil {
+			span.RecordError(d.Err)
+		}
+
+		span.End()
+	}
+}
+
+// keyHash is the first 8 bytes of the SHA-256 of the key ID in hex
+func keyHash(keyID string) string {
+	sum := sha256.Sum256([]byte(keyID))
+	return hex.EncodeToString(sum[:8])
+}
@@ -0,0 +1,59 @@
+package oteltrace
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/2bytes/leaky"
+	"github.com/2bytes/leaky/leakytest"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTracer(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+
+	tm := leakytest.NewTestManager(t, leaky.WithTracer(New(provider)))
+	handler := tm.ThrottlingHandler(func(w http.ResponseWriter, r *http.Request) {}, 1, 0,
+		func(r http.Request) string { return "client" }, "test")
+
+	ctx, parent := provider.Tracer("test").Start(context.Background(), "request")
+	req, _ := http.NewRequestWithContext(ctx, "GET", "", nil)
+
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	tm.Store.FailNext(errors.New("store down"))
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	parent.End()
+
+	var outcomes []string
+	for _, span := range recorder.Ended() {
+		if span.Name() != spanName {
+			continue
+		}
+
+		if span.Parent().SpanID() != parent.SpanContext().SpanID() {
+			t.Error("Decision span isn't a child of the request's span")
+		}
+
+		attrs := attribute.NewSet(span.Attributes()...)
+		if hash, _ := attrs.Value("leaky.key_hash"); hash.AsString() != keyHash("client") {
+			t.Errorf("Key hash wrong: %q", hash.AsString())
+		}
+		outcome, _ := attrs.Value("leaky.outcome")
+		outcomes = append(outcomes, outcome.AsString())
+
+		if len(outcomes) == 3 && len(span.Events()) == 0 {
+			t.Error("Store error not recorded on the span")
+		}
+	}
+
+	if len(outcomes) != 3 || outcomes[0] != "allowed" || outcomes[1] != "rejected" || outcomes[2] != "allowed" {
+		t.Errorf("Decisions traced wrong: %v", outcomes)
+	}
+}
@@ -0,0 +1,119 @@
+package leaky
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+type contextKey struct {
+	name string
+}
+
+// LimitOverrideKey is the request context key a LimitOverride is stored under
+var LimitOverrideKey = &contextKey{"limit-override"}
+
+// LimitOverride replaces a bucket's limits or key for a single request, so middleware which already
+// knows what a caller is entitled to, such as auth resolving their plan, can pass it on
+type LimitOverride struct {
+	// Size and Rate replace the bucket's size and leak rate per minute when HasLimits is set
+	Size      int
+	Rate      int
+	HasLimits bool
+	// KeyID replaces the result of the bucket's KeyFunc when not empty
+	KeyID string
+}
+
+// WithLimitOverride returns a copy of ctx overriding the size and leak rate per minute of any bucket
+// the request reaches, keeping any key already overridden
+func WithLimitOverride(ctx context.Context, size int, rate int) context.Context {
+	o, _ := LimitOverrideFromContext(ctx)
+	o.Size, o.Rate, o.HasLimits = size, rate, true
+
+	return context.WithValue(ctx, LimitOverrideKey, o)
+}
+
+// WithKeyOverride returns a copy of ctx overriding the key of any bucket the request reaches,
+// keeping any limits already overridden
+func WithKeyOverride(ctx context.Context, keyID string) context.Context {
+	o, _ := LimitOverrideFromContext(ctx)
+	o.KeyID = keyID
+
+	return context.WithValue(ctx, LimitOverrideKey, o)
+}
+
+// LimitOverrideFromContext returns the override stored in ctx, if there is one
+func LimitOverrideFromContext(ctx context.Context) (LimitOverride, bool) {
+	o, ok := ctx.Value(LimitOverrideKey).(LimitOverride)
+	return o, ok
+}
+
+// LimitFunc identifies the client making a request and the size and leak rate per minute of their bucket,
+// so clients on different plans, such as free and pro API keys, can be given different limits by one bucket
+type LimitFunc func(r *http.Request) (key string, size int, rate float64)
+
+// WithLimitFunc keys clients and sets their limits by fn, in place of the bucket's KeyFunc and limits.
+// Limits and keys overridden by the request's context, and limits stored for the client, take precedence.
+func WithLimitFunc(fn LimitFunc) Option {
+	return func(b *Bucket) {
+		b.limitFunc = fn
+	}
+}
+
+// resolve returns the limits and key to apply to a request, from its context if overridden
+// or from the bucket's defaults and KeyFunc, or its LimitFunc, if not
+func (b *Bucket) resolve(r *http.Request) (limits, string, error) {
+	if b.limitFunc == nil {
+		keyID, err := b.requestKey(r)
+		if err != nil {
+			return limits{}, "", err
+		}
+
+		lim, keyID := b.resolveContext(r.Context(), func() string { return keyID })
+		return lim, keyID, nil
+	}
+
+	keyID, size, rate := b.limitFunc(r)
+	base := b.currentLimits()
+	lim := newLimits(size, perDuration(rate, time.Minute)).withTTLOf(base).withAlgorithmOf(base)
+
+	lim, keyID = b.resolveWith(r.Context(), func() string { return keyID }, lim)
+	return lim, keyID, nil
+}
+
+// requestKey returns the request's key from its context if overridden, so the KeyFunc isn't called,
+// or else from the bucket's KeyFuncE or KeyFunc
+func (b *Bucket) requestKey(r *http.Request) (string, error) {
+	if o, ok := LimitOverrideFromContext(r.Context()); ok && o.KeyID != "" {
+		return o.KeyID, nil
+	}
+
+	if b.keyFuncE != nil {
+		return b.keyFuncE(r)
+	}
+
+	return b.keyFunc(*r), nil
+}
+
+// resolveContext is resolve for a request known only by its context, identified by keyID
+// unless the context overrides it
+func (b *Bucket) resolveContext(ctx context.Context, keyID func() string) (limits, string) {
+	return b.resolveWith(ctx, keyID, b.currentLimits())
+}
+
+// resolveWith returns the limits and key to apply to a request, from its context if overridden, or else
+// the limits stored for the client or def. Limits in the context take precedence over those stored.
+func (b *Bucket) resolveWith(ctx context.Context, keyID func() string, def limits) (limits, string) {
+	o, _ := LimitOverrideFromContext(ctx)
+
+	id := o.KeyID
+	if id == "" {
+		id = keyID()
+	}
+
+	if o.HasLimits {
+		return newLimits(o.Size, perMinute(o.Rate)).withTTLOf(def).withAlgorithmOf(def), id
+	}
+
+	return b.keyLimitsOr(ctx, id, def), id
+}
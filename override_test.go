@@ -0,0 +1,139 @@
+package leaky_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/2bytes/leaky"
+	"github.com/2bytes/leaky/leakytest"
+)
+
+// fakeAuth resolves the caller's account and plan, as auth middleware would, and passes on their limit
+func fakeAuth(next http.Handler) http.Handler {
+	plans := map[string]int{"free-user": 1, "pro-user": 3}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := r.Header.Get("X-User")
+
+		ctx := leaky.WithLimitOverride(r.Context(), plans[user], 0)
+		ctx = leaky.WithKeyOverride(ctx, "account-"+user)
+
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func TestLimitOverride(t *testing.T) {
+	tm := leakytest.NewTestManager(t)
+
+	keyFuncCalled := false
+	bucket := tm.ThrottlingHandler(handleFuncSuccessResponse, 10, 0, func(r http.Request) string {
+		keyFuncCalled = true
+		return "shared"
+	}, "test")
+	handler := fakeAuth(bucket)
+
+	serve := func(user string) int {
+		req, _ := http.NewRequest("GET", "", nil)
+		req.Header.Set("X-User", user)
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	for i, want := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		if code := serve("free-user"); code != want {
+			t.Errorf("Free request %d: status %v, expected %v", i, code, want)
+		}
+	}
+
+	for i, want := range []int{http.StatusOK, http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		if code := serve("pro-user"); code != want {
+			t.Errorf("Pro request %d: status %v, expected %v", i, code, want)
+		}
+	}
+
+	if keyFuncCalled {
+		t.Error("KeyFunc called for a request with its key overridden")
+	}
+
+	// Each request makes a single call to the store, overrides don't need looking up
+	if calls := tm.Store.Calls(); calls != 6 {
+		t.Errorf("Expected 6 store calls for 6 requests, got %d", calls)
+	}
+
+	keys := tm.Store.Keys()
+	if len(keys) != 2 || keys[0] != "leaky::test::account-free-user" || keys[1] != "leaky::test::account-pro-user" {
+		t.Errorf("Unexpected keys stored: %v", keys)
+	}
+}
+
+func TestLimitOverrideKeepsKeyFunc(t *testing.T) {
+	tm := leakytest.NewTestManager(t)
+	bucket := tm.ThrottlingHandler(handleFuncSuccessResponse, 10, 0, keyFunc, "test")
+
+	req, _ := http.NewRequest("GET", "", nil)
+	req = req.WithContext(leaky.WithLimitOverride(req.Context(), 1, 0))
+
+	bucket.ServeHTTP(httptest.NewRecorder(), req)
+
+	w := httptest.NewRecorder()
+	bucket.ServeHTTP(w, req)
+
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("Overridden limit not applied: %v", w.Code)
+	}
+
+	if keys := tm.Store.Keys(); len(keys) != 1 || keys[0] != "leaky::test::test-key" {
+		t.Errorf("KeyFunc not used without a key override: %v", keys)
+	}
+}
+
+func TestLimitFunc(t *testing.T) {
+	tm := leakytest.NewTestManager(t)
+
+	plans := map[string]int{"free-key": 1, "pro-key": 3}
+	bucket := tm.ThrottlingHandler(handleFuncSuccessResponse, 10, 0, nil, "test",
+		leaky.WithLimitFunc(func(r *http.Request) (string, int, float64) {
+			key := r.Header.Get("X-Api-Key")
+			return key, plans[key], 0
+		}),
+	)
+
+	serve := func(apiKey string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "", nil)
+		req.Header.Set("X-Api-Key", apiKey)
+
+		w := httptest.NewRecorder()
+		bucket.ServeHTTP(w, req)
+		return w
+	}
+
+	for i, want := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		if w := serve("free-key"); w.Code != want {
+			t.Errorf("Free request %d: status %v, expected %v", i, w.Code, want)
+		}
+	}
+
+	for i, want := range []int{http.StatusOK, http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		w := serve("pro-key")
+		if w.Code != want {
+			t.Errorf("Pro request %d: status %v, expected %v", i, w.Code, want)
+		}
+		if limit := w.Header().Get("X-RateLimit-Limit"); limit != "3" {
+			t.Errorf("Pro request %d: limit header %q", i, limit)
+		}
+	}
+
+	// Limits in the context take precedence
+	req, _ := http.NewRequest("GET", "", nil)
+	req.Header.Set("X-Api-Key", "unknown-key")
+	req = req.WithContext(leaky.WithLimitOverride(req.Context(), 5, 0))
+
+	w := httptest.NewRecorder()
+	bucket.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("Overridden request: status %v", w.Code)
+	}
+}
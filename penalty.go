@@ -0,0 +1,199 @@
+package leaky
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// PenaltyBox blocks clients which keep hitting their limit, for longer each time they are blocked.
+// Each client's record is kept in the store beside their bucket state, so every instance blocks them.
+type PenaltyBox struct {
+	// Threshold is how many rejections within Window put a client in the box, 10 if not set
+	Threshold int
+	// Window is a minute if not set
+	Window time.Duration
+	// Block is how long a client is first blocked for, a minute if not set. It doubles each time the client
+	// is blocked again, up to MaxBlock, a day if not set.
+	Block    time.Duration
+	MaxBlock time.Duration
+	// Forget is how long after a block ends the client's escalation is forgotten, a day if not set
+	Forget time.Duration
+	// CacheTTL is how long an instance remembers a client wasn't blocked, so it doesn't read their record for
+	// every request, a second if not set. Blocks are remembered until they end. A client blocked by another
+	// instance is let through by this one until what it remembers expires. A negative CacheTTL turns off
+	// remembering clients weren't blocked, reading their record for every request.
+	CacheTTL time.Duration
+}
+
+// Penalty is a client's record in a bucket's penalty box
+type Penalty struct {
+	// Strikes are the rejections since WindowStart
+	Strikes     int       `json:"strikes"`
+	WindowStart time.Time `json:"window_start"`
+	// Blocks is how many times the client has been blocked, since their escalation was last forgotten
+	Blocks int `json:"blocks"`
+	// Until is when the client's current block ends, zero if they haven't been blocked
+	Until time.Time `json:"until,omitempty"`
+}
+
+// WithPenaltyBox puts clients which keep hitting the bucket's limit in the penalty box, rejecting all of their
+// requests until their block ends whether or not their bucket has space
+func WithPenaltyBox(p PenaltyBox) Option {
+	return func(b *Bucket) {
+		b.penalty = p.withDefaults()
+		b.blocked = newExpiringMap[time.Time](knownMaxEntries)
+	}
+}
+
+func (p PenaltyBox) withDefaults() *PenaltyBox {
+	if p.Threshold <= 0 {
+		p.Threshold = 10
+	}
+	if p.Window <= 0 {
+		p.Window = time.Minute
+	}
+	if p.Block <= 0 {
+		p.Block = time.Minute
+	}
+	if p.MaxBlock <= 0 {
+		p.MaxBlock = 24 * time.Hour
+	}
+	if p.Forget <= 0 {
+		p.Forget = 24 * time.Hour
+	}
+	if p.CacheTTL == 0 {
+		p.CacheTTL = time.Second
+	}
+
+	return &p
+}
+
+// block returns how long the nth block lasts
+func (p *PenaltyBox) block(n int) time.Duration {
+	block := p.Block
+	for i := 1; i < n && block < p.MaxBlock; i++ {
+		block *= 2
+	}
+
+	if block > p.MaxBlock {
+		return p.MaxBlock
+	}
+	return block
+}
+
+// Penalty returns the client's record in the bucket's penalty box, empty if they have none
+func (b *Bucket) Penalty(ctx context.Context, keyID string) (Penalty, error) {
+	record, err := b.readRecord(ctx, "penalty", keyID)
+	if err != nil || record.Penalty == nil {
+		return Penalty{}, err
+	}
+
+	return *record.Penalty, nil
+}
+
+// Pardon takes the client out of the bucket's penalty box and forgets their escalation, such as when they
+// appeal a block. Instances which remember the block keep applying it until it ends.
+func (b *Bucket) Pardon(ctx context.Context, keyID string) error {
+	// Stores can't delete, so an empty record replaces theirs until it expires
+	if err := b.writeRecord(ctx, "penalty", keyID, State{}, stateTTL); err != nil {
+		return err
+	}
+
+	b.cacheBlock(keyID, time.Time{})
+	return nil
+}
+
+// cacheBlock remembers when the client's block ends, or that they weren't blocked for the cache TTL
+func (b *Bucket) cacheBlock(keyID string, until time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.clock.Now()
+	if until.After(now) {
+		b.blocked.set(keyID, until, until, now)
+	} else if b.penalty.CacheTTL < 0 {
+		b.blocked.delete(keyID)
+	} else {
+		b.blocked.set(keyID, time.Time{}, now.Add(b.penalty.CacheTTL), now)
+	}
+}
+
+// blockedFor returns how long until the client's block ends, if the bucket has a penalty box and
+// they are in it. Clients aren't blocked while the store is down.
+func (b *Bucket) blockedFor(ctx context.Context, keyID string) (time.Duration, bool) {
+	if b.penalty == nil {
+		return 0, false
+	}
+
+	now := b.clock.Now()
+
+	b.mu.Lock()
+	until, ok := b.blocked.get(keyID, now)
+	b.mu.Unlock()
+
+	if !ok {
+		p, err := b.Penalty(ctx, keyID)
+		if err != nil {
+			b.storeFailed(ctx, b.logger.Warn, "Retrieving penalty failed, not blocking", keyID, err)
+			return 0, false
+		}
+
+		until = p.Until
+		b.cacheBlock(keyID, until)
+	}
+
+	if !until.After(now) {
+		return 0, false
+	}
+	return until.Sub(now), true
+}
+
+// strike records a rejection of the client, blocking them if it takes them over the threshold. The record
+// is read and written back, so strikes racing each other on different instances may be lost.
+func (b *Bucket) strike(ctx context.Context, keyID string) {
+	if b.penalty == nil {
+		return
+	}
+
+	p, err := b.Penalty(ctx, keyID)
+	if err != nil {
+		b.storeFailed(ctx, b.logger.Warn, "Retrieving penalty failed, not counting the strike", keyID, err)
+		return
+	}
+
+	now := b.clock.Now()
+	// Strikes in the window keep the record past Forget, so the escalation is forgotten here too
+	if !p.Until.IsZero() && !now.Before(p.Until.Add(b.penalty.Forget)) {
+		p.Blocks, p.Until = 0, time.Time{}
+	}
+	if now.Sub(p.WindowStart) >= b.penalty.Window {
+		p.Strikes, p.WindowStart = 0, now
+	}
+	p.Strikes++
+
+	if p.Strikes >= b.penalty.Threshold {
+		p.Blocks++
+		p.Until = now.Add(b.penalty.block(p.Blocks))
+		p.Strikes, p.WindowStart = 0, now
+	}
+
+	// The record is kept while the client has strikes in the window, or until their escalation is forgotten
+	ttl := b.penalty.Window
+	if forget := p.Until.Add(b.penalty.Forget).Sub(now); forget > ttl {
+		ttl = forget
+	}
+
+	if err := b.writeRecord(ctx, "penalty", keyID, State{Penalty: &p}, ttl); err != nil {
+		b.storeFailed(ctx, b.logger.Warn, "Recording penalty failed", keyID, err)
+		return
+	}
+
+	b.cacheBlock(keyID, p.Until)
+}
+
+// blockedDecision is the decision rejecting a client in the penalty box until their block ends
+func (b *Bucket) blockedDecision(h http.Header, lim limits, keyID string, wait time.Duration) (Decision, limits, int, bool) {
+	setRetryAfter(h, wait)
+	return Decision{Bucket: b.bucketName, KeyID: keyID, Limit: lim.size, RetryAfter: wait, ResetAfter: wait}, lim, 0, false
+}
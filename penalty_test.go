@@ -0,0 +1,146 @@
+package leaky_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/2bytes/leaky"
+	"github.com/2bytes/leaky/leakytest"
+)
+
+func TestPenaltyBox(t *testing.T) {
+	tm := leakytest.NewTestManager(t)
+	bucket := tm.ThrottlingHandler(handleFuncSuccessResponse, 1, 60, keyFunc, "test",
+		leaky.WithPenaltyBox(leaky.PenaltyBox{Threshold: 2, Block: time.Minute, MaxBlock: 3 * time.Minute}))
+
+	serve := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		bucket.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		return w
+	}
+
+	// Two rejections block the client for a minute, then two, then three at most
+	for _, block := range []int{60, 120, 180, 180} {
+		for i, want := range []int{http.StatusOK, http.StatusTooManyRequests, http.StatusTooManyRequests} {
+			if w := serve(); w.Code != want {
+				t.Fatalf("Request %d before a %ds block: status %v, expected %v", i, block, w.Code, want)
+			}
+		}
+
+		tm.Clock.Advance(time.Second)
+		w := serve()
+		if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != strconv.Itoa(block-1) {
+			t.Errorf("Blocked request: status %v, Retry-After %s, expected %d", w.Code, w.Header().Get("Retry-After"), block-1)
+		}
+
+		tm.Clock.Advance(time.Duration(block) * time.Second)
+	}
+
+	p, err := bucket.Penalty(context.Background(), "test-key")
+	if err != nil || p.Blocks != 4 {
+		t.Errorf("Penalty %+v, %v", p, err)
+	}
+}
+
+func TestPenaltyForgotten(t *testing.T) {
+	tm := leakytest.NewTestManager(t)
+	bucket := tm.ThrottlingHandler(handleFuncSuccessResponse, 1, 60, keyFunc, "test",
+		leaky.WithPenaltyBox(leaky.PenaltyBox{Threshold: 2, Window: time.Hour, Block: time.Minute, Forget: 10 * time.Minute}))
+
+	serve := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		bucket.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		return w
+	}
+	block := func() {
+		for i, want := range []int{http.StatusOK, http.StatusTooManyRequests, http.StatusTooManyRequests} {
+			if w := serve(); w.Code != want {
+				t.Fatalf("Request %d before a block: status %v, expected %v", i, w.Code, want)
+			}
+		}
+	}
+
+	block()
+	tm.Clock.Advance(11 * time.Minute)
+
+	// A strike after the escalation is forgotten, kept by the window along with the record
+	if w := serve(); w.Code != http.StatusOK {
+		t.Fatalf("Request after the block: status %v", w.Code)
+	}
+	if w := serve(); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("Request striking the client: status %v", w.Code)
+	}
+
+	tm.Clock.Advance(time.Second)
+	block()
+
+	tm.Clock.Advance(time.Second)
+	if w := serve(); w.Header().Get("Retry-After") != "59" {
+		t.Errorf("Block after the escalation was forgotten: Retry-After %s, expected 59", w.Header().Get("Retry-After"))
+	}
+}
+
+func TestPardon(t *testing.T) {
+	tm := leakytest.NewTestManager(t)
+	bucket := tm.ThrottlingHandler(handleFuncSuccessResponse, 1, 60, keyFunc, "test",
+		leaky.WithPenaltyBox(leaky.PenaltyBox{Threshold: 1, Block: time.Hour}))
+	ctx := context.Background()
+
+	bucket.Add(1, "client")
+	if d, ok := bucket.AdmitKey(ctx, http.Header{}, "client"); ok || d.RetryAfter > time.Second {
+		t.Fatalf("Rejection not counted as the bucket's: %+v", d)
+	}
+
+	tm.Clock.Advance(time.Second)
+	if d, ok := bucket.AdmitKey(ctx, http.Header{}, "client"); ok || d.RetryAfter < 59*time.Minute {
+		t.Fatalf("Client not blocked: %+v", d)
+	}
+
+	if err := bucket.Pardon(ctx, "client"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := bucket.AdmitKey(ctx, http.Header{}, "client"); !ok {
+		t.Error("Client still blocked once pardoned")
+	}
+}
+
+func TestPenaltyCache(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		cacheTTL time.Duration
+		cached   bool
+	}{
+		{"default", 0, true},
+		{"off", -1, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tm := leakytest.NewTestManager(t)
+			bucket := tm.ThrottlingHandler(handleFuncSuccessResponse, 10, 60, keyFunc, "test",
+				leaky.WithPenaltyBox(leaky.PenaltyBox{CacheTTL: tc.cacheTTL}))
+			ctx := context.Background()
+
+			calls := func() int {
+				before := tm.Store.Calls()
+				if _, ok := bucket.AdmitKey(ctx, http.Header{}, "client"); !ok {
+					t.Fatal("Client rejected")
+				}
+				return tm.Store.Calls() - before
+			}
+
+			first := calls()
+			if again := calls(); (again < first) != tc.cached {
+				t.Errorf("Store calls for a request %d, then %d, expected the record cached: %v", first, again, tc.cached)
+			}
+
+			// The record is read again once the cache expires
+			tm.Clock.Advance(time.Second)
+			if again := calls(); again != first {
+				t.Errorf("Store calls for a request %d once the cache expired, expected %d", again, first)
+			}
+		})
+	}
+}
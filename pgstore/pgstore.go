@@ -0,0 +1,186 @@
+// Package pgstore provides a leaky.Store keeping bucket state in a PostgreSQL table,
+// for services whose only shared state is their database. It uses database/sql,
+// so works with any Postgres driver.
+//
+//	db, _ := sql.Open("pgx", os.Getenv("DATABASE_URL"))
+//	store := pgstore.New(db, "throttling")
+//	if err := store.CreateTable(ctx); err != nil {
+//		log.Fatal(err)
+//	}
+//	tm := leaky.NewThrottleManagerWithStore(store)
+package pgstore
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/2bytes/leaky"
+)
+
+// Store keeps bucket state in a table as JSON. Expired rows are ignored when read, and deleted by
+// DeleteExpired, which should be called every so often. GetSet holds an advisory lock on the key for its
+// transaction, so no other write can land between reading the previous state and writing the new one.
+type Store struct {
+	db   *sql.DB
+	name string
+	// table is the name quoted for use in statements
+	table string
+}
+
+// New creates a store keeping state in the named table, which CreateTable creates
+func New(db *sql.DB, table string) *Store {
+	return &Store{db: db, name: table, table: quoteIdentifier(table)}
+}
+
+// CreateTable creates the store's table and its index on expiry, if they don't already exist
+func (s *Store) CreateTable(ctx context.Context) error {
+	_, err := s.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS `+s.table+` (
+		key TEXT PRIMARY KEY,
+		state JSONB NOT NULL,
+		expires_at TIMESTAMPTZ NOT NULL
+	)`)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.ExecContext(ctx, `CREATE INDEX IF NOT EXISTS `+quoteIdentifier(s.name+"_expires_at")+
+		` ON `+s.table+` (expires_at)`)
+	return err
+}
+
+// DeleteExpired deletes expired state, returning how many rows were deleted
+func (s *Store) DeleteExpired(ctx context.Context) (int64, error) {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM `+s.table+` WHERE expires_at <= now()`)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+// Get implements leaky.Store
+func (s *Store) Get(ctx context.Context, key string) (leaky.State, bool, error) {
+	row := s.db.QueryRowContext(ctx, `SELECT state FROM `+s.table+` WHERE key = $1 AND expires_at > now()`, key)
+	return scanState(row)
+}
+
+// Set implements leaky.Store
+func (s *Store) Set(ctx context.Context, key string, state leaky.State, ttl time.Duration) error {
+	value, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.ExecContext(ctx, s.upsert(), key, string(value), ttl.Seconds())
+	return err
+}
+
+// GetSet implements leaky.GetSetter, taking four round trips for its transaction
+func (s *Store) GetSet(ctx context.Context, key string, state leaky.State, ttl time.Duration) (leaky.State, bool, error) {
+	value, err := json.Marshal(state)
+	if err != nil {
+		return leaky.State{}, false, err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return leaky.State{}, false, err
+	}
+	defer tx.Rollback()
+
+	// Row locks can't stop two transactions both creating a key, so lock the key itself.
+	// The next statement's snapshot is taken after the lock is held, so it reads the latest state.
+	if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock(hashtextextended($1, 0))`, key); err != nil {
+		return leaky.State{}, false, err
+	}
+
+	// Every part of a statement sees the same snapshot, so prev is the state from before the upsert
+	row := tx.QueryRowContext(ctx, `WITH prev AS (
+		SELECT state FROM `+s.table+` WHERE key = $1 AND expires_at > now()
+	), upsert AS (`+s.upsert()+`)
+	SELECT state FROM prev`, key, string(value), ttl.Seconds())
+
+	prev, ok, err := scanState(row)
+	if err != nil {
+		return prev, false, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return prev, ok, &leaky.WriteError{Err: err}
+	}
+
+	return prev, ok, nil
+}
+
+// Transact implements leaky.Transactor, holding advisory locks on the keys for its transaction. They are
+// taken in order, so transactions over the same keys can't deadlock.
+func (s *Store) Transact(ctx context.Context, keys []string, update func(states []leaky.State, exists []bool) ([]leaky.State, []time.Duration)) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	locks := append([]string(nil), keys...)
+	sort.Strings(locks)
+	for _, key := range locks {
+		if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock(hashtextextended($1, 0))`, key); err != nil {
+			return err
+		}
+	}
+
+	states := make([]leaky.State, len(keys))
+	exists := make([]bool, len(keys))
+	for i, key := range keys {
+		row := tx.QueryRowContext(ctx, `SELECT state FROM `+s.table+` WHERE key = $1 AND expires_at > now()`, key)
+		if states[i], exists[i], err = scanState(row); err != nil {
+			return err
+		}
+	}
+
+	writes, ttls := update(states, exists)
+	for i, state := range writes {
+		value, err := json.Marshal(state)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, s.upsert(), keys[i], string(value), ttls[i].Seconds()); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// upsert is the statement writing state $2 under key $1, expiring in $3 seconds
+func (s *Store) upsert() string {
+	return `INSERT INTO ` + s.table + ` (key, state, expires_at) VALUES ($1, $2::jsonb, now() + make_interval(secs => $3))
+		ON CONFLICT (key) DO UPDATE SET state = EXCLUDED.state, expires_at = EXCLUDED.expires_at`
+}
+
+func scanState(row *sql.Row) (leaky.State, bool, error) {
+	state := leaky.State{}
+
+	var value []byte
+	if err := row.Scan(&value); err != nil {
+		if err == sql.ErrNoRows {
+			return state, false, nil
+		}
+		return state, false, err
+	}
+
+	if err := json.Unmarshal(value, &state); err != nil {
+		return state, false, err
+	}
+
+	return state, true, nil
+}
+
+// quoteIdentifier quotes a name for use as an identifier in a statement
+func quoteIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
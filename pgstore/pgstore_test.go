@@ -0,0 +1,304 @@
+package pgstore
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/2bytes/leaky"
+)
+
+func TestQuoteIdentifier(t *testing.T) {
+	for name, want := range map[string]string{
+		"throttling":       `"throttling"`,
+		"Throttling":       `"Throttling"`,
+		`a"; DROP TABLE x`: `"a""; DROP TABLE x"`,
+	} {
+		if got := quoteIdentifier(name); got != want {
+			t.Errorf("Quoted %q as %s, expected %s", name, got, want)
+		}
+	}
+}
+
+// fakeDB is an in-memory table behind a database/sql driver, recognising the statements the store makes.
+// Writes in a transaction land when it commits, and advisory locks are held until it ends.
+type fakeDB struct {
+	mu    sync.Mutex
+	rows  map[string]fakeRow
+	locks map[string]*sync.Mutex
+	now   time.Time
+	// statements are the statements run, in order
+	statements []string
+	failCommit error
+}
+
+type fakeRow struct {
+	state   string
+	expires time.Time
+}
+
+func newFakeDB(t *testing.T) (*fakeDB, *Store) {
+	f := &fakeDB{rows: make(map[string]fakeRow), locks: make(map[string]*sync.Mutex), now: time.Unix(1700000000, 0)}
+	db := sql.OpenDB(f)
+	t.Cleanup(func() { db.Close() })
+
+	return f, New(db, "throttling")
+}
+
+func (f *fakeDB) Connect(ctx context.Context) (driver.Conn, error) { return &fakeConn{db: f}, nil }
+func (f *fakeDB) Driver() driver.Driver                            { return nil }
+
+func (f *fakeDB) put(key, state string, secs float64) {
+	f.rows[key] = fakeRow{state: state, expires: f.now.Add(time.Duration(secs * float64(time.Second)))}
+}
+
+// live returns the unexpired state stored under key
+func (f *fakeDB) live(key string) (string, bool) {
+	row, ok := f.rows[key]
+	if !ok || !row.expires.After(f.now) {
+		return "", false
+	}
+	return row.state, true
+}
+
+func (f *fakeDB) lock(key string) *sync.Mutex {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.locks[key] == nil {
+		f.locks[key] = &sync.Mutex{}
+	}
+	return f.locks[key]
+}
+
+// fakeConn runs statements against its fakeDB, in the transaction it has begun if any
+type fakeConn struct {
+	db *fakeDB
+	tx *fakeTx
+}
+
+type fakeTx struct {
+	conn   *fakeConn
+	writes []func()
+	held   []*sync.Mutex
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("not supported")
+}
+func (c *fakeConn) Close() error { return nil }
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	c.tx = &fakeTx{conn: c}
+	return c.tx, nil
+}
+
+func (tx *fakeTx) Commit() error {
+	defer tx.end()
+
+	f := tx.conn.db
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.failCommit != nil {
+		return f.failCommit
+	}
+	for _, write := range tx.writes {
+		write()
+	}
+	return nil
+}
+
+func (tx *fakeTx) Rollback() error {
+	tx.end()
+	return nil
+}
+
+func (tx *fakeTx) end() {
+	for _, l := range tx.held {
+		l.Unlock()
+	}
+	tx.conn.tx = nil
+}
+
+func (c *fakeConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	f := c.db
+	if strings.Contains(query, "pg_advisory_xact_lock") {
+		// Locked outside the table's mutex, so waiting for another transaction doesn't stop it committing
+		l := f.lock(args[0].Value.(string))
+		l.Lock()
+		c.tx.held = append(c.tx.held, l)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.statements = append(f.statements, query)
+
+	switch {
+	case strings.HasPrefix(query, "INSERT INTO"):
+		c.write(args)
+	case strings.HasPrefix(query, "DELETE FROM"):
+		deleted := 0
+		for key := range f.rows {
+			if _, ok := f.live(key); !ok {
+				delete(f.rows, key)
+				deleted++
+			}
+		}
+		return driver.RowsAffected(deleted), nil
+	}
+
+	return driver.RowsAffected(1), nil
+}
+
+func (c *fakeConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	f := c.db
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.statements = append(f.statements, query)
+
+	state, ok := f.live(args[0].Value.(string))
+	if strings.HasPrefix(query, "WITH prev AS") {
+		if !strings.Contains(query, "ON CONFLICT (key) DO UPDATE") {
+			return nil, errors.New("GetSet doesn't upsert")
+		}
+		c.write(args)
+	}
+
+	rows := &fakeRows{}
+	if ok {
+		rows.values = append(rows.values, state)
+	}
+	return rows, nil
+}
+
+// write upserts state $2 under key $1 expiring in $3 seconds, once the transaction commits if there is one
+func (c *fakeConn) write(args []driver.NamedValue) {
+	key, state, secs := args[0].Value.(string), args[1].Value.(string), args[2].Value.(float64)
+	if c.tx == nil {
+		c.db.put(key, state, secs)
+		return
+	}
+	c.tx.writes = append(c.tx.writes, func() { c.db.put(key, state, secs) })
+}
+
+type fakeRows struct {
+	values []string
+}
+
+func (r *fakeRows) Columns() []string { return []string{"state"} }
+func (r *fakeRows) Close() error      { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	dest[0], r.values = []byte(r.values[0]), r.values[1:]
+	return nil
+}
+
+func TestGetSet(t *testing.T) {
+	f, store := newFakeDB(t)
+	ctx := context.Background()
+
+	if prev, ok, err := store.GetSet(ctx, "alice", leaky.State{SpaceRemaining: 1}, time.Minute); err != nil || ok || prev.SpaceRemaining != 0 {
+		t.Fatalf("GetSet of a new key returned %+v, %v, %v", prev, ok, err)
+	}
+	if prev, ok, err := store.GetSet(ctx, "alice", leaky.State{SpaceRemaining: 2}, time.Minute); err != nil || !ok || prev.SpaceRemaining != 1 {
+		t.Fatalf("GetSet returned %+v, %v, %v, expected the state it replaced", prev, ok, err)
+	}
+	if state, ok, err := store.Get(ctx, "alice"); err != nil || !ok || state.SpaceRemaining != 2 {
+		t.Fatalf("Get returned %+v, %v, %v after GetSet", state, ok, err)
+	}
+
+	// The key is locked before the state it replaces is read
+	n := len(f.statements)
+	if !strings.Contains(f.statements[n-3], "pg_advisory_xact_lock") || !strings.HasPrefix(f.statements[n-2], "WITH prev AS") {
+		t.Errorf("GetSet ran %q, expected an advisory lock then the upsert", f.statements[n-3:n-1])
+	}
+
+	f.now = f.now.Add(time.Minute)
+	if prev, ok, err := store.GetSet(ctx, "alice", leaky.State{SpaceRemaining: 3}, time.Minute); err != nil || ok {
+		t.Errorf("GetSet returned expired state %+v, %v, %v", prev, ok, err)
+	}
+}
+
+func TestGetSetCommitFails(t *testing.T) {
+	f, store := newFakeDB(t)
+	ctx := context.Background()
+
+	if err := store.Set(ctx, "alice", leaky.State{SpaceRemaining: 1}, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	f.failCommit = errors.New("connection reset")
+	_, ok, err := store.GetSet(ctx, "alice", leaky.State{SpaceRemaining: 2}, time.Minute)
+	var writeErr *leaky.WriteError
+	if !errors.As(err, &writeErr) || !ok {
+		t.Fatalf("GetSet returned %v, %v, expected a WriteError with the state read", ok, err)
+	}
+
+	f.failCommit = nil
+	if state, _, _ := store.Get(ctx, "alice"); state.SpaceRemaining != 1 {
+		t.Errorf("State %+v written by a transaction which failed to commit", state)
+	}
+}
+
+func TestTransact(t *testing.T) {
+	_, store := newFakeDB(t)
+	ctx := context.Background()
+
+	// Transactions take the keys in either order and increment both, racing each other
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		keys := []string{"a", "b"}
+		if i%2 == 1 {
+			keys = []string{"b", "a"}
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := store.Transact(ctx, keys, func(states []leaky.State, exists []bool) ([]leaky.State, []time.Duration) {
+				for i := range states {
+					states[i].SpaceRemaining++
+				}
+				// Give racing transactions time to read the same states, were they not locked out
+				time.Sleep(time.Millisecond)
+				return states, []time.Duration{time.Minute, time.Minute}
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	for _, key := range []string{"a", "b"} {
+		if state, ok, err := store.Get(ctx, key); err != nil || !ok || state.SpaceRemaining != 20 {
+			t.Errorf("Key %s has %+v, %v, %v after 20 transactions, expected 20", key, state, ok, err)
+		}
+	}
+}
+
+func TestDeleteExpired(t *testing.T) {
+	f, store := newFakeDB(t)
+	ctx := context.Background()
+
+	store.Set(ctx, "alice", leaky.State{}, time.Second)
+	store.Set(ctx, "bob", leaky.State{}, time.Minute)
+
+	f.now = f.now.Add(time.Second)
+	if n, err := store.DeleteExpired(ctx); err != nil || n != 1 {
+		t.Errorf("Deleted %d, %v, expected one expired row", n, err)
+	}
+	if _, ok, _ := store.Get(ctx, "bob"); !ok {
+		t.Error("Unexpired state deleted")
+	}
+}
@@ -0,0 +1,46 @@
+package leaky
+
+import "net/http"
+
+// Priority is a request's class when the bucket is short of space
+type Priority int
+
+const (
+	// Normal requests may only use the space not reserved for High ones
+	Normal Priority = iota
+	// High requests may use every drop of the bucket, such as health checks and paid traffic
+	High
+)
+
+// PriorityFunc tags a request with its priority
+type PriorityFunc func(r *http.Request) Priority
+
+// PriorityHeader returns a PriorityFunc tagging requests High when they have the header set to value,
+// such as one set by a gateway for paid plans
+func PriorityHeader(header string, value string) PriorityFunc {
+	return func(r *http.Request) Priority {
+		if r.Header.Get(header) == value {
+			return High
+		}
+		return Normal
+	}
+}
+
+// WithPriority reserves drops of each client's bucket for the requests fn tags High, so they keep flowing
+// when Normal ones have used up the rest. Normal requests only fit while more than reserved drops are left,
+// and aren't held by WithDelay. Requests admitted by key, rather than from net/http, are High.
+func WithPriority(fn PriorityFunc, reserved int) Option {
+	return func(b *Bucket) {
+		b.priority = fn
+		b.reserved = reserved
+	}
+}
+
+// keep returns how many drops the request must leave in the bucket for those of a higher priority
+func (b *Bucket) keep(r *http.Request) int {
+	if b.priority == nil || b.priority(r) >= High {
+		return 0
+	}
+
+	return b.reserved
+}
@@ -0,0 +1,51 @@
+package leaky
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPriority(t *testing.T) {
+	tj := prepareTestJig()
+	defer tj.Close()
+
+	memory := NewMemoryStore()
+	defer memory.Close()
+
+	managers := map[string]*ThrottleManager{
+		"redis":  tj.ThrottleManager,
+		"memory": NewThrottleManagerWithStore(memory),
+	}
+
+	for name, tm := range managers {
+		t.Run(name, func(t *testing.T) {
+			bucket := tm.ThrottlingHandler(handleFuncSuccessResponse, 3, 0, keyFunc, "test",
+				WithPriority(PriorityHeader("X-Plan", "paid"), 1))
+
+			serve := func(plan string) int {
+				r := httptest.NewRequest("GET", "/", nil)
+				r.Header.Set("X-Plan", plan)
+				w := httptest.NewRecorder()
+				bucket.ServeHTTP(w, r)
+				return w.Code
+			}
+
+			requests := []struct {
+				plan string
+				want int
+			}{
+				{"free", http.StatusOK},
+				{"free", http.StatusOK},
+				{"free", http.StatusTooManyRequests},
+				{"paid", http.StatusOK},
+				{"paid", http.StatusTooManyRequests},
+			}
+			for i, req := range requests {
+				if code := serve(req.plan); code != req.want {
+					t.Errorf("Request %d on the %s plan: status %v, expected %v", i, req.plan, code, req.want)
+				}
+			}
+		})
+	}
+}
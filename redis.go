@@ -0,0 +1,706 @@
+package leaky
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// WithHashTags makes the key ID of each key a Redis Cluster hash tag, so all of a client's state
+// is kept in the same slot even when it is spread over several keys. Bucket names must not contain
+// braces, or they become the hash tag and all of a bucket's state is kept in one slot.
+func WithHashTags() ManagerOption {
+	return func(m *ThrottleManager) {
+		m.hashTags = true
+	}
+}
+
+// takeSource is the Lua source of takeScript
+//
+//go:embed take.lua
+var takeSource string
+
+// takeScript leaks and takes drops from a bucket's state in a single atomic step, it is run by its SHA1
+// and only sent in full if Redis doesn't have it cached
+var takeScript = redis.NewScript(takeSource)
+
+// windowSource is the Lua source of windowScript
+//
+//go:embed window.lua
+var windowSource string
+
+// windowScript counts and adds to the requests in a WindowBucket's window in a single atomic step
+var windowScript = redis.NewScript(windowSource)
+
+// Names of the scripts as Redis functions, registered by library
+const (
+	takeFunction   = "leaky_take"
+	windowFunction = "leaky_window"
+)
+
+// library is the Redis function library registering the scripts when functions are enabled
+var library = "#!lua name=leaky\n\n" + registerFunction(takeFunction, takeSource) + registerFunction(windowFunction, windowSource)
+
+// registerFunction returns the library code registering a script as a function
+func registerFunction(name string, source string) string {
+	return "redis.register_function('" + name + "', function(KEYS, ARGV)\n" + source + "\nend)\n"
+}
+
+// RedisStore stores bucket state in Redis hashes, which can be read with HGETALL. Values written as JSON
+// by earlier versions are still read, until they expire or are replaced.
+type RedisStore struct {
+	client     redis.UniversalClient
+	scripting  bool
+	functions  bool
+	serverTime bool
+}
+
+// RedisOption configures a RedisStore
+type RedisOption func(*RedisStore)
+
+// WithScripting sets whether drops are taken by a Lua script run in Redis, which is atomic so
+// concurrent requests can't take the same space. It is enabled by default; without it state is
+// read and written in a pipeline, for servers which don't run scripts.
+func WithScripting(enabled bool) RedisOption {
+	return func(s *RedisStore) {
+		s.scripting = enabled
+	}
+}
+
+// WithFunctions runs the take script as a function from a Redis function library named leaky, rather than
+// by EVALSHA, for Redis 7 and later. The library is visible with FUNCTION LIST and persisted with the
+// dataset, it is replaced with this version's when the manager is created.
+func WithFunctions() RedisOption {
+	return func(s *RedisStore) {
+		s.functions = true
+	}
+}
+
+// WithServerTime makes the take script leak state by the Redis server's clock rather than the clock of
+// the instance making the request, so instances with skewed clocks agree on how much has leaked.
+// It has no effect with scripting turned off.
+func WithServerTime() RedisOption {
+	return func(s *RedisStore) {
+		s.serverTime = true
+	}
+}
+
+// NewRedisStore creates a store keeping state in the Redis database of client, which can be
+// standalone, Sentinel backed or a cluster
+func NewRedisStore(client redis.UniversalClient, opts ...RedisOption) *RedisStore {
+	s := &RedisStore{client: client, scripting: true}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	return s
+}
+
+// Get implements Store
+func (s *RedisStore) Get(ctx context.Context, key string) (State, bool, error) {
+	pipe := s.client.Pipeline()
+	fields := pipe.HGetAll(ctx, key)
+	legacy := pipe.Get(ctx, key)
+
+	if _, err := pipe.Exec(ctx); err != nil && fields.Err() == nil && legacy.Err() == nil {
+		// The pipeline failed as a whole, such as the server not being reachable
+		return State{}, false, err
+	}
+
+	return readHash(fields, legacy)
+}
+
+// Set implements Store, replacing the whole hash in a transaction
+func (s *RedisStore) Set(ctx context.Context, key string, state State, ttl time.Duration) error {
+	pipe := s.client.TxPipeline()
+	writeHash(ctx, pipe, key, state, ttl)
+	_, err := pipe.Exec(ctx)
+
+	return err
+}
+
+// GetSet queues the read and the write in a single transaction pipeline
+func (s *RedisStore) GetSet(ctx context.Context, key string, state State, ttl time.Duration) (State, bool, error) {
+	pipe := s.client.TxPipeline()
+	fields := pipe.HGetAll(ctx, key)
+	legacy := pipe.Get(ctx, key)
+	writes := writeHash(ctx, pipe, key, state, ttl)
+	_, err := pipe.Exec(ctx)
+
+	writeErr := firstErr(writes)
+	if err != nil && fields.Err() == nil && legacy.Err() == nil && writeErr == nil {
+		// The transaction failed as a whole, such as MULTI being refused, so nothing ran
+		return State{}, false, err
+	}
+
+	prev, exists, err := readHash(fields, legacy)
+	if err != nil {
+		return prev, false, err
+	}
+
+	if writeErr != nil {
+		return prev, exists, &WriteError{Err: writeErr}
+	}
+
+	return prev, exists, nil
+}
+
+// transactAttempts is how many times Transact runs its update before giving up, when other writes keep
+// changing the keys it watches
+const transactAttempts = 10
+
+// Transact implements Transactor, watching the keys while their states are read and replacing them in a
+// MULTI transaction, which fails and is tried again if another write changed them. On a cluster the keys
+// must all be in the same slot.
+func (s *RedisStore) Transact(ctx context.Context, keys []string, update func(states []State, exists []bool) ([]State, []time.Duration)) error {
+	txf := func(tx *redis.Tx) error {
+		fields := make([]*redis.MapStringStringCmd, len(keys))
+		legacy := make([]*redis.StringCmd, len(keys))
+
+		pipe := tx.Pipeline()
+		for i, key := range keys {
+			fields[i] = pipe.HGetAll(ctx, key)
+			legacy[i] = pipe.Get(ctx, key)
+		}
+		if _, err := pipe.Exec(ctx); err != nil && !isWrongType(err) && err != redis.Nil {
+			return err
+		}
+
+		states := make([]State, len(keys))
+		exists := make([]bool, len(keys))
+		for i := range keys {
+			var err error
+			if states[i], exists[i], err = readHash(fields[i], legacy[i]); err != nil {
+				return err
+			}
+		}
+
+		writes, ttls := update(states, exists)
+		if writes == nil {
+			return nil
+		}
+
+		_, err := tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			for i, state := range writes {
+				writeHash(ctx, pipe, keys[i], state, ttls[i])
+			}
+			return nil
+		})
+		return err
+	}
+
+	var err error
+	for i := 0; i < transactAttempts; i++ {
+		if err = s.client.Watch(ctx, txf, keys...); err != redis.TxFailedErr {
+			return err
+		}
+	}
+
+	return err
+}
+
+// sameSlot reports whether a transaction over keys can run on the store, which on Redis Cluster needs
+// them all in the same slot
+func (s *RedisStore) sameSlot(keys []string) bool {
+	if _, ok := s.client.(*redis.ClusterClient); !ok || len(keys) == 0 {
+		return true
+	}
+
+	slot := keySlot(keys[0])
+	for _, key := range keys[1:] {
+		if keySlot(key) != slot {
+			return false
+		}
+	}
+	return true
+}
+
+// keySlot returns the Redis Cluster slot of key, which only its hash tag is hashed for if it has one
+func keySlot(key string) uint16 {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+
+	return crc16(key) % 16384
+}
+
+// crc16 is the CRC-16/XMODEM checksum Redis Cluster hashes keys by
+func crc16(s string) uint16 {
+	var crc uint16
+	for i := 0; i < len(s); i++ {
+		crc ^= uint16(s[i]) << 8
+		for bit := 0; bit < 8; bit++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+
+	return crc
+}
+
+// Fields of the hash a state is stored in
+const (
+	fieldRemaining   = "remaining"
+	fieldLastUpdate  = "last_update"
+	fieldSize        = "size"
+	fieldFingerprint = "fingerprint"
+	fieldSlots       = "slots"
+	fieldTAT         = "tat"
+	fieldLog         = "log"
+	fieldCounts      = "counts"
+	fieldKeyLimits   = "key_limits"
+	fieldAccess      = "access"
+	fieldPenalty     = "penalty"
+)
+
+// writeHash queues the commands replacing the hash under key with state
+func writeHash(ctx context.Context, pipe redis.Pipeliner, key string, state State, ttl time.Duration) []redis.Cmder {
+	values := []interface{}{fieldFingerprint, state.Fingerprint}
+	if !state.TAT.IsZero() {
+		// GCRA stores nothing more
+		values = append(values, fieldTAT, state.TAT.Format(time.RFC3339Nano))
+	} else {
+		values = append(values,
+			fieldRemaining, strconv.FormatFloat(state.SpaceRemaining, 'f', -1, 64),
+			fieldLastUpdate, state.LastUpdate.Format(time.RFC3339Nano),
+			fieldSize, state.Size,
+		)
+	}
+	if len(state.Slots) > 0 {
+		slots, _ := json.Marshal(state.Slots)
+		values = append(values, fieldSlots, slots)
+	}
+	if len(state.Log) > 0 {
+		entries, _ := json.Marshal(state.Log)
+		values = append(values, fieldLog, entries)
+	}
+	if state.Counts != nil {
+		counts, _ := json.Marshal(state.Counts)
+		values = append(values, fieldCounts, counts)
+	}
+	if state.KeyLimits != nil {
+		keyLimits, _ := json.Marshal(state.KeyLimits)
+		values = append(values, fieldKeyLimits, keyLimits)
+	}
+	if state.Access != "" {
+		values = append(values, fieldAccess, string(state.Access))
+	}
+	if state.Penalty != nil {
+		penalty, _ := json.Marshal(state.Penalty)
+		values = append(values, fieldPenalty, penalty)
+	}
+
+	return []redis.Cmder{
+		pipe.Del(ctx, key),
+		pipe.HSet(ctx, key, values...),
+		pipe.PExpire(ctx, key, ttl),
+	}
+}
+
+// readHash decodes the state read by HGETALL, or by GET if the key holds a JSON value written
+// before state was stored in hashes
+func readHash(fields *redis.MapStringStringCmd, legacy *redis.StringCmd) (State, bool, error) {
+	state := State{}
+
+	if err := fields.Err(); err != nil {
+		if !isWrongType(err) {
+			return state, false, err
+		}
+
+		if err := legacy.Scan(&state); err != nil {
+			return state, false, err
+		}
+		return state, true, nil
+	}
+
+	values := fields.Val()
+	if len(values) == 0 {
+		return state, false, nil
+	}
+
+	state.Fingerprint = values[fieldFingerprint]
+
+	var err error
+	if tat, ok := values[fieldTAT]; ok {
+		// Stored by GCRA, with nothing else
+		if state.TAT, err = time.Parse(time.RFC3339Nano, tat); err != nil {
+			return state, false, err
+		}
+		return state, true, nil
+	}
+
+	if state.SpaceRemaining, err = strconv.ParseFloat(values[fieldRemaining], 64); err != nil {
+		return state, false, err
+	}
+
+	if state.LastUpdate, err = time.Parse(time.RFC3339Nano, values[fieldLastUpdate]); err != nil {
+		return state, false, err
+	}
+
+	if size, ok := values[fieldSize]; ok {
+		if state.Size, err = strconv.Atoi(size); err != nil {
+			return state, false, err
+		}
+	}
+
+	if slots, ok := values[fieldSlots]; ok {
+		if err := json.Unmarshal([]byte(slots), &state.Slots); err != nil {
+			return state, false, err
+		}
+	}
+
+	if entries, ok := values[fieldLog]; ok {
+		if err := json.Unmarshal([]byte(entries), &state.Log); err != nil {
+			return state, false, err
+		}
+	}
+
+	if counts, ok := values[fieldCounts]; ok {
+		if err := json.Unmarshal([]byte(counts), &state.Counts); err != nil {
+			return state, false, err
+		}
+	}
+
+	state.Access = Access(values[fieldAccess])
+
+	if keyLimits, ok := values[fieldKeyLimits]; ok {
+		if err := json.Unmarshal([]byte(keyLimits), &state.KeyLimits); err != nil {
+			return state, false, err
+		}
+	}
+
+	if penalty, ok := values[fieldPenalty]; ok {
+		if err := json.Unmarshal([]byte(penalty), &state.Penalty); err != nil {
+			return state, false, err
+		}
+	}
+
+	return state, true, nil
+}
+
+// isWrongType reports whether Redis refused a command because the key holds another type of value
+func isWrongType(err error) bool {
+	var redisErr redis.Error
+	return errors.As(err, &redisErr) && strings.HasPrefix(redisErr.Error(), "WRONGTYPE ")
+}
+
+// firstErr returns the first error of the commands, if any failed
+func firstErr(cmds []redis.Cmder) error {
+	for _, cmd := range cmds {
+		if err := cmd.Err(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Take implements Taker, running the take script against the key
+func (s *RedisStore) Take(ctx context.Context, req TakeRequest) (TakeResult, error) {
+	args := s.takeArgs(req)
+
+	var reply []interface{}
+	var err error
+	if s.functions {
+		reply, err = s.fcall(ctx, takeFunction, req.Key, args)
+	} else {
+		reply, err = takeScript.Run(ctx, s.client, []string{req.Key}, args...).Slice()
+	}
+	if err != nil {
+		return TakeResult{}, err
+	}
+
+	return parseTakeReply(reply, len(req.Demands))
+}
+
+// TakeBatch implements BatchTaker, running the take script against every key in a single pipeline,
+// loading the scripts first if Redis doesn't have them
+func (s *RedisStore) TakeBatch(ctx context.Context, reqs []TakeRequest) ([]TakeResult, error) {
+	cmds, err := s.pipeTakes(ctx, reqs)
+	if err != nil && isMissingScript(err) {
+		if err := s.LoadScripts(ctx); err != nil {
+			return nil, err
+		}
+		cmds, err = s.pipeTakes(ctx, reqs)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]TakeResult, len(reqs))
+	for i, cmd := range cmds {
+		reply, err := cmd.Slice()
+		if err != nil {
+			return nil, err
+		}
+		if results[i], err = parseTakeReply(reply, len(reqs[i].Demands)); err != nil {
+			return nil, err
+		}
+	}
+
+	return results, nil
+}
+
+// pipeTakes runs the take script against each request's key in a pipeline, by name or SHA1 only
+func (s *RedisStore) pipeTakes(ctx context.Context, reqs []TakeRequest) ([]*redis.Cmd, error) {
+	pipe := s.client.Pipeline()
+	cmds := make([]*redis.Cmd, len(reqs))
+
+	for i, req := range reqs {
+		args := s.takeArgs(req)
+		if !s.functions {
+			cmds[i] = takeScript.EvalSha(ctx, pipe, []string{req.Key}, args...)
+			continue
+		}
+
+		cmds[i] = redis.NewCmd(ctx, append([]interface{}{"fcall", takeFunction, 1, req.Key}, args...)...)
+		// So a cluster client sends it to the key's slot
+		cmds[i].SetFirstKeyPos(3)
+		_ = pipe.Process(ctx, cmds[i])
+	}
+
+	_, err := pipe.Exec(ctx)
+	return cmds, err
+}
+
+// isMissingScript reports whether Redis didn't have the take script cached, or the function library loaded
+func isMissingScript(err error) bool {
+	return strings.HasPrefix(err.Error(), "NOSCRIPT") || strings.Contains(err.Error(), "Function not found")
+}
+
+// takeArgs returns the take script's arguments for the request
+func (s *RedisStore) takeArgs(req TakeRequest) []interface{} {
+	args := []interface{}{req.Now.Unix(), req.Now.Nanosecond(), req.Now.Format(time.RFC3339Nano)}
+	if s.serverTime {
+		args = []interface{}{"", "", ""}
+	}
+	args = append(args,
+		req.Size,
+		strconv.FormatFloat(req.LeakRate, 'g', -1, 64),
+		req.Fingerprint,
+		int(req.Migration),
+		req.MaxTTL.Milliseconds(),
+		req.TTLMargin.Milliseconds(),
+		req.GCRA,
+	)
+	for _, d := range req.Demands {
+		mode := 0
+		switch {
+		case d.Reserve:
+			mode = 2
+		case d.Partial:
+			mode = 1
+		}
+		args = append(args, d.Count, mode, d.Keep)
+	}
+
+	return args
+}
+
+// fcall calls one of the library's functions, loading the library first if Redis doesn't have it
+func (s *RedisStore) fcall(ctx context.Context, function string, key string, args []interface{}) ([]interface{}, error) {
+	call := func() *redis.Cmd {
+		cmd := redis.NewCmd(ctx, append([]interface{}{"fcall", function, 1, key}, args...)...)
+		// So a cluster client sends it to the key's slot
+		cmd.SetFirstKeyPos(3)
+		_ = s.client.Process(ctx, cmd)
+		return cmd
+	}
+
+	reply, err := call().Slice()
+	if err != nil && strings.Contains(err.Error(), "Function not found") {
+		if err := s.LoadScripts(ctx); err != nil {
+			return nil, err
+		}
+		reply, err = call().Slice()
+	}
+
+	return reply, err
+}
+
+// LoadScripts loads the store's scripts into the Redis script cache, or its function library, on every
+// master of a cluster, so they can be run by SHA1 or name from the first request. Scripts missing from
+// Redis, such as after it restarts, are sent again when they are run, loading them is only an optimisation.
+func (s *RedisStore) LoadScripts(ctx context.Context) error {
+	if !s.scripting {
+		return nil
+	}
+
+	load := func(ctx context.Context, client redis.UniversalClient) error {
+		if s.functions {
+			return client.Do(ctx, "function", "load", "replace", library).Err()
+		}
+		if err := takeScript.Load(ctx, client).Err(); err != nil {
+			return err
+		}
+		return windowScript.Load(ctx, client).Err()
+	}
+
+	cluster, ok := s.client.(*redis.ClusterClient)
+	if !ok {
+		return load(ctx, s.client)
+	}
+
+	return cluster.ForEachMaster(ctx, func(ctx context.Context, node *redis.Client) error {
+		return load(ctx, node)
+	})
+}
+
+// parseTakeReply decodes the reply of the take script
+func parseTakeReply(reply []interface{}, demands int) (TakeResult, error) {
+	result := TakeResult{}
+	if len(reply) != demands+2 {
+		return result, fmt.Errorf("leaky: take script replied with %d values, expected %d", len(reply), demands+2)
+	}
+
+	existed, ok := reply[0].(int64)
+	encoded, isString := reply[1].(string)
+	if !ok || !isString {
+		return result, fmt.Errorf("leaky: unexpected take script reply %v", reply)
+	}
+
+	result.Existed = existed == 1
+	if err := result.State.UnmarshalBinary([]byte(encoded)); err != nil {
+		return result, err
+	}
+
+	for _, v := range reply[2:] {
+		taken, ok := v.(int64)
+		if !ok {
+			return result, fmt.Errorf("leaky: unexpected take script reply %v", reply)
+		}
+		result.Taken = append(result.Taken, int(taken))
+	}
+
+	return result, nil
+}
+
+// CountWindow implements WindowCounter, running the window script against the key
+func (s *RedisStore) CountWindow(ctx context.Context, req WindowRequest) (WindowResult, error) {
+	args := []interface{}{req.Now.UnixMicro(), req.Window.Microseconds(), req.Limit, req.Count, int(req.Strategy), req.ID}
+
+	key := req.Key
+	if req.Strategy == FixedWindow {
+		// Each window is counted under a key of its own, so a count can't outlive its window
+		// however far the server's clock is from the caller's
+		key = fmt.Sprintf("%s:%d", req.Key, req.Now.UnixMicro()/req.Window.Microseconds())
+	}
+
+	var reply []interface{}
+	var err error
+	if s.functions {
+		reply, err = s.fcall(ctx, windowFunction, key, args)
+	} else {
+		reply, err = windowScript.Run(ctx, s.client, []string{key}, args...).Slice()
+	}
+	if err != nil {
+		return WindowResult{}, err
+	}
+
+	values := make([]int64, len(reply))
+	for i, v := range reply {
+		n, ok := v.(int64)
+		if !ok || len(reply) != 3 {
+			return WindowResult{}, fmt.Errorf("leaky: unexpected window script reply %v", reply)
+		}
+		values[i] = n
+	}
+
+	result := WindowResult{Allowed: values[0] == 1, Counted: int(values[1]), RetryAfter: InfDuration}
+	if values[2] >= 0 {
+		result.RetryAfter = time.Duration(values[2]) * time.Microsecond
+	}
+
+	return result, nil
+}
+
+// CountKeys implements KeyCounter, scanning for the keys under prefix, which takes many round trips on a large database.
+// On Redis Cluster every master is scanned.
+func (s *RedisStore) CountKeys(ctx context.Context, prefix string) (int, error) {
+	match := globEscaper.Replace(prefix) + "*"
+
+	cluster, ok := s.client.(*redis.ClusterClient)
+	if !ok {
+		return countKeys(ctx, s.client, match)
+	}
+
+	var mu sync.Mutex
+	total := 0
+	err := cluster.ForEachMaster(ctx, func(ctx context.Context, node *redis.Client) error {
+		count, err := countKeys(ctx, node, match)
+
+		mu.Lock()
+		defer mu.Unlock()
+		total += count
+		return err
+	})
+
+	return total, err
+}
+
+// countKeys scans a single server for the keys matching a pattern
+func countKeys(ctx context.Context, client redis.Cmdable, match string) (int, error) {
+	count := 0
+	var cursor uint64
+	for {
+		keys, next, err := client.Scan(ctx, cursor, match, 1000).Result()
+		if err != nil {
+			return 0, err
+		}
+
+		count += len(keys)
+		if next == 0 {
+			return count, nil
+		}
+		cursor = next
+	}
+}
+
+// Retryable implements RetryClassifier, errors are retryable when the server couldn't be dialled
+// or refused the command while it isn't ready, such as a demoted master during a failover
+func (s *RedisStore) Retryable(err error) bool {
+	var writeErr *WriteError
+	if errors.As(err, &writeErr) {
+		err = writeErr.Err
+	}
+
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+
+	var redisErr redis.Error
+	if !errors.As(err, &redisErr) {
+		return false
+	}
+
+	for _, prefix := range retryablePrefixes {
+		if strings.HasPrefix(redisErr.Error(), prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// retryablePrefixes begin the errors Redis replies with when it didn't carry out a command because
+// it isn't ready, rather than because the command was wrong
+var retryablePrefixes = []string{"READONLY ", "LOADING ", "MASTERDOWN ", "TRYAGAIN ", "CLUSTERDOWN "}
+
+// globEscaper escapes the characters special to Redis glob patterns
+var globEscaper = strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`)
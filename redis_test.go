@@ -0,0 +1,349 @@
+package leaky
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func newTestRedisStore(t *testing.T) (*RedisStore, *miniredis.Miniredis) {
+	mr := miniredis.RunT(t)
+	return NewRedisStore(redis.NewClient(&redis.Options{Addr: mr.Addr()})), mr
+}
+
+func TestRedisStoreGetSet(t *testing.T) {
+	store, mr := newTestRedisStore(t)
+
+	if _, ok, err := store.Get(ctx, "key"); ok || err != nil {
+		t.Fatalf("Get of an empty store returned %v, %v", ok, err)
+	}
+
+	state := State{LastUpdate: time.Unix(1000, 0).UTC(), SpaceRemaining: 3, Size: 5}
+	if err := store.Set(ctx, "key", state, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	if ttl := mr.TTL("key"); ttl != time.Minute {
+		t.Errorf("TTL %v, expected a minute", ttl)
+	}
+
+	next := State{LastUpdate: time.Unix(2000, 0).UTC(), SpaceRemaining: 2, Size: 5}
+	prev, ok, err := store.GetSet(ctx, "key", next, time.Minute)
+	if err != nil || !ok || !reflect.DeepEqual(prev, state) {
+		t.Errorf("GetSet returned %+v, %v, %v, expected the first state", prev, ok, err)
+	}
+
+	if got, ok, err := store.Get(ctx, "key"); err != nil || !ok || !reflect.DeepEqual(got, next) {
+		t.Errorf("Get returned %+v, %v, %v, expected the second state", got, ok, err)
+	}
+}
+
+func TestRedisStoreCountKeys(t *testing.T) {
+	store, _ := newTestRedisStore(t)
+
+	for _, key := range []string{"leaky::a*::1", "leaky::a*::2", "leaky::ab::1", "other"} {
+		if err := store.Set(ctx, key, State{}, time.Minute); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The * in the bucket name must not match as a glob
+	count, err := store.CountKeys(ctx, "leaky::a*::")
+	if err != nil || count != 2 {
+		t.Errorf("Counted %d, %v, expected 2", count, err)
+	}
+}
+
+func TestRedisCluster(t *testing.T) {
+	mr := miniredis.RunT(t)
+	cluster := redis.NewClusterClient(&redis.ClusterOptions{Addrs: []string{mr.Addr()}})
+	defer cluster.Close()
+
+	tm := NewThrottleManager(cluster)
+	bucket := tm.ThrottlingHandler(handleFuncSuccessResponse, 1, 60, keyFunc, "test")
+
+	for i, want := range []bool{true, false} {
+		if ok := bucket.Add(1, "client"); ok != want {
+			t.Errorf("Add %d: %v, expected %v", i, ok, want)
+		}
+	}
+
+	if keys := mr.Keys(); !reflect.DeepEqual(keys, []string{"leaky::test::{client}"}) {
+		t.Errorf("Keys %q, expected the key ID hash tagged", keys)
+	}
+
+	count, err := NewRedisStore(cluster).CountKeys(ctx, "leaky::test::")
+	if err != nil || count != 1 {
+		t.Errorf("Counted %d, %v, expected 1", count, err)
+	}
+}
+
+func TestKeySlot(t *testing.T) {
+	// Slots as reported by CLUSTER KEYSLOT
+	for key, want := range map[string]uint16{
+		"foo":                   12182,
+		"somekey":               11058,
+		"{user1000}.following":  keySlot("user1000"),
+		"leaky::api::{client}":  keySlot("client"),
+		"leaky::api::{}client}": crc16("leaky::api::{}client}") % 16384,
+	} {
+		if got := keySlot(key); got != want {
+			t.Errorf("Slot of %q is %d, expected %d", key, got, want)
+		}
+	}
+}
+
+func TestUniversalClient(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewUniversalClient(&redis.UniversalOptions{Addrs: []string{mr.Addr()}})
+	defer client.Close()
+
+	bucket := NewThrottleManager(client).ThrottlingHandler(handleFuncSuccessResponse, 1, 60, keyFunc, "test")
+	if !bucket.Add(1, "client") {
+		t.Fatal("Add rejected")
+	}
+
+	// A single address makes a standalone client, whose keys aren't hash tagged
+	if keys := mr.Keys(); !reflect.DeepEqual(keys, []string{"leaky::test::client"}) {
+		t.Errorf("Keys %q, expected the key ID untagged", keys)
+	}
+}
+
+func TestRedisStoreTakeConcurrent(t *testing.T) {
+	tj := prepareTestJig()
+	defer tj.Close()
+
+	bucket := tj.ThrottleManager.ThrottlingHandler(handleFuncSuccessResponse, 50, 0, keyFunc, "test")
+
+	var accepted atomic.Int64
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if bucket.Add(1, "test-key") {
+				accepted.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := accepted.Load(); n != 50 {
+		t.Errorf("Expected exactly 50 drops accepted, got %d", n)
+	}
+
+	if rt := bucket.Stats().RoundTrips; rt != 100 {
+		t.Errorf("Expected one round trip per drop, got %d", rt)
+	}
+}
+
+func TestRedisStoreTakeMatchesBucket(t *testing.T) {
+	clock := &testClock{now: time.Now()}
+	stored := []State{
+		{LastUpdate: clock.now.Add(-30 * time.Second), SpaceRemaining: 2, Size: 10, Fingerprint: "old"},
+		{LastUpdate: clock.now.Add(-1500 * time.Microsecond), SpaceRemaining: 4},
+		// Written by another instance in a different time zone
+		{LastUpdate: clock.now.Add(-10 * time.Second).In(time.FixedZone("IST", 5*3600+1800)), SpaceRemaining: 1,
+			Size: 20, Fingerprint: configFingerprint(algorithmLeaky, 20, perMinute(60))},
+	}
+
+	for _, migration := range []MigrationPolicy{MigrateProportional, MigrateReset, MigrateClamp} {
+		for i, state := range stored {
+			// Stored as a hash, and as JSON by an earlier version
+			for _, legacy := range []bool{false, true} {
+				var taken [2]int
+				var after, written [2]State
+				var ttl [2]time.Duration
+
+				for j, scripting := range []bool{true, false} {
+					mr := miniredis.RunT(t)
+					store := NewRedisStore(redis.NewClient(&redis.Options{Addr: mr.Addr()}), WithScripting(scripting))
+					if legacy {
+						data, _ := state.MarshalBinary()
+						mr.Set(testKey, string(data))
+					} else if err := store.Set(ctx, testKey, state, time.Hour); err != nil {
+						t.Fatal(err)
+					}
+
+					bucket := NewThrottleManagerWithStore(store, WithClock(clock)).
+						ThrottlingHandler(handleFuncSuccessResponse, 20, 60, keyFunc, "test", WithMigration(migration))
+
+					taken[j], after[j] = bucket.take(ctx, bucket.limits, "test-key", Demand{Count: 15, Partial: true})
+					ttl[j] = mr.TTL(testKey)
+					written[j], _, _ = store.Get(ctx, testKey)
+				}
+
+				if taken[0] != taken[1] || after[0].SpaceRemaining != after[1].SpaceRemaining {
+					t.Errorf("Policy %d, state %d, legacy %v: script took %d leaving %v, bucket took %d leaving %v",
+						migration, i, legacy, taken[0], after[0].SpaceRemaining, taken[1], after[1].SpaceRemaining)
+				}
+
+				if ttl[0] != ttl[1] {
+					t.Errorf("Policy %d, state %d, legacy %v: script set TTL %s, bucket set %s", migration, i, legacy, ttl[0], ttl[1])
+				}
+
+				if !reflect.DeepEqual(written[0], written[1]) {
+					t.Errorf("Policy %d, state %d, legacy %v: script wrote %+v, bucket wrote %+v", migration, i, legacy, written[0], written[1])
+				}
+			}
+		}
+	}
+}
+
+func TestRedisStoreScriptReload(t *testing.T) {
+	tj := prepareTestJig()
+	defer tj.Close()
+
+	rc := redis.NewClient(&redis.Options{Addr: tj.miniRedis.Addr()})
+	if loaded, err := takeScript.Exists(ctx, rc).Result(); err != nil || !loaded[0] {
+		t.Fatalf("Script not loaded by the manager: %v %v", loaded, err)
+	}
+
+	bucket := tj.ThrottleManager.ThrottlingHandler(handleFuncSuccessResponse, 2, 0, keyFunc, "test")
+	if !bucket.Add(1, "test-key") {
+		t.Fatal("First drop rejected")
+	}
+
+	// Redis restarting empties the script cache
+	if err := rc.ScriptFlush(ctx).Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bucket.Add(1, "test-key") {
+		t.Error("Drop rejected after the script cache was flushed")
+	}
+
+	if bucket.Add(1, "test-key") {
+		t.Error("Bucket overflow")
+	}
+
+	if fo := bucket.Stats().FailOpens; fo != 0 {
+		t.Errorf("Expected no fail-opens, got %d", fo)
+	}
+}
+
+// functionsHook emulates Redis functions, which miniredis doesn't have, by running the loaded
+// library with EVAL
+type functionsHook struct {
+	mu      sync.Mutex
+	library string
+}
+
+func (h *functionsHook) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (h *functionsHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return next
+}
+
+func (h *functionsHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		h.mu.Lock()
+		library := h.library
+		h.mu.Unlock()
+
+		args := cmd.Args()
+		switch cmd.Name() {
+		case "function":
+			h.mu.Lock()
+			h.library = args[3].(string)
+			h.mu.Unlock()
+			cmd.(*redis.Cmd).SetVal("leaky")
+			return nil
+		case "fcall":
+			if library == "" {
+				cmd.SetErr(errors.New("ERR Function not found"))
+				return cmd.Err()
+			}
+
+			// Run the library without its shebang, calling the function it registers
+			body := library[strings.Index(library, "\n"):]
+			script := "local registered = {}\nredis.register_function = function(name, fn) registered[name] = fn end\n" +
+				body + "\nreturn registered['" + args[1].(string) + "'](KEYS, ARGV)"
+
+			eval := redis.NewCmd(ctx, append([]interface{}{"eval", script}, args[2:]...)...)
+			err := next(ctx, eval)
+			cmd.(*redis.Cmd).SetVal(eval.Val())
+			cmd.SetErr(eval.Err())
+			return err
+		}
+
+		return next(ctx, cmd)
+	}
+}
+
+func TestRedisStoreFunctions(t *testing.T) {
+	mr := miniredis.RunT(t)
+	hook := &functionsHook{}
+	rc := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	rc.AddHook(hook)
+
+	tm := NewThrottleManagerWithStore(NewRedisStore(rc, WithFunctions()))
+	if hook.library != library {
+		t.Fatal("Library not loaded by the manager")
+	}
+
+	bucket := tm.ThrottlingHandler(handleFuncSuccessResponse, 2, 0, keyFunc, "test")
+	if !bucket.Add(1, "test-key") {
+		t.Fatal("First drop rejected")
+	}
+
+	// FUNCTION FLUSH, or a restart without persistence, removes the library
+	hook.library = ""
+
+	if !bucket.Add(1, "test-key") {
+		t.Error("Drop rejected after the library was removed")
+	}
+
+	if bucket.Add(1, "test-key") {
+		t.Error("Bucket overflow")
+	}
+
+	if fo := bucket.Stats().FailOpens; fo != 0 {
+		t.Errorf("Expected no fail-opens, got %d", fo)
+	}
+}
+
+func TestRedisStoreServerTime(t *testing.T) {
+	mr := miniredis.RunT(t)
+	mr.SetTime(time.Date(2024, 2, 29, 23, 59, 59, 999999000, time.UTC))
+
+	for _, serverTime := range []bool{false, true} {
+		opts := []RedisOption{}
+		if serverTime {
+			opts = append(opts, WithServerTime())
+		}
+		store := NewRedisStore(redis.NewClient(&redis.Options{Addr: mr.Addr()}), opts...)
+		mr.FlushAll()
+
+		// One instance's clock is a minute behind the other's
+		behind := &testClock{now: time.Now().Add(-time.Minute)}
+		ahead := &testClock{now: time.Now()}
+		tm := NewThrottleManagerWithStore(store)
+
+		first := tm.ThrottlingHandler(handleFuncSuccessResponse, 1, 10, keyFunc, "test", WithBucketClock(behind))
+		second := tm.ThrottlingHandler(handleFuncSuccessResponse, 1, 10, keyFunc, "test", WithBucketClock(ahead))
+
+		if !first.Add(1, "test-key") {
+			t.Fatal("First drop rejected")
+		}
+
+		if admitted := second.Add(1, "test-key"); admitted == serverTime {
+			t.Errorf("Server time %v: second drop admitted %v", serverTime, admitted)
+		}
+	}
+
+	state, _, err := NewRedisStore(redis.NewClient(&redis.Options{Addr: mr.Addr()})).Get(ctx, testKey)
+	if err != nil || !state.LastUpdate.Equal(time.Date(2024, 2, 29, 23, 59, 59, 999999000, time.UTC)) {
+		t.Errorf("Stored last update %s, %v, expected the server's time", state.LastUpdate, err)
+	}
+}
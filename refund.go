@@ -0,0 +1,124 @@
+package leaky
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"time"
+)
+
+// afterResponseTimeout bounds the store calls made for a request once its handler has returned
+const afterResponseTimeout = 2 * time.Second
+
+// StatusFunc reports whether a response status is one of a class, such as server errors
+type StatusFunc func(status int) bool
+
+// ServerErrors is a StatusFunc matching 5xx statuses
+func ServerErrors(status int) bool {
+	return status >= http.StatusInternalServerError
+}
+
+// Statuses returns a StatusFunc matching any of the statuses
+func Statuses(statuses ...int) StatusFunc {
+	return func(status int) bool {
+		for _, s := range statuses {
+			if status == s {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// WithRefundOn gives the drops a request took back to the client's bucket when its response has a status
+// fn matches, such as ServerErrors, so clients aren't limited for requests which failed through no fault
+// of their own
+func WithRefundOn(fn StatusFunc) Option {
+	return func(b *Bucket) {
+		b.refundOn = fn
+	}
+}
+
+// Refund gives n drops back to the client's bucket, up to its size. It isn't atomic with taking drops,
+// so a take from the same client racing it may be lost.
+func (b *Bucket) Refund(ctx context.Context, keyID string, n int) error {
+	return b.refund(ctx, b.adapt(b.limitsFor(ctx, keyID)), keyID, n)
+}
+
+func (b *Bucket) refund(ctx context.Context, lim limits, keyID string, n int) error {
+	stored, exists, err := b.readState(ctx, b.getKey(keyID))
+	if err != nil || !exists {
+		// Without state the bucket is already empty
+		return err
+	}
+
+	state := b.leak(lim, stored)
+	state.SpaceRemaining = math.Min(float64(lim.size), state.SpaceRemaining+float64(n))
+
+	return b.replaceState(ctx, lim, keyID, state)
+}
+
+// refundFor refunds the drops a request took if its response has a status the bucket refunds
+func (b *Bucket) refundFor(ctx context.Context, lim limits, keyID string, taken int, sw *statusWriter) {
+	if !b.refundOn(sw.sent()) {
+		return
+	}
+
+	ctx, cancel := afterResponse(ctx)
+	defer cancel()
+
+	if err := b.refund(ctx, lim, keyID, taken); err != nil {
+		b.storeFailed(ctx, b.logger.Warn, "Refunding drops failed", keyID, err)
+	}
+}
+
+// WithChargeOn only takes drops for requests whose response has a status fn matches, such as failed logins
+// with 401 Unauthorized, so a bucket can lock out clients after too many failed attempts while successful
+// ones remain unlimited. Requests are still rejected while the bucket is full. Drops are taken once the
+// response is written, so requests racing each other may all be admitted before they are counted.
+// Only requests served by the bucket as middleware are counted this way.
+func WithChargeOn(fn StatusFunc) Option {
+	return func(b *Bucket) {
+		b.chargeOn = fn
+	}
+}
+
+// chargeFor takes the drops a request costs if its response has a status the bucket charges for,
+// whether or not there is space for them, so every failure counts
+func (b *Bucket) chargeFor(ctx context.Context, lim limits, keyID string, cost int, sw *statusWriter) {
+	if !b.chargeOn(sw.sent()) {
+		return
+	}
+
+	ctx, cancel := afterResponse(ctx)
+	defer cancel()
+
+	b.take(ctx, lim, keyID, Demand{Count: cost, Reserve: true})
+}
+
+// afterResponse returns a context for store calls made once a request's handler has returned, which
+// aren't abandoned if the client has gone away by then, but are bounded by afterResponseTimeout
+func afterResponse(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(withoutCancel{ctx}, afterResponseTimeout)
+}
+
+// withoutCancel keeps the values of its parent context, such as traces, but not its cancellation or deadline
+type withoutCancel struct {
+	parent context.Context
+}
+
+func (withoutCancel) Deadline() (deadline time.Time, ok bool) {
+	return time.Time{}, false
+}
+
+func (withoutCancel) Done() <-chan struct{} {
+	return nil
+}
+
+func (withoutCancel) Err() error {
+	return nil
+}
+
+func (c withoutCancel) Value(key any) any {
+	return c.parent.Value(key)
+}
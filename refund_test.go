@@ -0,0 +1,124 @@
+package leaky_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/2bytes/leaky"
+	"github.com/2bytes/leaky/leakytest"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestRefundOn(t *testing.T) {
+	tm := leakytest.NewTestManager(t)
+
+	status := http.StatusInternalServerError
+	bucket := tm.ThrottlingHandler(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}, 2, 0, keyFunc, "test", leaky.WithRefundOn(leaky.ServerErrors))
+
+	serve := func() int {
+		w := httptest.NewRecorder()
+		bucket.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		return w.Code
+	}
+
+	for i := 0; i < 5; i++ {
+		if code := serve(); code != http.StatusInternalServerError {
+			t.Errorf("Failed request %d: status %v, expected its drop refunded", i, code)
+		}
+	}
+
+	status = http.StatusOK
+	for i, want := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		if code := serve(); code != want {
+			t.Errorf("Request %d: status %v, expected %v", i, code, want)
+		}
+	}
+}
+
+func TestRefundAfterDisconnect(t *testing.T) {
+	mr := miniredis.RunT(t)
+	tm := leaky.NewThrottleManager(redis.NewClient(&redis.Options{Addr: mr.Addr()}))
+
+	// The client disconnects before the failed response is written, cancelling the request's context
+	ctx, cancel := context.WithCancel(context.Background())
+	bucket := tm.ThrottlingHandler(func(w http.ResponseWriter, r *http.Request) {
+		cancel()
+		w.WriteHeader(http.StatusInternalServerError)
+	}, 1, 0, keyFunc, "test", leaky.WithRefundOn(leaky.ServerErrors))
+
+	bucket.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil).WithContext(ctx))
+
+	if remaining, _ := bucket.Remaining(context.Background(), "test-key"); remaining != 1 {
+		t.Errorf("%d remaining after the disconnected request's refund, expected 1", remaining)
+	}
+}
+
+func TestRefund(t *testing.T) {
+	tm := leakytest.NewTestManager(t)
+	bucket := tm.ThrottlingHandler(handleFuncSuccessResponse, 5, 0, keyFunc, "test")
+	ctx := context.Background()
+
+	bucket.Add(4, "client")
+	if err := bucket.Refund(ctx, "client", 3); err != nil {
+		t.Fatal(err)
+	}
+	if remaining, _ := bucket.Remaining(ctx, "client"); remaining != 4 {
+		t.Errorf("%d remaining after the refund, expected 4", remaining)
+	}
+
+	// Refunds don't overfill the bucket
+	if err := bucket.Refund(ctx, "client", 10); err != nil {
+		t.Fatal(err)
+	}
+	if remaining, _ := bucket.Remaining(ctx, "client"); remaining != 5 {
+		t.Errorf("%d remaining after refunding more than was taken, expected 5", remaining)
+	}
+}
+
+func TestStatuses(t *testing.T) {
+	notFound := leaky.Statuses(http.StatusNotFound, http.StatusGone)
+	if !notFound(http.StatusGone) || notFound(http.StatusOK) {
+		t.Error("Statuses matched the wrong statuses")
+	}
+}
+
+func TestChargeOn(t *testing.T) {
+	tm := leakytest.NewTestManager(t)
+
+	bucket := tm.ThrottlingHandler(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Password") != "correct" {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}, 3, 0, keyFunc, "login", leaky.WithChargeOn(leaky.Statuses(http.StatusUnauthorized, http.StatusForbidden)))
+
+	login := func(password string) int {
+		req := httptest.NewRequest("POST", "/login", nil)
+		req.Header.Set("X-Password", password)
+
+		w := httptest.NewRecorder()
+		bucket.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	for i := 0; i < 5; i++ {
+		if code := login("correct"); code != http.StatusOK {
+			t.Errorf("Successful login %d: status %v", i, code)
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		if code := login("wrong"); code != http.StatusUnauthorized {
+			t.Errorf("Failed login %d: status %v", i, code)
+		}
+	}
+
+	// Locked out after three failures, even with the right password
+	if code := login("correct"); code != http.StatusTooManyRequests {
+		t.Errorf("Login once locked out: status %v", code)
+	}
+}
@@ -0,0 +1,218 @@
+package leaky
+
+import (
+	"bytes"
+	htmltemplate "html/template"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Rejection is the response sent to requests over the limit, for gateways and clients expecting something
+// other than the default 429 Too Many Requests
+type Rejection struct {
+	// Status is the status code, 429 if not set
+	Status int
+	// Body is written as is, if not set the body is rendered by Templates for the type the request accepts
+	Body string
+	// ContentType is the type of Body, plain text if not set
+	ContentType string
+	// Templates render the body when Body isn't set, any not set are the defaults
+	Templates RejectionTemplates
+}
+
+// RejectionTemplates render the body of a rejection as JSON for APIs, HTML for browsers, or plain text
+// for anything else, chosen by the request's Accept header. They are executed with RejectionData.
+type RejectionTemplates struct {
+	JSON *template.Template
+	HTML *htmltemplate.Template
+	Text *template.Template
+}
+
+// RejectionData describes a rejection to the templates rendering it
+type RejectionData struct {
+	Bucket string
+	Status int
+	// RetryAfter is the whole seconds until the client should retry, 0 if it isn't known
+	RetryAfter int64
+}
+
+var defaultRejection = Rejection{
+	Status:      http.StatusTooManyRequests,
+	ContentType: "text/plain; charset=utf-8",
+	Templates: RejectionTemplates{
+		JSON: template.Must(template.New("json").Parse(
+			`{"error":"rate limit exceeded","retry_after":{{.RetryAfter}}}` + "\n")),
+		HTML: htmltemplate.Must(htmltemplate.New("html").Parse(
+			`<!DOCTYPE html><html><head><title>Rate Limit Exceeded</title></head><body><h1>Rate Limit Exceeded</h1>` +
+				`{{if .RetryAfter}}<p>Please try again in {{.RetryAfter}} seconds.</p>{{end}}</body></html>` + "\n")),
+		Text: template.Must(template.New("text").Parse("Rate Limit Exceeded\n")),
+	},
+}
+
+// The types a rejection can be rendered as, in order of preference when the request accepts them equally
+const (
+	textType = "text/plain; charset=utf-8"
+	jsonType = "application/json"
+	htmlType = "text/html; charset=utf-8"
+)
+
+// WithRejection sets the response sent to requests the bucket rejects, including those rejected by a
+// concurrency limit stacked on it
+func WithRejection(rejection Rejection) Option {
+	return func(b *Bucket) {
+		b.rejection = rejection
+	}
+}
+
+// WithConcurrencyRejection sets the response sent to requests rejected for lack of a slot
+func WithConcurrencyRejection(rejection Rejection) ConcurrencyOption {
+	return func(c *ConcurrencyBucket) {
+		c.rejection = rejection
+	}
+}
+
+// WithWindowRejection sets the response sent to requests over the window's limit
+func WithWindowRejection(rejection Rejection) WindowOption {
+	return func(w *WindowBucket) {
+		w.rejection = rejection
+	}
+}
+
+// withDefaults fills in the fields not set from the default rejection
+func (rj Rejection) withDefaults() Rejection {
+	if rj.Status == 0 {
+		rj.Status = defaultRejection.Status
+	}
+	if rj.ContentType == "" {
+		rj.ContentType = defaultRejection.ContentType
+	}
+	if rj.Templates.JSON == nil {
+		rj.Templates.JSON = defaultRejection.Templates.JSON
+	}
+	if rj.Templates.HTML == nil {
+		rj.Templates.HTML = defaultRejection.Templates.HTML
+	}
+	if rj.Templates.Text == nil {
+		rj.Templates.Text = defaultRejection.Templates.Text
+	}
+
+	return rj
+}
+
+// write sends the rejection of r by the bucket as http.Error would, leaving the headers already set
+// such as Retry-After. The wait is how long until the client should retry, 0 if it isn't known.
+func (rj Rejection) write(w http.ResponseWriter, r *http.Request, logger Logger, bucketName string, wait time.Duration) {
+	rj = rj.withDefaults()
+
+	contentType, body := rj.ContentType, rj.Body
+	if body == "" {
+		contentType, body = rj.render(r, logger, RejectionData{
+			Bucket:     bucketName,
+			Status:     rj.Status,
+			RetryAfter: retrySeconds(wait),
+		})
+	}
+
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Set("Content-Type", contentType)
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(rj.Status)
+	io.WriteString(w, body)
+}
+
+// render executes the template for the type the request accepts, falling back to the default
+// plain text if it fails
+func (rj Rejection) render(r *http.Request, logger Logger, data RejectionData) (string, string) {
+	var buf bytes.Buffer
+	var err error
+
+	contentType := negotiate(r.Header.Values("Accept"))
+	switch contentType {
+	case jsonType:
+		err = rj.Templates.JSON.Execute(&buf, data)
+	case htmlType:
+		err = rj.Templates.HTML.Execute(&buf, data)
+	default:
+		err = rj.Templates.Text.Execute(&buf, data)
+	}
+
+	if err != nil {
+		logger.Error("Rendering rejection failed", "bucket", data.Bucket, "error", err)
+		return textType, "Rate Limit Exceeded\n"
+	}
+
+	return contentType, buf.String()
+}
+
+// negotiate chooses the type the Accept header prefers, by its quality values and then the most specific range
+// matching each type, plain text if it accepts none of them or there is no header
+func negotiate(accept []string) string {
+	offers := []struct{ contentType, mediaType string }{
+		{textType, "text/plain"},
+		{jsonType, "application/json"},
+		{htmlType, "text/html"},
+	}
+
+	best, bestQ, bestSpecificity := textType, 0.0, -1
+	for _, offer := range offers {
+		q, specificity := acceptance(accept, offer.mediaType)
+		if q > bestQ || (q == bestQ && q > 0 && specificity > bestSpecificity) {
+			best, bestQ, bestSpecificity = offer.contentType, q, specificity
+		}
+	}
+
+	return best
+}
+
+// acceptance returns the quality the Accept header gives the media type, from the most specific range
+// matching it, and how specific that range is
+func acceptance(accept []string, mediaType string) (float64, int) {
+	q, specificity := 0.0, -1
+	major, _, _ := strings.Cut(mediaType, "/")
+
+	for _, header := range accept {
+		for _, part := range strings.Split(header, ",") {
+			rng, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+			if err != nil {
+				continue
+			}
+
+			s := -1
+			switch rng {
+			case mediaType:
+				s = 2
+			case major + "/*":
+				s = 1
+			case "*/*":
+				s = 0
+			}
+			if s <= specificity {
+				continue
+			}
+
+			q, specificity = 1, s
+			if v, ok := params["q"]; ok {
+				if f, err := strconv.ParseFloat(v, 64); err == nil {
+					q = f
+				}
+			}
+		}
+	}
+
+	return q, specificity
+}
+
+// retrySeconds is the wait in whole seconds rounded up, 0 if it is forever
+func retrySeconds(wait time.Duration) int64 {
+	if wait == InfDuration {
+		return 0
+	}
+
+	return seconds(wait)
+}
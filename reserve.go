@@ -0,0 +1,83 @@
+package leaky
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrNeverFits is returned when drops can never fit in a bucket, because there are more than it can hold
+// or it doesn't leak
+var ErrNeverFits = errors.New("leaky: drops can never fit in the bucket")
+
+// AllowN adds n drops to the client's bucket if there is space for all of them
+func (b *Bucket) AllowN(ctx context.Context, keyID string, n int) bool {
+	return b.AddContext(ctx, n, keyID)
+}
+
+// Reserve takes n drops from the client's bucket whether or not there is space for them now, returning
+// how long the caller should wait before acting on them, zero if they fit straight away. Other requests
+// are held back until the reserved drops have leaked. If the drops can never fit nothing is taken and
+// the delay is InfDuration.
+func (b *Bucket) Reserve(ctx context.Context, keyID string, n int) time.Duration {
+	lim := b.adapt(b.limitsFor(ctx, keyID))
+	if n > lim.size {
+		return InfDuration
+	}
+
+	demand := Demand{Count: n, Reserve: true}
+	if lim.leakRate <= 0 {
+		// Space is never given back, so only drops which fit now can be taken
+		demand = exactly(n)
+	}
+
+	taken, after := b.take(ctx, lim, keyID, demand)
+	if taken < n {
+		return InfDuration
+	}
+
+	// The wait is how long until the drops would have fitted had they not been taken yet
+	before := after
+	before.SpaceRemaining += float64(taken)
+	return lim.waitFor(n, before)
+}
+
+// Wait blocks until a drop can be added to the client's bucket, or ctx is done
+func (b *Bucket) Wait(ctx context.Context, keyID string) error {
+	return b.WaitN(ctx, keyID, 1)
+}
+
+// WaitN blocks until n drops can be added to the client's bucket, or ctx is done. If they don't fit straight
+// away they are reserved, and it sleeps for as long as the bucket takes to leak enough space for them rather
+// than asking the store again, so waiting takes at most two round trips. A cancelled wait gives the drops back.
+// If the drops can't fit before the deadline of ctx it returns context.DeadlineExceeded straight away, and
+// ErrNeverFits if they can never fit.
+func (b *Bucket) WaitN(ctx context.Context, keyID string, n int) error {
+	return b.waitUnder(ctx, b.limitsFor(ctx, keyID), keyID, n)
+}
+
+// waitUnder is WaitN for a client whose limits have been found
+func (b *Bucket) waitUnder(ctx context.Context, lim limits, keyID string, n int) error {
+	lim = b.adapt(lim)
+	taken, after := b.take(ctx, lim, keyID, exactly(n))
+	if taken == n {
+		return nil
+	}
+
+	wait := lim.waitFor(n, after)
+	if wait == InfDuration {
+		return ErrNeverFits
+	}
+	if !beforeDeadline(ctx, wait) {
+		return context.DeadlineExceeded
+	}
+
+	// Reserving the drops stops those who ask while this waits from taking the space first
+	taken, _, wait = b.reserveHeld(ctx, lim, keyID, n)
+	if taken < n || !beforeDeadline(ctx, wait) {
+		b.giveBack(lim, keyID, taken)
+		return context.DeadlineExceeded
+	}
+
+	return b.sleepHeld(ctx, lim, keyID, taken, wait)
+}
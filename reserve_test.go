@@ -0,0 +1,99 @@
+package leaky
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestReserve(t *testing.T) {
+	tj := prepareTestJig()
+	defer tj.Close()
+
+	clock := &testClock{now: time.Now()}
+	bucket := tj.ThrottleManager.ThrottlingHandler(handleFuncSuccessResponse, 2, 60, keyFunc, "test", WithBucketClock(clock))
+
+	if wait := bucket.Reserve(ctx, "test-key", 2); wait != 0 {
+		t.Errorf("Reservation which fits waits %s", wait)
+	}
+
+	// The bucket is full, so the next drop waits a second to leak
+	if wait := bucket.Reserve(ctx, "test-key", 1); wait != time.Second {
+		t.Errorf("Reservation waits %s, expected a second", wait)
+	}
+
+	// Reserved drops hold back other requests
+	clock.now = clock.now.Add(time.Second)
+	if bucket.AllowN(ctx, "test-key", 1) {
+		t.Error("Drop admitted into reserved space")
+	}
+
+	clock.now = clock.now.Add(time.Second)
+	if !bucket.AllowN(ctx, "test-key", 1) {
+		t.Error("Drop rejected after the reservation leaked")
+	}
+
+	if wait := bucket.Reserve(ctx, "test-key", 3); wait != InfDuration {
+		t.Errorf("Reservation larger than the bucket waits %s", wait)
+	}
+}
+
+func TestWait(t *testing.T) {
+	tj := prepareTestJig()
+	defer tj.Close()
+
+	// A drop leaks every 100ms
+	bucket := tj.ThrottleManager.ThrottlingHandler(handleFuncSuccessResponse, 1, 600, keyFunc, "test")
+
+	if err := bucket.Wait(ctx, "test-key"); err != nil {
+		t.Fatalf("Wait with space returned %v", err)
+	}
+
+	short, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if err := bucket.Wait(short, "test-key"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Wait past the deadline returned %v", err)
+	}
+
+	start := time.Now()
+	if err := bucket.Wait(ctx, "test-key"); err != nil {
+		t.Fatalf("Wait returned %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("Wait returned after %s, before a drop leaked", elapsed)
+	}
+
+	if err := bucket.WaitN(ctx, "test-key", 2); !errors.Is(err, ErrNeverFits) {
+		t.Errorf("Wait for more than the bucket holds returned %v", err)
+	}
+}
+
+func TestWaitNReserves(t *testing.T) {
+	tj := prepareTestJig()
+	defer tj.Close()
+
+	// Two drops leak every 200ms
+	bucket := tj.ThrottleManager.ThrottlingHandler(handleFuncSuccessResponse, 2, 600, keyFunc, "test")
+	bucket.Add(2, "test-key")
+
+	before := bucket.Stats().RoundTrips
+	if err := bucket.WaitN(ctx, "test-key", 2); err != nil {
+		t.Fatalf("WaitN returned %v", err)
+	}
+	if trips := bucket.Stats().RoundTrips - before; trips > 2 {
+		t.Errorf("WaitN made %d round trips, expected the take and the reservation", trips)
+	}
+
+	// Cancelled well into the wait, as a store call cancelled before the reservation is made fails open
+	cancelled, cancel := context.WithCancel(ctx)
+	time.AfterFunc(100*time.Millisecond, cancel)
+	if err := bucket.WaitN(cancelled, "test-key", 2); !errors.Is(err, context.Canceled) {
+		t.Errorf("Cancelled WaitN returned %v", err)
+	}
+
+	// Only the first wait's drops are left in the bucket
+	if state := bucket.getState(ctx, "test-key"); state.SpaceRemaining < -0.5 {
+		t.Errorf("Space remaining %v, expected the cancelled wait's drops back", state.SpaceRemaining)
+	}
+}
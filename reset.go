@@ -0,0 +1,93 @@
+package leaky
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrUnknownBucket is returned when the manager has no bucket with a name
+var ErrUnknownBucket = errors.New("leaky: unknown bucket")
+
+// Reset empties the client's bucket, as if they had made no requests, under their own limits if they have any
+func (b *Bucket) Reset(ctx context.Context, keyID string) error {
+	lim := b.adapt(b.limitsFor(ctx, keyID))
+	return b.replaceState(ctx, lim, keyID, b.fullState(lim))
+}
+
+// Drain fills the client's bucket, so their requests are rejected until it leaks
+func (b *Bucket) Drain(ctx context.Context, keyID string) error {
+	lim := b.adapt(b.limitsFor(ctx, keyID))
+	return b.replaceState(ctx, lim, keyID, b.newState(lim, 0))
+}
+
+// replaceState stores the state for a key regardless of what was stored before
+func (b *Bucket) replaceState(ctx context.Context, lim limits, keyID string, state State) error {
+	key := b.getKey(keyID)
+
+	if err := b.writeState(ctx, lim, key, state); err != nil {
+		b.forget(key)
+		return err
+	}
+
+	b.remember(lim, key, knownState{state: state, exists: true})
+	return nil
+}
+
+// Bucket returns the bucket created by the manager with a name
+func (m *ThrottleManager) Bucket(name string) (*Bucket, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	b, ok := m.buckets[name]
+	return b, ok
+}
+
+// SetLimits changes the size and leak rate per minute of the named bucket, as Bucket.SetLimits
+func (m *ThrottleManager) SetLimits(bucketName string, size int, rate int) error {
+	b, ok := m.Bucket(bucketName)
+	if !ok {
+		return ErrUnknownBucket
+	}
+
+	b.SetLimits(size, rate)
+	return nil
+}
+
+// SetLimit changes the size and leak rate of the named bucket, as Bucket.SetLimit
+func (m *ThrottleManager) SetLimit(bucketName string, l Limit) error {
+	b, ok := m.Bucket(bucketName)
+	if !ok {
+		return ErrUnknownBucket
+	}
+
+	b.SetLimit(l)
+	return nil
+}
+
+// Reset empties a client's bucket in the named bucket, as Bucket.Reset
+func (m *ThrottleManager) Reset(ctx context.Context, bucketName string, keyID string) error {
+	b, ok := m.Bucket(bucketName)
+	if !ok {
+		return ErrUnknownBucket
+	}
+
+	return b.Reset(ctx, keyID)
+}
+
+// Drain fills a client's bucket in the named bucket, as Bucket.Drain
+func (m *ThrottleManager) Drain(ctx context.Context, bucketName string, keyID string) error {
+	b, ok := m.Bucket(bucketName)
+	if !ok {
+		return ErrUnknownBucket
+	}
+
+	return b.Drain(ctx, keyID)
+}
+
+// register records a bucket created by the manager, replacing any other with the same name
+func (m *ThrottleManager) register(b *Bucket) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.buckets[b.bucketName] = b
+}
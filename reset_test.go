@@ -0,0 +1,73 @@
+package leaky
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestResetAndDrain(t *testing.T) {
+	tj := prepareTestJig()
+	defer tj.Close()
+
+	bucket := tj.ThrottleManager.ThrottlingHandler(handleFuncSuccessResponse, 2, 0, keyFunc, "test")
+
+	if err := tj.ThrottleManager.Drain(ctx, "test", "test-key"); err != nil {
+		t.Fatal(err)
+	}
+	if bucket.Add(1, "test-key") {
+		t.Error("Drop admitted into a drained bucket")
+	}
+
+	if err := bucket.Reset(ctx, "test-key"); err != nil {
+		t.Fatal(err)
+	}
+	if !bucket.Add(2, "test-key") {
+		t.Error("Drops rejected from a reset bucket")
+	}
+
+	if err := tj.ThrottleManager.Reset(ctx, "missing", "test-key"); !errors.Is(err, ErrUnknownBucket) {
+		t.Errorf("Reset of an unknown bucket returned %v", err)
+	}
+}
+
+func TestResetKeyLimits(t *testing.T) {
+	tj := prepareTestJig()
+	defer tj.Close()
+
+	for _, migration := range []MigrationPolicy{MigrateProportional, MigrateClamp} {
+		bucket := tj.ThrottleManager.ThrottlingHandler(handleFuncSuccessResponse, 2, 0, keyFunc, "test",
+			WithKeyLimits(0), WithMigration(migration))
+
+		if err := bucket.SetKeyLimits(ctx, "premium", KeyLimits{Size: 10}, time.Hour); err != nil {
+			t.Fatal(err)
+		}
+		bucket.Add(10, "premium")
+
+		// Through the manager, as the admin API resets clients
+		if err := tj.ThrottleManager.Reset(ctx, "test", "premium"); err != nil {
+			t.Fatal(err)
+		}
+		if remaining, _ := bucket.Remaining(ctx, "premium"); remaining != 10 {
+			t.Errorf("Migration %v: reset client has %d drops of space, expected their own size of 10", migration, remaining)
+		}
+
+		if err := bucket.Drain(ctx, "premium"); err != nil {
+			t.Fatal(err)
+		}
+		if remaining, _ := bucket.Remaining(ctx, "premium"); remaining != 0 {
+			t.Errorf("Migration %v: drained client has %d drops of space", migration, remaining)
+		}
+	}
+}
+
+func TestResetStoreFailure(t *testing.T) {
+	tj := prepareTestJig()
+	tj.Close()
+
+	bucket := tj.ThrottleManager.ThrottlingHandler(handleFuncSuccessResponse, 2, 0, keyFunc, "test")
+
+	if err := bucket.Reset(ctx, "test-key"); err == nil {
+		t.Error("Reset reported success without a store")
+	}
+}
@@ -0,0 +1,45 @@
+package leaky
+
+import (
+	"context"
+	"time"
+)
+
+// RetryClassifier is implemented by stores which can tell the errors worth retrying, those where
+// the call wasn't carried out and may soon succeed, such as a replica refusing writes during a failover
+type RetryClassifier interface {
+	Retryable(err error) bool
+}
+
+// WithRetries retries store calls failing with errors the store classifies as retryable, up to retries
+// times, waiting backoff before the first retry and twice as long before each one after. Calls to stores
+// which don't implement RetryClassifier aren't retried.
+func WithRetries(retries int, backoff time.Duration) ManagerOption {
+	return func(m *ThrottleManager) {
+		m.retry = retryPolicy{retries: retries, backoff: backoff}
+	}
+}
+
+type retryPolicy struct {
+	retries int
+	backoff time.Duration
+}
+
+// do calls fn, then calls it again while it fails with an error classifier says is retryable,
+// counting every call as a round trip. It stops waiting to retry when ctx is done.
+func (p retryPolicy) do(ctx context.Context, classifier RetryClassifier, roundTrip func() error) error {
+	err := roundTrip()
+
+	for attempt := 0; err != nil && attempt < p.retries && classifier != nil && classifier.Retryable(err); attempt++ {
+		timer := time.NewTimer(p.backoff << attempt)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		}
+		err = roundTrip()
+	}
+
+	return err
+}
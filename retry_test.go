@@ -0,0 +1,121 @@
+package leaky
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+var errFailover = errors.New("failing over")
+
+// failoverStore fails its first reads with errFailover, the only error it retries.
+// It doesn't implement GetSetter so every fill reads with Get.
+type failoverStore struct {
+	memory   *MemoryStore
+	failures int
+}
+
+func (s *failoverStore) Get(ctx context.Context, key string) (State, bool, error) {
+	if s.failures > 0 {
+		s.failures--
+		return State{}, false, errFailover
+	}
+
+	return s.memory.Get(ctx, key)
+}
+
+func (s *failoverStore) Set(ctx context.Context, key string, state State, ttl time.Duration) error {
+	return s.memory.Set(ctx, key, state, ttl)
+}
+
+func (s *failoverStore) Retryable(err error) bool {
+	return err == errFailover
+}
+
+func newFailoverBucket(t *testing.T, failures int, opts ...ManagerOption) *Bucket {
+	memory := NewMemoryStore()
+	t.Cleanup(memory.Close)
+
+	tm := NewThrottleManagerWithStore(&failoverStore{memory: memory, failures: failures}, opts...)
+
+	return tm.ThrottlingHandler(handleFuncSuccessResponse, 1, 0, keyFunc, "test")
+}
+
+func TestRetriesRidesOutFailover(t *testing.T) {
+	bucket := newFailoverBucket(t, 2, WithRetries(2, time.Millisecond))
+
+	if !bucket.Add(1, "client") {
+		t.Fatal("Add rejected")
+	}
+	if bucket.Add(1, "client") {
+		t.Error("Add accepted over the limit after retries")
+	}
+
+	if stats := bucket.Stats(); stats.FailOpens != 0 || stats.RoundTrips != 5 {
+		t.Errorf("Stats %+v, expected no fail opens and 5 round trips", stats)
+	}
+}
+
+func TestRetriesBounded(t *testing.T) {
+	bucket := newFailoverBucket(t, 3, WithRetries(2, time.Millisecond))
+
+	bucket.Add(1, "client")
+
+	if stats := bucket.Stats(); stats.FailOpens != 1 || stats.RoundTrips != 4 {
+		t.Errorf("Stats %+v, expected 1 fail open and 4 round trips", stats)
+	}
+}
+
+func TestFailOpensCounted(t *testing.T) {
+	bucket := newFailoverBucket(t, 1)
+
+	bucket.Add(1, "client")
+
+	if stats := bucket.Stats(); stats.FailOpens != 1 || stats.RoundTrips != 2 {
+		t.Errorf("Stats %+v, expected 1 fail open and 2 round trips", stats)
+	}
+}
+
+func TestRedisStoreRetryable(t *testing.T) {
+	mr := miniredis.RunT(t)
+	store := NewRedisStore(redis.NewClient(&redis.Options{Addr: mr.Addr(), MaxRetries: -1}))
+
+	mr.SetError("READONLY You can't write against a read only replica.")
+	if _, _, err := store.GetSet(ctx, "key", State{}, time.Minute); !store.Retryable(err) {
+		t.Errorf("Error %q not retryable", err)
+	}
+
+	mr.SetError("ERR unknown command")
+	if _, _, err := store.Get(ctx, "key"); err == nil || store.Retryable(err) {
+		t.Errorf("Error %v retryable", err)
+	}
+
+	mr.SetError("")
+	mr.Close()
+	if _, _, err := store.Get(ctx, "key"); !store.Retryable(err) {
+		t.Errorf("Error %q not retryable", err)
+	}
+}
+
+func TestRetriesStopWhenCancelled(t *testing.T) {
+	bucket := newFailoverBucket(t, 10, WithRetries(5, time.Hour))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	bucket.AddContext(ctx, 1, "client")
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Waited %s to retry after the context was done", elapsed)
+	}
+
+	// The failed read isn't retried, the write of the failed open state is still made
+	if stats := bucket.Stats(); stats.FailOpens != 1 || stats.RoundTrips != 2 {
+		t.Errorf("Stats %+v, expected 1 fail open and 2 round trips", stats)
+	}
+}
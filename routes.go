@@ -0,0 +1,129 @@
+package leaky
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Route limits the requests whose path matches Pattern by its own bucket, of Size leaking Rate drops every
+// Per, a minute if not set. A pattern's segments match literally, except for "{name}", which matches any one
+// segment, and a final "{name...}", which matches the rest of the path, such as "/api/users/{id}" or
+// "/static/{file...}".
+type Route struct {
+	Pattern string
+	Size    int
+	Rate    int
+	Per     time.Duration
+	// Options configure this route's bucket, after those given for every route
+	Options []Option
+}
+
+// RoutedBucket limits each request by the bucket of the first route its path matches, so requests to
+// /api/users/1 and /api/users/2 share the bucket of "/api/users/{id}" while /api/search has its own
+type RoutedBucket struct {
+	routes  []routeBucket
+	handler Handler
+}
+
+// routeBucket is a route's parsed pattern and its bucket
+type routeBucket struct {
+	segments []string
+	// rest is set when the last segment matches the rest of the path
+	rest   bool
+	bucket *Bucket
+}
+
+// RouteHandler creates a new handler wrapper limiting requests by the route they match, in the order given,
+// so more specific patterns should come first. Requests matching no route aren't limited, a final route of
+// "/{path...}" limits the rest. Each route's bucket keys clients by keyFunc and is named after the bucket and
+// its pattern, such as "api::/api/users/{id}". It panics if a pattern has "{name...}" before its last segment.
+func (m *ThrottleManager) RouteHandler(handler Handler, routes []Route, keyFunc KeyFunc, bucketName string, opts ...Option) *RoutedBucket {
+	rb := &RoutedBucket{handler: handler}
+
+	for _, route := range routes {
+		segments := splitPath(route.Pattern)
+		rest := false
+		for i, segment := range segments {
+			if !isWildcard(segment) || !strings.HasSuffix(segment, "...}") {
+				continue
+			}
+			if i != len(segments)-1 {
+				panic("leaky: route pattern " + route.Pattern + " matches the rest of the path before its last segment")
+			}
+			segments, rest = segments[:i], true
+		}
+
+		lim := Tier{Size: route.Size, Rate: route.Rate, Per: route.Per}.limits()
+		routeOpts := append(append([]Option(nil), opts...), route.Options...)
+		bucket := m.newBucket(nil, lim, keyFunc, bucketName+"::"+route.Pattern, routeOpts)
+
+		rb.routes = append(rb.routes, routeBucket{segments: segments, rest: rest, bucket: bucket})
+	}
+
+	return rb
+}
+
+// Match returns the bucket of the first route the path matches, and false if it matches none
+func (rb *RoutedBucket) Match(path string) (*Bucket, bool) {
+	segments := splitPath(path)
+
+	for _, route := range rb.routes {
+		if route.matches(segments) {
+			return route.bucket, true
+		}
+	}
+
+	return nil, false
+}
+
+// ServeHTTP implements http.Handler
+func (rb *RoutedBucket) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rb.serve(w, r, rb.handler)
+}
+
+// Wrap returns next throttled by the routes' buckets in place of its own handler
+func (rb *RoutedBucket) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rb.serve(w, r, next.ServeHTTP)
+	})
+}
+
+func (rb *RoutedBucket) serve(w http.ResponseWriter, r *http.Request, handler Handler) {
+	bucket, ok := rb.Match(r.URL.Path)
+	if !ok {
+		handler(w, r)
+		return
+	}
+
+	bucket.serve(w, r, handler)
+}
+
+// matches reports whether the route's pattern matches a path split into segments
+func (route routeBucket) matches(segments []string) bool {
+	if len(segments) < len(route.segments) || !route.rest && len(segments) != len(route.segments) {
+		return false
+	}
+
+	for i, segment := range route.segments {
+		if isWildcard(segment) {
+			if segments[i] == "" {
+				return false
+			}
+		} else if segments[i] != segment {
+			return false
+		}
+	}
+
+	return true
+}
+
+// isWildcard reports whether a pattern's segment matches any segment
+func isWildcard(segment string) bool {
+	return len(segment) > 2 && segment[0] == '{' && segment[len(segment)-1] == '}'
+}
+
+// splitPath splits a path into its segments, without the leading slash
+func splitPath(path string) []string {
+	return strings.Split(strings.TrimPrefix(path, "/"), "/")
+}
@@ -0,0 +1,57 @@
+package leaky_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/2bytes/leaky"
+	"github.com/2bytes/leaky/leakytest"
+)
+
+func TestRouteHandler(t *testing.T) {
+	tm := leakytest.NewTestManager(t)
+	handler := tm.RouteHandler(handleFuncSuccessResponse, []leaky.Route{
+		{Pattern: "/api/users/{id}", Size: 1},
+		{Pattern: "/api/search", Size: 2},
+		{Pattern: "/static/{file...}", Size: 1},
+	}, keyFunc, "api")
+
+	for i, tc := range []struct {
+		path string
+		want int
+	}{
+		{"/api/users/1", http.StatusOK},
+		{"/api/users/2", http.StatusTooManyRequests},
+		{"/api/search", http.StatusOK},
+		{"/api/search", http.StatusOK},
+		{"/api/search", http.StatusTooManyRequests},
+		{"/api/users", http.StatusOK},
+		{"/api/users/1/posts", http.StatusOK},
+		{"/static/css/site.css", http.StatusOK},
+		{"/static/", http.StatusTooManyRequests},
+	} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", tc.path, nil))
+
+		if w.Code != tc.want {
+			t.Errorf("Request %d to %s: status %v, expected %v", i, tc.path, w.Code, tc.want)
+		}
+	}
+
+	named, _ := tm.Bucket("api::/api/users/{id}")
+	if b, ok := handler.Match("/api/users/3"); !ok || b != named {
+		t.Error("Route's bucket not found by its name")
+	}
+}
+
+func TestRouteHandlerInvalidPattern(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("Pattern matching the rest of the path before its end accepted")
+		}
+	}()
+
+	tm := leakytest.NewTestManager(t)
+	tm.RouteHandler(handleFuncSuccessResponse, []leaky.Route{{Pattern: "/{path...}/edit", Size: 1}}, keyFunc, "api")
+}
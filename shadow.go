@@ -0,0 +1,34 @@
+package leaky
+
+import "net/http"
+
+// WithShadowMode has the bucket account for every request as usual, reporting would-be rejections to its
+// OnDeny hook and metrics, but let them all through, so its limits can be tried out in production before
+// they are enforced. Their decisions are marked Shadowed, and no rate limit headers are sent.
+// Concurrency limits stacked on the bucket are still enforced.
+func WithShadowMode() Option {
+	return func(b *Bucket) {
+		b.shadow = true
+	}
+}
+
+// shadowed lets a request through if the bucket is in shadow mode, marking its decision if it would have
+// been rejected, and otherwise returns the decision as made
+func (b *Bucket) shadowed(d Decision, lim limits, taken int, ok bool) (Decision, limits, int, bool) {
+	if !b.shadow || ok {
+		return d, lim, taken, ok
+	}
+
+	d.Shadowed = true
+	return d, lim, 0, true
+}
+
+// shadowHeader is where the bucket sets its headers, discarded in shadow mode so clients don't see limits
+// which aren't enforced
+func (b *Bucket) shadowHeader(h http.Header) http.Header {
+	if b.shadow {
+		return http.Header{}
+	}
+
+	return h
+}
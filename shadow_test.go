@@ -0,0 +1,47 @@
+package leaky_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/2bytes/leaky"
+	"github.com/2bytes/leaky/leakytest"
+)
+
+func TestShadowMode(t *testing.T) {
+	tm := leakytest.NewTestManager(t)
+
+	denied := 0
+	var shadowed []bool
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		d, _ := leaky.DecisionFromContext(r.Context())
+		shadowed = append(shadowed, d.Shadowed)
+	}
+	bucket := tm.ThrottlingHandler(handler, 1, 0, keyFunc, "test", leaky.WithShadowMode(),
+		leaky.OnDeny(func(ctx context.Context, d leaky.Decision, cost int) { denied++ }))
+
+	for i := 0; i < 3; i++ {
+		w := httptest.NewRecorder()
+		bucket.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+
+		if w.Code != http.StatusOK {
+			t.Errorf("Request %d rejected in shadow mode: %v", i, w.Code)
+		}
+		if len(w.Header()) > 0 {
+			t.Errorf("Request %d given headers in shadow mode: %v", i, w.Header())
+		}
+	}
+
+	if len(shadowed) != 3 || shadowed[0] || !shadowed[1] || !shadowed[2] {
+		t.Errorf("Decisions shadowed %v, expected all but the first", shadowed)
+	}
+	if denied != 2 {
+		t.Errorf("Would-be rejections hooked %d times, expected 2", denied)
+	}
+
+	if d, ok := bucket.AdmitKey(context.Background(), http.Header{}, "test-key"); !ok || !d.Shadowed {
+		t.Errorf("Client over the limit not let through by AdmitKey: %+v", d)
+	}
+}
@@ -0,0 +1,120 @@
+package leaky
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+)
+
+// State is the stored state of a single client's bucket
+type State struct {
+	LastUpdate time.Time `json:"last_update"`
+	// SpaceRemaining keeps the fractions of a drop which have leaked, only whole drops are taken
+	SpaceRemaining float64 `json:"space_remaining"`
+	// Size is the size of the bucket the state was written by
+	Size int `json:"size,omitempty"`
+	// Fingerprint identifies the bucket config the state was written under
+	Fingerprint string `json:"fingerprint,omitempty"`
+	// Slots are the expiry times of the slots held in a ConcurrencyBucket, by slot ID
+	Slots map[string]time.Time `json:"slots,omitempty"`
+	// Log holds the times of the requests in a WindowBucket's window, for stores which can't count them
+	Log []time.Time `json:"log,omitempty"`
+	// Counts are a WindowBucket's counts of requests, for stores which can't count them
+	Counts *WindowCounts `json:"counts,omitempty"`
+	// TAT is when the bucket will have fully leaked, the only time stored by a bucket using GCRA
+	// in place of LastUpdate and SpaceRemaining
+	TAT time.Time `json:"tat,omitempty"`
+	// KeyLimits are the limits stored for a single client by SetKeyLimits, in place of their bucket state
+	KeyLimits *KeyLimits `json:"key_limits,omitempty"`
+	// Access is whether a single client is allowlisted or denylisted, stored by AllowKey or DenyKey
+	// in place of their bucket state
+	Access Access `json:"access,omitempty"`
+	// Penalty is a single client's record in a bucket's penalty box, in place of their bucket state
+	Penalty *Penalty `json:"penalty,omitempty"`
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler
+func (s State) MarshalBinary() ([]byte, error) {
+	return json.Marshal(s)
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler
+func (s *State) UnmarshalBinary(data []byte) error {
+	return json.Unmarshal(data, s)
+}
+
+// Store holds bucket state shared between instances of a service
+type Store interface {
+	// Get returns the state stored under key, and false if there is none
+	Get(ctx context.Context, key string) (State, bool, error)
+	// Set stores the state under key, expiring it after ttl
+	Set(ctx context.Context, key string, state State, ttl time.Duration) error
+}
+
+// GetSetter is implemented by stores which can return the stored state and replace it in a single round trip
+type GetSetter interface {
+	// GetSet stores the state under key, expiring it after ttl, and returns the state it replaced.
+	// If only the write failed the error is a *WriteError, and the previous state is still valid.
+	GetSet(ctx context.Context, key string, state State, ttl time.Duration) (State, bool, error)
+}
+
+// Taker is implemented by stores which can leak and take drops from a bucket's state themselves,
+// atomically in a single round trip, so no two requests can take the same space
+type Taker interface {
+	Take(ctx context.Context, req TakeRequest) (TakeResult, error)
+}
+
+// BatchTaker is implemented by Takers which can take from the states under several keys in a single round
+// trip, each atomically but independently of the others, such as for Bucket.AddMulti
+type BatchTaker interface {
+	TakeBatch(ctx context.Context, reqs []TakeRequest) ([]TakeResult, error)
+}
+
+// Transactor is implemented by stores which can read the states under several keys and replace them
+// atomically, so no other write lands between, such as for a ChainedBucket taking from all of its buckets or none
+type Transactor interface {
+	// Transact calls update with the states under keys, and whether each existed, then stores the states it
+	// returns under the same keys with their TTLs, or nothing if it returns nil. Update may be called again
+	// if the states changed before they could be replaced.
+	Transact(ctx context.Context, keys []string, update func(states []State, exists []bool) ([]State, []time.Duration)) error
+}
+
+// TakeRequest asks a Taker to take drops from the state under Key, leaking it first as of Now
+type TakeRequest struct {
+	Key string
+	Now time.Time
+	// Size and LeakRate, in drops per millisecond, are the limits of the bucket and Fingerprint
+	// identifies them; state written under another fingerprint is migrated by Migration first
+	Size        int
+	LeakRate    float64
+	Fingerprint string
+	Migration   MigrationPolicy
+	// Demands are taken in turn, each from the space the ones before it left
+	Demands []Demand
+	// MaxTTL is the longest the state may be kept in the store, it is kept until the bucket has fully leaked
+	// plus TTLMargin
+	MaxTTL    time.Duration
+	TTLMargin time.Duration
+	// GCRA stores the state as the time the bucket will have fully leaked, see WithGCRA
+	GCRA bool
+}
+
+// TakeResult is what a Taker took, and the state it left. Existed reports whether there was state before.
+type TakeResult struct {
+	Taken   []int
+	State   State
+	Existed bool
+}
+
+// WriteError is returned by GetSet when the previous state was read but the new state could not be written
+type WriteError struct {
+	Err error
+}
+
+func (e *WriteError) Error() string {
+	return "leaky: writing state failed: " + e.Err.Error()
+}
+
+func (e *WriteError) Unwrap() error {
+	return e.Err
+}
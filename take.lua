@@ -0,0 +1,204 @@
+-- Leaks and takes drops from the bucket state in the hash under KEYS[1], atomically.
+-- The same steps as Bucket.leak, Bucket.migrate and Demand.decide in Go.
+--
+-- ARGV: now seconds, now nanoseconds, now as RFC 3339, all empty to use the server's clock, size, leak rate per millisecond,
+-- fingerprint, migration policy, max TTL and TTL margin in milliseconds, 1 to store the state by GCRA as the time
+-- the bucket will have fully leaked, then a count, a mode and the space to keep for each demand, mode 0 to take
+-- all or none, 1 to take as many as fit and 2 to take them all, as a reservation
+-- Returns: 1 if there was state, the state left as JSON, then the number taken for each demand
+
+local now_s, now_ns, now_str = tonumber(ARGV[1]), tonumber(ARGV[2]), ARGV[3]
+local size, rate = tonumber(ARGV[4]), tonumber(ARGV[5])
+local fingerprint, policy, max_ttl, margin = ARGV[6], tonumber(ARGV[7]), tonumber(ARGV[8]), tonumber(ARGV[9])
+local gcra = ARGV[10] == '1' and rate > 0
+
+local PROPORTIONAL, RESET = 0, 1
+
+-- parse_time returns the seconds and nanoseconds since the epoch of an RFC 3339 time
+local function parse_time(s)
+	local y, mo, d, h, mi, sec, frac, zone =
+		string.match(s, '^(%d+)-(%d+)-(%d+)T(%d+):(%d+):(%d+)%.?(%d*)(.*)$')
+	if not y then
+		return nil
+	end
+
+	-- Days from the civil date, see http://howardhinnant.github.io/date_algorithms.html
+	y, mo, d = tonumber(y), tonumber(mo), tonumber(d)
+	if mo <= 2 then
+		y = y - 1
+	end
+	local era = math.floor(y / 400)
+	local yoe = y - era * 400
+	local doy = math.floor((153 * ((mo + 9) % 12) + 2) / 5) + d - 1
+	local doe = yoe * 365 + math.floor(yoe / 4) - math.floor(yoe / 100) + doy
+	local days = era * 146097 + doe - 719468
+
+	local secs = days * 86400 + tonumber(h) * 3600 + tonumber(mi) * 60 + tonumber(sec)
+	local nanos = 0
+	if frac ~= '' then
+		nanos = tonumber(string.sub(frac .. '000000000', 1, 9))
+	end
+
+	if zone ~= 'Z' then
+		local sign, zh, zm = string.match(zone, '^([+-])(%d+):(%d+)$')
+		if not sign then
+			return nil
+		end
+		local offset = tonumber(zh) * 3600 + tonumber(zm) * 60
+		if sign == '+' then
+			secs = secs - offset
+		else
+			secs = secs + offset
+		end
+	end
+
+	return secs, nanos
+end
+
+-- format_time returns the RFC 3339 time, in UTC, of seconds and nanoseconds since the epoch
+local function format_time(secs, nanos)
+	-- Civil date from days, see http://howardhinnant.github.io/date_algorithms.html
+	local days = math.floor(secs / 86400)
+	local rem = secs - days * 86400
+	local z = days + 719468
+	local era = math.floor(z / 146097)
+	local doe = z - era * 146097
+	local yoe = math.floor((doe - math.floor(doe / 1460) + math.floor(doe / 36524) - math.floor(doe / 146096)) / 365)
+	local doy = doe - (365 * yoe + math.floor(yoe / 4) - math.floor(yoe / 100))
+	local mp = math.floor((5 * doy + 2) / 153)
+	local d = doy - math.floor((153 * mp + 2) / 5) + 1
+	local m = mp + 3
+	if m > 12 then
+		m = m - 12
+	end
+	local y = yoe + era * 400
+	if m <= 2 then
+		y = y + 1
+	end
+
+	return string.format('%04d-%02d-%02dT%02d:%02d:%02d.%09dZ', y, m, d,
+		math.floor(rem / 3600), math.floor(rem % 3600 / 60), rem % 60, nanos)
+end
+
+if ARGV[1] == '' then
+	-- The server's clock, so instances with skewed clocks agree on how much has leaked
+	local time = redis.call('TIME')
+	now_s, now_ns = tonumber(time[1]), tonumber(time[2]) * 1000
+	now_str = format_time(now_s, now_ns)
+end
+
+local space = size
+local existed = 0
+local kind = redis.call('TYPE', KEYS[1]).ok
+-- Set when the stored hash can have its space updated in place, rather than being rewritten
+local stored_remaining = nil
+
+local state = nil
+if kind == 'hash' then
+	local fields = redis.call('HGETALL', KEYS[1])
+	state = {}
+	for i = 1, #fields, 2 do
+		state[fields[i]] = fields[i + 1]
+	end
+	if state.tat then
+		-- Stored by GCRA, the space is what has leaked of the time until the bucket is empty
+		local tat_s, tat_ns = parse_time(state.tat)
+		if not tat_s then
+			return redis.error_reply('leaky: unparseable tat ' .. tostring(state.tat))
+		end
+		local backlog = ((tat_s - now_s) * 1e9 + (tat_ns - now_ns)) / 1e6
+		state.space_remaining = size - math.max(0, backlog) * rate
+		state.last_update = now_str
+	else
+		state.space_remaining = tonumber(state.remaining)
+	end
+elseif kind == 'string' then
+	-- Written as JSON before state was stored in hashes
+	state = cjson.decode(redis.call('GET', KEYS[1]))
+end
+
+if state then
+	existed = 1
+	local remaining = state.space_remaining
+	local last_s, last_ns = parse_time(state.last_update)
+	if not last_s then
+		return redis.error_reply('leaky: unparseable last_update ' .. tostring(state.last_update))
+	end
+
+	if (state.fingerprint or '') ~= fingerprint then
+		local old_size = tonumber(state.size) or 0
+		if policy == RESET then
+			remaining, last_s, last_ns = size, now_s, now_ns
+		elseif policy == PROPORTIONAL and old_size > 0 then
+			remaining = remaining * size / old_size
+		else
+			remaining = math.min(remaining, size)
+		end
+	elseif kind == 'hash' and not state.tat then
+		stored_remaining = state.space_remaining
+	end
+
+	-- Whole milliseconds elapsed, truncated like a Go duration
+	local elapsed = ((now_s - last_s) * 1e9 + (now_ns - last_ns)) / 1e6
+	if elapsed >= 0 then
+		elapsed = math.floor(elapsed)
+	else
+		elapsed = math.ceil(elapsed)
+	end
+
+	-- Fractions of a drop are kept, only whole drops are taken
+	space = math.min(size, remaining + elapsed * rate)
+end
+
+local result = { existed, '' }
+local total = 0
+for i = 11, #ARGV, 3 do
+	local count, mode, keep = tonumber(ARGV[i]), ARGV[i + 1], tonumber(ARGV[i + 2])
+	local taken = 0
+	-- Whole drops there is space for, allowing for rounding error as leakEpsilon does
+	local whole = math.floor(space - keep + 1e-9)
+	if mode == '2' then
+		taken = count
+	elseif mode == '1' then
+		if whole >= 1 then
+			taken = math.min(count, whole)
+		end
+	elseif whole >= count then
+		taken = count
+	end
+
+	space = space - taken
+	total = total + taken
+	table.insert(result, taken)
+end
+
+result[2] = cjson.encode({
+	last_update = now_str,
+	space_remaining = space,
+	size = size,
+	fingerprint = fingerprint,
+})
+
+if total > 0 then
+	if gcra then
+		-- Nanoseconds from now until the bucket will have fully leaked, truncated like a Go duration
+		local tat_ns = now_ns + math.floor((size - space) / rate * 1e6)
+		local tat_s = now_s + math.floor(tat_ns / 1e9)
+		redis.call('DEL', KEYS[1])
+		redis.call('HSET', KEYS[1], 'fingerprint', fingerprint, 'tat', format_time(tat_s, tat_ns % 1e9))
+	elseif stored_remaining then
+		redis.call('HINCRBYFLOAT', KEYS[1], 'remaining', string.format('%.17g', space - stored_remaining))
+		redis.call('HSET', KEYS[1], 'last_update', now_str)
+	else
+		redis.call('DEL', KEYS[1])
+		redis.call('HSET', KEYS[1], 'remaining', string.format('%.17g', space), 'last_update', now_str, 'size', size, 'fingerprint', fingerprint)
+	end
+
+	local ttl = max_ttl
+	if rate > 0 then
+		ttl = math.max(1, math.min(max_ttl, math.ceil((size - space) / rate) + margin))
+	end
+	redis.call('PEXPIRE', KEYS[1], ttl)
+end
+
+return result
@@ -0,0 +1,596 @@
+package leaky_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"text/template"
+	"time"
+
+	"github.com/2bytes/leaky"
+	"github.com/2bytes/leaky/leakytest"
+)
+
+func handleFuncSuccessResponse(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+}
+
+func keyFunc(r http.Request) string {
+	return "test-key"
+}
+
+// onBothPaths runs test on a manager backed by a FakeStore, which buckets take from with GetSet, then on
+// one backed by a TakingFakeStore, which takes drops itself as RedisStore does
+func onBothPaths(t *testing.T, test func(t *testing.T, tm *leakytest.TestManager)) {
+	t.Run("getset", func(t *testing.T) { test(t, leakytest.NewTestManager(t)) })
+	t.Run("take", func(t *testing.T) { test(t, leakytest.NewTakingTestManager(t)) })
+}
+
+func TestThrottleOnOff(t *testing.T) {
+	onBothPaths(t, func(t *testing.T, tm *leakytest.TestManager) {
+		// With a leak rate of 600/min (10/s) we should be able to add another drop to the bucket after 100 milliseconds
+		handler := tm.ThrottlingHandler(handleFuncSuccessResponse, 1, 600, keyFunc, "test")
+		req, _ := http.NewRequest("GET", "", nil)
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Errorf("Status not OK: %v\n", w.Code)
+		}
+
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		if w.Code != http.StatusTooManyRequests {
+			t.Errorf("Status not TooManyRequests: %v\n", w.Code)
+		}
+
+		tm.Clock.Advance(time.Millisecond * 99)
+
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		if w.Code != http.StatusTooManyRequests {
+			t.Errorf("Status not TooManyRequests before the drop leaked: %v\n", w.Code)
+		}
+
+		tm.Clock.Advance(time.Millisecond)
+
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Errorf("Status not OK: %v\n", w.Code)
+		}
+	})
+}
+
+func TestStickyThrottle(t *testing.T) {
+	onBothPaths(t, func(t *testing.T, tm *leakytest.TestManager) {
+		// With a leak rate of 600/min (10/s) we should be able to add another drop to the bucket after 100 milliseconds
+		handler := tm.ThrottlingHandler(handleFuncSuccessResponse, 1, 600, keyFunc, "test")
+		req, _ := http.NewRequest("GET", "", nil)
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Errorf("Status not OK: %v\n", w.Code)
+		}
+
+		// If we add drops at a rate faster than the leak rate, we should be throttled until we slow down
+		// The bucket should allow exactly 10 of our drops through at this rate
+		var leakCount int
+
+		for i := 0; i <= 100; i++ {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			if w.Code != http.StatusTooManyRequests {
+				leakCount++
+			}
+
+			tm.Clock.Advance(time.Millisecond * 10)
+		}
+
+		if leakCount != 10 {
+			t.Errorf("Bucket leaked %d drops, expected 10", leakCount)
+		}
+	})
+}
+
+func TestStoreFailureFailsOpen(t *testing.T) {
+	onBothPaths(t, func(t *testing.T, tm *leakytest.TestManager) {
+		handler := tm.ThrottlingHandler(handleFuncSuccessResponse, 1, 0, keyFunc, "test")
+		req, _ := http.NewRequest("GET", "", nil)
+
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		tm.Store.FailNext(leakytest.ErrClosed)
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Errorf("Store failure was critical: %v\n", w.Code)
+		}
+
+		if !handler.Add(1, "other-key") || handler.Add(1, "other-key") {
+			t.Error("Bucket didn't recover after the store failure")
+		}
+	})
+}
+
+func TestAddUpToExactFit(t *testing.T) {
+	onBothPaths(t, func(t *testing.T, tm *leakytest.TestManager) {
+		bucket := tm.ThrottlingHandler(handleFuncSuccessResponse, 10, 60, keyFunc, "test")
+
+		accepted, retryAfter := bucket.AddUpTo(10, "test-key")
+		if accepted != 10 || retryAfter != 0 {
+			t.Errorf("Exact fit not accepted: %d, %s", accepted, retryAfter)
+		}
+	})
+}
+
+func TestAddUpToPartial(t *testing.T) {
+	onBothPaths(t, func(t *testing.T, tm *leakytest.TestManager) {
+		bucket := tm.ThrottlingHandler(handleFuncSuccessResponse, 10, 60, keyFunc, "test")
+
+		bucket.Add(7, "test-key")
+
+		// 3 fit now, the other 2 leak out at one a second
+		accepted, retryAfter := bucket.AddUpTo(5, "test-key")
+		if accepted != 3 || retryAfter != 2*time.Second {
+			t.Errorf("Partial fill: %d, %s", accepted, retryAfter)
+		}
+
+		tm.Clock.Advance(retryAfter)
+
+		if accepted, retryAfter := bucket.AddUpTo(2, "test-key"); accepted != 2 || retryAfter != 0 {
+			t.Errorf("Remainder didn't fit after waiting: %d, %s", accepted, retryAfter)
+		}
+	})
+}
+
+func TestAddUpToEmpty(t *testing.T) {
+	onBothPaths(t, func(t *testing.T, tm *leakytest.TestManager) {
+		bucket := tm.ThrottlingHandler(handleFuncSuccessResponse, 10, 60, keyFunc, "test")
+
+		bucket.Add(10, "test-key")
+
+		// Half a drop has leaked, which isn't enough for any of these
+		tm.Clock.Advance(500 * time.Millisecond)
+
+		accepted, retryAfter := bucket.AddUpTo(50, "test-key")
+		if accepted != 0 || retryAfter != leaky.InfDuration {
+			t.Errorf("Full bucket accepted drops: %d, %s", accepted, retryAfter)
+		}
+
+		// The half drop which has leaked is kept, so the next fits in another half second
+		accepted, retryAfter = bucket.AddUpTo(1, "test-key")
+		if accepted != 0 || retryAfter != 500*time.Millisecond {
+			t.Errorf("Full bucket accepted drops: %d, %s", accepted, retryAfter)
+		}
+	})
+}
+
+func TestAddUpToZeroSizeBucket(t *testing.T) {
+	onBothPaths(t, func(t *testing.T, tm *leakytest.TestManager) {
+		bucket := tm.ThrottlingHandler(handleFuncSuccessResponse, 0, 60, keyFunc, "test")
+
+		if accepted, retryAfter := bucket.AddUpTo(1, "test-key"); accepted != 0 || retryAfter != leaky.InfDuration {
+			t.Errorf("Zero size bucket accepted drops: %d, %s", accepted, retryAfter)
+		}
+	})
+}
+
+func TestLimitHandlerBurst(t *testing.T) {
+	onBothPaths(t, func(t *testing.T, tm *leakytest.TestManager) {
+		bucket := tm.LimitHandler(handleFuncSuccessResponse, leaky.Limit{Rate: 60, Burst: 5}, keyFunc, "test")
+
+		// An idle client can burst, then is held to a drop a second
+		if !bucket.Add(5, "test-key") {
+			t.Fatal("Burst rejected")
+		}
+		if bucket.Add(1, "test-key") {
+			t.Error("Drop admitted over the burst")
+		}
+
+		for i := 0; i < 10; i++ {
+			tm.Clock.Advance(time.Second)
+			if !bucket.Add(1, "test-key") {
+				t.Fatalf("Drop %d rejected at the sustained rate", i)
+			}
+			if bucket.Add(1, "test-key") {
+				t.Fatalf("Drop %d admitted over the sustained rate", i)
+			}
+		}
+	})
+}
+
+func TestLimitHandlerDefaultBurst(t *testing.T) {
+	onBothPaths(t, func(t *testing.T, tm *leakytest.TestManager) {
+		bucket := tm.LimitHandler(handleFuncSuccessResponse, leaky.Limit{Rate: 2.5, Per: time.Hour}, keyFunc, "test")
+
+		if accepted, _ := bucket.AddUpTo(10, "test-key"); accepted != 3 {
+			t.Errorf("Burst of %d, expected the rate rounded up to 3", accepted)
+		}
+	})
+}
+
+func TestRetryAfter(t *testing.T) {
+	onBothPaths(t, func(t *testing.T, tm *leakytest.TestManager) {
+		// A drop leaks every 30 seconds
+		handler := tm.ThrottlingHandler(handleFuncSuccessResponse, 1, 2, keyFunc, "test")
+		req, _ := http.NewRequest("GET", "", nil)
+
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if ra := w.Header().Get("Retry-After"); ra != "30" {
+			t.Errorf("Retry-After %q, expected 30", ra)
+		}
+
+		// Rounded up, so the client doesn't retry before the drop has leaked
+		tm.Clock.Advance(29500 * time.Millisecond)
+
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if ra := w.Header().Get("Retry-After"); ra != "1" {
+			t.Errorf("Retry-After %q, expected 1", ra)
+		}
+
+		// A bucket which never leaks can't say when to retry
+		never := tm.ThrottlingHandler(handleFuncSuccessResponse, 1, 0, keyFunc, "never")
+		never.ServeHTTP(httptest.NewRecorder(), req)
+
+		w = httptest.NewRecorder()
+		never.ServeHTTP(w, req)
+		if w.Code != http.StatusTooManyRequests {
+			t.Errorf("Status not TooManyRequests: %v\n", w.Code)
+		}
+		if ra := w.Header().Get("Retry-After"); ra != "" {
+			t.Errorf("Retry-After %q from a bucket which never leaks", ra)
+		}
+	})
+}
+
+func TestRateLimitHeaders(t *testing.T) {
+	onBothPaths(t, func(t *testing.T, tm *leakytest.TestManager) {
+		// A drop leaks every second
+		handler := tm.ThrottlingHandler(handleFuncSuccessResponse, 5, 60, keyFunc, "test")
+		req, _ := http.NewRequest("GET", "", nil)
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		expectHeaders(t, w, "5", "4", "1")
+
+		for i := 0; i < 4; i++ {
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+		}
+
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != http.StatusTooManyRequests {
+			t.Errorf("Status not TooManyRequests: %v\n", w.Code)
+		}
+		expectHeaders(t, w, "5", "0", "5")
+
+		off := tm.ThrottlingHandler(handleFuncSuccessResponse, 5, 60, keyFunc, "off", leaky.WithHeaderScheme(leaky.NoRateLimitHeaders))
+
+		w = httptest.NewRecorder()
+		off.ServeHTTP(w, req)
+		expectHeaders(t, w, "", "", "")
+	})
+}
+
+func expectHeaders(t *testing.T, w *httptest.ResponseRecorder, limit, remaining, reset string) {
+	t.Helper()
+
+	h := w.Header()
+	if h.Get("X-RateLimit-Limit") != limit || h.Get("X-RateLimit-Remaining") != remaining || h.Get("X-RateLimit-Reset") != reset {
+		t.Errorf("Headers limit %q, remaining %q, reset %q, expected %q, %q, %q", h.Get("X-RateLimit-Limit"),
+			h.Get("X-RateLimit-Remaining"), h.Get("X-RateLimit-Reset"), limit, remaining, reset)
+	}
+}
+
+func TestIETFRateLimitHeaders(t *testing.T) {
+	onBothPaths(t, func(t *testing.T, tm *leakytest.TestManager) {
+		// A full bucket leaks in 10 seconds
+		handler := tm.ThrottlingHandler(handleFuncSuccessResponse, 10, 60, keyFunc, "api", leaky.WithHeaderScheme(leaky.IETFRateLimitHeaders))
+		req, _ := http.NewRequest("GET", "", nil)
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		handler.ServeHTTP(w, req)
+
+		if policy := w.Header().Get("RateLimit-Policy"); policy != `"api";q=10;w=10` {
+			t.Errorf("RateLimit-Policy %q", policy)
+		}
+		if limit := w.Header().Get("RateLimit"); limit != `"api";r=8;t=2` {
+			t.Errorf("RateLimit %q", limit)
+		}
+		if w.Header().Get("X-RateLimit-Limit") != "" {
+			t.Error("X-RateLimit headers sent as well")
+		}
+	})
+}
+
+func TestRejection(t *testing.T) {
+	onBothPaths(t, func(t *testing.T, tm *leakytest.TestManager) {
+		handler := tm.ThrottlingHandler(handleFuncSuccessResponse, 1, 60, keyFunc, "test", leaky.WithRejection(leaky.Rejection{
+			Status:      http.StatusServiceUnavailable,
+			Body:        `{"error":"throttled"}`,
+			ContentType: "application/json",
+		}))
+		req, _ := http.NewRequest("GET", "", nil)
+
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		if w.Code != http.StatusServiceUnavailable {
+			t.Errorf("Status not ServiceUnavailable: %v\n", w.Code)
+		}
+		if body := w.Body.String(); body != `{"error":"throttled"}` {
+			t.Errorf("Unexpected body %q", body)
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("Unexpected content type %q", ct)
+		}
+		if w.Header().Get("Retry-After") != "1" {
+			t.Error("Retry-After not sent with the rejection")
+		}
+
+		// Fields not set keep their defaults
+		status := tm.ThrottlingHandler(handleFuncSuccessResponse, 1, 60, keyFunc, "status", leaky.WithRejection(leaky.Rejection{
+			Status: http.StatusServiceUnavailable,
+		}))
+		status.ServeHTTP(httptest.NewRecorder(), req)
+
+		w = httptest.NewRecorder()
+		status.ServeHTTP(w, req)
+
+		if w.Code != http.StatusServiceUnavailable || w.Body.String() != "Rate Limit Exceeded\n" {
+			t.Errorf("Unexpected rejection %v %q", w.Code, w.Body.String())
+		}
+	})
+}
+
+func TestNegotiatedRejection(t *testing.T) {
+	onBothPaths(t, func(t *testing.T, tm *leakytest.TestManager) {
+		handler := tm.ThrottlingHandler(handleFuncSuccessResponse, 1, 60, keyFunc, "test")
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+		cases := []struct {
+			accept      string
+			contentType string
+			body        string
+		}{
+			{"", "text/plain; charset=utf-8", "Rate Limit Exceeded\n"},
+			{"*/*", "text/plain; charset=utf-8", "Rate Limit Exceeded\n"},
+			{"application/json", "application/json", `{"error":"rate limit exceeded","retry_after":1}` + "\n"},
+			{"application/json;q=0.5, text/html", "text/html; charset=utf-8", "<h1>Rate Limit Exceeded</h1>"},
+			{"text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", "text/html; charset=utf-8", "<h1>Rate Limit Exceeded</h1>"},
+			{"application/*, */*;q=0.1", "application/json", `"retry_after":1`},
+			{"image/png", "text/plain; charset=utf-8", "Rate Limit Exceeded\n"},
+		}
+
+		for _, c := range cases {
+			req := httptest.NewRequest("GET", "/", nil)
+			if c.accept != "" {
+				req.Header.Set("Accept", c.accept)
+			}
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			if ct := w.Header().Get("Content-Type"); ct != c.contentType {
+				t.Errorf("Accepting %q, content type %q, expected %q", c.accept, ct, c.contentType)
+			}
+			if !strings.Contains(w.Body.String(), c.body) {
+				t.Errorf("Accepting %q, body %q, expected %q", c.accept, w.Body.String(), c.body)
+			}
+		}
+	})
+}
+
+func TestRejectionTemplates(t *testing.T) {
+	onBothPaths(t, func(t *testing.T, tm *leakytest.TestManager) {
+		handler := tm.ThrottlingHandler(handleFuncSuccessResponse, 1, 60, keyFunc, "search", leaky.WithRejection(leaky.Rejection{
+			Templates: leaky.RejectionTemplates{
+				JSON: template.Must(template.New("json").Parse(`{"bucket":"{{.Bucket}}","status":{{.Status}}}`)),
+			},
+		}))
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Accept", "application/json")
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if body := w.Body.String(); body != `{"bucket":"search","status":429}` {
+			t.Errorf("Unexpected body %q", body)
+		}
+
+		// Templates not set are the defaults
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		if body := w.Body.String(); body != "Rate Limit Exceeded\n" {
+			t.Errorf("Unexpected body %q", body)
+		}
+	})
+}
+
+func TestThrottleWrapsHandler(t *testing.T) {
+	onBothPaths(t, func(t *testing.T, tm *leakytest.TestManager) {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/", handleFuncSuccessResponse)
+
+		handler := tm.Throttle(mux, 1, 60, keyFunc, "test")
+		req, _ := http.NewRequest("GET", "/", nil)
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Errorf("Status not OK: %v\n", w.Code)
+		}
+
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != http.StatusTooManyRequests {
+			t.Errorf("Status not TooManyRequests: %v\n", w.Code)
+		}
+	})
+}
+
+func TestMiddleware(t *testing.T) {
+	onBothPaths(t, func(t *testing.T, tm *leakytest.TestManager) {
+		throttle := tm.Middleware(2, 60, keyFunc, "test")
+		a := throttle(http.HandlerFunc(handleFuncSuccessResponse))
+		b := throttle(http.HandlerFunc(handleFuncSuccessResponse))
+		req, _ := http.NewRequest("GET", "/", nil)
+
+		// The handlers wrapped share the bucket
+		for i, h := range []http.Handler{a, b, a} {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			expected := http.StatusOK
+			if i == 2 {
+				expected = http.StatusTooManyRequests
+			}
+			if w.Code != expected {
+				t.Errorf("Request %d status %v, expected %v", i, w.Code, expected)
+			}
+		}
+
+		if _, ok := tm.Bucket("test"); !ok {
+			t.Error("Middleware's bucket not found by name")
+		}
+	})
+}
+
+func TestAdmit(t *testing.T) {
+	onBothPaths(t, func(t *testing.T, tm *leakytest.TestManager) {
+		bucket := tm.ThrottlingHandler(nil, 1, 60, keyFunc, "test")
+		req, _ := http.NewRequest("GET", "/", nil)
+
+		h := http.Header{}
+		if d, ok := bucket.Admit(h, req); !ok || d.KeyID != "test-key" || d.Remaining != 0 {
+			t.Errorf("Request not admitted as expected: %t %+v", ok, d)
+		}
+
+		h = http.Header{}
+		d, ok := bucket.Admit(h, req)
+		if ok {
+			t.Error("Request admitted over the limit")
+		}
+		if d.RetryAfter != time.Second || h.Get("Retry-After") != "1" {
+			t.Errorf("Rejection retrying after %s, header %q", d.RetryAfter, h.Get("Retry-After"))
+		}
+	})
+}
+
+func TestAdmitKey(t *testing.T) {
+	onBothPaths(t, func(t *testing.T, tm *leakytest.TestManager) {
+		bucket := tm.ThrottlingHandler(nil, 1, 60, nil, "test")
+
+		if d, ok := bucket.AdmitKey(context.Background(), http.Header{}, "alice"); !ok || d.KeyID != "alice" {
+			t.Errorf("Request not admitted as expected: %t %+v", ok, d)
+		}
+		if _, ok := bucket.AdmitKey(context.Background(), http.Header{}, "alice"); ok {
+			t.Error("Request admitted over the limit")
+		}
+
+		// Overrides in the context apply
+		ctx := leaky.WithKeyOverride(context.Background(), "bob")
+		if d, ok := bucket.AdmitKey(ctx, http.Header{}, "alice"); !ok || d.KeyID != "bob" {
+			t.Errorf("Key override not applied: %t %+v", ok, d)
+		}
+	})
+}
+
+func TestLimitByIP(t *testing.T) {
+	onBothPaths(t, func(t *testing.T, tm *leakytest.TestManager) {
+		handler := tm.LimitByIP(2, time.Minute)(http.HandlerFunc(handleFuncSuccessResponse))
+
+		for i, addr := range []string{"10.0.0.1:1234", "10.0.0.1:5678", "10.0.0.1:1234", "10.0.0.2:1234"} {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = addr
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			expected := http.StatusOK
+			if i == 2 {
+				expected = http.StatusTooManyRequests
+			}
+			if w.Code != expected {
+				t.Errorf("Request %d from %s status %v, expected %v", i, addr, w.Code, expected)
+			}
+		}
+
+		// A request leaks from the client's bucket every 30 seconds
+		tm.Clock.Advance(30 * time.Second)
+
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Errorf("Status not OK once a request had leaked: %v", w.Code)
+		}
+	})
+}
+
+func TestLimitKeyFuncs(t *testing.T) {
+	onBothPaths(t, func(t *testing.T, tm *leakytest.TestManager) {
+		throttle := tm.Limit(1, time.Minute, leaky.WithKeyFuncs(leaky.KeyByIP, leaky.KeyByPath), leaky.WithBucketName("per-endpoint"))
+		handler := throttle(http.HandlerFunc(handleFuncSuccessResponse))
+
+		for i, path := range []string{"/a", "/b", "/a"} {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+
+			expected := http.StatusOK
+			if i == 2 {
+				expected = http.StatusTooManyRequests
+			}
+			if w.Code != expected {
+				t.Errorf("Request %d to %s status %v, expected %v", i, path, w.Code, expected)
+			}
+		}
+
+		if _, ok := tm.Bucket("per-endpoint"); !ok {
+			t.Error("Bucket not found by the name it was given")
+		}
+	})
+}
+
+func TestDecide(t *testing.T) {
+	onBothPaths(t, func(t *testing.T, tm *leakytest.TestManager) {
+		// A drop leaks every second
+		bucket := tm.ThrottlingHandler(nil, 5, 60, nil, "test")
+
+		d, ok := bucket.Decide(context.Background(), 3, "test-key")
+		if !ok || d.Remaining != 2 || d.ResetAfter != 3*time.Second {
+			t.Errorf("Unexpected decision %t %+v", ok, d)
+		}
+
+		d, ok = bucket.Decide(context.Background(), 3, "test-key")
+		if ok || d.Remaining != 2 {
+			t.Errorf("Drops added over the limit %t %+v", ok, d)
+		}
+
+		never := tm.ThrottlingHandler(nil, 5, 0, nil, "never")
+		if d, _ := never.Decide(context.Background(), 1, "test-key"); d.ResetAfter != leaky.InfDuration {
+			t.Errorf("Bucket which never leaks resets after %s", d.ResetAfter)
+		}
+	})
+}
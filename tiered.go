@@ -0,0 +1,230 @@
+package leaky
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+)
+
+// Tier is one of the limits of a TieredBucket, Rate drops leak every Per from a bucket of Size,
+// Per is a minute if not set. Name identifies the tier in the rate limit headers, such as "burst" or
+// "daily", it is tier0, tier1 and so on if not set.
+type Tier struct {
+	Size int
+	Rate int
+	Per  time.Duration
+	Name string
+}
+
+// limits converts the tier to the limits of a bucket, keeping state for as long as the tier
+// takes to refill even when that's longer than buckets usually keep it
+func (t Tier) limits() limits {
+	per := t.Per
+	if per <= 0 {
+		per = time.Minute
+	}
+
+	lim := newLimits(t.Size, perDuration(float64(t.Rate), per))
+	if lim.leakRate > 0 {
+		refill := time.Duration(math.Ceil(float64(t.Size)/lim.leakRate)) * time.Millisecond
+		if refill > lim.maxTTL {
+			lim.maxTTL = refill
+		}
+	}
+
+	return lim
+}
+
+// TierRejection describes why a TieredBucket refused drops
+type TierRejection struct {
+	// Exceeded holds the indexes of the tiers without space for the drops
+	Exceeded []int
+	// RetryAfter is how long until every tier has space, InfDuration if one never will
+	RetryAfter time.Duration
+}
+
+// TieredBucket limits each client by several buckets at once, such as a burst per second and a total
+// per hour. Drops are only added when every tier has space for them, and are then added to every tier,
+// in a single atomic step if the store is a Transactor.
+type TieredBucket struct {
+	tiers []*Bucket
+	// names are the tiers' policy names in the rate limit headers
+	names      []string
+	bucketName string
+	handler    Handler
+	keyFunc    KeyFunc
+}
+
+// TieredHandler creates a new handler wrapper limiting clients by every one of the tiers, in the order given.
+// Each tier is stored under its own key. The options apply to the bucket of every tier, though coalescing,
+// key caps, concurrency limits and adapting have no effect on a TieredBucket, nor do limit overrides.
+func (m *ThrottleManager) TieredHandler(handler Handler, tiers []Tier, keyFunc KeyFunc, bucketName string, opts ...Option) *TieredBucket {
+	t := &TieredBucket{
+		bucketName: bucketName,
+		handler:    handler,
+		keyFunc:    keyFunc,
+	}
+
+	for i, tier := range tiers {
+		b := m.newBucket(nil, tier.limits(), nil, fmt.Sprintf("%s::tier%d", bucketName, i), opts)
+		t.tiers = append(t.tiers, b)
+
+		name := tier.Name
+		if name == "" {
+			name = fmt.Sprintf("tier%d", i)
+		}
+		t.names = append(t.names, bucketName+"::"+name)
+	}
+
+	return t
+}
+
+// Stats returns a snapshot of the bucket's counters, summed across its tiers. Tiers sharing a breaker
+// count its trips once, and the breaker reported is the least closed of them.
+func (t *TieredBucket) Stats() Stats {
+	stats := Stats{}
+	breakers := make(map[*breaker]bool, 1)
+	for _, b := range t.tiers {
+		s := b.Stats()
+		stats.RoundTrips += s.RoundTrips
+		stats.FailOpens += s.FailOpens
+		stats.ShortCircuits += s.ShortCircuits
+
+		if breakers[b.breaker] {
+			continue
+		}
+		breakers[b.breaker] = true
+		stats.BreakerTrips += s.BreakerTrips
+		if s.Breaker != BreakerClosed && stats.Breaker != BreakerOpen {
+			stats.Breaker = s.Breaker
+		}
+	}
+
+	return stats
+}
+
+// Add adds drops to every tier if they all have space, otherwise nothing is added
+// and the rejection describes which tiers were full
+func (t *TieredBucket) Add(count int, keyID string) (bool, TierRejection) {
+	return t.AddContext(context.Background(), count, keyID)
+}
+
+// AddContext is Add, making its calls to the store with ctx
+func (t *TieredBucket) AddContext(ctx context.Context, count int, keyID string) (bool, TierRejection) {
+	ok, rejection, _ := t.add(ctx, count, keyID)
+	return ok, rejection
+}
+
+// add is Add, also returning the state of each tier afterwards
+func (t *TieredBucket) add(ctx context.Context, count int, keyID string) (bool, TierRejection, []State) {
+	if len(t.tiers) == 0 {
+		return true, TierRejection{}, nil
+	}
+
+	links := make([]link, len(t.tiers))
+	for i, b := range t.tiers {
+		links[i] = link{bucket: b, lim: b.currentLimits(), keyID: keyID, cost: count}
+	}
+
+	ctx, decided := t.observe(ctx, keyID)
+	states, ok := takeAll(ctx, links)
+	decided(ok)
+
+	rejection := TierRejection{}
+	if ok {
+		return true, rejection, states
+	}
+
+	for i, l := range links {
+		if wait := l.lim.waitFor(count, states[i]); wait > 0 {
+			rejection.Exceeded = append(rejection.Exceeded, i)
+			if wait > rejection.RetryAfter {
+				rejection.RetryAfter = wait
+			}
+		}
+	}
+
+	return false, rejection, states
+}
+
+// setHeaders describes every tier of the client's bucket, left in states, in the rate limit headers
+func (t *TieredBucket) setHeaders(h http.Header, states []State) {
+	if len(t.tiers) == 0 {
+		return
+	}
+
+	policies := make([]policy, len(t.tiers))
+	for i, b := range t.tiers {
+		policies[i] = policy{name: t.names[i], lim: b.currentLimits(), state: states[i]}
+	}
+
+	setPolicyHeaders(h, t.tiers[0].headers, policies)
+}
+
+// logger is the logger of the bucket's tiers
+func (t *TieredBucket) logger() Logger {
+	if len(t.tiers) == 0 {
+		return discardLogger{}
+	}
+
+	return t.tiers[0].logger
+}
+
+// observe is storeClient.observe under the bucket's name rather than a tier's
+func (t *TieredBucket) observe(ctx context.Context, keyID string) (context.Context, func(allowed bool)) {
+	if len(t.tiers) == 0 {
+		return ctx, func(bool) {}
+	}
+
+	c := &t.tiers[0].storeClient
+	return observe(ctx, c.tracer, c.metrics, t.bucketName, keyID)
+}
+
+// decision describes a request allowed by the bucket, by the tier with the least space left
+func (t *TieredBucket) decision(keyID string, states []State) Decision {
+	d := Decision{Bucket: t.bucketName, KeyID: keyID}
+
+	for i, b := range t.tiers {
+		tier := newDecision(t.bucketName, keyID, b.currentLimits(), states[i])
+		if i == 0 || tier.Remaining < d.Remaining {
+			d.Remaining, d.Limit = tier.Remaining, tier.Limit
+		}
+		if tier.RetryAfter > d.RetryAfter {
+			d.RetryAfter = tier.RetryAfter
+		}
+	}
+
+	return d
+}
+
+// ServeHTTP implements http.Handler
+func (t *TieredBucket) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	keyID := ""
+	if o, ok := LimitOverrideFromContext(r.Context()); ok {
+		keyID = o.KeyID
+	}
+	if keyID == "" {
+		keyID = t.keyFunc(*r)
+	}
+
+	ok, rejection, states := t.add(r.Context(), 1, keyID)
+	t.setHeaders(w.Header(), states)
+	if ok {
+		t.handler(w, withDecision(r, t.decision(keyID, states)))
+		return
+	}
+
+	setRetryAfter(w.Header(), rejection.RetryAfter)
+	t.rejection().write(w, r, t.logger(), t.bucketName, rejection.RetryAfter)
+}
+
+// rejection is the response to requests the tiers reject, which the options set on every tier alike
+func (t *TieredBucket) rejection() Rejection {
+	if len(t.tiers) == 0 {
+		return Rejection{}
+	}
+
+	return t.tiers[0].rejection
+}
@@ -0,0 +1,176 @@
+package leaky_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/2bytes/leaky"
+	"github.com/2bytes/leaky/leakytest"
+)
+
+var burstAndHourly = []leaky.Tier{
+	{Size: 5, Rate: 5, Per: time.Second},
+	{Size: 20, Rate: 20, Per: time.Hour},
+}
+
+func TestTieredBurstStoppedByLongWindow(t *testing.T) {
+	tm := leakytest.NewTestManager(t)
+	bucket := tm.TieredHandler(handleFuncSuccessResponse, burstAndHourly, keyFunc, "test")
+
+	// Bursts of 5 a second fit the short window, but use up the long one after 4 seconds
+	for second := 0; second < 4; second++ {
+		for i := 0; i < 5; i++ {
+			if ok, rejection := bucket.Add(1, "client"); !ok {
+				t.Fatalf("Second %d, request %d rejected by tiers %v", second, i, rejection.Exceeded)
+			}
+		}
+
+		if ok, rejection := bucket.Add(1, "client"); ok {
+			t.Fatalf("Second %d: 6th request accepted", second)
+		} else if second < 3 && !reflect.DeepEqual(rejection.Exceeded, []int{0}) {
+			t.Errorf("Second %d: rejected by tiers %v, expected the short window", second, rejection.Exceeded)
+		}
+
+		tm.Clock.Advance(time.Second)
+	}
+
+	ok, rejection := bucket.Add(1, "client")
+	if ok {
+		t.Fatal("Request accepted after the long window was used up")
+	}
+
+	if !reflect.DeepEqual(rejection.Exceeded, []int{1}) {
+		t.Errorf("Rejected by tiers %v, expected the long window", rejection.Exceeded)
+	}
+
+	// 20 an hour is one every 3 minutes, less the 4 seconds leaked since the window started filling
+	if want := 3*time.Minute - 4*time.Second; rejection.RetryAfter != want {
+		t.Errorf("Retry after %v, expected %v", rejection.RetryAfter, want)
+	}
+}
+
+func TestTieredRejectionAddsToNoTier(t *testing.T) {
+	tm := leakytest.NewTestManager(t)
+	bucket := tm.TieredHandler(handleFuncSuccessResponse, burstAndHourly, keyFunc, "test")
+
+	bucket.Add(5, "client")
+	if ok, _ := bucket.Add(1, "client"); ok {
+		t.Fatal("Request accepted with the short window full")
+	}
+
+	long, _ := tm.Store.State("leaky::test::tier1::client")
+	if long.SpaceRemaining != 15 {
+		t.Errorf("Long window has %v space remaining, expected 15", long.SpaceRemaining)
+	}
+}
+
+func TestTieredRetryAfterIsLongest(t *testing.T) {
+	tm := leakytest.NewTestManager(t)
+	bucket := tm.TieredHandler(handleFuncSuccessResponse, []leaky.Tier{
+		{Size: 2, Rate: 2, Per: time.Second},
+		{Size: 2, Rate: 2, Per: time.Minute},
+	}, keyFunc, "test")
+
+	bucket.Add(2, "client")
+
+	ok, rejection := bucket.Add(1, "client")
+	if ok {
+		t.Fatal("Request accepted with both tiers full")
+	}
+
+	if !reflect.DeepEqual(rejection.Exceeded, []int{0, 1}) {
+		t.Errorf("Rejected by tiers %v, expected both", rejection.Exceeded)
+	}
+
+	if want := 30 * time.Second; rejection.RetryAfter != want {
+		t.Errorf("Retry after %v, expected %v", rejection.RetryAfter, want)
+	}
+}
+
+func TestTieredServeHTTP(t *testing.T) {
+	tm := leakytest.NewTestManager(t)
+	bucket := tm.TieredHandler(handleFuncSuccessResponse, []leaky.Tier{
+		{Size: 1, Rate: 1, Per: time.Second},
+		{Size: 2, Rate: 2, Per: time.Minute},
+	}, keyFunc, "test")
+
+	req, _ := http.NewRequest("GET", "", nil)
+
+	for i, want := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		w := httptest.NewRecorder()
+		bucket.ServeHTTP(w, req)
+
+		if w.Code != want {
+			t.Errorf("Request %d: status %v, expected %v", i, w.Code, want)
+		}
+	}
+
+	tm.Clock.Advance(time.Second)
+	bucket.ServeHTTP(httptest.NewRecorder(), req)
+
+	w := httptest.NewRecorder()
+	bucket.ServeHTTP(w, req)
+
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("Status %v, expected %v", w.Code, http.StatusTooManyRequests)
+	}
+
+	// A drop leaks from the minute tier every 30 seconds, one of which has passed
+	if retry := w.Header().Get("Retry-After"); retry != "29" {
+		t.Errorf("Retry-After %q, expected 29", retry)
+	}
+}
+
+func TestTieredHeaders(t *testing.T) {
+	tm := leakytest.NewTestManager(t)
+	tiers := []leaky.Tier{
+		{Size: 5, Rate: 5, Per: time.Second, Name: "burst"},
+		{Size: 20, Rate: 20, Per: time.Hour, Name: "hourly"},
+	}
+	req, _ := http.NewRequest("GET", "", nil)
+
+	w := httptest.NewRecorder()
+	tm.TieredHandler(handleFuncSuccessResponse, tiers, keyFunc, "ietf", leaky.WithHeaderScheme(leaky.IETFRateLimitHeaders)).ServeHTTP(w, req)
+
+	if policy := w.Header().Get("RateLimit-Policy"); policy != `"ietf::burst";q=5;w=1, "ietf::hourly";q=20;w=3600` {
+		t.Errorf("RateLimit-Policy %q", policy)
+	}
+	if limit := w.Header().Get("RateLimit"); limit != `"ietf::burst";r=4;t=1, "ietf::hourly";r=19;t=180` {
+		t.Errorf("RateLimit %q", limit)
+	}
+
+	// The X-RateLimit headers describe the tier closest to its limit, the hourly one once it has fewer left
+	tiers[1].Size, tiers[1].Rate = 6, 6
+	bucket := tm.TieredHandler(handleFuncSuccessResponse, tiers, keyFunc, "x")
+	for i, want := range []string{"5", "5", "6"} {
+		w := httptest.NewRecorder()
+		bucket.ServeHTTP(w, req)
+
+		if limit := w.Header().Get("X-RateLimit-Limit"); limit != want {
+			t.Errorf("Request %d: X-RateLimit-Limit %s, expected %s", i, limit, want)
+		}
+
+		tm.Clock.Advance(time.Second)
+	}
+}
+
+func TestTieredStats(t *testing.T) {
+	tm := leakytest.NewTestManager(t, leaky.WithBreaker(1, time.Hour))
+	bucket := tm.TieredHandler(handleFuncSuccessResponse, burstAndHourly, keyFunc, "test")
+
+	// Taking from both tiers together fails, opening the breaker they share, and fails open for each
+	tm.Store.FailAll(errors.New("store down"))
+	bucket.Add(1, "client")
+
+	stats := bucket.Stats()
+	if stats.FailOpens != 2 {
+		t.Errorf("%d fail-opens, expected one for each tier", stats.FailOpens)
+	}
+	if stats.Breaker != leaky.BreakerOpen || stats.BreakerTrips != 1 {
+		t.Errorf("Breaker %s after %d trips, expected the shared breaker open after one", stats.Breaker, stats.BreakerTrips)
+	}
+}
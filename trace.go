@@ -0,0 +1,98 @@
+package leaky
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Tracer traces the decisions of a manager's buckets, such as with spans in a distributed trace
+type Tracer interface {
+	// StartDecision is called as a bucket starts deciding a request by the client keyID, it returns the context
+	// the decision's calls to the store are made with and the func called with the decision once it's made
+	StartDecision(ctx context.Context, bucketName string, keyID string) (context.Context, func(DecisionTrace))
+}
+
+// DecisionTrace describes how a bucket decided a request
+type DecisionTrace struct {
+	Allowed bool
+	// RoundTrips is the number of calls made to the store, and StoreLatency how long they took altogether
+	RoundTrips   int
+	StoreLatency time.Duration
+	// Err is the error of the last round trip to fail, the request was decided by the failure policy
+	// if it was the last round trip made
+	Err error
+}
+
+// WithTracer traces the decisions of the manager's buckets with t
+func WithTracer(t Tracer) ManagerOption {
+	return func(m *ThrottleManager) {
+		m.tracer = t
+	}
+}
+
+// traceKey is the context key of the traceRecord of a decision being traced
+type traceKey struct{}
+
+// traceRecord adds up the round trips made deciding a request
+type traceRecord struct {
+	mu    sync.Mutex
+	trace DecisionTrace
+}
+
+func (t *traceRecord) roundTrip(latency time.Duration, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.trace.RoundTrips++
+	t.trace.StoreLatency += latency
+	if err != nil {
+		t.trace.Err = err
+	}
+}
+
+// shortCircuited records a call the circuit breaker cut short, which isn't a round trip
+func (t *traceRecord) shortCircuited() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.trace.Err = errBreakerOpen
+}
+
+func traceFromContext(ctx context.Context) *traceRecord {
+	t, _ := ctx.Value(traceKey{}).(*traceRecord)
+	return t
+}
+
+// observe starts tracing a decision about the client if the bucket has a tracer, returning the context
+// to decide it with and the func reporting the decision to the tracer and the metrics
+func (c *storeClient) observe(ctx context.Context, keyID string) (context.Context, func(allowed bool)) {
+	return observe(ctx, c.tracer, c.metrics, c.name, keyID)
+}
+
+func observe(ctx context.Context, tracer Tracer, metrics Metrics, bucketName string, keyID string) (context.Context, func(allowed bool)) {
+	if tracer == nil {
+		return ctx, func(allowed bool) {
+			if metrics != nil {
+				metrics.Decided(bucketName, allowed)
+			}
+		}
+	}
+
+	ctx, end := tracer.StartDecision(ctx, bucketName, keyID)
+	record := &traceRecord{}
+	ctx = context.WithValue(ctx, traceKey{}, record)
+
+	return ctx, func(allowed bool) {
+		if metrics != nil {
+			metrics.Decided(bucketName, allowed)
+		}
+
+		record.mu.Lock()
+		trace := record.trace
+		record.mu.Unlock()
+
+		trace.Allowed = allowed
+		end(trace)
+	}
+}
@@ -0,0 +1,75 @@
+package leaky
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+type parentKey struct{}
+
+type recordedTracer struct {
+	parents []interface{}
+	traces  []DecisionTrace
+}
+
+func (t *recordedTracer) StartDecision(ctx context.Context, bucketName string, keyID string) (context.Context, func(DecisionTrace)) {
+	t.parents = append(t.parents, ctx.Value(parentKey{}))
+	return ctx, func(trace DecisionTrace) {
+		t.traces = append(t.traces, trace)
+	}
+}
+
+func TestTracer(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mr.Close()
+
+	tracer := &recordedTracer{}
+	rc := redis.NewClient(&redis.Options{Addr: mr.Addr(), MaxRetries: -1})
+	tm := NewThrottleManager(rc, WithTracer(tracer))
+
+	handler := tm.ThrottlingHandler(handleFuncSuccessResponse, 1, 0, keyFunc, "test")
+	req, _ := http.NewRequest("GET", "", nil)
+	req = req.WithContext(context.WithValue(req.Context(), parentKey{}, "parent"))
+
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if len(tracer.traces) != 2 {
+		t.Fatalf("Traced %d decisions, expected 2", len(tracer.traces))
+	}
+	for _, parent := range tracer.parents {
+		if parent != "parent" {
+			t.Error("Decision not traced from the request's context")
+		}
+	}
+
+	if !tracer.traces[0].Allowed || tracer.traces[1].Allowed {
+		t.Errorf("Traced decisions wrong: %+v", tracer.traces)
+	}
+
+	roundTrips := 0
+	for _, trace := range tracer.traces {
+		roundTrips += trace.RoundTrips
+		if trace.Err != nil {
+			t.Errorf("Traced an error: %s", trace.Err)
+		}
+	}
+	if rt := handler.Stats().RoundTrips; uint64(roundTrips) != rt {
+		t.Errorf("Traced %d round trips, bucket made %d", roundTrips, rt)
+	}
+
+	mr.Close()
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if trace := tracer.traces[2]; !trace.Allowed || trace.Err == nil {
+		t.Errorf("Decision by the failure policy traced wrong: %+v", trace)
+	}
+}
@@ -0,0 +1,69 @@
+package leaky
+
+import (
+	"errors"
+	"net/http"
+	"time"
+)
+
+// Transport is an http.RoundTripper limiting outgoing requests by a bucket, so clients of third-party APIs keep
+// within their quotas. The bucket is created as usual with a nil handler, keying requests by its KeyFunc, such
+// as KeyByHost for a limit per API sent to. Its cost, method limits, overrides in the request's context and
+// hooks apply as they do to incoming requests.
+type Transport struct {
+	// Base sends the requests the bucket admits, http.DefaultTransport if nil
+	Base   http.RoundTripper
+	Bucket *Bucket
+	// Wait has requests which don't fit wait for space, as Bucket.WaitN does, rather than failing with a
+	// *LimitedError. Those which can't fit before their context's deadline fail straight away.
+	Wait bool
+}
+
+// LimitedError is returned by a Transport for a request its bucket rejected
+type LimitedError struct {
+	Decision Decision
+}
+
+func (e *LimitedError) Error() string {
+	if e.Decision.RetryAfter == InfDuration {
+		return "leaky: rate limited by bucket " + e.Decision.Bucket
+	}
+	return "leaky: rate limited by bucket " + e.Decision.Bucket + ", retry after " + e.Decision.RetryAfter.Round(time.Millisecond).String()
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *Transport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if err := t.limit(r); err != nil {
+		// RoundTrip must close the body, even when the request isn't sent
+		if r.Body != nil {
+			r.Body.Close()
+		}
+		return nil, err
+	}
+
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return base.RoundTrip(r)
+}
+
+// limit takes the request's drops from its bucket, waiting for space if the transport waits
+func (t *Transport) limit(r *http.Request) error {
+	if !t.Wait {
+		if d, ok := t.Bucket.Admit(http.Header{}, r); !ok {
+			return &LimitedError{Decision: d}
+		}
+		return nil
+	}
+
+	b := t.Bucket.forMethod(r)
+	lim, keyID, err := b.resolve(r)
+	if errors.Is(err, ErrSkip) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	return b.waitUnder(r.Context(), lim, keyID, b.cost(r))
+}
@@ -0,0 +1,83 @@
+package leaky
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// roundTripFunc is a func as an http.RoundTripper
+type roundTripFunc func(r *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+func TestTransport(t *testing.T) {
+	tj := prepareTestJig()
+	defer tj.Close()
+
+	sent := 0
+	base := roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		sent++
+		return httptest.NewRecorder().Result(), nil
+	})
+
+	bucket := tj.ThrottleManager.ThrottlingHandler(nil, 2, 0, KeyByHost, "outbound")
+	client := &http.Client{Transport: &Transport{Base: base, Bucket: bucket}}
+
+	for i, url := range []string{"http://a.example/", "http://a.example/x", "http://b.example/"} {
+		resp, err := client.Get(url)
+		if err != nil {
+			t.Fatalf("Request %d to %s failed: %v", i, url, err)
+		}
+		resp.Body.Close()
+	}
+
+	_, err := client.Get("http://a.example/")
+	var limited *LimitedError
+	if !errors.As(err, &limited) {
+		t.Fatalf("Request over the limit returned %v, expected a LimitedError", err)
+	}
+	if limited.Decision.Bucket != "outbound" || limited.Decision.KeyID != "a.example" {
+		t.Errorf("Rejection decided by %+v", limited.Decision)
+	}
+	if sent != 3 {
+		t.Errorf("Sent %d requests, expected 3", sent)
+	}
+}
+
+func TestTransportWait(t *testing.T) {
+	tj := prepareTestJig()
+	defer tj.Close()
+
+	base := roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		return httptest.NewRecorder().Result(), nil
+	})
+
+	// A drop leaks every 100ms
+	bucket := tj.ThrottleManager.ThrottlingHandler(nil, 1, 600, KeyByHost, "outbound")
+	transport := &Transport{Base: base, Bucket: bucket, Wait: true}
+
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		resp, err := transport.RoundTrip(httptest.NewRequest("GET", "http://a.example/", nil))
+		if err != nil {
+			t.Fatalf("Request %d failed: %v", i, err)
+		}
+		resp.Body.Close()
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("Second request sent after %v, expected it to wait for a drop to leak", elapsed)
+	}
+
+	short, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	r := httptest.NewRequest("GET", "http://a.example/", nil).WithContext(short)
+	if _, err := transport.RoundTrip(r); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Request which can't fit before its deadline returned %v", err)
+	}
+}
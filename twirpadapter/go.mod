@@ -0,0 +1,17 @@
+module github.com/2bytes/leaky/twirpadapter
+
+go 1.20
+
+require (
+	github.com/2bytes/leaky v0.1.1
+	github.com/twitchtv/twirp v8.1.3+incompatible
+)
+
+require (
+	github.com/cespare/xxhash/v2 v2.2.0 // indirect
+	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
+	github.com/pkg/errors v0.9.1 // indirect
+	github.com/redis/go-redis/v9 v9.0.2 // indirect
+)
+
+replace github.com/2bytes/leaky => ../
@@ -0,0 +1,65 @@
+// Package twirpadapter throttles Twirp services with leaky buckets, through server hooks
+//
+//	hooks := twirpadapter.ServerHooks(tm.ThrottlingHandler(nil, 10, 60, nil, "rpc"), callerFromContext)
+//	handler := haberdasher.NewHaberdasherServer(server, twirp.WithServerHooks(hooks))
+package twirpadapter
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/2bytes/leaky"
+	"github.com/twitchtv/twirp"
+)
+
+// CallerFunc identifies the caller of a method from the request context, such as by the account
+// authentication middleware put there
+type CallerFunc func(ctx context.Context) string
+
+// ServerHooks admits calls to the bucket once Twirp has routed them, keyed by the method and the caller, so
+// each caller has a bucket per method, or by the method alone if caller is nil. Calls rejected fail with ResourceExhausted, with the seconds to wait
+// in the retry_after metadata, and every call has the bucket's rate limit headers.
+func ServerHooks(b *leaky.Bucket, caller CallerFunc) *twirp.ServerHooks {
+	return &twirp.ServerHooks{
+		RequestRouted: func(ctx context.Context) (context.Context, error) {
+			h := http.Header{}
+			d, ok := b.AdmitKey(ctx, h, key(ctx, caller))
+			for name, values := range h {
+				for _, v := range values {
+					twirp.SetHTTPResponseHeader(ctx, name, v)
+				}
+			}
+
+			if !ok {
+				return ctx, exhausted(d)
+			}
+
+			return leaky.ContextWithDecision(ctx, d), nil
+		},
+	}
+}
+
+// key is the service and method called, which can't contain '|', then the caller
+func key(ctx context.Context, caller CallerFunc) string {
+	service, _ := twirp.ServiceName(ctx)
+	method, _ := twirp.MethodName(ctx)
+
+	if caller == nil {
+		return service + "/" + method
+	}
+
+	return service + "/" + method + "|" + caller(ctx)
+}
+
+// exhausted is the error for a call the decision rejected
+func exhausted(d leaky.Decision) twirp.Error {
+	err := twirp.NewError(twirp.ResourceExhausted, "rate limit exceeded")
+	if d.RetryAfter > 0 && d.RetryAfter != leaky.InfDuration {
+		seconds := (d.RetryAfter + time.Second - 1) / time.Second
+		err = err.WithMeta("retry_after", strconv.FormatInt(int64(seconds), 10))
+	}
+
+	return err
+}
@@ -0,0 +1,58 @@
+package twirpadapter
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/2bytes/leaky/leakytest"
+	"github.com/twitchtv/twirp"
+	"github.com/twitchtv/twirp/ctxsetters"
+)
+
+type callerKey struct{}
+
+func caller(ctx context.Context) string {
+	id, _ := ctx.Value(callerKey{}).(string)
+	return id
+}
+
+func routed(method string, id string) (context.Context, *httptest.ResponseRecorder) {
+	w := httptest.NewRecorder()
+	ctx := context.WithValue(context.Background(), callerKey{}, id)
+	ctx = ctxsetters.WithServiceName(ctx, "Haberdasher")
+	ctx = ctxsetters.WithMethodName(ctx, method)
+	ctx = ctxsetters.WithResponseWriter(ctx, w)
+	return ctx, w
+}
+
+func TestServerHooks(t *testing.T) {
+	tm := leakytest.NewTestManager(t)
+	hooks := ServerHooks(tm.ThrottlingHandler(nil, 1, 60, nil, "rpc"), caller)
+
+	ctx, w := routed("MakeHat", "alice")
+	if _, err := hooks.RequestRouted(ctx); err != nil {
+		t.Fatalf("Call rejected: %s", err)
+	}
+	if w.Header().Get("X-RateLimit-Remaining") != "0" {
+		t.Errorf("Rate limit headers not set: %v", w.Header())
+	}
+
+	ctx, _ = routed("MakeHat", "alice")
+	_, err := hooks.RequestRouted(ctx)
+	terr, ok := err.(twirp.Error)
+	if !ok || terr.Code() != twirp.ResourceExhausted {
+		t.Fatalf("Call over the limit not rejected: %v", err)
+	}
+	if terr.Meta("retry_after") != "1" {
+		t.Errorf("Retry metadata %q, expected 1", terr.Meta("retry_after"))
+	}
+
+	// Each caller has a bucket per method
+	for _, call := range [][2]string{{"MakeHat", "bob"}, {"ListHats", "alice"}} {
+		ctx, _ = routed(call[0], call[1])
+		if _, err := hooks.RequestRouted(ctx); err != nil {
+			t.Errorf("Call to %s by %s rejected: %s", call[0], call[1], err)
+		}
+	}
+}
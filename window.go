@@ -0,0 +1,356 @@
+package leaky
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// WindowStrategy decides how a WindowBucket counts a client's requests in its window
+type WindowStrategy int
+
+const (
+	// SlidingLog logs the time of every request, and counts exactly those in the window ending now.
+	// It stores an entry per request, so suits limits in the hundreds rather than millions.
+	SlidingLog WindowStrategy = iota
+	// SlidingCounter counts requests in fixed windows, and estimates those in the window ending now from
+	// the count of the current window and the part of the previous one it overlaps, assuming its requests
+	// were spread evenly. It stores two counts whatever the limit, but can be off by a share of the
+	// previous window's requests when they weren't spread evenly.
+	SlidingCounter
+	// FixedWindow counts requests in fixed windows starting at multiples of the window's length since the
+	// Unix epoch, such as each calendar minute or hour in UTC, and starts each window's count again from
+	// nothing. It stores a single count, but a client can make twice the limit across the end of a window.
+	FixedWindow
+)
+
+// WindowCounts are the requests a SlidingCounter or FixedWindow counted in the window numbered Window, counting windows
+// of its length since the Unix epoch, and in the window before it
+type WindowCounts struct {
+	Window   int64 `json:"window"`
+	Current  int   `json:"current"`
+	Previous int   `json:"previous"`
+}
+
+// WindowCounter is implemented by stores which can count a client's requests in a window and add to them,
+// atomically in a single round trip
+type WindowCounter interface {
+	CountWindow(ctx context.Context, req WindowRequest) (WindowResult, error)
+}
+
+// WindowRequest asks a WindowCounter to add Count requests to the window ending Now under Key,
+// if they fit within Limit
+type WindowRequest struct {
+	Key      string
+	Now      time.Time
+	Window   time.Duration
+	Limit    int
+	Count    int
+	Strategy WindowStrategy
+	// ID distinguishes requests logged at the same time by SlidingLog
+	ID string
+}
+
+// WindowResult is whether a WindowCounter added the requests and how many it counted in the window after.
+// RetryAfter is how long until another request fits, or until the requests would if they weren't added,
+// InfDuration if they never will.
+type WindowResult struct {
+	Allowed    bool
+	Counted    int
+	RetryAfter time.Duration
+}
+
+// WindowBucket limits each client to a number of requests within a window of time, counting them
+// rather than smoothing them out as a leaky bucket does
+type WindowBucket struct {
+	limit      int
+	window     time.Duration
+	strategy   WindowStrategy
+	bucketName string
+	handler    Handler
+	keyFunc    KeyFunc
+	rejection  Rejection
+
+	storeClient
+	counter WindowCounter
+}
+
+// WindowOption configures a WindowBucket
+type WindowOption func(*WindowBucket)
+
+// WithWindowStrategy sets how requests in the window are counted, the default is SlidingLog
+func WithWindowStrategy(strategy WindowStrategy) WindowOption {
+	return func(w *WindowBucket) {
+		w.strategy = strategy
+	}
+}
+
+// WindowHandler creates a new handler wrapper allowing each client limit requests in any window of time
+func (m *ThrottleManager) WindowHandler(handler Handler, limit int, window time.Duration, keyFunc KeyFunc, bucketName string, opts ...WindowOption) *WindowBucket {
+	w := &WindowBucket{
+		limit:       limit,
+		window:      window,
+		bucketName:  bucketName,
+		handler:     handler,
+		keyFunc:     keyFunc,
+		storeClient: m.storeClient(bucketName),
+		counter:     windowCounterOf(m.store),
+	}
+
+	for _, opt := range opts {
+		opt(w)
+	}
+
+	return w
+}
+
+// windowCounterOf returns the store as a WindowCounter, or nil if it isn't one or has scripting turned off
+func windowCounterOf(store Store) WindowCounter {
+	if s, ok := store.(*RedisStore); ok && !s.scripting {
+		return nil
+	}
+
+	counter, _ := store.(WindowCounter)
+	return counter
+}
+
+func (w *WindowBucket) getKey(keyID string) string {
+	return w.key(w.bucketName, keyID)
+}
+
+// Stats returns a snapshot of the bucket's counters
+func (w *WindowBucket) Stats() Stats {
+	return w.stats()
+}
+
+// Add adds count requests to the client's window if they fit, otherwise nothing is added and
+// the wait is how long until they would
+func (w *WindowBucket) Add(count int, keyID string) (ok bool, retryAfter time.Duration) {
+	return w.AddContext(context.Background(), count, keyID)
+}
+
+// AddContext is Add, making its calls to the store with ctx
+func (w *WindowBucket) AddContext(ctx context.Context, count int, keyID string) (ok bool, retryAfter time.Duration) {
+	result := w.count(ctx, count, keyID)
+	if result.Allowed {
+		return true, 0
+	}
+
+	return false, result.RetryAfter
+}
+
+// count adds the requests to the client's window, allowing them if the store fails
+func (w *WindowBucket) count(ctx context.Context, count int, keyID string) WindowResult {
+	ctx, decided := w.observe(ctx, keyID)
+
+	req := WindowRequest{
+		Key:      w.getKey(keyID),
+		Now:      w.clock.Now(),
+		Window:   w.window,
+		Limit:    w.limit,
+		Count:    count,
+		Strategy: w.strategy,
+		ID:       newSlotID(),
+	}
+
+	var result WindowResult
+	err := w.roundTrip(ctx, func() error {
+		var err error
+		if w.counter != nil {
+			result, err = w.counter.CountWindow(ctx, req)
+		} else {
+			result, err = w.countState(ctx, req)
+		}
+		return err
+	})
+
+	if err != nil {
+		w.logFailure(w.logger.Error, "Counting window failed, allowing request", req.Key, err)
+		w.failOpens.Add(1)
+		decided(true)
+		return WindowResult{Allowed: true, Counted: count}
+	}
+
+	decided(result.Allowed)
+	return result
+}
+
+// countState counts the window in the state of a store which can't count it itself, reading and writing
+// the state back rather than atomically. It is a single round trip for the breaker, as one request.
+func (w *WindowBucket) countState(ctx context.Context, req WindowRequest) (WindowResult, error) {
+	state, _, err := w.store.Get(ctx, req.Key)
+	if err != nil {
+		return WindowResult{}, err
+	}
+
+	var result WindowResult
+	var updated State
+	var ttl time.Duration
+	switch req.Strategy {
+	case SlidingCounter:
+		result, updated, ttl = countCounters(state, req)
+	case FixedWindow:
+		result, updated, ttl = countFixed(state, req)
+	default:
+		result, updated, ttl = countLog(state, req)
+	}
+
+	if result.Allowed && req.Count > 0 {
+		updated.LastUpdate = req.Now
+		if err := w.store.Set(ctx, req.Key, updated, ttl); err != nil {
+			return WindowResult{}, err
+		}
+	}
+
+	return result, nil
+}
+
+// countLog counts the requests logged in the window, adding them to the log if they fit
+func countLog(state State, req WindowRequest) (WindowResult, State, time.Duration) {
+	start := req.Now.Add(-req.Window)
+	entries := make([]time.Time, 0, len(state.Log)+req.Count)
+	for _, t := range state.Log {
+		if t.After(start) {
+			entries = append(entries, t)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Before(entries[j]) })
+
+	result := WindowResult{Counted: len(entries)}
+	need := req.Count
+	if len(entries)+req.Count <= req.Limit {
+		result.Allowed = true
+		for i := 0; i < req.Count; i++ {
+			entries = append(entries, req.Now)
+		}
+		result.Counted = len(entries)
+		need = 1
+	}
+
+	result.RetryAfter = logRetryAfter(entries, need, req)
+
+	return result, State{Log: entries}, req.Window
+}
+
+// logRetryAfter is how long until need more requests fit in a window holding the sorted entries,
+// which is when the entry making room for them leaves the window
+func logRetryAfter(entries []time.Time, need int, req WindowRequest) time.Duration {
+	if need > req.Limit {
+		return InfDuration
+	}
+
+	over := len(entries) + need - req.Limit
+	if over <= 0 {
+		return 0
+	}
+
+	return entries[over-1].Add(req.Window).Sub(req.Now)
+}
+
+// countCounters estimates the requests in the window from the counts of the current and previous windows,
+// adding them to the current window's count if they fit. Times are in whole microseconds, as they are in Redis.
+func countCounters(state State, req WindowRequest) (WindowResult, State, time.Duration) {
+	now, window := req.Now.UnixMicro(), req.Window.Microseconds()
+	counts := WindowCounts{Window: now / window}
+	elapsed := now - counts.Window*window
+
+	if c := state.Counts; c != nil {
+		switch c.Window {
+		case counts.Window:
+			counts.Current, counts.Previous = c.Current, c.Previous
+		case counts.Window - 1:
+			counts.Previous = c.Current
+		}
+	}
+
+	result := WindowResult{}
+	need := req.Count
+	if counts.estimate(elapsed, window)+float64(req.Count) <= float64(req.Limit)+leakEpsilon {
+		result.Allowed = true
+		counts.Current += req.Count
+		need = 1
+	}
+
+	result.Counted = int(math.Ceil(counts.estimate(elapsed, window) - leakEpsilon))
+	result.RetryAfter = counts.retryAfter(elapsed, window, need, req.Limit)
+
+	return result, State{Counts: &counts}, 2 * req.Window
+}
+
+// countFixed counts the requests in the current fixed window, adding them to its count if they fit.
+// Times are in whole microseconds, as they are in Redis.
+func countFixed(state State, req WindowRequest) (WindowResult, State, time.Duration) {
+	now, window := req.Now.UnixMicro(), req.Window.Microseconds()
+	counts := WindowCounts{Window: now / window}
+	ends := time.Duration((counts.Window+1)*window-now) * time.Microsecond
+
+	if c := state.Counts; c != nil && c.Window == counts.Window {
+		counts.Current = c.Current
+	}
+
+	result := WindowResult{}
+	need := req.Count
+	if counts.Current+req.Count <= req.Limit {
+		result.Allowed = true
+		counts.Current += req.Count
+		need = 1
+	}
+	result.Counted = counts.Current
+
+	if need > req.Limit {
+		result.RetryAfter = InfDuration
+	} else if counts.Current+need > req.Limit {
+		result.RetryAfter = ends
+	}
+
+	return result, State{Counts: &counts}, ends
+}
+
+// estimate is the number of requests in the window ending elapsed microseconds into the current window,
+// taking the part of the previous window's requests it overlaps
+func (c WindowCounts) estimate(elapsed int64, window int64) float64 {
+	return float64(c.Previous)*float64(window-elapsed)/float64(window) + float64(c.Current)
+}
+
+// retryAfter is how long until need more requests fit within limit, once enough of the previous window,
+// or the current one if it is already too full, has passed out of the window
+func (c WindowCounts) retryAfter(elapsed int64, window int64, need int, limit int) time.Duration {
+	if need > limit {
+		return InfDuration
+	}
+
+	room := float64(limit - need)
+	prev, cur, w, e := float64(c.Previous), float64(c.Current), float64(window), float64(elapsed)
+
+	if cur <= room {
+		if prev == 0 {
+			return 0
+		}
+		return time.Duration(math.Max(0, math.Ceil(w*(1-(room-cur)/prev)-e))) * time.Microsecond
+	}
+
+	// The current window becomes the previous one, which then has to pass out of the window far enough
+	return time.Duration(w-e+math.Ceil(w*(1-room/cur))) * time.Microsecond
+}
+
+// ServeHTTP implements http.Handler
+func (w *WindowBucket) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	keyID := w.keyFunc(*r)
+
+	result := w.count(r.Context(), 1, keyID)
+	if result.Allowed {
+		w.handler(rw, withDecision(r, Decision{
+			Bucket:     w.bucketName,
+			KeyID:      keyID,
+			Remaining:  int(math.Max(0, float64(w.limit-result.Counted))),
+			Limit:      w.limit,
+			RetryAfter: result.RetryAfter,
+		}))
+		return
+	}
+
+	setRetryAfter(rw.Header(), result.RetryAfter)
+	w.rejection.write(rw, r, w.logger, w.bucketName, result.RetryAfter)
+}
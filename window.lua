@@ -0,0 +1,136 @@
+-- Counts the requests in the window ending now under KEYS[1], and adds to them if they fit, atomically.
+-- The same steps as countLog, countCounters and countFixed in Go.
+--
+-- ARGV: now and the window in microseconds, the limit, the number of requests to add, the strategy,
+-- 0 for a sliding log, 1 for a sliding counter and 2 for a fixed window, and an ID unique to the call
+-- Returns: 1 if the requests were added, the number counted in the window after, then how long in microseconds
+-- until another request fits, or until the requests would if they weren't added, -1 if they never will
+
+local now, window, limit, count = tonumber(ARGV[1]), tonumber(ARGV[2]), tonumber(ARGV[3]), tonumber(ARGV[4])
+local strategy, id = ARGV[5], ARGV[6]
+
+local SLIDING_COUNTER, FIXED_WINDOW = '1', '2'
+
+-- Numbers are formatted in full, Lua would otherwise round them to 14 significant digits
+local function full(n)
+	return string.format('%.17g', n)
+end
+
+-- The fallback writes a hash when scripting is turned off, and the strategy may have changed
+local kind = redis.call('TYPE', KEYS[1]).ok
+local want = 'zset'
+if strategy == SLIDING_COUNTER then
+	want = 'hash'
+elseif strategy == FIXED_WINDOW then
+	want = 'string'
+end
+if kind ~= want and kind ~= 'none' then
+	redis.call('DEL', KEYS[1])
+end
+
+local allowed, counted, retry = 0, 0, 0
+
+if strategy == SLIDING_COUNTER then
+	local index = math.floor(now / window)
+	local elapsed = now - index * window
+	local stored = redis.call('HMGET', KEYS[1], 'window', 'current', 'previous')
+	local stored_index = tonumber(stored[1])
+
+	local current, previous = 0, 0
+	if stored_index == index then
+		current, previous = tonumber(stored[2]), tonumber(stored[3])
+	elseif stored_index == index - 1 then
+		previous = tonumber(stored[2])
+	end
+
+	local function estimate()
+		return previous * (window - elapsed) / window + current
+	end
+
+	local need = count
+	if estimate() + count <= limit + 1e-9 then
+		allowed = 1
+		need = 1
+		current = current + count
+
+		if count > 0 then
+			redis.call('DEL', KEYS[1])
+			redis.call('HSET', KEYS[1], 'window', full(index), 'current', current, 'previous', previous)
+			redis.call('PEXPIRE', KEYS[1], math.max(1, math.ceil(2 * window / 1000)))
+		end
+	end
+	counted = math.ceil(estimate() - 1e-9)
+
+	-- Until enough of the previous window, or of the current one if it is already too full, has passed
+	local room = limit - need
+	if need > limit then
+		retry = -1
+	elseif current <= room then
+		if previous > 0 then
+			retry = math.max(0, math.ceil(window * (1 - (room - current) / previous) - elapsed))
+		end
+	else
+		retry = window - elapsed + math.ceil(window * (1 - room / current))
+	end
+
+	return { allowed, counted, retry }
+end
+
+if strategy == FIXED_WINDOW then
+	-- The key is the window's own, its count expires as the window ends
+	local ends = (math.floor(now / window) + 1) * window
+	counted = tonumber(redis.call('GET', KEYS[1]) or 0)
+
+	local need = count
+	if counted + count <= limit then
+		allowed = 1
+		need = 1
+
+		if count > 0 then
+			counted = redis.call('INCRBY', KEYS[1], count)
+			if counted == count then
+				redis.call('PEXPIRE', KEYS[1], math.max(1, math.ceil((ends - now) / 1000)))
+			end
+		end
+	end
+
+	if need > limit then
+		retry = -1
+	elseif counted + need > limit then
+		retry = ends - now
+	end
+
+	return { allowed, counted, retry }
+end
+
+-- An entry is in the window until a whole window has passed since it was logged
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', full(now - window))
+counted = redis.call('ZCARD', KEYS[1])
+
+if counted + count <= limit then
+	allowed = 1
+	for i = 1, count do
+		redis.call('ZADD', KEYS[1], ARGV[1], id .. ':' .. i)
+	end
+	counted = counted + count
+
+	if count > 0 then
+		redis.call('PEXPIRE', KEYS[1], math.max(1, math.ceil(window / 1000)))
+	end
+end
+
+local need = 1
+if allowed == 0 then
+	need = count
+end
+
+if need > limit then
+	retry = -1
+elseif counted + need > limit then
+	-- The entry making room for them is the one which leaves the window last of those which must
+	local over = counted + need - limit - 1
+	local entry = redis.call('ZRANGE', KEYS[1], over, over, 'WITHSCORES')
+	retry = tonumber(entry[2]) + window - now
+end
+
+return { allowed, counted, retry }
@@ -0,0 +1,241 @@
+package leaky
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// windowStores are the ways a WindowBucket can count, by script and by reading and writing state
+func windowStores(t *testing.T, clock Clock) map[string]Store {
+	scripted := miniredis.RunT(t)
+	unscripted := miniredis.RunT(t)
+
+	memory := NewMemoryStore(WithMemoryClock(clock))
+	t.Cleanup(memory.Close)
+
+	return map[string]Store{
+		"script":   NewRedisStore(redis.NewClient(&redis.Options{Addr: scripted.Addr()})),
+		"pipeline": NewRedisStore(redis.NewClient(&redis.Options{Addr: unscripted.Addr()}), WithScripting(false)),
+		"memory":   memory,
+	}
+}
+
+func TestSlidingLog(t *testing.T) {
+	clock := &testClock{}
+
+	for name, store := range windowStores(t, clock) {
+		clock.now = time.Date(2023, 3, 1, 12, 0, 0, 0, time.UTC)
+		tm := NewThrottleManagerWithStore(store, WithClock(clock))
+		bucket := tm.WindowHandler(handleFuncSuccessResponse, 3, 10*time.Second, keyFunc, "test")
+
+		steps := []struct {
+			advance time.Duration
+			count   int
+			ok      bool
+			wait    time.Duration
+		}{
+			{0, 2, true, 0},
+			{4 * time.Second, 1, true, 0},
+			// The first two leave the window ten seconds after they were added
+			{time.Second, 1, false, 5 * time.Second},
+			{5*time.Second - time.Millisecond, 1, false, time.Millisecond},
+			{time.Millisecond, 2, true, 0},
+			{0, 1, false, 4 * time.Second},
+			{0, 4, false, InfDuration},
+		}
+
+		for i, step := range steps {
+			clock.now = clock.now.Add(step.advance)
+			if ok, wait := bucket.Add(step.count, "test-key"); ok != step.ok || wait != step.wait {
+				t.Errorf("%s, step %d: added %t waiting %s, expected %t waiting %s", name, i, ok, wait, step.ok, step.wait)
+			}
+		}
+
+		if fo := bucket.Stats().FailOpens; fo != 0 {
+			t.Errorf("%s: expected no fail-opens, got %d", name, fo)
+		}
+	}
+}
+
+func TestSlidingCounter(t *testing.T) {
+	clock := &testClock{}
+
+	for name, store := range windowStores(t, clock) {
+		clock.now = time.Date(2023, 3, 1, 12, 0, 0, 0, time.UTC)
+		tm := NewThrottleManagerWithStore(store, WithClock(clock))
+		bucket := tm.WindowHandler(handleFuncSuccessResponse, 10, 10*time.Second, keyFunc, "test", WithWindowStrategy(SlidingCounter))
+
+		steps := []struct {
+			advance time.Duration
+			count   int
+			ok      bool
+			wait    time.Duration
+		}{
+			{0, 10, true, 0},
+			// Until a tenth of the full window is out of the window, after the next one starts
+			{0, 1, false, 11 * time.Second},
+			{10 * time.Second, 1, false, time.Second},
+			// A tenth of the ten in the previous window is estimated to have left it
+			{time.Second, 1, true, 0},
+			{4 * time.Second, 4, true, 0},
+			{0, 1, false, time.Second},
+			{0, 11, false, InfDuration},
+			// Once two windows have passed nothing is counted
+			{15 * time.Second, 10, true, 0},
+		}
+
+		for i, step := range steps {
+			clock.now = clock.now.Add(step.advance)
+			if ok, wait := bucket.Add(step.count, "test-key"); ok != step.ok || wait != step.wait {
+				t.Errorf("%s, step %d: added %t waiting %s, expected %t waiting %s", name, i, ok, wait, step.ok, step.wait)
+			}
+		}
+
+		if fo := bucket.Stats().FailOpens; fo != 0 {
+			t.Errorf("%s: expected no fail-opens, got %d", name, fo)
+		}
+	}
+}
+
+func TestSlidingCounterStoresCounts(t *testing.T) {
+	tj := prepareTestJig()
+	defer tj.Close()
+
+	bucket := tj.ThrottleManager.WindowHandler(handleFuncSuccessResponse, 3, time.Minute, keyFunc, "test", WithWindowStrategy(SlidingCounter))
+	bucket.Add(2, "test-key")
+
+	if current := tj.miniRedis.HGet(testKey, "current"); current != "2" {
+		t.Errorf("Counted %q in the current window, expected 2", current)
+	}
+
+	if ttl := tj.miniRedis.TTL(testKey); ttl != 2*time.Minute {
+		t.Errorf("Counts expire in %s, expected two windows", ttl)
+	}
+}
+
+func TestFixedWindow(t *testing.T) {
+	clock := &testClock{}
+
+	for name, store := range windowStores(t, clock) {
+		clock.now = time.Date(2023, 3, 1, 12, 0, 40, 0, time.UTC)
+		tm := NewThrottleManagerWithStore(store, WithClock(clock))
+		bucket := tm.WindowHandler(handleFuncSuccessResponse, 3, time.Minute, keyFunc, "test", WithWindowStrategy(FixedWindow))
+
+		steps := []struct {
+			advance time.Duration
+			count   int
+			ok      bool
+			wait    time.Duration
+		}{
+			{0, 2, true, 0},
+			{0, 2, false, 20 * time.Second},
+			{0, 1, true, 0},
+			{20*time.Second - time.Millisecond, 1, false, time.Millisecond},
+			// The count starts again as the calendar minute does
+			{time.Millisecond, 3, true, 0},
+			{0, 4, false, InfDuration},
+		}
+
+		for i, step := range steps {
+			clock.now = clock.now.Add(step.advance)
+			if ok, wait := bucket.Add(step.count, "test-key"); ok != step.ok || wait != step.wait {
+				t.Errorf("%s, step %d: added %t waiting %s, expected %t waiting %s", name, i, ok, wait, step.ok, step.wait)
+			}
+		}
+
+		if fo := bucket.Stats().FailOpens; fo != 0 {
+			t.Errorf("%s: expected no fail-opens, got %d", name, fo)
+		}
+	}
+}
+
+func TestFixedWindowStoresCount(t *testing.T) {
+	mr := miniredis.RunT(t)
+	clock := &testClock{now: time.Date(2023, 3, 1, 12, 0, 45, 0, time.UTC)}
+	tm := NewThrottleManagerWithStore(NewRedisStore(redis.NewClient(&redis.Options{Addr: mr.Addr()})), WithClock(clock))
+
+	bucket := tm.WindowHandler(handleFuncSuccessResponse, 3, time.Minute, keyFunc, "test", WithWindowStrategy(FixedWindow))
+	bucket.Add(2, "test-key")
+	bucket.Add(1, "test-key")
+
+	// Counted under the key of the minute
+	key := fmt.Sprintf("%s:%d", testKey, clock.now.Unix()/60)
+	if count, err := mr.Get(key); err != nil || count != "3" {
+		t.Errorf("Counted %q, %v, expected 3", count, err)
+	}
+
+	if ttl := mr.TTL(key); ttl != 15*time.Second {
+		t.Errorf("Count expires in %s, expected the end of the minute", ttl)
+	}
+}
+
+func TestSlidingLogStoresSortedSet(t *testing.T) {
+	tj := prepareTestJig()
+	defer tj.Close()
+
+	bucket := tj.ThrottleManager.WindowHandler(handleFuncSuccessResponse, 3, time.Minute, keyFunc, "test")
+	bucket.Add(2, "test-key")
+
+	members, err := tj.miniRedis.ZMembers(testKey)
+	if err != nil || len(members) != 2 {
+		t.Errorf("Logged %v, %v, expected an entry per request", members, err)
+	}
+
+	if ttl := tj.miniRedis.TTL(testKey); ttl != time.Minute {
+		t.Errorf("Log expires in %s, expected a minute", ttl)
+	}
+}
+
+func TestSlidingLogFunctions(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rc := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	rc.AddHook(&functionsHook{})
+
+	tm := NewThrottleManagerWithStore(NewRedisStore(rc, WithFunctions()))
+	bucket := tm.WindowHandler(handleFuncSuccessResponse, 1, time.Minute, keyFunc, "test")
+
+	if ok, _ := bucket.Add(1, "test-key"); !ok {
+		t.Error("First request rejected")
+	}
+	if ok, _ := bucket.Add(1, "test-key"); ok {
+		t.Error("Second request admitted")
+	}
+	if fo := bucket.Stats().FailOpens; fo != 0 {
+		t.Errorf("Expected no fail-opens, got %d", fo)
+	}
+}
+
+func TestWindowServeHTTP(t *testing.T) {
+	tj := prepareTestJig()
+	defer tj.Close()
+
+	var decision Decision
+	bucket := tj.ThrottleManager.WindowHandler(func(w http.ResponseWriter, r *http.Request) {
+		decision, _ = DecisionFromContext(r.Context())
+	}, 2, 90*time.Second, keyFunc, "test")
+
+	req, _ := http.NewRequest("GET", "", nil)
+	for i := 0; i < 2; i++ {
+		bucket.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	if decision.Remaining != 0 || decision.Limit != 2 {
+		t.Errorf("Decision has %d remaining of %d, expected none of 2", decision.Remaining, decision.Limit)
+	}
+
+	w := httptest.NewRecorder()
+	bucket.ServeHTTP(w, req)
+
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("Status not TooManyRequests over the limit: %v", w.Code)
+	}
+	if retry := w.Header().Get("Retry-After"); retry != "90" {
+		t.Errorf("Retry-After %q, expected the window", retry)
+	}
+}